@@ -23,9 +23,35 @@ var (
 	defaultLogLevel       = "info"
 	defaultShardNum       = 1024
 	defaultChanBufferSize = 10
+	defaultDir            = "./"
+	defaultDBFilename     = "dump.rdb"
+	defaultAOFFilename    = "appendonly.aof"
+	defaultAppendFsync    = "everysec"
+	defaultAOFRewritePerc = 100
+	defaultAOFRewriteMin  = int64(64 * 1024 * 1024)
+	defaultReplBacklog    = int64(1024 * 1024)
+	defaultReplTimeout    = 60
+	defaultReplPingPeriod = 10
+	defaultProtoMaxBulk   = int64(512 * 1024 * 1024)
+	defaultProtoMaxMulti  = 1024 * 1024
+	defaultQueryBufLimit  = int64(1024 * 1024 * 1024)
 	configFile            = "./redis.conf"
 )
 
+// the default raft settings
+var defaultRaft = RaftConfig{
+	Dir:             "",
+	SnapCount:       10000,
+	CatchUpEntries:  10000,
+	TickMs:          200,
+	HeartbeatTicks:  1,
+	ElectionTicks:   10,
+	MaxInflightMsgs: 256,
+	MaxSizePerMsg:   1024 * 1024,
+	MaxBatchSize:    256,
+	MaxBatchDelayUs: 0,
+}
+
 type Config struct {
 	ConfFile          string
 	Host              string
@@ -35,15 +61,111 @@ type Config struct {
 	ShardNum          int
 	ChanBufferSize    int
 	Databases         int
+	Dir               string      // working directory of the persistence files
+	DBFilename        string      // file name of the rdb snapshot
+	SaveParams        []SaveParam // automatic snapshot points. empty means never save automatically
+	AppendOnly        bool        // enable the append only file
+	AppendFilename    string      // file name of the append only file
+	AppendFsync       string      // fsync policy of the append only file: always, everysec or no
+	AOFRewritePerc    int         // rewrite the append only file when it grows by this percentage since the last rewrite. 0 disables it
+	AOFRewriteMinSize int64       // never rewrite the append only file automatically below this size in bytes
+	ReplicaOf         string      // host:port of the master to replicate at startup. empty for a master
+	ReplicaReadOnly   bool        // reject the writes of the clients while replicating a master
+	ReplBacklogSize   int64       // size in bytes of the backlog of the replication stream kept for the partial resyncs
+	ReplTimeout       int         // seconds without data from the other side before a replication link is dropped
+	ReplPingPeriod    int         // seconds between two pings of the master to its replicas
+	ProtoMaxBulkLen   int64       // size in bytes of the largest bulk string a client may send
+	ProtoMaxMultiBulk int         // number of elements of the largest array a client may send
+	QueryBufLimit     int64       // size in bytes of the largest request a client may send
 	Others            map[string]any
 	ClusterConfigPath string
 	IsCluster         bool   `json:"IsCluster"`
 	PeerAddrs         string `json:"PeerAddrs"`
 	PeerIDs           string `json:"PeerIDs"`
 	RaftAddr          string `json:"RaftAddr"`
+	PeerKVAddrs       string `json:"PeerKVAddrs"` // comma separated client addresses (host:port) of the peers, in the order of PeerAddrs
 	NodeID            int    `json:"NodeID"`
 	KVPort            int    `json:"KVPort"`
 	JoinCluster       bool   `json:"JoinCluster"`
+	// raft groups serving the hash slots. A single group with the settings above serves all the slots if it's empty
+	Shards []ShardConfig `json:"Shards"`
+	Raft   RaftConfig    `json:"Raft"`
+}
+
+// RaftConfig holds the settings of the raft nodes in cluster mode.
+type RaftConfig struct {
+	Dir             string `json:"Dir"`             // directory of the raft logs and snapshots, the working directory if empty
+	SnapCount       uint64 `json:"SnapCount"`       // applied entries between two raft snapshots
+	CatchUpEntries  uint64 `json:"CatchUpEntries"`  // entries kept after a snapshot, so slow followers catch up without it
+	TickMs          int    `json:"TickMs"`          // duration of a raft tick in milliseconds
+	HeartbeatTicks  int    `json:"HeartbeatTicks"`  // ticks between the heartbeats of the leader
+	ElectionTicks   int    `json:"ElectionTicks"`   // ticks a follower waits for the leader before starting an election
+	MaxInflightMsgs int    `json:"MaxInflightMsgs"` // append messages sent to a follower without being acknowledged
+	MaxSizePerMsg   uint64 `json:"MaxSizePerMsg"`   // size of the entries of an append message in bytes
+	MaxBatchSize    int    `json:"MaxBatchSize"`    // client writes coalesced into a raft entry
+	MaxBatchDelayUs int    `json:"MaxBatchDelayUs"` // microseconds a write waits for others to join its entry, 0 to never wait
+}
+
+// Validate checks the raft settings, which raft would otherwise reject by panicking.
+func (r *RaftConfig) Validate() error {
+	switch {
+	case r.SnapCount == 0:
+		return &CfgError{message: "Raft SnapCount should be a positive integer"}
+	case r.CatchUpEntries == 0:
+		return &CfgError{message: "Raft CatchUpEntries should be a positive integer"}
+	case r.TickMs <= 0:
+		return &CfgError{message: fmt.Sprintf("Raft TickMs should be a positive integer, but %d is given.", r.TickMs)}
+	case r.HeartbeatTicks <= 0:
+		return &CfgError{message: fmt.Sprintf("Raft HeartbeatTicks should be a positive integer, but %d is given.", r.HeartbeatTicks)}
+	case r.ElectionTicks <= r.HeartbeatTicks:
+		return &CfgError{message: fmt.Sprintf("Raft ElectionTicks should be greater than HeartbeatTicks, but %d and %d are given.",
+			r.ElectionTicks, r.HeartbeatTicks)}
+	case r.MaxInflightMsgs <= 0:
+		return &CfgError{message: fmt.Sprintf("Raft MaxInflightMsgs should be a positive integer, but %d is given.", r.MaxInflightMsgs)}
+	case r.MaxBatchSize <= 0:
+		return &CfgError{message: fmt.Sprintf("Raft MaxBatchSize should be a positive integer, but %d is given.", r.MaxBatchSize)}
+	case r.MaxBatchDelayUs < 0:
+		return &CfgError{message: fmt.Sprintf("Raft MaxBatchDelayUs should not be negative, but %d is given.", r.MaxBatchDelayUs)}
+	}
+	return nil
+}
+
+// ShardConfig describes a raft group serving some of the hash slots in cluster mode.
+type ShardConfig struct {
+	Slots       string `json:"Slots"`       // comma separated slots and slot ranges like "0-5460,16383"
+	PeerAddrs   string `json:"PeerAddrs"`   // comma separated raft URLs of the members
+	PeerKVAddrs string `json:"PeerKVAddrs"` // comma separated client addresses of the members, in the order of PeerAddrs
+	NodeID      int    `json:"NodeID"`      // raft ID of this node in the group, 0 if it's not a member
+	RaftAddr    string `json:"RaftAddr"`
+	JoinCluster bool   `json:"JoinCluster"`
+}
+
+// number of hash slots in cluster mode
+const ClusterSlots = 16384
+
+// SlotRanges parses the slots of the shard into inclusive ranges.
+func (s *ShardConfig) SlotRanges() ([][2]int, error) {
+	ranges := make([][2]int, 0)
+	for _, part := range strings.Split(s.Slots, ",") {
+		part = strings.TrimSpace(part)
+		bounds := strings.SplitN(part, "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		end := start
+		if err == nil && len(bounds) == 2 {
+			end, err = strconv.Atoi(bounds[1])
+		}
+		if err != nil || start < 0 || end < start || end >= ClusterSlots {
+			return nil, &CfgError{message: fmt.Sprintf("Invalid slot range %q", part)}
+		}
+		ranges = append(ranges, [2]int{start, end})
+	}
+	return ranges, nil
+}
+
+// SaveParam triggers a snapshot after Seconds passed and at least Changes writes happened.
+type SaveParam struct {
+	Seconds int
+	Changes int
 }
 
 type CfgError struct {
@@ -82,6 +204,22 @@ func Setup() (*Config, error) {
 		ShardNum:          defaultShardNum,
 		ChanBufferSize:    defaultChanBufferSize,
 		Databases:         16,
+		Dir:               defaultDir,
+		DBFilename:        defaultDBFilename,
+		SaveParams:        make([]SaveParam, 0),
+		AppendOnly:        false,
+		AppendFilename:    defaultAOFFilename,
+		AppendFsync:       defaultAppendFsync,
+		AOFRewritePerc:    defaultAOFRewritePerc,
+		AOFRewriteMinSize: defaultAOFRewriteMin,
+		ReplicaReadOnly:   true,
+		ReplBacklogSize:   defaultReplBacklog,
+		ReplTimeout:       defaultReplTimeout,
+		ReplPingPeriod:    defaultReplPingPeriod,
+		ProtoMaxBulkLen:   defaultProtoMaxBulk,
+		ProtoMaxMultiBulk: defaultProtoMaxMulti,
+		QueryBufLimit:     defaultQueryBufLimit,
+		Raft:              defaultRaft,
 		Others:            make(map[string]any),
 		ClusterConfigPath: "",
 		IsCluster:         false,
@@ -182,18 +320,153 @@ func (cfg *Config) Parse(cfgFile string) error {
 				cfg.LogLevel = strings.ToLower(fields[1])
 			case "shardnum":
 				cfg.ShardNum, err = strconv.Atoi(fields[1])
-				if err != nil {
-					fmt.Println("ShardNum should be a number. Get: ", fields[1])
-					panic(err)
+				if err != nil || cfg.ShardNum <= 0 {
+					return &CfgError{message: fmt.Sprintf("shardnum should be a positive integer, but %s is given.", fields[1])}
 				}
 			case "databases":
 				cfg.Databases, err = strconv.Atoi(fields[1])
+				if err != nil || cfg.Databases <= 0 {
+					return &CfgError{message: fmt.Sprintf("databases should be a positive integer, but %s is given.", fields[1])}
+				}
+			case "dir":
+				cfg.Dir = fields[1]
+			case "dbfilename":
+				cfg.DBFilename = fields[1]
+			case "save":
+				params, err := parseSaveParams(fields[1:])
+				if err != nil {
+					return err
+				}
+				// save "" disables automatic snapshots
+				if params == nil {
+					cfg.SaveParams = nil
+				} else {
+					cfg.SaveParams = append(cfg.SaveParams, params...)
+				}
+			case "appendonly":
+				switch strings.ToLower(fields[1]) {
+				case "yes":
+					cfg.AppendOnly = true
+				case "no":
+					cfg.AppendOnly = false
+				default:
+					return &CfgError{message: fmt.Sprintf("appendonly should be yes or no, but %s is given.", fields[1])}
+				}
+			case "appendfilename":
+				cfg.AppendFilename = strings.Trim(fields[1], `"`)
+			case "appendfsync":
+				fsync := strings.ToLower(fields[1])
+				if fsync != "always" && fsync != "everysec" && fsync != "no" {
+					return &CfgError{message: fmt.Sprintf("appendfsync should be always, everysec or no, but %s is given.", fields[1])}
+				}
+				cfg.AppendFsync = fsync
+			case "auto-aof-rewrite-percentage":
+				perc, err := strconv.Atoi(fields[1])
+				if err != nil || perc < 0 {
+					return &CfgError{message: fmt.Sprintf("auto-aof-rewrite-percentage should be a non-negative integer, but %s is given.", fields[1])}
+				}
+				cfg.AOFRewritePerc = perc
+			case "auto-aof-rewrite-min-size":
+				size, err := parseMemorySize(fields[1])
+				if err != nil {
+					return err
+				}
+				cfg.AOFRewriteMinSize = size
+			case "replicaof", "slaveof":
+				if len(fields) != 3 {
+					return &CfgError{message: fmt.Sprintf("%s should be followed by the host and the port of the master", cfgName)}
+				}
+				port, err := strconv.Atoi(fields[2])
+				if err != nil || port <= 0 || port >= 65536 {
+					return &CfgError{message: fmt.Sprintf("Invalid master port %s", fields[2])}
+				}
+				cfg.ReplicaOf = net.JoinHostPort(fields[1], fields[2])
+			case "replica-read-only", "slave-read-only":
+				switch strings.ToLower(fields[1]) {
+				case "yes":
+					cfg.ReplicaReadOnly = true
+				case "no":
+					cfg.ReplicaReadOnly = false
+				default:
+					return &CfgError{message: fmt.Sprintf("%s should be yes or no, but %s is given.", cfgName, fields[1])}
+				}
+			case "repl-backlog-size":
+				size, err := parseMemorySize(fields[1])
+				if err != nil {
+					return err
+				}
+				if size < 16*1024 {
+					return &CfgError{message: fmt.Sprintf("repl-backlog-size should be at least 16kb, but %s is given.", fields[1])}
+				}
+				cfg.ReplBacklogSize = size
+			case "repl-timeout", "repl-ping-replica-period", "repl-ping-slave-period":
+				seconds, err := strconv.Atoi(fields[1])
+				if err != nil || seconds <= 0 {
+					return &CfgError{message: fmt.Sprintf("%s should be a positive integer, but %s is given.", cfgName, fields[1])}
+				}
+				if cfgName == "repl-timeout" {
+					cfg.ReplTimeout = seconds
+				} else {
+					cfg.ReplPingPeriod = seconds
+				}
+			case "proto-max-bulk-len", "client-query-buffer-limit":
+				size, err := parseMemorySize(fields[1])
+				if err != nil {
+					return err
+				}
+				if size < 1024*1024 {
+					return &CfgError{message: fmt.Sprintf("%s should be at least 1mb, but %s is given.", cfgName, fields[1])}
+				}
+				if cfgName == "proto-max-bulk-len" {
+					cfg.ProtoMaxBulkLen = size
+				} else {
+					cfg.QueryBufLimit = size
+				}
+			case "proto-max-multibulk-len":
+				n, err := strconv.ParseUint(fields[1], 10, 31)
+				if err != nil || n == 0 {
+					return &CfgError{message: fmt.Sprintf("%s should be a positive integer, but %s is given.", cfgName, fields[1])}
+				}
+				cfg.ProtoMaxMultiBulk = int(n)
+			case "raft-dir":
+				cfg.Raft.Dir = fields[1]
+			case "raft-snapshot-count":
+				if cfg.Raft.SnapCount, err = parseRaftUint(cfgName, fields[1]); err != nil {
+					return err
+				}
+			case "raft-catchup-entries":
+				if cfg.Raft.CatchUpEntries, err = parseRaftUint(cfgName, fields[1]); err != nil {
+					return err
+				}
+			case "raft-tick-ms", "raft-heartbeat-ticks", "raft-election-ticks", "raft-max-inflight-msgs", "raft-max-batch-size":
+				n, err := parseRaftUint(cfgName, fields[1])
+				if err != nil {
+					return err
+				}
+				switch cfgName {
+				case "raft-tick-ms":
+					cfg.Raft.TickMs = int(n)
+				case "raft-heartbeat-ticks":
+					cfg.Raft.HeartbeatTicks = int(n)
+				case "raft-election-ticks":
+					cfg.Raft.ElectionTicks = int(n)
+				case "raft-max-batch-size":
+					cfg.Raft.MaxBatchSize = int(n)
+				default:
+					cfg.Raft.MaxInflightMsgs = int(n)
+				}
+			case "raft-max-size-per-msg":
+				size, err := parseMemorySize(fields[1])
 				if err != nil {
-					log.Fatal("Databases should be an integer. Get: ", fields[1])
+					return err
 				}
-				if cfg.Databases <= 0 {
-					log.Fatal("Databases should be an positive integer. Get: ", fields[1])
+				cfg.Raft.MaxSizePerMsg = uint64(size)
+			case "raft-max-batch-delay-us":
+				delay, err := strconv.ParseUint(fields[1], 10, 31)
+				if err != nil {
+					return &CfgError{message: fmt.Sprintf("%s should be a non negative integer, but %s is given.", cfgName, fields[1])}
 				}
+				cfg.Raft.MaxBatchDelayUs = int(delay)
 			default:
 				cfg.Others[cfgName] = fields[1]
 			}
@@ -205,22 +478,130 @@ func (cfg *Config) Parse(cfgFile string) error {
 	return nil
 }
 
+// parseRaftUint parses the positive integer of a raft directive.
+func parseRaftUint(name string, s string) (uint64, error) {
+	n, err := strconv.ParseUint(s, 10, 31)
+	if err != nil || n == 0 {
+		return 0, &CfgError{message: fmt.Sprintf("%s should be a positive integer, but %s is given.", name, s)}
+	}
+	return n, nil
+}
+
+// parseSaveParams parses the "<seconds> <changes> [<seconds> <changes> ...]" arguments of the save directive.
+// It returns nil for save "".
+func parseSaveParams(args []string) ([]SaveParam, error) {
+	if len(args) == 1 && (args[0] == `""` || args[0] == "''") {
+		return nil, nil
+	}
+	if len(args)%2 != 0 {
+		return nil, &CfgError{message: fmt.Sprintf("Invalid save parameters %v, expect <seconds> <changes> pairs", args)}
+	}
+	params := make([]SaveParam, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		seconds, err := strconv.Atoi(args[i])
+		if err != nil || seconds <= 0 {
+			return nil, &CfgError{message: fmt.Sprintf("Invalid save seconds %s", args[i])}
+		}
+		changes, err := strconv.Atoi(args[i+1])
+		if err != nil || changes < 0 {
+			return nil, &CfgError{message: fmt.Sprintf("Invalid save changes %s", args[i+1])}
+		}
+		params = append(params, SaveParam{Seconds: seconds, Changes: changes})
+	}
+	return params, nil
+}
+
+// parseMemorySize parses sizes like 1024, 1k, 1kb, 64mb or 1gb.
+// k, m and g are powers of 1000 while kb, mb and gb are powers of 1024.
+func parseMemorySize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000}, {"b", 1},
+	}
+	num, mul := strings.ToLower(s), int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(num, unit.suffix) {
+			num, mul = strings.TrimSuffix(num, unit.suffix), unit.mul
+			break
+		}
+	}
+	size, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || size < 0 {
+		return 0, &CfgError{message: fmt.Sprintf("Invalid memory size %s", s)}
+	}
+	return size * mul, nil
+}
+
 func (cfg *Config) ParseConfigJson(path string) error {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return errors.New("json config not exist")
 	}
-	err = json.Unmarshal(data, cfg)
-	if cfg.NodeID <= 0 {
-		panic("NodeID not set")
+	// the raft settings of the json file override the ones of the config file
+	if cfg.Raft == (RaftConfig{}) {
+		cfg.Raft = defaultRaft
 	}
+	err = json.Unmarshal(data, cfg)
 	if err != nil {
 		return errors.New("Invalid config file fields. ")
 	}
-	if cfg.RaftAddr == "" {
-		cfg.RaftAddr = strings.Split(cfg.PeerAddrs, ",")[cfg.NodeID-1]
+	if err := cfg.Raft.Validate(); err != nil {
+		return err
+	}
+	if len(cfg.Shards) == 0 {
+		if cfg.NodeID <= 0 {
+			return &CfgError{message: "NodeID should be set to the position of the node in PeerAddrs, from 1"}
+		}
+		cfg.Shards = []ShardConfig{{
+			Slots:       fmt.Sprintf("0-%d", ClusterSlots-1),
+			PeerAddrs:   cfg.PeerAddrs,
+			PeerKVAddrs: cfg.PeerKVAddrs,
+			NodeID:      cfg.NodeID,
+			RaftAddr:    cfg.RaftAddr,
+			JoinCluster: cfg.JoinCluster,
+		}}
+	}
+	// every slot is served by exactly one shard
+	var owned [ClusterSlots]bool
+	member := false
+	for i := range cfg.Shards {
+		shard := &cfg.Shards[i]
+		ranges, err := shard.SlotRanges()
+		if err != nil {
+			return err
+		}
+		for _, r := range ranges {
+			for slot := r[0]; slot <= r[1]; slot++ {
+				if owned[slot] {
+					return &CfgError{message: fmt.Sprintf("Slot %d is served by more than one shard", slot)}
+				}
+				owned[slot] = true
+			}
+		}
+		peers := strings.Split(shard.PeerAddrs, ",")
+		if shard.NodeID < 0 || shard.NodeID > len(peers) {
+			return &CfgError{message: fmt.Sprintf("NodeID %d of shard %d is not one of its peers", shard.NodeID, i+1)}
+		}
+		if shard.NodeID == 0 {
+			continue
+		}
+		member = true
+		if shard.RaftAddr == "" {
+			shard.RaftAddr = peers[shard.NodeID-1]
+		}
+		log.Println("shard ", i+1, " RaftAddr = ", shard.RaftAddr)
+	}
+	for slot, ok := range owned {
+		if !ok {
+			return &CfgError{message: fmt.Sprintf("Slot %d is not served by any shard", slot)}
+		}
+	}
+	if !member {
+		return errors.New("the node is not a member of any shard")
 	}
-	log.Println("RaftAddr = ", cfg.RaftAddr)
 	// we only support a single database in cluster mode
 	cfg.Databases = 1
 	return nil
@@ -2,6 +2,8 @@ package config
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -27,3 +29,226 @@ func TestConfig_Parse(t *testing.T) {
 		t.Error(fmt.Sprintf("cfg.ShardNum == %d, expect 1024", cfg.ShardNum))
 	}
 }
+
+func TestConfig_ParseSave(t *testing.T) {
+	cfg := new(Config)
+	err := cfg.Parse("./RedisGO.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Dir != "/tmp" || cfg.DBFilename != "redisgo.rdb" {
+		t.Error(fmt.Sprintf("cfg.Dir == %s, cfg.DBFilename == %s, expect /tmp, redisgo.rdb", cfg.Dir, cfg.DBFilename))
+	}
+	expect := []SaveParam{{900, 1}, {300, 10}, {60, 10000}}
+	if len(cfg.SaveParams) != len(expect) {
+		t.Fatal(fmt.Sprintf("cfg.SaveParams == %v, expect %v", cfg.SaveParams, expect))
+	}
+	for i := range expect {
+		if cfg.SaveParams[i] != expect[i] {
+			t.Error(fmt.Sprintf("cfg.SaveParams == %v, expect %v", cfg.SaveParams, expect))
+		}
+	}
+
+	params, err := parseSaveParams([]string{`""`})
+	if err != nil || params != nil {
+		t.Error(fmt.Sprintf("parseSaveParams(\"\") == %v, %v, expect nil, nil", params, err))
+	}
+	if _, err := parseSaveParams([]string{"60"}); err == nil {
+		t.Error("parseSaveParams(60) should fail")
+	}
+}
+
+func TestConfig_ParseAppendOnly(t *testing.T) {
+	cfg := new(Config)
+	err := cfg.Parse("./RedisGO.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.AppendOnly || cfg.AppendFilename != "redisgo.aof" || cfg.AppendFsync != "always" {
+		t.Error(fmt.Sprintf("cfg.AppendOnly == %v, cfg.AppendFilename == %s, cfg.AppendFsync == %s, expect true, redisgo.aof, always",
+			cfg.AppendOnly, cfg.AppendFilename, cfg.AppendFsync))
+	}
+}
+
+func TestConfig_ParseAOFRewrite(t *testing.T) {
+	cfg := new(Config)
+	err := cfg.Parse("./RedisGO.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AOFRewritePerc != 50 || cfg.AOFRewriteMinSize != 16*1024*1024 {
+		t.Error(fmt.Sprintf("cfg.AOFRewritePerc == %d, cfg.AOFRewriteMinSize == %d, expect 50, %d",
+			cfg.AOFRewritePerc, cfg.AOFRewriteMinSize, 16*1024*1024))
+	}
+	sizes := map[string]int64{"1024": 1024, "1k": 1000, "1KB": 1024, "2mb": 2 * 1024 * 1024, "1g": 1000 * 1000 * 1000}
+	for s, expect := range sizes {
+		if size, err := parseMemorySize(s); err != nil || size != expect {
+			t.Error(fmt.Sprintf("parseMemorySize(%s) == %d, %v, expect %d", s, size, err, expect))
+		}
+	}
+	if _, err := parseMemorySize("12xb"); err == nil {
+		t.Error("parseMemorySize(12xb) should fail")
+	}
+}
+
+func TestConfig_ParseShards(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cluster.json")
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"IsCluster": true, "Shards": [
+		{"Slots": "0-8191", "PeerAddrs": "http://127.0.0.1:16380", "NodeID": 1},
+		{"Slots": "8192-16000,16001-16383", "PeerAddrs": "http://127.0.0.1:16381,http://127.0.0.1:16382"}]}`)
+	cfg := new(Config)
+	if err := cfg.ParseConfigJson(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Shards) != 2 || cfg.Shards[0].RaftAddr != "http://127.0.0.1:16380" || cfg.Shards[1].RaftAddr != "" {
+		t.Error(fmt.Sprintf("cfg.Shards == %v, expect the raft address of the first shard only", cfg.Shards))
+	}
+	ranges, err := cfg.Shards[1].SlotRanges()
+	if err != nil || len(ranges) != 2 || ranges[0] != [2]int{8192, 16000} || ranges[1] != [2]int{16001, 16383} {
+		t.Error(fmt.Sprintf("SlotRanges() == %v, %v, expect [[8192 16000] [16001 16383]]", ranges, err))
+	}
+
+	// a single shard serves all the slots without Shards
+	write(`{"IsCluster": true, "PeerAddrs": "http://127.0.0.1:16380,http://127.0.0.1:16381", "NodeID": 2}`)
+	cfg = new(Config)
+	if err := cfg.ParseConfigJson(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Shards) != 1 || cfg.Shards[0].Slots != "0-16383" || cfg.Shards[0].RaftAddr != "http://127.0.0.1:16381" {
+		t.Error(fmt.Sprintf("cfg.Shards == %v, expect a single shard serving all the slots", cfg.Shards))
+	}
+
+	invalid := []string{
+		// overlapping slots
+		`{"Shards": [{"Slots": "0-16383", "PeerAddrs": "a", "NodeID": 1}, {"Slots": "5", "PeerAddrs": "b"}]}`,
+		// missing slots
+		`{"Shards": [{"Slots": "0-16000", "PeerAddrs": "a", "NodeID": 1}]}`,
+		// out of range slots
+		`{"Shards": [{"Slots": "0-16384", "PeerAddrs": "a", "NodeID": 1}]}`,
+		// not a member of any shard
+		`{"Shards": [{"Slots": "0-16383", "PeerAddrs": "a"}]}`,
+		// NodeID out of the peers
+		`{"Shards": [{"Slots": "0-16383", "PeerAddrs": "a", "NodeID": 2}]}`,
+	}
+	for _, data := range invalid {
+		write(data)
+		if err := new(Config).ParseConfigJson(path); err == nil {
+			t.Error(fmt.Sprintf("ParseConfigJson(%s) should fail", data))
+		}
+	}
+}
+
+func TestConfig_ParseRaft(t *testing.T) {
+	dir := t.TempDir()
+	confPath := filepath.Join(dir, "redis.conf")
+	jsonPath := filepath.Join(dir, "cluster.json")
+	write := func(path string, data string) {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(confPath, "raft-dir /var/lib/redisgo\nraft-snapshot-count 500\nraft-catchup-entries 100\nraft-tick-ms 50\n"+
+		"raft-heartbeat-ticks 2\nraft-election-ticks 20\nraft-max-inflight-msgs 64\nraft-max-size-per-msg 512kb\n"+
+		"raft-max-batch-size 32\nraft-max-batch-delay-us 0\n")
+	cfg := &Config{Raft: defaultRaft, Others: make(map[string]any)}
+	if err := cfg.Parse(confPath); err != nil {
+		t.Fatal(err)
+	}
+	expect := RaftConfig{Dir: "/var/lib/redisgo", SnapCount: 500, CatchUpEntries: 100, TickMs: 50,
+		HeartbeatTicks: 2, ElectionTicks: 20, MaxInflightMsgs: 64, MaxSizePerMsg: 512 * 1024, MaxBatchSize: 32}
+	if cfg.Raft != expect {
+		t.Error(fmt.Sprintf("cfg.Raft == %+v, expect %+v", cfg.Raft, expect))
+	}
+
+	// the json file overrides the config file
+	write(jsonPath, `{"PeerAddrs": "http://127.0.0.1:16380", "NodeID": 1, "Raft": {"SnapCount": 1000, "TickMs": 100, "MaxBatchDelayUs": 200}}`)
+	if err := cfg.ParseConfigJson(jsonPath); err != nil {
+		t.Fatal(err)
+	}
+	expect.SnapCount, expect.TickMs, expect.MaxBatchDelayUs = 1000, 100, 200
+	if cfg.Raft != expect {
+		t.Error(fmt.Sprintf("cfg.Raft == %+v, expect %+v", cfg.Raft, expect))
+	}
+	cfg = new(Config)
+	write(jsonPath, `{"PeerAddrs": "http://127.0.0.1:16380", "NodeID": 1}`)
+	if err := cfg.ParseConfigJson(jsonPath); err != nil || cfg.Raft != defaultRaft {
+		t.Error(fmt.Sprintf("cfg.Raft == %+v, %v, expect the defaults", cfg.Raft, err))
+	}
+
+	for _, line := range []string{"raft-snapshot-count 0", "raft-tick-ms -5", "raft-election-ticks ten", "raft-max-size-per-msg 1xb", "raft-max-batch-size 0", "raft-max-batch-delay-us -1"} {
+		write(confPath, line+"\n")
+		if err := (&Config{Others: make(map[string]any)}).Parse(confPath); err == nil {
+			t.Error(fmt.Sprintf("Parse(%s) should fail", line))
+		}
+	}
+	invalid := []string{
+		// the election timeout must be longer than the heartbeat interval
+		`{"PeerAddrs": "a", "NodeID": 1, "Raft": {"HeartbeatTicks": 10, "ElectionTicks": 10}}`,
+		`{"PeerAddrs": "a", "NodeID": 1, "Raft": {"MaxInflightMsgs": 0}}`,
+		`{"PeerAddrs": "a", "NodeID": 1, "Raft": {"TickMs": -1}}`,
+		`{"PeerAddrs": "a", "NodeID": 1, "Raft": {"SnapCount": -1}}`,
+		`{"PeerAddrs": "a", "NodeID": 1, "Raft": {"MaxBatchDelayUs": -1}}`,
+		// NodeID is not set
+		`{"PeerAddrs": "a"}`,
+	}
+	for _, data := range invalid {
+		write(jsonPath, data)
+		if err := new(Config).ParseConfigJson(jsonPath); err == nil {
+			t.Error(fmt.Sprintf("ParseConfigJson(%s) should fail", data))
+		}
+	}
+}
+
+func TestConfig_ParseReplication(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redis.conf")
+	data := "replicaof 10.0.0.1 6379\nreplica-read-only no\nrepl-backlog-size 4mb\nrepl-timeout 30\nrepl-ping-replica-period 5\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{ReplicaReadOnly: true, Others: make(map[string]any)}
+	if err := cfg.Parse(path); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ReplicaOf != "10.0.0.1:6379" || cfg.ReplicaReadOnly || cfg.ReplBacklogSize != 4*1024*1024 ||
+		cfg.ReplTimeout != 30 || cfg.ReplPingPeriod != 5 {
+		t.Error(fmt.Sprintf("cfg.ReplicaOf == %s, cfg.ReplicaReadOnly == %v, cfg.ReplBacklogSize == %d, cfg.ReplTimeout == %d, cfg.ReplPingPeriod == %d",
+			cfg.ReplicaOf, cfg.ReplicaReadOnly, cfg.ReplBacklogSize, cfg.ReplTimeout, cfg.ReplPingPeriod))
+	}
+	for _, line := range []string{"replicaof 10.0.0.1", "replicaof 10.0.0.1 port", "replica-read-only maybe", "repl-backlog-size 1kb", "repl-timeout 0"} {
+		if err := os.WriteFile(path, []byte(line+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&Config{Others: make(map[string]any)}).Parse(path); err == nil {
+			t.Error(fmt.Sprintf("Parse(%s) should fail", line))
+		}
+	}
+}
+
+func TestConfig_ParseProtoLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redis.conf")
+	data := "proto-max-bulk-len 8mb\nproto-max-multibulk-len 1000\nclient-query-buffer-limit 64mb\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{Others: make(map[string]any)}
+	if err := cfg.Parse(path); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ProtoMaxBulkLen != 8*1024*1024 || cfg.ProtoMaxMultiBulk != 1000 || cfg.QueryBufLimit != 64*1024*1024 {
+		t.Error(fmt.Sprintf("cfg.ProtoMaxBulkLen == %d, cfg.ProtoMaxMultiBulk == %d, cfg.QueryBufLimit == %d",
+			cfg.ProtoMaxBulkLen, cfg.ProtoMaxMultiBulk, cfg.QueryBufLimit))
+	}
+	for _, line := range []string{"proto-max-bulk-len 1kb", "proto-max-multibulk-len 0", "proto-max-multibulk-len many", "client-query-buffer-limit 1xb"} {
+		if err := os.WriteFile(path, []byte(line+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&Config{Others: make(map[string]any)}).Parse(path); err == nil {
+			t.Error(fmt.Sprintf("Parse(%s) should fail", line))
+		}
+	}
+}
@@ -92,7 +92,7 @@ func Debug(v ...any) {
 	logMu.Lock()
 	defer logMu.Unlock()
 	setPrefix(DEBUG)
-	logger.Println(v)
+	logger.Println(v...)
 }
 
 func Info(v ...any) {
@@ -102,7 +102,7 @@ func Info(v ...any) {
 	logMu.Lock()
 	defer logMu.Unlock()
 	setPrefix(INFO)
-	logger.Println(v)
+	logger.Println(v...)
 }
 
 func Warning(v ...any) {
@@ -112,7 +112,7 @@ func Warning(v ...any) {
 	logMu.Lock()
 	defer logMu.Unlock()
 	setPrefix(WARNING)
-	logger.Println(v)
+	logger.Println(v...)
 }
 
 func Error(v ...any) {
@@ -122,7 +122,7 @@ func Error(v ...any) {
 	logMu.Lock()
 	defer logMu.Unlock()
 	setPrefix(ERROR)
-	logger.Println(v)
+	logger.Println(v...)
 }
 
 func Panic(v ...any) {
@@ -132,5 +132,5 @@ func Panic(v ...any) {
 	logMu.Lock()
 	defer logMu.Unlock()
 	setPrefix(PANIC)
-	logger.Println(v)
+	logger.Println(v...)
 }
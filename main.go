@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log"
 	"os"
 
 	"github.com/innovationb1ue/RedisGO/config"
@@ -19,14 +20,17 @@ func init() {
 	memdb.RegisterPubSubCommands()
 	memdb.RegisterSortedSetCommands()
 	memdb.RegisterStreamCommands()
+	memdb.RegisterDumpCommands()
 	memdb.RegisterRaftCommand()
+	server.RegisterServerCommands()
 }
 
 func main() {
 	// setup config
 	cfg, err := config.Setup()
 	if err != nil {
-		logger.Error(err)
+		// the logger is set up from the config, report to stderr
+		log.Println(err)
 		os.Exit(1)
 	}
 	// setup logger
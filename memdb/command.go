@@ -10,21 +10,111 @@ import (
 type cmdBytes = [][]byte
 
 // CmdTable holds all registered commands
-var CmdTable = make(map[string]*command)
+var CmdTable = make(map[string]*Command)
 
 // We allow executor to directly write message back to the tcp connection for some blocking commands.
 // But it should never be spoilt. Normal commands should always return a data but not write
 // into the pipe by themselves.
 type cmdExecutor func(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData
 
-type command struct {
+// command flags
+const (
+	CmdWrite    = 1 << iota // may modify the dataset
+	CmdReadOnly             // only reads the dataset
+	CmdBlocking             // may block the client
+	CmdAdmin                // administrative command
+)
+
+// cmdFlagNames are the names of the flags reported by the COMMAND command, in the order of the flags.
+var cmdFlagNames = []string{"write", "readonly", "blocking", "admin"}
+
+// Command is a registered command and its metadata.
+type Command struct {
+	// nil for the commands executed by the server instead of a MemDb, like SELECT and MULTI
 	Executor cmdExecutor
+	Name     string
+	// number of arguments including the command name. -N means at least N arguments
+	Arity int
+	Flags int
+	// position of the first key, the last key and the step between keys in the arguments.
+	// a negative LastKey counts from the end of the command, -1 being the last argument.
+	// all of them are 0 for commands without keys
+	FirstKey, LastKey, KeyStep int
+	// GetKeys finds the keys of the commands whose keys are not at fixed positions, like MIGRATE. nil for the others
+	GetKeys func(cmd [][]byte) []string
 }
 
-func RegisterCommand(cmdName string, executor cmdExecutor) {
-	CmdTable[cmdName] = &command{
+// RegisterCommand registers a command along with its metadata.
+func RegisterCommand(cmdName string, executor cmdExecutor, arity int, flags int, firstKey, lastKey, keyStep int) {
+	CmdTable[cmdName] = &Command{
 		Executor: executor,
+		Name:     cmdName,
+		Arity:    arity,
+		Flags:    flags,
+		FirstKey: firstKey,
+		LastKey:  lastKey,
+		KeyStep:  keyStep,
+	}
+}
+
+// CheckArity reports whether the command accepts argc arguments.
+func (c *Command) CheckArity(argc int) bool {
+	if c.Arity < 0 {
+		return argc >= -c.Arity
+	}
+	return argc == c.Arity
+}
+
+func (c *Command) HasFlag(flag int) bool {
+	return c.Flags&flag != 0
+}
+
+// FlagNames returns the names of the flags of the command.
+func (c *Command) FlagNames() []string {
+	names := make([]string, 0)
+	for i, name := range cmdFlagNames {
+		if c.Flags&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Keys returns the keys accessed by cmd, which must satisfy the arity of the command.
+func (c *Command) Keys(cmd [][]byte) []string {
+	if c.GetKeys != nil {
+		return c.GetKeys(cmd)
+	}
+	if c.FirstKey == 0 || c.FirstKey >= len(cmd) {
+		return nil
+	}
+	last := c.LastKey
+	if last < 0 {
+		last += len(cmd)
+	}
+	if last >= len(cmd) {
+		last = len(cmd) - 1
+	}
+	keys := make([]string, 0, 1)
+	for i := c.FirstKey; i <= last; i += c.KeyStep {
+		keys = append(keys, string(cmd[i]))
+	}
+	return keys
+}
+
+// IsWriteCommand reports whether the command may modify the dataset.
+func IsWriteCommand(cmdName string) bool {
+	c, ok := CmdTable[cmdName]
+	return ok && c.HasFlag(CmdWrite)
+}
+
+// CommandKeys returns the keys accessed by the command.
+func CommandKeys(cmd [][]byte) []string {
+	c, ok := CmdTable[strings.ToLower(string(cmd[0]))]
+	if !ok || !c.CheckArity(len(cmd)) {
+		return nil
 	}
+	return c.Keys(cmd)
 }
 
 func MakeCommandBytes(input string) cmdBytes {
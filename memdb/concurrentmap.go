@@ -57,7 +57,7 @@ func (m *ConcurrentMap) Set(key string, value any) int {
 	defer shard.rwMu.Unlock()
 
 	if _, ok := shard.item[key]; !ok {
-		m.count++
+		atomic.AddInt64(&m.count, 1)
 		added = 1
 	}
 	shard.item[key] = value
@@ -84,7 +84,7 @@ func (m *ConcurrentMap) SetIfNotExist(key string, value any) int {
 	defer shard.rwMu.Unlock()
 
 	if _, ok := shard.item[key]; !ok {
-		m.count++
+		atomic.AddInt64(&m.count, 1)
 		shard.item[key] = value
 		return 1
 	}
@@ -111,7 +111,7 @@ func (m *ConcurrentMap) Delete(key string) int {
 
 	if _, ok := shard.item[key]; ok {
 		delete(shard.item, key)
-		m.count--
+		atomic.AddInt64(&m.count, -1)
 		return 1
 	} else {
 		return 0
@@ -128,13 +128,12 @@ func (m *ConcurrentMap) Clear() {
 
 // Keys return all stored keys in the concurrent map
 func (m *ConcurrentMap) Keys() []string {
-	keys := make([]string, m.count)
-	i := 0
+	// keys might be added while iterating, so the length is only used as a hint
+	keys := make([]string, 0, m.Len())
 	for _, shard := range m.table {
 		shard.rwMu.RLock()
 		for key := range shard.item {
-			keys[i] = key
-			i++
+			keys = append(keys, key)
 		}
 		shard.rwMu.RUnlock()
 	}
@@ -2,11 +2,10 @@ package memdb
 
 import (
 	"context"
-	"encoding/json"
 	"github.com/innovationb1ue/RedisGO/raftexample"
-	"log"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/innovationb1ue/RedisGO/config"
@@ -16,30 +15,40 @@ import (
 
 // MemDb is the memory cache database
 // All key:value pairs are stored in db
-// All ttl keys are stored in ttlKeys
+// All ttl keys are stored in ttlKeys and indexed by their expiration time in expires
 // locks is used to lock a key for db to ensure some atomic operations
 // SubChans are an independent concurrent map of channel shards used in PUB/SUB commands
 type MemDb struct {
 	db       *ConcurrentMap
 	ttlKeys  *ConcurrentMap
+	expires  *expireIndex
 	locks    *Locks
 	SubChans *ChanMap
 	Raft     *raftexample.RaftNode
+	// passiveExpire keeps expired keys until they are deleted by a command.
+	// It's used in cluster mode and by the replicas, where the leader or the master replicates the deletion
+	// of expired keys so that every node applies the commands the same way no matter what its clock says.
+	passiveExpire atomic.Bool
+	// onExpire is called with the keys deleted because they expired. nil if not set
+	onExpire    func(key string)
+	expireStats expireStats
 }
 
 func NewMemDb() *MemDb {
+	ttlKeys := NewConcurrentMap(config.Configures.ShardNum)
 	return &MemDb{
 		db:       NewConcurrentMap(config.Configures.ShardNum),
-		ttlKeys:  NewConcurrentMap(config.Configures.ShardNum),
+		ttlKeys:  ttlKeys,
+		expires:  newExpireIndex(ttlKeys),
 		locks:    NewLocks(config.Configures.ShardNum * 2),
 		SubChans: NewChanMap(config.Configures.ShardNum),
 		Raft:     nil,
 	}
 }
 
+// TTLInfo is the expiration unix time of a key in milliseconds.
 type TTLInfo struct {
-	value  int64
-	cancel chan struct{}
+	value int64
 }
 
 func (m *MemDb) ExecCommand(ctx context.Context, cmd [][]byte, conn net.Conn) resp.RedisData {
@@ -50,88 +59,155 @@ func (m *MemDb) ExecCommand(ctx context.Context, cmd [][]byte, conn net.Conn) re
 	cmdName := strings.ToLower(string(cmd[0]))
 	// get the command from hash table and execute it.
 	command, ok := CmdTable[cmdName]
-	if !ok {
+	if !ok || command.Executor == nil {
 		res = resp.MakeErrorData("ERR unknown command ", cmdName)
+	} else if !command.CheckArity(len(cmd)) {
+		res = resp.MakeWrongNumberArgs(cmdName)
 	} else {
 		res = command.Executor(ctx, m, cmd, conn)
 	}
 	return res
 }
 
+// SetPassiveExpire makes the keys expire only when they are deleted by a command instead of by the local clock.
+// Once it's turned off, the keys that expired in the meantime are deleted by the next active expire cycle.
+func (m *MemDb) SetPassiveExpire(passive bool) {
+	m.passiveExpire.Store(passive)
+}
+
+// SetExpireHook sets the function called with the keys deleted by the local clock, which is
+// used to replicate the deletions. It must be set before the database is used.
+func (m *MemDb) SetExpireHook(hook func(key string)) {
+	m.onExpire = hook
+}
+
 // CheckTTL check ttl keys and delete expired keys
 // return false if key is expired, else true.
 // Attention: Don't lock this function because it has called locks.Lock(key) for atomic deleting expired key.
 // Otherwise, it will cause a deadlock.
 func (m *MemDb) CheckTTL(key string) bool {
+	if m.passiveExpire.Load() {
+		return true
+	}
 	ttl, ok := m.ttlKeys.Get(key)
 	if !ok {
 		return true
 	}
 	ttlTime := ttl.(*TTLInfo)
-	now := time.Now().Unix()
+	now := time.Now().UnixMilli()
 	if ttlTime.value > now {
 		return true
 	}
 	// if it should expire
 	m.locks.Lock(key)
 	defer m.locks.UnLock(key)
+	// the key may have been deleted or given a new TTL while waiting for the lock
+	if ttl, ok = m.ttlKeys.Get(key); !ok || ttl.(*TTLInfo).value > now {
+		return ok
+	}
 	m.db.Delete(key)
-	m.ttlKeys.Delete(key)
+	m.expires.remove(key)
+	m.expireStats.expired.Add(1)
+	if m.onExpire != nil {
+		m.onExpire(key)
+	}
 	return false
 }
 
+// expiredAt tells whether the key has a TTL that is not after now, in unix milliseconds.
+// Unlike CheckTTL, it never deletes the key.
+func (m *MemDb) expiredAt(key string, now int64) bool {
+	ttl, ok := m.ttlKeys.Get(key)
+	return ok && ttl.(*TTLInfo).value <= now
+}
+
+// Lookup deletes the expired keys of a command before it runs and returns the database to run it on.
+// In passive expire mode the expired keys are kept until the leader or the master deletes them: the writes see them
+// so that every node applies the writes the same way, while the reads run on a view of the database
+// without them, so that no client reads a key after its expiration time.
+// The caller must hold the keys, exclusively for a write, while the command runs.
+func (m *MemDb) Lookup(keys []string, write bool) *MemDb {
+	if !m.passiveExpire.Load() {
+		for _, key := range keys {
+			m.CheckTTL(key)
+		}
+		return m
+	}
+	if write {
+		return m
+	}
+	now := time.Now().UnixMilli()
+	expired := false
+	for _, key := range keys {
+		if m.expiredAt(key, now) {
+			expired = true
+			break
+		}
+	}
+	if !expired {
+		return m
+	}
+	// the view shares the values of the live keys, which the read cannot change
+	ttlKeys := NewConcurrentMap(1)
+	view := &MemDb{
+		db:       NewConcurrentMap(1),
+		ttlKeys:  ttlKeys,
+		expires:  newExpireIndex(ttlKeys),
+		locks:    NewLocks(1),
+		SubChans: m.SubChans,
+		Raft:     m.Raft,
+	}
+	view.passiveExpire.Store(true)
+	for _, key := range keys {
+		if m.expiredAt(key, now) {
+			continue
+		}
+		m.locks.RLock(key)
+		if val, ok := m.db.Get(key); ok {
+			view.db.Set(key, val)
+			if ttl, ok := m.ttlKeys.Get(key); ok {
+				view.expires.set(key, ttl.(*TTLInfo).value)
+			}
+		}
+		m.locks.RUnLock(key)
+	}
+	return view
+}
+
 // SetTTL set ttl for key
 // return bool to check if ttl set success
 // return int to check if the key is a new ttl key
-// value: seconds at expire
+// value: unix time in milliseconds at expire
 func (m *MemDb) SetTTL(key string, value int64) int {
 	if _, ok := m.db.Get(key); !ok {
 		logger.Debug("SetTTL: key not exist")
 		return 0
 	}
-	cancel := make(chan struct{})
-	// remove old TTL task if exist
-	ttlInfoTmp, ok := m.ttlKeys.Get(key)
-	if ok {
-		ttlInfo := ttlInfoTmp.(*TTLInfo)
-		close(ttlInfo.cancel)
-		m.ttlKeys.Delete(key)
-	}
-	// save TTL
-	m.ttlKeys.Set(key, &TTLInfo{
-		value:  value,
-		cancel: cancel,
-	})
-	// start TTL check timed task
-	go func() {
-		select {
-		// this chan fires after the ttl expire
-		case <-time.After(time.Duration(value-time.Now().Unix()) * time.Second):
-			// CheckTTL locks itself
-			m.CheckTTL(key)
-			log.Println("TLL fires")
-		case <-cancel:
-			log.Println("TTL canceled")
-			return
-		}
-	}()
+	// the key is deleted by the active expire cycle or when it's accessed after it expired
+	m.expires.set(key, value)
 	return 1
 }
 
+// DelTTL removes the TTL of the key and returns 1 if it had one.
 func (m *MemDb) DelTTL(key string) int {
-	// check ttl exist
-	ttlTmp, ok := m.ttlKeys.Get(key)
-	if !ok {
-		return 0
+	return m.expires.remove(key)
+}
+
+// ExpiredKeys returns at most count keys whose expiration time is not after now, in unix milliseconds.
+func (m *MemDb) ExpiredKeys(now int64, count int) []string {
+	return m.expires.due(now, count)
+}
+
+// Exists tells whether the key exists.
+func (m *MemDb) Exists(key string) bool {
+	if !m.CheckTTL(key) {
+		return false
 	}
-	// cancel timed TTL task
-	ttl := ttlTmp.(*TTLInfo)
-	close(ttl.cancel)
-	// delete TTL key from cMap
-	return m.ttlKeys.Delete(key)
+	_, ok := m.db.Get(key)
+	return ok
 }
 
-func (m *MemDb) GetSnapshot() ([]byte, error) {
-	// todo: change the snapshot format to rdb|aof
-	return json.Marshal(m.db.KeyVals())
+// Keys returns all the keys of the database, including the expired keys that are not deleted yet.
+func (m *MemDb) Keys() []string {
+	return m.db.Keys()
 }
@@ -0,0 +1,85 @@
+package memdb
+
+import (
+	"encoding/binary"
+	"hash/crc64"
+	"math"
+)
+
+// digest.go computes fingerprints of keys, which tell whether a key was changed without keeping its old value.
+// Elements of sets and hashes are combined in an order independent way, so equal values
+// always have the same digest no matter how they are stored.
+
+// KeyDigest returns the digest of the value and the expiration time of the key, or 0 if the key does not exist.
+func (m *MemDb) KeyDigest(key string) uint64 {
+	if !m.CheckTTL(key) {
+		return 0
+	}
+	m.locks.RLock(key)
+	defer m.locks.RUnLock(key)
+	val, ok := m.db.Get(key)
+	if !ok {
+		return 0
+	}
+	typ, known := rdbType(val)
+	if !known {
+		return 0
+	}
+	sum := crc64.Update(0, crcTable, []byte{typ})
+	switch v := val.(type) {
+	case []byte:
+		sum = crc64.Update(sum, crcTable, v)
+	case *List:
+		for node := v.Head.Next; node != v.Tail; node = node.Next {
+			sum = digestAppend(sum, node.Val)
+		}
+	case *Set:
+		var members uint64
+		for member := range v.table {
+			members += crc64.Checksum([]byte(member), crcTable)
+		}
+		sum = digestAppendUint(sum, members)
+	case *Hash:
+		var fields uint64
+		for field, value := range v.table {
+			fields += digestAppend(crc64.Checksum([]byte(field), crcTable), value)
+		}
+		sum = digestAppendUint(sum, fields)
+	case *SortedSet[*SortedSetNode]:
+		var members uint64
+		for name, node := range v.dict {
+			members += digestAppendUint(crc64.Checksum([]byte(name), crcTable), math.Float64bits(node.Value.GetScore()))
+		}
+		sum = digestAppendUint(sum, members)
+	case *Stream:
+		v.lock.RLock()
+		for _, id := range v.timeStamps {
+			sum = digestAppend(sum, []byte(id.Format()))
+			for _, f := range v.entry[id.Format()] {
+				sum = digestAppend(sum, []byte(f))
+			}
+		}
+		v.lock.RUnlock()
+	}
+	if ttl, ok := m.ttlKeys.Get(key); ok {
+		sum = digestAppendUint(sum, uint64(ttl.(*TTLInfo).value))
+	}
+	// never collide with the digest of a missing key
+	if sum == 0 {
+		sum = 1
+	}
+	return sum
+}
+
+// digestAppend mixes the length and the bytes of an element into sum,
+// so that a list of elements can not be confused with their concatenation.
+func digestAppend(sum uint64, p []byte) uint64 {
+	sum = digestAppendUint(sum, uint64(len(p)))
+	return crc64.Update(sum, crcTable, p)
+}
+
+func digestAppendUint(sum uint64, v uint64) uint64 {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return crc64.Update(sum, crcTable, buf[:])
+}
@@ -0,0 +1,148 @@
+package memdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc64"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/innovationb1ue/RedisGO/resp"
+)
+
+// dump.go implements DUMP and RESTORE, which serialize a single key to move it between instances.
+// A payload holds the value in the snapshot encoding of rdb.go:
+//
+//	type(1 byte) | value | uint16(version) | uint64(crc64 of everything before)
+//
+// The version is the snapshot version, so payloads are only restored by instances that can decode them.
+
+var ErrDumpPayload = errors.New("ERR DUMP payload version or checksum are wrong")
+
+// encodeDump encodes a value into a DUMP payload. It returns false if the value can not be encoded.
+func encodeDump(val any) ([]byte, bool) {
+	typ, ok := rdbType(val)
+	if !ok {
+		return nil, false
+	}
+	var buf bytes.Buffer
+	e := &rdbEncoder{w: &buf}
+	e.writeByte(typ)
+	e.writeValue(val)
+	payload := binary.BigEndian.AppendUint16(buf.Bytes(), rdbVersion)
+	return binary.BigEndian.AppendUint64(payload, crc64.Checksum(payload, crcTable)), true
+}
+
+// decodeDump decodes the value of a DUMP payload.
+func decodeDump(payload []byte) (any, error) {
+	n := len(payload)
+	if n < 1+2+8 {
+		return nil, ErrDumpPayload
+	}
+	if crc64.Checksum(payload[:n-8], crcTable) != binary.BigEndian.Uint64(payload[n-8:]) ||
+		binary.BigEndian.Uint16(payload[n-10:n-8]) != rdbVersion {
+		return nil, ErrDumpPayload
+	}
+	d := &rdbDecoder{r: bufio.NewReader(bytes.NewReader(payload[:n-10])), crc: crc64.New(crcTable)}
+	val := d.readValue(d.readByte())
+	if d.err != nil {
+		return nil, errors.New("ERR Bad data format")
+	}
+	// the value must span the whole payload
+	if _, err := d.r.ReadByte(); err != io.EOF {
+		return nil, errors.New("ERR Bad data format")
+	}
+	return val, nil
+}
+
+// Dump returns the DUMP payload of the key and its expiration time in unix milliseconds, 0 if it has none.
+// It returns false if the key does not exist.
+func (m *MemDb) Dump(key string) ([]byte, int64, bool) {
+	if !m.CheckTTL(key) {
+		return nil, 0, false
+	}
+	m.locks.RLock(key)
+	defer m.locks.RUnLock(key)
+	val, ok := m.db.Get(key)
+	if !ok {
+		return nil, 0, false
+	}
+	payload, ok := encodeDump(val)
+	if !ok {
+		return nil, 0, false
+	}
+	var expireAt int64
+	if ttl, ok := m.ttlKeys.Get(key); ok {
+		expireAt = ttl.(*TTLInfo).value
+	}
+	return payload, expireAt, true
+}
+
+func dumpKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
+	payload, _, ok := m.Dump(string(cmd[1]))
+	if !ok {
+		return resp.MakeBulkData(nil)
+	}
+	return resp.MakeBulkData(payload)
+}
+
+// restoreKey creates a key from a DUMP payload: RESTORE key ttl payload [REPLACE] [ABSTTL].
+// ttl is in milliseconds, or a unix time in milliseconds with ABSTTL, and 0 means no expiration.
+func restoreKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
+	key := string(cmd[1])
+	ttl, err := strconv.ParseInt(string(cmd[2]), 10, 64)
+	if err != nil {
+		return resp.MakeErrorData("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return resp.MakeErrorData("ERR Invalid TTL value, must be >= 0")
+	}
+	var replace, absTTL bool
+	for _, arg := range cmd[4:] {
+		switch strings.ToLower(string(arg)) {
+		case "replace":
+			replace = true
+		case "absttl":
+			absTTL = true
+		default:
+			return resp.MakeErrorData("ERR syntax error")
+		}
+	}
+	val, err := decodeDump(cmd[3])
+	if err != nil {
+		return resp.MakeErrorData(err.Error())
+	}
+	nowMs := time.Now().UnixMilli()
+	expireAt := ttl
+	if ttl > 0 && !absTTL {
+		expireAt = nowMs + ttl
+	}
+	m.CheckTTL(key)
+	m.locks.Lock(key)
+	defer m.locks.UnLock(key)
+	if _, ok := m.db.Get(key); ok && !replace {
+		return resp.MakeErrorData("BUSYKEY Target key name already exists.")
+	}
+	m.DelTTL(key)
+	m.db.Delete(key)
+	// a key restored already expired is not created, unless its deletion is left to the raft leader
+	if expireAt > 0 && expireAt <= nowMs && !m.passiveExpire.Load() {
+		return resp.MakeStringData("OK")
+	}
+	m.db.Set(key, val)
+	if expireAt > 0 {
+		m.SetTTL(key, expireAt)
+	}
+	return resp.MakeStringData("OK")
+}
+
+func RegisterDumpCommands() {
+	RegisterCommand("dump", dumpKey, 2, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("restore", restoreKey, -4, CmdWrite, 1, 1, 1)
+}
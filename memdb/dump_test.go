@@ -0,0 +1,96 @@
+package memdb
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDumpRestore(t *testing.T) {
+	ctx := context.Background()
+	src, dst := NewMemDb(), NewMemDb()
+	setString(ctx, src, MakeCommandBytes("set str hello ex 100"), nil)
+	rPushList(ctx, src, MakeCommandBytes("rpush list a b c"), nil)
+	hSetHash(ctx, src, MakeCommandBytes("hset hash f1 v1 f2 v2"), nil)
+	zadd(ctx, src, MakeCommandBytes("zadd zset 1 a 2 b"), nil)
+	xadd(ctx, src, MakeCommandBytes("xadd stream 1-1 k1 v1"), nil)
+	for _, key := range []string{"str", "list", "hash", "zset", "stream"} {
+		payload := dumpKey(ctx, src, [][]byte{[]byte("dump"), []byte(key)}, nil).ByteData()
+		res := restoreKey(ctx, dst, [][]byte{[]byte("restore"), []byte(key), []byte("0"), payload}, nil)
+		if !bytes.Equal(res.ToBytes(), []byte("+OK\r\n")) {
+			t.Errorf("restore %s reply is %q", key, res.ToBytes())
+		}
+	}
+	if v, _ := dst.db.Get("str"); !bytes.Equal(v.([]byte), []byte("hello")) {
+		t.Error("string value is not restored")
+	}
+	if _, ok := dst.ttlKeys.Get("str"); ok {
+		t.Error("restore with ttl 0 should not set a ttl")
+	}
+	if v, _ := dst.db.Get("list"); !reflect.DeepEqual(v.(*List).Range(0, -1), [][]byte{[]byte("a"), []byte("b"), []byte("c")}) {
+		t.Error("list value is not restored")
+	}
+	if v, _ := dst.db.Get("hash"); !bytes.Equal(v.(*Hash).Get("f2"), []byte("v2")) {
+		t.Error("hash value is not restored")
+	}
+	if res := zrange(ctx, dst, MakeCommandBytes("zrange zset 0 -1 withscores"), nil); !bytes.Equal(res.ToBytes(), zrange(ctx, src, MakeCommandBytes("zrange zset 0 -1 withscores"), nil).ToBytes()) {
+		t.Error("sorted set value is not restored")
+	}
+	if v, _ := dst.db.Get("stream"); v.(*Stream).LastID().Format() != "1-1" {
+		t.Error("stream value is not restored")
+	}
+	if res := dumpKey(ctx, src, MakeCommandBytes("dump missing"), nil); res.ByteData() != nil {
+		t.Error("dump of a missing key should be nil")
+	}
+}
+
+func TestRestoreOptions(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemDb()
+	setString(ctx, m, MakeCommandBytes("set k v"), nil)
+	payload, _, _ := m.Dump("k")
+	restore := func(args ...string) []byte {
+		cmd := [][]byte{[]byte("restore"), []byte(args[0]), []byte(args[1]), payload}
+		for _, arg := range args[2:] {
+			cmd = append(cmd, []byte(arg))
+		}
+		return restoreKey(ctx, m, cmd, nil).ToBytes()
+	}
+	if res := restore("k", "0"); !bytes.HasPrefix(res, []byte("-BUSYKEY")) {
+		t.Errorf("restore of an existing key reply is %q", res)
+	}
+	if res := restore("k", "100000", "replace"); !bytes.Equal(res, []byte("+OK\r\n")) {
+		t.Errorf("restore replace reply is %q", res)
+	}
+	if ttl, ok := m.ttlKeys.Get("k"); !ok || ttl.(*TTLInfo).value-time.Now().UnixMilli() > 101000 || ttl.(*TTLInfo).value-time.Now().UnixMilli() < 99000 {
+		t.Error("relative ttl is not restored")
+	}
+	at := time.Now().Add(time.Hour).UnixMilli()
+	restore("k2", strconv.FormatInt(at, 10), "absttl")
+	if ttl, ok := m.ttlKeys.Get("k2"); !ok || ttl.(*TTLInfo).value != at {
+		t.Error("absolute ttl is not restored")
+	}
+	// a key restored already expired is not created
+	restore("k3", "1000", "absttl")
+	if _, ok := m.db.Get("k3"); ok {
+		t.Error("expired key should not be restored")
+	}
+	if res := restore("k4", "-1"); !bytes.HasPrefix(res, []byte("-ERR Invalid TTL")) {
+		t.Errorf("restore with a negative ttl reply is %q", res)
+	}
+	if res := restore("k4", "0", "nope"); !bytes.Equal(res, []byte("-ERR syntax error\r\n")) {
+		t.Errorf("restore with an invalid option reply is %q", res)
+	}
+	// corrupted payloads are rejected
+	payload[0] ^= 0xff
+	if res := restore("k5", "0"); !bytes.HasPrefix(res, []byte("-ERR DUMP payload")) {
+		t.Errorf("restore of a corrupted payload reply is %q", res)
+	}
+	payload = []byte("short")
+	if res := restore("k5", "0"); !bytes.HasPrefix(res, []byte("-ERR DUMP payload")) {
+		t.Errorf("restore of a short payload reply is %q", res)
+	}
+}
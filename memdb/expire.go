@@ -0,0 +1,198 @@
+package memdb
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// expire.go implements the expiration of the keys. The expiration times of the keys are indexed by a min-heap,
+// and the expired keys are deleted either when a command accesses them (lazy expiry) or by the active expire
+// cycle, which the server runs periodically and which finds the expired keys through the heap.
+
+const (
+	// ExpireCycleInterval is the time between two regular active expire cycles, the slow cycles.
+	ExpireCycleInterval = 100 * time.Millisecond
+	// ExpireSlowCycleBudget bounds the time of a slow cycle, 25% of the interval.
+	ExpireSlowCycleBudget = 25 * time.Millisecond
+	// ExpireFastCycleBudget bounds the time of the fast cycles run between two slow cycles
+	// while the slow cycles can't keep up with the expired keys.
+	ExpireFastCycleBudget = time.Millisecond
+	// expireKeysPerLoop is the number of expired keys deleted between two checks of the time budget.
+	expireKeysPerLoop = 20
+	// expireAcceptableStale is the percentage of the keys with a TTL that may be expired but not deleted yet,
+	// above which fast cycles run.
+	expireAcceptableStale = 10
+	// expireStaleSamples is the number of keys sampled to estimate the percentage of stale keys.
+	expireStaleSamples = 20
+)
+
+// expireEntry is a key with a TTL and its position in the heap.
+type expireEntry struct {
+	key   string
+	at    int64 // expiration unix time in milliseconds
+	index int
+}
+
+// expireHeap orders the keys by expiration time. It implements heap.Interface.
+type expireHeap []*expireEntry
+
+func (h expireHeap) Len() int           { return len(h) }
+func (h expireHeap) Less(i, j int) bool { return h[i].at < h[j].at }
+func (h expireHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expireHeap) Push(x any) {
+	entry := x.(*expireEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expireHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// expireIndex holds the expiration times of the keys with a TTL. The times are looked up in ttlKeys,
+// which is changed together with the heap so that both hold the same keys.
+type expireIndex struct {
+	mu      sync.Mutex
+	ttlKeys *ConcurrentMap
+	heap    expireHeap
+	byKey   map[string]*expireEntry
+}
+
+func newExpireIndex(ttlKeys *ConcurrentMap) *expireIndex {
+	return &expireIndex{ttlKeys: ttlKeys, byKey: make(map[string]*expireEntry)}
+}
+
+// set sets the expiration time of the key.
+func (x *expireIndex) set(key string, at int64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.ttlKeys.Set(key, &TTLInfo{value: at})
+	if entry, ok := x.byKey[key]; ok {
+		entry.at = at
+		heap.Fix(&x.heap, entry.index)
+		return
+	}
+	entry := &expireEntry{key: key, at: at}
+	x.byKey[key] = entry
+	heap.Push(&x.heap, entry)
+}
+
+// remove removes the TTL of the key and returns 1 if it had one.
+func (x *expireIndex) remove(key string) int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if entry, ok := x.byKey[key]; ok {
+		delete(x.byKey, key)
+		heap.Remove(&x.heap, entry.index)
+	}
+	return x.ttlKeys.Delete(key)
+}
+
+// due returns at most count keys whose expiration time is not after now.
+func (x *expireIndex) due(now int64, count int) []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	res := make([]string, 0)
+	// the children of a key expire after it, so only the subtrees of the expired keys are visited
+	stack := []int{0}
+	for len(stack) > 0 && len(res) < count {
+		i := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if i >= len(x.heap) || x.heap[i].at > now {
+			continue
+		}
+		res = append(res, x.heap[i].key)
+		stack = append(stack, 2*i+2, 2*i+1)
+	}
+	return res
+}
+
+// stalePerc estimates the percentage of the keys that expired at now by sampling them.
+func (x *expireIndex) stalePerc(now int64) float64 {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if len(x.heap) == 0 {
+		return 0
+	}
+	expired := 0
+	for i := 0; i < expireStaleSamples; i++ {
+		if x.heap[rand.Intn(len(x.heap))].at <= now {
+			expired++
+		}
+	}
+	return float64(expired) * 100 / expireStaleSamples
+}
+
+// expireStats counts the keys deleted because they expired and the work of the active expire cycle.
+type expireStats struct {
+	expired        atomic.Int64
+	timeCapReached atomic.Int64
+	mu             sync.Mutex
+	stalePerc      float64 // moving average of the estimates of the cycles
+}
+
+// ExpireStats are the metrics of the expiration of the keys of a MemDb.
+type ExpireStats struct {
+	Expired        int64   // keys deleted because they expired
+	Volatile       int64   // keys with a TTL
+	StalePerc      float64 // estimated percentage of the keys with a TTL that expired but are not deleted yet
+	TimeCapReached int64   // active expire cycles that stopped before deleting every expired key
+}
+
+// ExpireStats returns the metrics of the expiration of the keys.
+func (m *MemDb) ExpireStats() ExpireStats {
+	m.expireStats.mu.Lock()
+	defer m.expireStats.mu.Unlock()
+	return ExpireStats{
+		Expired:        m.expireStats.expired.Load(),
+		Volatile:       m.ttlKeys.Len(),
+		StalePerc:      m.expireStats.stalePerc,
+		TimeCapReached: m.expireStats.timeCapReached.Load(),
+	}
+}
+
+// ActiveExpireCycle deletes the expired keys until there is none left or the deadline passes.
+// It returns true if it stopped at the deadline and the expired keys left are more than the acceptable stale
+// percentage, in which case the caller should run fast cycles before the next slow cycle.
+// Nothing is deleted in passive expire mode.
+func (m *MemDb) ActiveExpireCycle(deadline time.Time) bool {
+	if m.passiveExpire.Load() {
+		return false
+	}
+	for {
+		now := time.Now()
+		keys := m.expires.due(now.UnixMilli(), expireKeysPerLoop)
+		for _, key := range keys {
+			m.CheckTTL(key)
+		}
+		if len(keys) < expireKeysPerLoop {
+			m.updateStalePerc(0)
+			return false
+		}
+		if time.Now().After(deadline) {
+			m.expireStats.timeCapReached.Add(1)
+			perc := m.expires.stalePerc(time.Now().UnixMilli())
+			return m.updateStalePerc(perc) > expireAcceptableStale
+		}
+	}
+}
+
+// updateStalePerc adds the estimate of a cycle to the moving average and returns the average.
+func (m *MemDb) updateStalePerc(perc float64) float64 {
+	m.expireStats.mu.Lock()
+	defer m.expireStats.mu.Unlock()
+	m.expireStats.stalePerc = perc*0.05 + m.expireStats.stalePerc*0.95
+	return m.expireStats.stalePerc
+}
@@ -0,0 +1,143 @@
+package memdb
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExpireIndex(t *testing.T) {
+	x := newExpireIndex(NewConcurrentMap(4))
+	for i, at := range []int64{50, 10, 40, 20, 30} {
+		x.set("k"+strconv.Itoa(i), at)
+	}
+	x.set("k0", 5)
+	x.remove("k3")
+	keys := x.due(30, 10)
+	sort.Strings(keys)
+	if len(keys) != 3 || keys[0] != "k0" || keys[1] != "k1" || keys[2] != "k4" {
+		t.Errorf("due keys = %v", keys)
+	}
+	if keys := x.due(30, 2); len(keys) != 2 {
+		t.Errorf("due keys = %v, want 2 keys", keys)
+	}
+	if keys := x.due(4, 10); len(keys) != 0 {
+		t.Errorf("due keys = %v, want none", keys)
+	}
+	if x.ttlKeys.Len() != 4 || len(x.heap) != 4 {
+		t.Errorf("the index holds %d and %d keys, want 4", x.ttlKeys.Len(), len(x.heap))
+	}
+	for i, entry := range x.heap {
+		if entry.index != i {
+			t.Errorf("entry %s is at %d, want %d", entry.key, entry.index, i)
+		}
+	}
+}
+
+func TestActiveExpireCycle(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemDb()
+	var expired []string
+	m.SetExpireHook(func(key string) { expired = append(expired, key) })
+	past := time.Now().Add(-time.Minute).UnixMilli()
+	for _, key := range []string{"a", "b", "c", "live"} {
+		setString(ctx, m, MakeCommandBytes("set "+key+" v"), nil)
+	}
+	m.SetTTL("a", past)
+	m.SetTTL("b", past)
+	m.SetTTL("live", time.Now().Add(time.Hour).UnixMilli())
+
+	if m.ActiveExpireCycle(time.Now().Add(time.Second)) {
+		t.Error("the cycle should not be behind")
+	}
+	sort.Strings(expired)
+	if len(expired) != 2 || expired[0] != "a" || expired[1] != "b" {
+		t.Errorf("expired keys = %v", expired)
+	}
+	if m.Exists("a") || !m.Exists("c") || !m.Exists("live") {
+		t.Error("only the expired keys should be deleted")
+	}
+	stats := m.ExpireStats()
+	if stats.Expired != 2 || stats.Volatile != 1 || stats.TimeCapReached != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// the keys accessed after they expired are counted as well
+	m.SetTTL("c", past)
+	if m.Exists("c") {
+		t.Error("the expired key should be deleted when accessed")
+	}
+	if stats := m.ExpireStats(); stats.Expired != 3 {
+		t.Errorf("expired = %d, want 3", stats.Expired)
+	}
+}
+
+func TestActiveExpireCycleTimeCap(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemDb()
+	past := time.Now().Add(-time.Minute).UnixMilli()
+	for i := 0; i < 3*expireKeysPerLoop; i++ {
+		key := "k" + strconv.Itoa(i)
+		setString(ctx, m, MakeCommandBytes("set "+key+" v"), nil)
+		m.SetTTL(key, past)
+	}
+	// a cycle past its deadline still deletes a batch of keys before it stops
+	m.ActiveExpireCycle(time.Now().Add(-time.Second))
+	stats := m.ExpireStats()
+	if stats.Expired != expireKeysPerLoop || stats.TimeCapReached != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if stats.StalePerc <= 0 {
+		t.Errorf("stale percentage = %f, want above 0", stats.StalePerc)
+	}
+	m.ActiveExpireCycle(time.Now().Add(time.Second))
+	if stats := m.ExpireStats(); stats.Expired != 3*expireKeysPerLoop || stats.Volatile != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// nothing is deleted in passive expire mode
+	m.SetPassiveExpire(true)
+	setString(ctx, m, MakeCommandBytes("set k v"), nil)
+	m.SetTTL("k", past)
+	if m.ActiveExpireCycle(time.Now().Add(time.Second)) || !m.Exists("k") {
+		t.Error("the key should be kept in passive expire mode")
+	}
+}
+
+func TestLookupPassiveExpire(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemDb()
+	m.SetPassiveExpire(true)
+	past := time.Now().Add(-time.Minute).UnixMilli()
+	setString(ctx, m, MakeCommandBytes("set expired v"), nil)
+	setString(ctx, m, MakeCommandBytes("set live v"), nil)
+	m.SetTTL("expired", past)
+	m.SetTTL("live", time.Now().Add(time.Hour).UnixMilli())
+
+	// the reads don't see the expired key
+	view := m.Lookup([]string{"expired", "live"}, false)
+	if res := string(getString(ctx, view, MakeCommandBytes("get expired"), nil).ToBytes()); res != "$-1\r\n" {
+		t.Errorf("get expired = %q, want a nil reply", res)
+	}
+	if res := string(existsKey(ctx, view, MakeCommandBytes("exists expired live"), nil).ToBytes()); res != ":1\r\n" {
+		t.Errorf("exists = %q, want 1", res)
+	}
+	if res := string(ttlKey(ctx, view, MakeCommandBytes("ttl expired"), nil).ToBytes()); res != ":-2\r\n" {
+		t.Errorf("ttl expired = %q, want -2", res)
+	}
+	if res := string(ttlKey(ctx, view, MakeCommandBytes("ttl live"), nil).ToBytes()); res == ":-1\r\n" || res == ":-2\r\n" {
+		t.Errorf("ttl live = %q, want the ttl of the key", res)
+	}
+	if res := string(keysKey(ctx, m, MakeCommandBytes("keys *"), nil).ToBytes()); res != "*1\r\n$4\r\nlive\r\n" {
+		t.Errorf("keys = %q, want only the live key", res)
+	}
+	// the writes and the database still see it until it's deleted by a command
+	if m.Lookup([]string{"expired"}, true) != m || !m.Exists("expired") {
+		t.Error("the expired key should be kept in passive expire mode")
+	}
+	if m.Lookup([]string{"live"}, false) != m {
+		t.Error("the reads of live keys should run on the database")
+	}
+}
@@ -18,10 +18,6 @@ func hDelHash(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.R
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) < 3 {
-		return resp.MakeErrorData("wrong number of arguments for 'hdel' command")
-	}
-
 	key := string(cmd[1])
 
 	m.locks.Lock(key)
@@ -57,10 +53,6 @@ func hExistsHash(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) res
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) != 3 {
-		return resp.MakeErrorData("wrong number of arguments for 'hexists' command")
-	}
-
 	key := string(cmd[1])
 	if !m.CheckTTL(key) {
 		return resp.MakeIntData(0)
@@ -90,9 +82,6 @@ func hGetHash(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.R
 		logger.Error("hGetHash: command Names is not hget")
 		return resp.MakeErrorData("server error")
 	}
-	if len(cmd) != 3 {
-		return resp.MakeErrorData("wrong number of arguments for 'hget' command")
-	}
 
 	key := string(cmd[1])
 	if !m.CheckTTL(key) {
@@ -124,13 +113,9 @@ func hGetAllHash(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) res
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) != 2 {
-		return resp.MakeErrorData("wrong number of arguments for 'hgetall' command")
-	}
-
 	key := string(cmd[1])
 	if !m.CheckTTL(key) {
-		return resp.MakeEmptyArrayData()
+		return resp.MakeMapData([]resp.RedisData{})
 	}
 
 	m.locks.RLock(key)
@@ -138,7 +123,7 @@ func hGetAllHash(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) res
 
 	tem, ok := m.db.Get(key)
 	if !ok {
-		return resp.MakeEmptyArrayData()
+		return resp.MakeMapData([]resp.RedisData{})
 	}
 	hash, ok := tem.(*Hash)
 	if !ok {
@@ -150,7 +135,7 @@ func hGetAllHash(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) res
 	for k, v := range table {
 		res = append(res, resp.MakeBulkData([]byte(k)), resp.MakeBulkData(v))
 	}
-	return resp.MakeArrayData(res)
+	return resp.MakeMapData(res)
 }
 
 func hIncrByHash(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
@@ -159,10 +144,6 @@ func hIncrByHash(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) res
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) != 4 {
-		return resp.MakeErrorData("wrong number of arguments for 'hincrby' command")
-	}
-
 	var incr int
 	var err error
 	var hash *Hash
@@ -202,10 +183,6 @@ func hIncrByFloatHash(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) != 4 {
-		return resp.MakeErrorData("wrong number of arguments for 'hincrbyfloat' command")
-	}
-
 	var hash *Hash
 	key, field := string(cmd[1]), string(cmd[2])
 	incr, err := strconv.ParseFloat(string(cmd[3]), 64)
@@ -242,10 +219,6 @@ func hKeysHash(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) != 2 {
-		return resp.MakeErrorData("wrong number of arguments for 'hkeys' command")
-	}
-
 	key := string(cmd[1])
 	if !m.CheckTTL(key) {
 		return resp.MakeEmptyArrayData()
@@ -276,10 +249,6 @@ func hLenHash(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.R
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) != 2 {
-		return resp.MakeErrorData("wrong number of arguments for 'hlen' command")
-	}
-
 	key := string(cmd[1])
 	if !m.CheckTTL(key) {
 		return resp.MakeIntData(0)
@@ -306,10 +275,6 @@ func hMGetHash(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) < 3 {
-		return resp.MakeErrorData("wrong number of arguments for 'hmget' command")
-	}
-
 	key := string(cmd[1])
 	if !m.CheckTTL(key) {
 		return resp.MakeEmptyArrayData()
@@ -345,7 +310,7 @@ func hSetHash(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.R
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) < 4 || len(cmd)&1 == 1 {
+	if len(cmd)&1 == 1 {
 		return resp.MakeErrorData("wrong number of arguments for 'hset' command")
 	}
 
@@ -381,10 +346,6 @@ func hSetNxHash(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) != 4 {
-		return resp.MakeErrorData("wrong number of arguments for 'hsetnx' command")
-	}
-
 	key := string(cmd[1])
 	field := string(cmd[2])
 	value := cmd[3]
@@ -420,10 +381,6 @@ func hValsHash(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) != 2 {
-		return resp.MakeErrorData("wrong number of arguments for 'hvals' command")
-	}
-
 	key := string(cmd[1])
 	if !m.CheckTTL(key) {
 		return resp.MakeEmptyArrayData()
@@ -454,10 +411,6 @@ func hStrLenHash(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) res
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) != 3 {
-		return resp.MakeErrorData("wrong number of arguments for 'hstrlen' command")
-	}
-
 	key := string(cmd[1])
 	field := string(cmd[2])
 
@@ -488,7 +441,7 @@ func hRandFieldHash(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn)
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) != 2 && len(cmd) != 3 && len(cmd) != 4 {
+	if len(cmd) > 4 {
 		return resp.MakeErrorData("wrong number of arguments for 'hrandfield' command")
 	}
 
@@ -543,18 +496,18 @@ func hRandFieldHash(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn)
 }
 
 func RegisterHashCommands() {
-	RegisterCommand("hdel", hDelHash)
-	RegisterCommand("hexists", hExistsHash)
-	RegisterCommand("hget", hGetHash)
-	RegisterCommand("hgetall", hGetAllHash)
-	RegisterCommand("hincrby", hIncrByHash)
-	RegisterCommand("hincrbyfloat", hIncrByFloatHash)
-	RegisterCommand("hkeys", hKeysHash)
-	RegisterCommand("hlen", hLenHash)
-	RegisterCommand("hmget", hMGetHash)
-	RegisterCommand("hset", hSetHash)
-	RegisterCommand("hsetnx", hSetNxHash)
-	RegisterCommand("hvals", hValsHash)
-	RegisterCommand("hstrlen", hStrLenHash)
-	RegisterCommand("hrandfield", hRandFieldHash)
+	RegisterCommand("hdel", hDelHash, -3, CmdWrite, 1, 1, 1)
+	RegisterCommand("hexists", hExistsHash, 3, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("hget", hGetHash, 3, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("hgetall", hGetAllHash, 2, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("hincrby", hIncrByHash, 4, CmdWrite, 1, 1, 1)
+	RegisterCommand("hincrbyfloat", hIncrByFloatHash, 4, CmdWrite, 1, 1, 1)
+	RegisterCommand("hkeys", hKeysHash, 2, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("hlen", hLenHash, 2, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("hmget", hMGetHash, -3, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("hset", hSetHash, -4, CmdWrite, 1, 1, 1)
+	RegisterCommand("hsetnx", hSetNxHash, 4, CmdWrite, 1, 1, 1)
+	RegisterCommand("hvals", hValsHash, 2, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("hstrlen", hStrLenHash, 3, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("hrandfield", hRandFieldHash, -2, CmdReadOnly, 1, 1, 1)
 }
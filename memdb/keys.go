@@ -3,6 +3,7 @@ package memdb
 import (
 	"context"
 	"fmt"
+	"math"
 	"net"
 	"strconv"
 	"strings"
@@ -28,18 +29,13 @@ func delKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.Red
 	for _, key := range cmd[1:] {
 		m.locks.Lock(string(key))
 		dKey += m.db.Delete(string(key))
-		m.ttlKeys.Delete(string(key))
+		m.DelTTL(string(key))
 		m.locks.UnLock(string(key))
 	}
 	return resp.MakeIntData(int64(dKey))
 }
 
 func existsKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
-	cmdName := string(cmd[0])
-	if strings.ToLower(cmdName) != "exists" || len(cmd) < 2 {
-		logger.Error("existsKey Function: cmdName is not exists or command args number is invalid")
-		return resp.MakeErrorData("Protocol error: cmdName is not exists")
-	}
 	eKey := 0
 	var key string
 	for _, keyByte := range cmd[1:] {
@@ -56,15 +52,13 @@ func existsKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 }
 
 func keysKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
-	if strings.ToLower(string(cmd[0])) != "keys" || len(cmd) != 2 {
-		logger.Error("keysKey Function: cmdName is not keys or cmd length is not 2")
-		return resp.MakeErrorData(fmt.Sprintf("error: keys function get invalid command %s %s", string(cmd[0]), string(cmd[1])))
-	}
 	res := make([]resp.RedisData, 0)
 	allKeys := m.db.Keys()
 	pattern := string(cmd[1])
+	now := time.Now().UnixMilli()
 	for _, key := range allKeys {
-		if m.CheckTTL(key) {
+		// the expired keys kept in passive expire mode are not listed either
+		if m.CheckTTL(key) && !m.expiredAt(key, now) {
 			if util.PattenMatch(pattern, key) {
 				res = append(res, resp.MakeBulkData([]byte(key)))
 			}
@@ -74,23 +68,47 @@ func keysKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.Re
 }
 
 func expireKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
-	cmdName := string(cmd[0])
-	if strings.ToLower(cmdName) != "expire" || len(cmd) < 3 || len(cmd) > 4 {
-		logger.Error("expireKey Function: cmdName is not expire or command args number is invalid")
-		return resp.MakeErrorData("error: cmdName is not expire or command args number is invalid")
-	}
+	return expireGeneric(m, cmd, time.Now().UnixMilli(), 1000)
+}
 
+// pexpireKey sets the time to live of the key in milliseconds: PEXPIRE key milliseconds [NX|XX|GT|LT].
+func pexpireKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
+	return expireGeneric(m, cmd, time.Now().UnixMilli(), 1)
+}
+
+// expireatKey sets the absolute unix time in seconds at which the key expires: EXPIREAT key timestamp [NX|XX|GT|LT].
+func expireatKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
+	return expireGeneric(m, cmd, 0, 1000)
+}
+
+// pexpireatKey sets the absolute unix time in milliseconds at which the key expires: PEXPIREAT key timestamp [NX|XX|GT|LT].
+func pexpireatKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
+	return expireGeneric(m, cmd, 0, 1)
+}
+
+// expireGeneric sets the expiration time of the key to base + cmd[2] * unit milliseconds
+// with an optional nx, xx, gt or lt condition.
+func expireGeneric(m *MemDb, cmd [][]byte, base, unit int64) resp.RedisData {
+	cmdName := strings.ToLower(string(cmd[0]))
+	if len(cmd) > 4 {
+		return resp.MakeWrongNumberArgs(cmdName)
+	}
 	v, err := strconv.ParseInt(string(cmd[2]), 10, 64)
 	if err != nil {
-		logger.Error("expireKey Function: cmd[2] %s is not int", string(cmd[2]))
-		return resp.MakeErrorData(fmt.Sprintf("error: %s is not int", string(cmd[2])))
+		return resp.MakeErrorData("ERR value is not an integer or out of range")
+	}
+	if v > (math.MaxInt64-base)/unit || v < math.MinInt64/unit {
+		return resp.MakeErrorData(fmt.Sprintf("ERR invalid expire time in '%s' command", cmdName))
 	}
-	ttl := time.Now().Unix() + v
 	var opt string
 	if len(cmd) == 4 {
 		opt = strings.ToLower(string(cmd[3]))
 	}
-	key := string(cmd[1])
+	return m.expireKeyAt(string(cmd[1]), base+v*unit, opt)
+}
+
+// expireKeyAt sets the expiration unix time in milliseconds of the key with an optional nx, xx, gt or lt condition.
+func (m *MemDb) expireKeyAt(key string, ttl int64, opt string) resp.RedisData {
 	if !m.CheckTTL(key) {
 		return resp.MakeIntData(int64(0))
 	}
@@ -117,7 +135,7 @@ func expireKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 		}
 	default:
 		if opt != "" {
-			logger.Error("expireKey Function: opt %s is not nx, xx, gt or lt", opt)
+			logger.Error("expireKey Function: opt ", opt, " is not nx, xx, gt or lt")
 			return resp.MakeErrorData(fmt.Sprintf("ERR Unsupported option %s, except nx, xx, gt, lt", opt))
 		}
 		res = m.SetTTL(key, ttl)
@@ -126,11 +144,6 @@ func expireKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 }
 
 func persistKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
-	cmdName := string(cmd[0])
-	if strings.ToLower(cmdName) != "persist" || len(cmd) != 2 {
-		logger.Error("persistKey Function: cmdName is not persist or command args number is invalid")
-		return resp.MakeErrorData("error: cmdName is not persist or command args number is invalid")
-	}
 	key := string(cmd[1])
 	if !m.CheckTTL(key) {
 		return resp.MakeIntData(int64(0))
@@ -143,13 +156,28 @@ func persistKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp
 }
 
 func ttlKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
-	cmdName := string(cmd[0])
-	if strings.ToLower(cmdName) != "ttl" || len(cmd) != 2 {
-		logger.Error("ttlKey Function: cmdName is not ttl or command args number is invalid")
-		return resp.MakeErrorData("error: cmdName is not ttl or command args number is invalid")
-	}
-	key := string(cmd[1])
+	return m.ttlGeneric(string(cmd[1]), false, false)
+}
+
+// pttlKey returns the time to live of the key in milliseconds.
+func pttlKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
+	return m.ttlGeneric(string(cmd[1]), true, false)
+}
+
+// expiretimeKey returns the absolute unix time in seconds at which the key expires.
+func expiretimeKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
+	return m.ttlGeneric(string(cmd[1]), false, true)
+}
 
+// pexpiretimeKey returns the absolute unix time in milliseconds at which the key expires.
+func pexpiretimeKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
+	return m.ttlGeneric(string(cmd[1]), true, true)
+}
+
+// ttlGeneric returns the time left before the key expires, or its expiration unix time if abs is set,
+// in milliseconds if ms is set and rounded to seconds otherwise. It returns -2 if the key doesn't exist
+// and -1 if it has no TTL.
+func (m *MemDb) ttlGeneric(key string, ms, abs bool) resp.RedisData {
 	if !m.CheckTTL(key) {
 		return resp.MakeIntData(int64(-2))
 	}
@@ -159,20 +187,25 @@ func ttlKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.Red
 	if _, ok := m.db.Get(key); !ok {
 		return resp.MakeIntData(int64(-2))
 	}
-	now := time.Now().Unix()
 	ttl, ok := m.ttlKeys.Get(key)
 	if !ok {
 		return resp.MakeIntData(int64(-1))
 	}
-	return resp.MakeIntData(ttl.(*TTLInfo).value - now)
+	left := ttl.(*TTLInfo).value
+	if !abs {
+		left -= time.Now().UnixMilli()
+		// an expired key is kept until its deletion is replicated in cluster mode
+		if left < 0 {
+			left = 0
+		}
+	}
+	if !ms {
+		left = (left + 500) / 1000
+	}
+	return resp.MakeIntData(left)
 }
 
 func typeKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
-	cmdName := string(cmd[0])
-	if strings.ToLower(cmdName) != "type" || len(cmd) != 2 {
-		logger.Error("typeKey Function: cmdName is not type or command args number is invalid")
-		return resp.MakeErrorData("error: cmdName is not type or command args number is invalid")
-	}
 	key := string(cmd[1])
 
 	if !m.CheckTTL(key) {
@@ -201,11 +234,6 @@ func typeKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.Re
 }
 
 func renameKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
-	cmdName := string(cmd[0])
-	if strings.ToLower(cmdName) != "rename" || len(cmd) != 3 {
-		logger.Error("renameKey Function: cmdName is not rename or command args number is invalid")
-		return resp.MakeErrorData("error: cmdName is not rename or command args number is invalid")
-	}
 	oldName, newName := string(cmd[1]), string(cmd[2])
 
 	if !m.CheckTTL(oldName) {
@@ -220,16 +248,16 @@ func renameKey(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 		return resp.MakeErrorData(fmt.Sprintf("error: %s not exist", oldName))
 	}
 	m.db.Delete(oldName)
-	m.ttlKeys.Delete(oldName)
+	m.DelTTL(oldName)
 	m.db.Delete(newName)
-	m.ttlKeys.Delete(newName)
+	m.DelTTL(newName)
 	m.db.Set(newName, oldValue)
 	return resp.MakeStringData("OK")
 }
 
 func pingKeys(ctx context.Context, m *MemDb, cmd [][]byte, _ net.Conn) resp.RedisData {
 	if len(cmd) > 2 {
-		return resp.MakeErrorData("error: wrong number of arguments for 'ping' command")
+		return resp.MakeWrongNumberArgs("ping")
 	}
 	// default reply
 	if len(cmd) == 1 {
@@ -240,13 +268,19 @@ func pingKeys(ctx context.Context, m *MemDb, cmd [][]byte, _ net.Conn) resp.Redi
 }
 
 func RegisterKeyCommands() {
-	RegisterCommand("ping", pingKeys)
-	RegisterCommand("del", delKey)
-	RegisterCommand("exists", existsKey)
-	RegisterCommand("keys", keysKey)
-	RegisterCommand("expire", expireKey)
-	RegisterCommand("persist", persistKey)
-	RegisterCommand("ttl", ttlKey)
-	RegisterCommand("type", typeKey)
-	RegisterCommand("rename", renameKey)
+	RegisterCommand("ping", pingKeys, -1, 0, 0, 0, 0)
+	RegisterCommand("del", delKey, -2, CmdWrite, 1, -1, 1)
+	RegisterCommand("exists", existsKey, -2, CmdReadOnly, 1, -1, 1)
+	RegisterCommand("keys", keysKey, 2, CmdReadOnly, 0, 0, 0)
+	RegisterCommand("expire", expireKey, -3, CmdWrite, 1, 1, 1)
+	RegisterCommand("pexpire", pexpireKey, -3, CmdWrite, 1, 1, 1)
+	RegisterCommand("expireat", expireatKey, -3, CmdWrite, 1, 1, 1)
+	RegisterCommand("pexpireat", pexpireatKey, -3, CmdWrite, 1, 1, 1)
+	RegisterCommand("persist", persistKey, 2, CmdWrite, 1, 1, 1)
+	RegisterCommand("ttl", ttlKey, 2, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("pttl", pttlKey, 2, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("expiretime", expiretimeKey, 2, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("pexpiretime", pexpiretimeKey, 2, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("type", typeKey, 2, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("rename", renameKey, 3, CmdWrite, 1, 2, 1)
 }
@@ -3,6 +3,8 @@ package memdb
 import (
 	"bytes"
 	"context"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -43,7 +45,7 @@ func TestExpireKey(t *testing.T) {
 		t.Error("expire reply is not correct")
 	}
 	attl, _ := memdb.ttlKeys.Get("a")
-	if attl.(*TTLInfo).value-time.Now().Unix() > 100 || attl.(*TTLInfo).value-time.Now().Unix() < 99 {
+	if attl.(*TTLInfo).value-time.Now().UnixMilli() > 100000 || attl.(*TTLInfo).value-time.Now().UnixMilli() < 99000 {
 		t.Error("ttl set incorrect")
 	}
 	expire_a1 := expireKey(ctx, memdb, [][]byte{[]byte("expire"), []byte("a"), []byte("1000"), []byte("xx")}, nil)
@@ -51,7 +53,7 @@ func TestExpireKey(t *testing.T) {
 		t.Error("expire reply is not correct")
 	}
 	a1ttl, _ := memdb.ttlKeys.Get("a")
-	if a1ttl.(*TTLInfo).value-time.Now().Unix() > 1000 || a1ttl.(*TTLInfo).value-time.Now().Unix() < 999 {
+	if a1ttl.(*TTLInfo).value-time.Now().UnixMilli() > 1000000 || a1ttl.(*TTLInfo).value-time.Now().UnixMilli() < 999000 {
 		t.Error("ttl set incorrect")
 	}
 
@@ -60,7 +62,7 @@ func TestExpireKey(t *testing.T) {
 		t.Error("expire reply is not correct")
 	}
 	bttl, _ := memdb.ttlKeys.Get("b")
-	if bttl.(*TTLInfo).value-time.Now().Unix() > 100 || bttl.(*TTLInfo).value-time.Now().Unix() < 99 {
+	if bttl.(*TTLInfo).value-time.Now().UnixMilli() > 100000 || bttl.(*TTLInfo).value-time.Now().UnixMilli() < 99000 {
 		t.Error("ttl set incorrect")
 	}
 
@@ -69,7 +71,81 @@ func TestExpireKey(t *testing.T) {
 		t.Error("expire reply is not correct")
 	}
 	b1ttl, _ := memdb.ttlKeys.Get("b")
-	if b1ttl.(*TTLInfo).value-time.Now().Unix() > 1000 || b1ttl.(*TTLInfo).value-time.Now().Unix() < 999 {
+	if b1ttl.(*TTLInfo).value-time.Now().UnixMilli() > 1000000 || b1ttl.(*TTLInfo).value-time.Now().UnixMilli() < 999000 {
 		t.Error("ttl set incorrect")
 	}
 }
+
+func TestPExpireAtKey(t *testing.T) {
+	memdb := NewMemDb()
+	memdb.db.Set("a", "a")
+	ctx := context.Background()
+	at := time.Now().UnixMilli() + 100500
+	res := pexpireatKey(ctx, memdb, [][]byte{[]byte("pexpireat"), []byte("a"), []byte(strconv.FormatInt(at, 10))}, nil)
+	if !bytes.Equal(res.ToBytes(), []byte(":1\r\n")) {
+		t.Error("pexpireat reply is not correct")
+	}
+	attl, _ := memdb.ttlKeys.Get("a")
+	if attl.(*TTLInfo).value != at {
+		t.Error("ttl should be kept in milliseconds")
+	}
+	res = pexpireatKey(ctx, memdb, [][]byte{[]byte("pexpireat"), []byte("a"), []byte(strconv.FormatInt(at+5000, 10)), []byte("lt")}, nil)
+	if !bytes.Equal(res.ToBytes(), []byte(":0\r\n")) {
+		t.Error("pexpireat lt should not extend the ttl")
+	}
+}
+
+func TestExpireFamily(t *testing.T) {
+	RegisterKeyCommands()
+	RegisterStringCommands()
+	m := NewMemDb()
+	ctx := context.Background()
+	exec := func(cmd string) string {
+		return string(m.ExecCommand(ctx, MakeCommandBytes(cmd), nil).ToBytes())
+	}
+	exec("set a v")
+	if res := exec("pttl a"); res != ":-1\r\n" {
+		t.Errorf("pttl without ttl = %q", res)
+	}
+	if res := exec("expiretime nokey"); res != ":-2\r\n" {
+		t.Errorf("expiretime of a missing key = %q", res)
+	}
+
+	if res := exec("pexpire a 100500"); res != ":1\r\n" {
+		t.Errorf("pexpire reply = %q", res)
+	}
+	pttl, _ := strconv.ParseInt(strings.Trim(exec("pttl a"), ":\r\n"), 10, 64)
+	if pttl > 100500 || pttl < 100000 {
+		t.Errorf("pttl = %d", pttl)
+	}
+	if res := exec("ttl a"); res != ":101\r\n" && res != ":100\r\n" {
+		t.Errorf("ttl should be rounded to the second, got %q", res)
+	}
+	if res := exec("pexpire a 10 gt"); res != ":0\r\n" {
+		t.Errorf("pexpire gt should not shorten the ttl, got %q", res)
+	}
+
+	at := time.Now().Add(time.Hour).Unix()
+	if res := exec("expireat a " + strconv.FormatInt(at, 10) + " xx"); res != ":1\r\n" {
+		t.Errorf("expireat reply = %q", res)
+	}
+	if res := exec("expiretime a"); res != ":"+strconv.FormatInt(at, 10)+"\r\n" {
+		t.Errorf("expiretime = %q", res)
+	}
+	if res := exec("pexpiretime a"); res != ":"+strconv.FormatInt(at*1000, 10)+"\r\n" {
+		t.Errorf("pexpiretime = %q", res)
+	}
+	if res := exec("expireat a 1 lt"); res != ":1\r\n" {
+		t.Errorf("expireat lt reply = %q", res)
+	}
+	if res := exec("pttl a"); res != ":-2\r\n" {
+		t.Errorf("a key expired in the past should be deleted, pttl = %q", res)
+	}
+
+	if res := exec("pexpire a ten"); !strings.HasPrefix(res, "-ERR value is not an integer") {
+		t.Errorf("pexpire with an invalid time = %q", res)
+	}
+	if res := exec("expire a 9223372036854775807"); res != "-ERR invalid expire time in 'expire' command\r\n" {
+		t.Errorf("expire with an overflowing time = %q", res)
+	}
+}
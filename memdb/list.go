@@ -22,10 +22,6 @@ func lLenList(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.R
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) != 2 {
-		return resp.MakeErrorData("wrong number of arguments for 'llen' command")
-	}
-
 	key := string(cmd[1])
 
 	//if !m.CheckTTL(key) {
@@ -54,10 +50,6 @@ func lIndexList(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) != 3 {
-		return resp.MakeErrorData("wrong number of arguments for 'lindex' command")
-	}
-
 	key := string(cmd[1])
 	index, err := strconv.Atoi(string(cmd[2]))
 	if err != nil {
@@ -93,7 +85,7 @@ func lPosList(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.R
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) < 3 || len(cmd)&1 != 1 {
+	if len(cmd)&1 != 1 {
 		return resp.MakeErrorData("wrong number of arguments for 'lpos' command")
 	}
 
@@ -279,7 +271,7 @@ func lPosList(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.R
 }
 
 func lPopList(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
-	if len(cmd) != 2 && len(cmd) != 3 {
+	if len(cmd) > 3 {
 		return resp.MakeErrorData("wrong number of arguments for 'lpop' command")
 	}
 
@@ -342,7 +334,7 @@ func rPopList(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.R
 		logger.Error("rPopList: command is not rpop")
 		return resp.MakeErrorData("server error")
 	}
-	if len(cmd) != 2 && len(cmd) != 3 {
+	if len(cmd) > 3 {
 		return resp.MakeErrorData("wrong number of arguments for 'rpop' command")
 	}
 
@@ -404,9 +396,6 @@ func lPushList(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 		logger.Error("lPushList Function : cmdName is not lpush")
 		return resp.MakeErrorData("Server Error")
 	}
-	if len(cmd) < 3 {
-		return resp.MakeErrorData("wrong number of arguments for 'lpush' command")
-	}
 
 	key := string(cmd[1])
 	m.CheckTTL(key)
@@ -440,9 +429,6 @@ func lPushXList(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp
 		logger.Error("lPushXList Function : cmdName is not lpushx")
 		return resp.MakeErrorData("Server Error")
 	}
-	if len(cmd) < 3 {
-		return resp.MakeErrorData("wrong number of arguments for 'lpushx' command")
-	}
 
 	key := string(cmd[1])
 	m.CheckTTL(key)
@@ -471,9 +457,6 @@ func rPushList(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 		logger.Error("rPushList Function : cmdName is not rpush")
 		return resp.MakeErrorData("server error")
 	}
-	if len(cmd) < 3 {
-		return resp.MakeErrorData("wrong number of arguments for 'rpush' command")
-	}
 
 	key := string(cmd[1])
 	m.CheckTTL(key)
@@ -503,9 +486,6 @@ func rPushXList(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp
 		logger.Error("rPushXList Function : cmdName is not rpushx")
 		return resp.MakeErrorData("server error")
 	}
-	if len(cmd) < 3 {
-		return resp.MakeErrorData("wrong number of arguments for 'rpushX' command")
-	}
 
 	key := string(cmd[1])
 	m.CheckTTL(key)
@@ -534,9 +514,6 @@ func lSetList(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.R
 		logger.Error("lSetList Function : cmdName is not lset")
 		return resp.MakeErrorData("server error")
 	}
-	if len(cmd) != 4 {
-		return resp.MakeErrorData("wrong number of arguments for 'lset' command")
-	}
 
 	index, err := strconv.Atoi(string(cmd[2]))
 	if err != nil {
@@ -575,10 +552,6 @@ func lRemList(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.R
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) != 4 {
-		return resp.MakeErrorData("wrong number of arguments for 'lrem' command")
-	}
-
 	count, err := strconv.Atoi(string(cmd[2]))
 	if err != nil {
 		return resp.MakeErrorData("count must be an integer")
@@ -619,9 +592,6 @@ func lTrimList(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 		logger.Error("lTrimList Function : cmdName is not ltrim")
 		return resp.MakeErrorData("server error")
 	}
-	if len(cmd) != 4 {
-		return resp.MakeErrorData("wrong number of arguments for 'ltrim' command")
-	}
 	start, err1 := strconv.Atoi(string(cmd[2]))
 	end, err2 := strconv.Atoi(string(cmd[3]))
 	if err1 != nil || err2 != nil {
@@ -662,10 +632,6 @@ func lRangeList(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) != 4 {
-		return resp.MakeErrorData("wrong number of arguments for 'lrange' command")
-	}
-
 	start, err1 := strconv.Atoi(string(cmd[2]))
 	end, err2 := strconv.Atoi(string(cmd[3]))
 	if err1 != nil || err2 != nil {
@@ -707,10 +673,6 @@ func lMoveList(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) != 5 {
-		return resp.MakeErrorData("wrong number of arguments for 'lmove' command")
-	}
-
 	src := string(cmd[1])
 	des := string(cmd[2])
 	srcDrc := strings.ToLower(string(cmd[3]))
@@ -781,22 +743,15 @@ func lMoveList(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 
 func blPopList(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
 	// at least 3 args like "BLPOP key timeout"
-	if len(cmd) < 3 {
-		return resp.MakeErrorData("ERR wrong number of arguments for 'blpop' command")
-	}
 	return bXPopList(ctx, m, cmd, "left")
 }
 
 func brPopList(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
 	// at least 3 args like "BLPOP key timeout"
-	if len(cmd) < 3 {
-		return resp.MakeErrorData("ERR wrong number of arguments for 'blpop' command")
-	}
 	return bXPopList(ctx, m, cmd, "right")
 }
 
 func bXPopList(ctx context.Context, m *MemDb, cmd [][]byte, direction string) resp.RedisData {
-
 	// last arg is block timeout
 	timeout, err := strconv.Atoi(string(cmd[len(cmd)-1]))
 	if err != nil {
@@ -860,20 +815,20 @@ func bXPopList(ctx context.Context, m *MemDb, cmd [][]byte, direction string) re
 }
 
 func RegisterListCommands() {
-	RegisterCommand("llen", lLenList)
-	RegisterCommand("lindex", lIndexList)
-	RegisterCommand("lpos", lPosList)
-	RegisterCommand("lpop", lPopList)
-	RegisterCommand("rpop", rPopList)
-	RegisterCommand("lpush", lPushList)
-	RegisterCommand("lpushx", lPushXList)
-	RegisterCommand("rpush", rPushList)
-	RegisterCommand("rpushx", rPushXList)
-	RegisterCommand("lset", lSetList)
-	RegisterCommand("lrem", lRemList)
-	RegisterCommand("ltrim", lTrimList)
-	RegisterCommand("lrange", lRangeList)
-	RegisterCommand("lmove", lMoveList)
-	RegisterCommand("blpop", blPopList)
-	RegisterCommand("brpop", brPopList)
+	RegisterCommand("llen", lLenList, 2, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("lindex", lIndexList, 3, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("lpos", lPosList, -3, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("lpop", lPopList, -2, CmdWrite, 1, 1, 1)
+	RegisterCommand("rpop", rPopList, -2, CmdWrite, 1, 1, 1)
+	RegisterCommand("lpush", lPushList, -3, CmdWrite, 1, 1, 1)
+	RegisterCommand("lpushx", lPushXList, -3, CmdWrite, 1, 1, 1)
+	RegisterCommand("rpush", rPushList, -3, CmdWrite, 1, 1, 1)
+	RegisterCommand("rpushx", rPushXList, -3, CmdWrite, 1, 1, 1)
+	RegisterCommand("lset", lSetList, 4, CmdWrite, 1, 1, 1)
+	RegisterCommand("lrem", lRemList, 4, CmdWrite, 1, 1, 1)
+	RegisterCommand("ltrim", lTrimList, 4, CmdWrite, 1, 1, 1)
+	RegisterCommand("lrange", lRangeList, 4, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("lmove", lMoveList, 5, CmdWrite, 1, 2, 1)
+	RegisterCommand("blpop", blPopList, -3, CmdWrite|CmdBlocking, 1, -2, 1)
+	RegisterCommand("brpop", brPopList, -3, CmdWrite|CmdBlocking, 1, -2, 1)
 }
@@ -7,14 +7,11 @@ import (
 )
 
 func RegisterPubSubCommands() {
-	RegisterCommand("subscribe", subscribe)
-	RegisterCommand("publish", publish)
+	RegisterCommand("subscribe", subscribe, -2, 0, 0, 0, 0)
+	RegisterCommand("publish", publish, 3, 0, 0, 0, 0)
 }
 
 func subscribe(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
-	if len(cmd) < 2 {
-		return resp.MakeWrongNumberArgs("subscribe")
-	}
 	// get all subscribe keys
 	keys := make([]string, 0, len(cmd)-1)
 	for _, b := range cmd[1:] {
@@ -44,13 +41,10 @@ func subscribe(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 		res = append(res, resp.MakeBulkData([]byte("subscribe")),
 			resp.MakeBulkData([]byte(key)), resp.MakeIntData(int64(1)))
 	}
-	return resp.MakeArrayData(res)
+	return resp.MakePushData(res)
 }
 
 func publish(ctx context.Context, m *MemDb, cmd [][]byte, _ net.Conn) resp.RedisData {
-	if len(cmd) != 3 {
-		return resp.MakeWrongNumberArgs("publish")
-	}
 	key := string(cmd[1])
 	val := string(cmd[2])
 	numSubs := m.SubChans.Send(key, val)
@@ -49,12 +49,17 @@ func (m *ChanMap) Send(key string, val string) int {
 		key:  key,
 		val:  val,
 	}
+	data := resp.MakePushData([]resp.RedisData{resp.MakeBulkData([]byte(msg.info)),
+		resp.MakeBulkData([]byte(msg.key)),
+		resp.MakeBulkData([]byte(msg.val.(string))),
+	})
+	// the subscribers that fail to receive the message are removed
+	channel.rw.Lock()
+	defer channel.rw.Unlock()
 	// block sending messages since we need to get the number of active clients
 	for k, c := range channel.conns {
-		_, err := c.Write(resp.MakeArrayData([]resp.RedisData{resp.MakeBulkData([]byte(msg.info)),
-			resp.MakeBulkData([]byte(msg.key)),
-			resp.MakeBulkData([]byte(msg.val.(string))),
-		}).ToBytes())
+		// a push message for the RESP3 clients, an array for the others
+		_, err := c.Write(resp.Encode(data, resp.ConnProtocol(c)))
 		if err != nil {
 			_ = c.Close()
 			delete(channel.conns, k)
@@ -1,71 +1,71 @@
 package memdb
 
 import (
-	"github.com/innovationb1ue/RedisGO/resp"
-	"go.etcd.io/etcd/raft/v3/raftpb"
+	"context"
+	"errors"
 	"net"
 	"strconv"
 	"strings"
-)
+	"time"
 
-import (
-	"context"
+	"github.com/innovationb1ue/RedisGO/resp"
+	"go.etcd.io/etcd/raft/v3/raftpb"
 )
 
-// rconf stands for raft configuration.
-func rconf(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
-	if len(cmd) < 3 {
-		return resp.MakeWrongNumberArgs("rconf")
-	}
-
-	confCTmp := ctx.Value("confChangeC")
-	var confChangeC chan<- raftpb.ConfChangeI
-	var ok bool
+// confChangeTimeout bounds the time rconf waits for the membership change to apply.
+const confChangeTimeout = 5 * time.Second
 
-	confChangeC, ok = confCTmp.(chan<- raftpb.ConfChangeI)
-	if !ok {
-		return resp.MakeErrorData("ERR can not resolve conf change channel.l Make sure server runs in cluster mode. ")
+// rconf stands for raft configuration: RCONF ADD|ADDLEARNER id url [addr] | DELETE id | UPDATE id url [addr] | PROMOTE id.
+// It replies once the change is applied by this node. A learner is promoted by the leader once it caught up.
+func rconf(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
+	if m.Raft == nil {
+		return resp.MakeErrorData("ERR raft node is not initialized. Make sure server runs in cluster mode.")
 	}
 	var actType raftpb.ConfChangeType
-	var url string
 	switch strings.ToLower(string(cmd[1])) {
-	case "add":
+	case "add", "promote":
 		actType = raftpb.ConfChangeAddNode
-		url = string(cmd[3])
+	case "addlearner":
+		actType = raftpb.ConfChangeAddLearnerNode
 	case "delete":
 		actType = raftpb.ConfChangeRemoveNode
 	case "update":
 		actType = raftpb.ConfChangeUpdateNode
 	default:
-		return resp.MakeErrorData("unrecognized key")
+		return resp.MakeErrorData("ERR unknown action " + string(cmd[1]))
 	}
-	nodeID, err := strconv.ParseUint(string(cmd[2]), 10, 64)
-	if err != nil {
-		return resp.MakeErrorData("ERR value is not integer or out of range")
+	promote := strings.ToLower(string(cmd[1])) == "promote"
+	var url, addr string
+	if actType == raftpb.ConfChangeRemoveNode || promote {
+		if len(cmd) != 3 {
+			return resp.MakeErrorData("ERR syntax error")
+		}
+	} else {
+		if len(cmd) != 4 && len(cmd) != 5 {
+			return resp.MakeErrorData("ERR syntax error")
+		}
+		url = string(cmd[3])
+		if len(cmd) == 5 {
+			addr = string(cmd[4])
+		}
 	}
-	if nodeID < 0 {
-		return resp.MakeErrorData("ID should be a positive integer")
+	nodeID, err := strconv.ParseUint(string(cmd[2]), 10, 64)
+	if err != nil || nodeID == 0 {
+		return resp.MakeErrorData("ERR value is not an integer or out of range")
 	}
-	cc := raftpb.ConfChangeSingle{
-		Type:   actType,
-		NodeID: nodeID,
+	ctx, cancel := context.WithTimeout(ctx, confChangeTimeout)
+	defer cancel()
+	if promote {
+		err = m.Raft.PromoteMember(ctx, nodeID)
+	} else {
+		err = m.Raft.ChangeMembership(ctx, raftpb.ConfChangeSingle{Type: actType, NodeID: nodeID}, url, addr)
 	}
-	changeV2 := raftpb.ConfChangeV2{
-		Transition: 2,
-		Changes:    []raftpb.ConfChangeSingle{cc},
-		Context:    []byte(url),
+	if errors.Is(err, context.DeadlineExceeded) {
+		return resp.MakeErrorData("ERR Timed out waiting for the membership change to apply, it may be applied later")
+	} else if err != nil {
+		return resp.MakeErrorData("ERR " + err.Error())
 	}
-	confChangeC <- changeV2
-
-	// legacy ConfChange method
-	//change := raftpb.ConfChange{
-	//	Type:    raftpb.ConfChangeAddNode,
-	//	NodeID:  nodeID,
-	//	Context: []byte(url),
-	//}
-	//confChangeC <- change
-
-	return resp.MakeStringData("send changeV2 to confChange")
+	return resp.MakeStringData("OK")
 }
 
 // Member is designed to be a single arg command
@@ -77,21 +77,33 @@ func Member(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.Red
 	}
 }
 
-// MemberList implementing 'list' option of Member command
+// MemberList implementing 'list' option of Member command. It reports every member of the raft group
+// as seen by this node.
 func MemberList(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
 	node := m.Raft
 	if node == nil {
 		return resp.MakeErrorData("raft node is not initialized. ")
 	}
-	peers := m.Raft.Peers
-	res := make([]resp.RedisData, 0, len(peers))
-	for _, k := range peers {
-		res = append(res, resp.MakeStringData(k))
+	members := node.MembersStatus()
+	res := make([]resp.RedisData, 0, len(members))
+	for _, member := range members {
+		reachable := int64(0)
+		if member.Reachable {
+			reachable = 1
+		}
+		res = append(res, resp.MakeArrayData([]resp.RedisData{
+			resp.MakeBulkData([]byte("id")), resp.MakeIntData(int64(member.ID)),
+			resp.MakeBulkData([]byte("url")), resp.MakeBulkData([]byte(member.URL)),
+			resp.MakeBulkData([]byte("addr")), resp.MakeBulkData([]byte(member.Addr)),
+			resp.MakeBulkData([]byte("role")), resp.MakeBulkData([]byte(member.Role)),
+			resp.MakeBulkData([]byte("match-index")), resp.MakeIntData(int64(member.Match)),
+			resp.MakeBulkData([]byte("reachable")), resp.MakeIntData(reachable),
+		}))
 	}
 	return resp.MakeArrayData(res)
 }
 
 func RegisterRaftCommand() {
-	RegisterCommand("rconf", rconf)
-	RegisterCommand("member", Member)
+	RegisterCommand("rconf", rconf, -3, CmdAdmin, 0, 0, 0)
+	RegisterCommand("member", Member, -2, CmdAdmin, 0, 0, 0)
 }
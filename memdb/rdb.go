@@ -0,0 +1,426 @@
+package memdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"math"
+	"time"
+)
+
+// rdb.go implements a compact binary snapshot format for MemDb.
+// Layout of a snapshot:
+//
+//	"REDISGO" | version(1 byte)
+//	{ opSelectDB | uvarint(db index)
+//	  { [opExpireMs | int64(unix ms)] | type(1 byte) | string(key) | value }* }*
+//	opEOF | uint64(crc64 of everything before)
+//
+// Strings are encoded as uvarint(length) followed by the raw bytes.
+// Numbers are written in big endian.
+
+const (
+	rdbMagic   = "REDISGO"
+	rdbVersion = 1
+
+	rdbOpSelectDB = 0xFE
+	rdbOpExpireMs = 0xFC
+	rdbOpEOF      = 0xFF
+
+	rdbTypeString    = 0
+	rdbTypeList      = 1
+	rdbTypeSet       = 2
+	rdbTypeSortedSet = 3
+	rdbTypeHash      = 4
+	rdbTypeStream    = 5
+)
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+var ErrRDBChecksum = errors.New("ERR snapshot checksum mismatch")
+
+// rdbEncoder writes rdb primitives. The first error is kept and all following writes are skipped.
+type rdbEncoder struct {
+	w   io.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (e *rdbEncoder) write(p []byte) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = e.w.Write(p)
+}
+
+func (e *rdbEncoder) writeByte(b byte) {
+	e.buf[0] = b
+	e.write(e.buf[:1])
+}
+
+func (e *rdbEncoder) writeUvarint(v uint64) {
+	n := binary.PutUvarint(e.buf[:], v)
+	e.write(e.buf[:n])
+}
+
+func (e *rdbEncoder) writeInt64(v int64) {
+	binary.BigEndian.PutUint64(e.buf[:8], uint64(v))
+	e.write(e.buf[:8])
+}
+
+func (e *rdbEncoder) writeFloat(f float64) {
+	binary.BigEndian.PutUint64(e.buf[:8], math.Float64bits(f))
+	e.write(e.buf[:8])
+}
+
+func (e *rdbEncoder) writeString(s []byte) {
+	e.writeUvarint(uint64(len(s)))
+	e.write(s)
+}
+
+// rdbType returns the type byte of a value. It returns false if the value can not be encoded.
+func rdbType(val any) (byte, bool) {
+	switch val.(type) {
+	case []byte:
+		return rdbTypeString, true
+	case *List:
+		return rdbTypeList, true
+	case *Set:
+		return rdbTypeSet, true
+	case *SortedSet[*SortedSetNode]:
+		return rdbTypeSortedSet, true
+	case *Hash:
+		return rdbTypeHash, true
+	case *Stream:
+		return rdbTypeStream, true
+	}
+	return 0, false
+}
+
+// writeValue writes the encoded value without its type byte.
+func (e *rdbEncoder) writeValue(val any) {
+	switch v := val.(type) {
+	case []byte:
+		e.writeString(v)
+	case *List:
+		e.writeUvarint(uint64(v.Len))
+		for node := v.Head.Next; node != v.Tail; node = node.Next {
+			e.writeString(node.Val)
+		}
+	case *Set:
+		e.writeUvarint(uint64(v.Len()))
+		for member := range v.table {
+			e.writeString([]byte(member))
+		}
+	case *SortedSet[*SortedSetNode]:
+		e.writeUvarint(uint64(len(v.dict)))
+		v.Ascend(func(node *Node[*SortedSetNode], _ int) bool {
+			for name := range node.Value.GetNames() {
+				e.writeString([]byte(name))
+				e.writeFloat(node.Value.GetScore())
+			}
+			return true
+		})
+	case *Hash:
+		e.writeUvarint(uint64(v.Len()))
+		for field, value := range v.table {
+			e.writeString([]byte(field))
+			e.writeString(value)
+		}
+	case *Stream:
+		v.lock.RLock()
+		defer v.lock.RUnlock()
+		e.writeUvarint(uint64(len(v.timeStamps)))
+		for _, id := range v.timeStamps {
+			e.writeInt64(id.time)
+			e.writeInt64(id.seqNum)
+			fields := v.entry[id.Format()]
+			e.writeUvarint(uint64(len(fields)))
+			for _, f := range fields {
+				e.writeString([]byte(f))
+			}
+		}
+	}
+}
+
+// rdbDecoder reads rdb primitives and keeps the crc64 of all consumed bytes.
+type rdbDecoder struct {
+	r   *bufio.Reader
+	crc hash.Hash64
+	buf [8]byte
+	err error
+}
+
+func (d *rdbDecoder) ReadByte() (byte, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	b, err := d.r.ReadByte()
+	if err != nil {
+		d.err = err
+		return 0, err
+	}
+	d.buf[0] = b
+	d.crc.Write(d.buf[:1])
+	return b, nil
+}
+
+func (d *rdbDecoder) read(p []byte) {
+	if d.err != nil {
+		return
+	}
+	if _, d.err = io.ReadFull(d.r, p); d.err == nil {
+		d.crc.Write(p)
+	}
+}
+
+func (d *rdbDecoder) readByte() byte {
+	b, _ := d.ReadByte()
+	return b
+}
+
+func (d *rdbDecoder) readUvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(d)
+	if err != nil {
+		d.err = err
+	}
+	return v
+}
+
+func (d *rdbDecoder) readInt64() int64 {
+	d.read(d.buf[:8])
+	return int64(binary.BigEndian.Uint64(d.buf[:8]))
+}
+
+func (d *rdbDecoder) readFloat() float64 {
+	d.read(d.buf[:8])
+	return math.Float64frombits(binary.BigEndian.Uint64(d.buf[:8]))
+}
+
+func (d *rdbDecoder) readString() []byte {
+	n := d.readUvarint()
+	if d.err != nil {
+		return nil
+	}
+	s := make([]byte, n)
+	d.read(s)
+	return s
+}
+
+// readValue reads a value of the given type.
+func (d *rdbDecoder) readValue(typ byte) any {
+	switch typ {
+	case rdbTypeString:
+		return d.readString()
+	case rdbTypeList:
+		list := NewList()
+		for n := d.readUvarint(); n > 0 && d.err == nil; n-- {
+			list.RPush(d.readString())
+		}
+		return list
+	case rdbTypeSet:
+		set := NewSet()
+		for n := d.readUvarint(); n > 0 && d.err == nil; n-- {
+			set.Add(string(d.readString()))
+		}
+		return set
+	case rdbTypeSortedSet:
+		sortedSet := NewSortedSet()
+		for n := d.readUvarint(); n > 0 && d.err == nil; n-- {
+			name := string(d.readString())
+			score := d.readFloat()
+			sortedSet.Insert(&SortedSetNode{Names: map[string]struct{}{name: {}}, Score: score})
+		}
+		return sortedSet
+	case rdbTypeHash:
+		h := NewHash()
+		for n := d.readUvarint(); n > 0 && d.err == nil; n-- {
+			field := string(d.readString())
+			h.Set(field, d.readString())
+		}
+		return h
+	case rdbTypeStream:
+		stream := NewStream()
+		for n := d.readUvarint(); n > 0 && d.err == nil; n-- {
+			id := &StreamID{time: d.readInt64(), seqNum: d.readInt64()}
+			fields := make([]string, 0)
+			for k := d.readUvarint(); k > 0 && d.err == nil; k-- {
+				fields = append(fields, string(d.readString()))
+			}
+			stream.timeStamps = append(stream.timeStamps, id)
+			stream.entry[id.Format()] = fields
+		}
+		return stream
+	default:
+		if d.err == nil {
+			d.err = fmt.Errorf("ERR unknown value type %d in snapshot", typ)
+		}
+		return nil
+	}
+}
+
+// WriteRDB serializes all the given databases into w.
+// Every key is captured under its own lock, so it's safe to call while other clients keep writing,
+// but a command changing several keys may then be in the snapshot only in part.
+func WriteRDB(w io.Writer, dbs []*MemDb) error {
+	bw := bufio.NewWriter(w)
+	crc := crc64.New(crcTable)
+	e := &rdbEncoder{w: io.MultiWriter(bw, crc)}
+	e.write([]byte(rdbMagic))
+	e.writeByte(rdbVersion)
+	now := time.Now().UnixMilli()
+	for idx, m := range dbs {
+		if m.db.Len() == 0 {
+			continue
+		}
+		e.writeByte(rdbOpSelectDB)
+		e.writeUvarint(uint64(idx))
+		for _, key := range m.db.Keys() {
+			m.locks.RLock(key)
+			val, ok := m.db.Get(key)
+			if !ok {
+				m.locks.RUnLock(key)
+				continue
+			}
+			if ttl, ok := m.ttlKeys.Get(key); ok {
+				at := ttl.(*TTLInfo).value
+				// skip expired keys, unless their deletion is left to the raft leader
+				if at <= now && !m.passiveExpire.Load() {
+					m.locks.RUnLock(key)
+					continue
+				}
+				e.writeByte(rdbOpExpireMs)
+				e.writeInt64(at)
+			}
+			typ, known := rdbType(val)
+			if !known {
+				m.locks.RUnLock(key)
+				return fmt.Errorf("ERR can not encode value of key %s", key)
+			}
+			e.writeByte(typ)
+			e.writeString([]byte(key))
+			e.writeValue(val)
+			m.locks.RUnLock(key)
+		}
+		if e.err != nil {
+			return e.err
+		}
+	}
+	e.writeByte(rdbOpEOF)
+	if e.err != nil {
+		return e.err
+	}
+	binary.BigEndian.PutUint64(e.buf[:8], crc.Sum64())
+	if _, err := bw.Write(e.buf[:8]); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ReadRDB loads a snapshot written by WriteRDB into dbs.
+// Keys that already expired are dropped, unless the databases expire keys passively.
+func ReadRDB(r io.Reader, dbs []*MemDb) error {
+	d := &rdbDecoder{r: bufio.NewReader(r), crc: crc64.New(crcTable)}
+	header := make([]byte, len(rdbMagic)+1)
+	d.read(header)
+	if d.err != nil {
+		return d.err
+	}
+	if string(header[:len(rdbMagic)]) != rdbMagic {
+		return errors.New("ERR invalid snapshot header")
+	}
+	if header[len(rdbMagic)] > rdbVersion {
+		return fmt.Errorf("ERR unsupported snapshot version %d", header[len(rdbMagic)])
+	}
+	var m *MemDb
+	var expireAt int64
+	now := time.Now().UnixMilli()
+	for {
+		op := d.readByte()
+		if d.err != nil {
+			return d.err
+		}
+		switch op {
+		case rdbOpEOF:
+			sum := d.crc.Sum64()
+			if _, err := io.ReadFull(d.r, d.buf[:8]); err != nil {
+				return err
+			}
+			if binary.BigEndian.Uint64(d.buf[:8]) != sum {
+				return ErrRDBChecksum
+			}
+			return nil
+		case rdbOpSelectDB:
+			idx := d.readUvarint()
+			if d.err != nil {
+				return d.err
+			}
+			if idx >= uint64(len(dbs)) {
+				return fmt.Errorf("ERR snapshot DB index %d is out of range", idx)
+			}
+			m = dbs[idx]
+		case rdbOpExpireMs:
+			expireAt = d.readInt64()
+		default:
+			if m == nil {
+				return errors.New("ERR snapshot key without a database")
+			}
+			key := string(d.readString())
+			val := d.readValue(op)
+			if d.err != nil {
+				return d.err
+			}
+			if expireAt == 0 || expireAt > now || m.passiveExpire.Load() {
+				m.db.Set(key, val)
+				if expireAt > 0 {
+					m.SetTTL(key, expireAt)
+				}
+			}
+			expireAt = 0
+		}
+	}
+}
+
+// Snapshot encodes dbs in the rdb format. It's used for the snapshots saved on disk, sent to the replicas
+// and taken by raft in cluster mode.
+func Snapshot(dbs []*MemDb) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := WriteRDB(&buf, dbs); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// LoadSnapshot replaces the contents of dbs with a snapshot encoded by Snapshot.
+// The snapshot is decoded into new databases first, so dbs are left untouched if it's invalid.
+// No command may run on dbs while the contents are swapped.
+func LoadSnapshot(data []byte, dbs []*MemDb) error {
+	loaded := make([]*MemDb, len(dbs))
+	for i := range loaded {
+		loaded[i] = NewMemDb()
+		loaded[i].passiveExpire.Store(dbs[i].passiveExpire.Load())
+	}
+	if err := ReadRDB(bytes.NewReader(data), loaded); err != nil {
+		return err
+	}
+	for i, m := range dbs {
+		m.replace(loaded[i])
+	}
+	return nil
+}
+
+// replace swaps the keys of m for the keys of src.
+func (m *MemDb) replace(src *MemDb) {
+	m.db = src.db
+	m.ttlKeys = src.ttlKeys
+	m.expires = src.expires
+	m.locks = src.locks
+}
@@ -0,0 +1,123 @@
+package memdb
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRDBRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	src := []*MemDb{NewMemDb(), NewMemDb()}
+	setString(ctx, src[0], MakeCommandBytes("set str hello"), nil)
+	setString(ctx, src[0], MakeCommandBytes("set ttl world ex 100"), nil)
+	rPushList(ctx, src[0], MakeCommandBytes("rpush list a b c"), nil)
+	sAddSet(ctx, src[0], MakeCommandBytes("sadd set a b"), nil)
+	hSetHash(ctx, src[1], MakeCommandBytes("hset hash f1 v1 f2 v2"), nil)
+	zadd(ctx, src[1], MakeCommandBytes("zadd zset 1 a 2 b 2 c"), nil)
+	xadd(ctx, src[1], MakeCommandBytes("xadd stream 1-1 k1 v1"), nil)
+	xadd(ctx, src[1], MakeCommandBytes("xadd stream 2-0 k2 v2"), nil)
+
+	var buf bytes.Buffer
+	if err := WriteRDB(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	dst := []*MemDb{NewMemDb(), NewMemDb()}
+	if err := ReadRDB(bytes.NewReader(buf.Bytes()), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := dst[0].db.Get("str"); !bytes.Equal(v.([]byte), []byte("hello")) {
+		t.Error("string value is not restored")
+	}
+	ttl, ok := dst[0].ttlKeys.Get("ttl")
+	if !ok || ttl.(*TTLInfo).value-time.Now().UnixMilli() > 100000 || ttl.(*TTLInfo).value-time.Now().UnixMilli() < 99000 {
+		t.Error("ttl is not restored")
+	}
+	if v, _ := dst[0].db.Get("list"); !reflect.DeepEqual(v.(*List).Range(0, -1), [][]byte{[]byte("a"), []byte("b"), []byte("c")}) {
+		t.Error("list value is not restored")
+	}
+	members := func(s *Set) []string {
+		res := s.Members()
+		sort.Strings(res)
+		return res
+	}
+	if v, _ := dst[0].db.Get("set"); !reflect.DeepEqual(members(v.(*Set)), []string{"a", "b"}) {
+		t.Error("set value is not restored")
+	}
+	if v, _ := dst[1].db.Get("hash"); !reflect.DeepEqual(v.(*Hash).Table(), map[string][]byte{"f1": []byte("v1"), "f2": []byte("v2")}) {
+		t.Error("hash value is not restored")
+	}
+	zset, _ := dst[1].db.Get("zset")
+	if node := zset.(*SortedSet[*SortedSetNode]).GetByName("c"); node == nil || node.Value.GetScore() != 2 || zset.(*SortedSet[*SortedSetNode]).Len() != 2 {
+		t.Error("sorted set value is not restored")
+	}
+	stream, _ := dst[1].db.Get("stream")
+	ids, entries := stream.(*Stream).Range(&StreamID{-1, -1}, &StreamID{-1, -1})
+	if len(ids) != 2 || ids[1].Format() != "2-0" || !reflect.DeepEqual(entries[1], []string{"k2", "v2"}) {
+		t.Error("stream value is not restored")
+	}
+}
+
+func TestRDBChecksum(t *testing.T) {
+	src := []*MemDb{NewMemDb()}
+	setString(context.Background(), src[0], MakeCommandBytes("set key value"), nil)
+	var buf bytes.Buffer
+	if err := WriteRDB(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// flip a byte of the value
+	data[len(data)-12] ^= 0xFF
+	if err := ReadRDB(bytes.NewReader(data), []*MemDb{NewMemDb()}); err != ErrRDBChecksum {
+		t.Error("corrupted snapshot should fail the checksum, got ", err)
+	}
+	if err := ReadRDB(bytes.NewReader(data[:10]), []*MemDb{NewMemDb()}); err == nil {
+		t.Error("truncated snapshot should fail")
+	}
+}
+
+func TestLoadSnapshot(t *testing.T) {
+	ctx := context.Background()
+	src := []*MemDb{NewMemDb()}
+	setString(ctx, src[0], MakeCommandBytes("set str hello"), nil)
+	setString(ctx, src[0], MakeCommandBytes("set ttl world ex 100"), nil)
+	data, err := Snapshot(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbs := []*MemDb{NewMemDb()}
+	setString(ctx, dbs[0], MakeCommandBytes("set stale value ex 100"), nil)
+	setString(ctx, dbs[0], MakeCommandBytes("set ttl old"), nil)
+	// an invalid snapshot leaves the database untouched
+	if err := LoadSnapshot(data[:len(data)-1], dbs); err == nil {
+		t.Fatal("truncated snapshot should fail")
+	}
+	if _, ok := dbs[0].db.Get("stale"); !ok {
+		t.Fatal("failed load should not modify the database")
+	}
+
+	if err := LoadSnapshot(data, dbs); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dbs[0].db.Get("stale"); ok {
+		t.Error("keys missing from the snapshot should be removed")
+	}
+	if keys := dbs[0].ExpiredKeys(math.MaxInt64, 10); len(keys) != 1 || keys[0] != "ttl" {
+		t.Errorf("the expiration times of the replaced keys should be dropped, expiring keys = %v", keys)
+	}
+	if v, _ := dbs[0].db.Get("ttl"); !bytes.Equal(v.([]byte), []byte("world")) {
+		t.Error("string value is not restored")
+	}
+	if _, ok := dbs[0].ttlKeys.Get("ttl"); !ok {
+		t.Error("ttl is not restored")
+	}
+	if dbs[0].db.Len() != 2 {
+		t.Errorf("restored %d keys, expected 2", dbs[0].db.Len())
+	}
+}
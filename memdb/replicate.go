@@ -0,0 +1,147 @@
+package memdb
+
+import (
+	"strconv"
+	"strings"
+)
+
+// replicate.go rewrites the commands that depend on the clock of the node executing them
+// into forms that every node of a cluster applies the same way.
+
+// RewriteForReplication returns cmd in a form that has the same effect on every node no matter when it's applied,
+// or cmd itself if it's deterministic already. now is the unix time in milliseconds of the proposing node.
+// Malformed commands are returned unchanged, so they fail the same way on every node.
+func (m *MemDb) RewriteForReplication(cmd [][]byte, now int64) [][]byte {
+	switch name := strings.ToLower(string(cmd[0])); name {
+	case "expire", "pexpire":
+		// EXPIRE key seconds [NX|XX|GT|LT] => PEXPIREAT key milliseconds [NX|XX|GT|LT]
+		// PEXPIRE key milliseconds [NX|XX|GT|LT] => PEXPIREAT key milliseconds [NX|XX|GT|LT]
+		if len(cmd) < 3 {
+			return cmd
+		}
+		ms, err := strconv.ParseInt(string(cmd[2]), 10, 64)
+		if err != nil {
+			return cmd
+		}
+		if name == "expire" {
+			ms *= 1000
+		}
+		res := [][]byte{[]byte("PEXPIREAT"), cmd[1], []byte(strconv.FormatInt(now+ms, 10))}
+		return append(res, cmd[3:]...)
+	case "setex":
+		// SETEX key seconds value => SET key value PXAT milliseconds
+		if len(cmd) != 4 {
+			return cmd
+		}
+		seconds, err := strconv.ParseInt(string(cmd[2]), 10, 64)
+		if err != nil {
+			return cmd
+		}
+		return [][]byte{[]byte("SET"), cmd[1], cmd[3], []byte("PXAT"), []byte(strconv.FormatInt(now+seconds*1000, 10))}
+	case "set":
+		// SET key value EX seconds | PX milliseconds => SET key value PXAT milliseconds
+		return withAbsoluteExpire(cmd, 3, now)
+	case "getex":
+		// GETEX key EX seconds | PX milliseconds => GETEX key PXAT milliseconds
+		return withAbsoluteExpire(cmd, 2, now)
+	case "restore":
+		// RESTORE key milliseconds payload [options] => RESTORE key milliseconds payload [options] ABSTTL
+		if len(cmd) < 4 {
+			return cmd
+		}
+		for _, arg := range cmd[4:] {
+			if strings.ToLower(string(arg)) == "absttl" {
+				return cmd
+			}
+		}
+		ms, err := strconv.ParseInt(string(cmd[2]), 10, 64)
+		if err != nil || ms <= 0 {
+			return cmd
+		}
+		res := [][]byte{cmd[0], cmd[1], []byte(strconv.FormatInt(now+ms, 10))}
+		res = append(res, cmd[3:]...)
+		return append(res, []byte("ABSTTL"))
+	case "xadd":
+		// XADD key [options] * field value... => XADD key [options] milliseconds-* field value...
+		idx := xaddIDIndex(cmd)
+		if idx < 0 || string(cmd[idx]) != "*" {
+			return cmd
+		}
+		// keep the IDs increasing if the clock of this node is behind the last entry
+		key := string(cmd[1])
+		m.locks.RLock(key)
+		if val, ok := m.db.Get(key); ok {
+			if stream, ok := val.(*Stream); ok {
+				if top := stream.LastID(); top != nil && top.time > now {
+					now = top.time
+				}
+			}
+		}
+		m.locks.RUnLock(key)
+		res := make([][]byte, len(cmd))
+		copy(res, cmd)
+		res[idx] = []byte(strconv.FormatInt(now, 10) + "-*")
+		return res
+	}
+	return cmd
+}
+
+// withAbsoluteExpire replaces the EX and PX options found from cmd[start] on with PXAT.
+func withAbsoluteExpire(cmd [][]byte, start int, now int64) [][]byte {
+	res := make([][]byte, len(cmd))
+	copy(res, cmd)
+	for i := start; i < len(res)-1; i++ {
+		opt := strings.ToLower(string(res[i]))
+		if opt == "exat" || opt == "pxat" {
+			i++
+			continue
+		}
+		if opt != "ex" && opt != "px" {
+			continue
+		}
+		ms, err := strconv.ParseInt(string(res[i+1]), 10, 64)
+		if err != nil {
+			return cmd
+		}
+		if opt == "ex" {
+			ms *= 1000
+		}
+		res[i] = []byte("PXAT")
+		res[i+1] = []byte(strconv.FormatInt(now+ms, 10))
+		i++
+	}
+	return res
+}
+
+// WithXAddID returns XADD cmd with its entry ID replaced by id, which is the ID the entry was added with.
+// It's used to replicate the IDs generated by XADD *. cmd is returned unchanged if it has no ID.
+func WithXAddID(cmd [][]byte, id []byte) [][]byte {
+	idx := xaddIDIndex(cmd)
+	if idx < 0 {
+		return cmd
+	}
+	res := make([][]byte, len(cmd))
+	copy(res, cmd)
+	res[idx] = id
+	return res
+}
+
+// xaddIDIndex returns the position of the entry ID in an XADD command, or -1 if there is none.
+func xaddIDIndex(cmd [][]byte) int {
+	for idx := 2; idx < len(cmd); idx++ {
+		switch strings.ToLower(string(cmd[idx])) {
+		case "nomkstream", "~":
+		case "maxlen", "minid":
+			// the threshold follows an optional = or ~
+			if idx+1 < len(cmd) && (string(cmd[idx+1]) == "=" || string(cmd[idx+1]) == "~") {
+				idx++
+			}
+			idx++
+		case "limit":
+			idx++
+		default:
+			return idx
+		}
+	}
+	return -1
+}
@@ -0,0 +1,121 @@
+package memdb
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRewriteForReplication(t *testing.T) {
+	m := NewMemDb()
+	now := int64(1700000000000)
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"expire k 10", "PEXPIREAT k 1700000010000"},
+		{"expire k 10 gt", "PEXPIREAT k 1700000010000 gt"},
+		{"pexpire k 10500", "PEXPIREAT k 1700000010500"},
+		{"getex k ex 10", "getex k PXAT 1700000010000"},
+		{"getex k persist", "getex k persist"},
+		{"setex k 10 v", "SET k v PXAT 1700000010000"},
+		{"set k v nx ex 10 get", "set k v nx PXAT 1700000010000 get"},
+		{"set k v px 500", "set k v PXAT 1700000000500"},
+		{"xadd s maxlen ~ 10 * f v", "xadd s maxlen ~ 10 1700000000000-* f v"},
+		{"restore k 500 payload replace", "restore k 1700000000500 payload replace ABSTTL"},
+		// deterministic and malformed commands are left alone
+		{"set k v exat 1700000010", "set k v exat 1700000010"},
+		{"expireat k 1700000010", "expireat k 1700000010"},
+		{"expire k ten", "expire k ten"},
+		{"xadd s 5-1 f v", "xadd s 5-1 f v"},
+		{"restore k 0 payload", "restore k 0 payload"},
+		{"restore k 1700000000500 payload absttl", "restore k 1700000000500 payload absttl"},
+		{"sadd s a", "sadd s a"},
+	}
+	for _, tt := range tests {
+		if got := m.RewriteForReplication(MakeCommandBytes(tt.cmd), now); !reflect.DeepEqual(got, MakeCommandBytes(tt.want)) {
+			t.Errorf("rewrite %q = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+
+	// stream IDs never go backwards when the clock of the node is behind the stream
+	ctx := context.Background()
+	xadd(ctx, m, MakeCommandBytes("xadd s 1800000000000-3 f v"), nil)
+	cmd := m.RewriteForReplication(MakeCommandBytes("xadd s * f v"), now)
+	if !reflect.DeepEqual(cmd, MakeCommandBytes("xadd s 1800000000000-* f v")) {
+		t.Errorf("xadd is rewritten to %q", cmd)
+	}
+	if res := xadd(ctx, m, cmd, nil); !bytes.Equal(res.ToBytes(), []byte("$15\r\n1800000000000-4\r\n")) {
+		t.Error("rewritten xadd reply is not correct")
+	}
+}
+
+func TestPassiveExpire(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemDb()
+	m.SetPassiveExpire(true)
+	past := time.Now().Add(-time.Minute).UnixMilli()
+	setString(ctx, m, MakeCommandBytes("set k v"), nil)
+	setString(ctx, m, MakeCommandBytes("set gone v"), nil)
+	pexpireatKey(ctx, m, [][]byte{[]byte("pexpireat"), []byte("gone"), []byte(strconv.FormatInt(past, 10))}, nil)
+	// the expired key stays until it's deleted by a command, the reads hide it with Lookup
+	if res := getString(ctx, m, MakeCommandBytes("get gone"), nil); !bytes.Equal(res.ToBytes(), []byte("$1\r\nv\r\n")) {
+		t.Error("expired key should be kept")
+	}
+	if res := ttlKey(ctx, m, MakeCommandBytes("ttl gone"), nil); !bytes.Equal(res.ToBytes(), []byte(":0\r\n")) {
+		t.Error("ttl of an expired key should be 0")
+	}
+	if keys := m.ExpiredKeys(time.Now().UnixMilli(), 10); !reflect.DeepEqual(keys, []string{"gone"}) {
+		t.Errorf("expired keys = %v", keys)
+	}
+
+	// snapshots keep the expired keys as well
+	data, err := Snapshot([]*MemDb{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewMemDb()
+	loaded.SetPassiveExpire(true)
+	if err := LoadSnapshot(data, []*MemDb{loaded}); err != nil {
+		t.Fatal(err)
+	}
+	if keys := loaded.ExpiredKeys(time.Now().UnixMilli(), 10); !reflect.DeepEqual(keys, []string{"gone"}) {
+		t.Errorf("expired keys after loading the snapshot = %v", keys)
+	}
+
+	// the keys expire by the local clock again once the passive mode is turned off
+	expired := make(chan string, 1)
+	loaded.SetExpireHook(func(key string) { expired <- key })
+	loaded.SetPassiveExpire(false)
+	loaded.ActiveExpireCycle(time.Now().Add(time.Second))
+	select {
+	case key := <-expired:
+		if key != "gone" {
+			t.Errorf("expired key = %s", key)
+		}
+	default:
+		t.Fatal("the expired key is not deleted")
+	}
+	if loaded.Exists("gone") || !loaded.Exists("k") {
+		t.Error("only the expired key should be deleted")
+	}
+}
+
+func TestWithXAddID(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"xadd s * f v", "xadd s 5-1 f v"},
+		{"xadd s nomkstream maxlen = 10 5-* f v", "xadd s nomkstream maxlen = 10 5-1 f v"},
+		{"xadd s", "xadd s"},
+	}
+	for _, tt := range tests {
+		if got := WithXAddID(MakeCommandBytes(tt.cmd), []byte("5-1")); !reflect.DeepEqual(got, MakeCommandBytes(tt.want)) {
+			t.Errorf("WithXAddID(%q) = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package memdb
+
+import (
+	"strconv"
+	"time"
+)
+
+// rewrite.go generates the shortest command stream that rebuilds the current contents of a MemDb.
+// It's used to rewrite the append only file.
+
+// RewriteKey calls emit with the commands that reconstruct the key. Nothing is emitted if the key does not exist
+// or already expired. The key is read under its lock and emit must not call back into m.
+func (m *MemDb) RewriteKey(key string, emit func(cmd [][]byte) error) error {
+	m.locks.RLock(key)
+	defer m.locks.RUnLock(key)
+	return m.rewriteKey(key, time.Now().UnixMilli(), emit)
+}
+
+func (m *MemDb) rewriteKey(key string, now int64, emit func(cmd [][]byte) error) error {
+	val, ok := m.db.Get(key)
+	if !ok {
+		return nil
+	}
+	var expireAt int64
+	if ttl, ok := m.ttlKeys.Get(key); ok {
+		expireAt = ttl.(*TTLInfo).value
+		if expireAt <= now {
+			return nil
+		}
+	}
+	keyBytes := []byte(key)
+	var cmd [][]byte
+	var err error
+	switch v := val.(type) {
+	case []byte:
+		cmd = [][]byte{[]byte("SET"), keyBytes, v}
+	case *List:
+		cmd = make([][]byte, 0, v.Len+2)
+		cmd = append(cmd, []byte("RPUSH"), keyBytes)
+		for node := v.Head.Next; node != v.Tail; node = node.Next {
+			cmd = append(cmd, node.Val)
+		}
+	case *Set:
+		cmd = make([][]byte, 0, v.Len()+2)
+		cmd = append(cmd, []byte("SADD"), keyBytes)
+		for member := range v.table {
+			cmd = append(cmd, []byte(member))
+		}
+	case *Hash:
+		cmd = make([][]byte, 0, v.Len()*2+2)
+		cmd = append(cmd, []byte("HSET"), keyBytes)
+		for field, value := range v.table {
+			cmd = append(cmd, []byte(field), value)
+		}
+	case *SortedSet[*SortedSetNode]:
+		cmd = make([][]byte, 0, len(v.dict)*2+2)
+		cmd = append(cmd, []byte("ZADD"), keyBytes)
+		v.Ascend(func(node *Node[*SortedSetNode], _ int) bool {
+			score := []byte(strconv.FormatFloat(node.Value.GetScore(), 'f', -1, 64))
+			for name := range node.Value.GetNames() {
+				cmd = append(cmd, score, []byte(name))
+			}
+			return true
+		})
+	case *Stream:
+		// XADD takes a single entry, so a stream needs one command per entry
+		v.lock.RLock()
+		for _, id := range v.timeStamps {
+			entry := [][]byte{[]byte("XADD"), keyBytes, []byte(id.Format())}
+			for _, f := range v.entry[id.Format()] {
+				entry = append(entry, []byte(f))
+			}
+			if err = emit(entry); err != nil {
+				break
+			}
+		}
+		v.lock.RUnlock()
+		if err != nil || len(v.timeStamps) == 0 {
+			return err
+		}
+	default:
+		return nil
+	}
+	if cmd != nil {
+		// empty collections can not be created by commands and are dropped
+		if len(cmd) == 2 {
+			return nil
+		}
+		if err = emit(cmd); err != nil {
+			return err
+		}
+	}
+	if expireAt == 0 {
+		return nil
+	}
+	return emit([][]byte{[]byte("PEXPIREAT"), keyBytes, []byte(strconv.FormatInt(expireAt, 10))})
+}
@@ -12,10 +12,6 @@ import (
 )
 
 func sAddSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
-	if len(cmd) < 3 {
-		return resp.MakeErrorData("wrong number of arguments for 'sadd' command")
-	}
-
 	key := string(cmd[1])
 	m.CheckTTL(key)
 
@@ -46,10 +42,6 @@ func sCardSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.R
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) != 2 {
-		return resp.MakeErrorData("wrong number of arguments for 'scard' command")
-	}
-
 	key := string(cmd[1])
 	if !m.CheckTTL(key) {
 		return resp.MakeIntData(0)
@@ -77,10 +69,6 @@ func sDiffSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.R
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) < 2 {
-		return resp.MakeErrorData("wrong number of arguments for 'sdiff' command")
-	}
-
 	keys := make([]string, 0, len(cmd)-1)
 	for i := 1; i < len(cmd); i++ {
 		keys = append(keys, string(cmd[i]))
@@ -95,7 +83,7 @@ func sDiffSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.R
 
 	tem, ok := m.db.Get(keys[0])
 	if !ok {
-		return resp.MakeEmptyArrayData()
+		return resp.MakeSetData([]resp.RedisData{})
 	}
 	primSet, ok := tem.(*Set)
 	if !ok {
@@ -110,7 +98,7 @@ func sDiffSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.R
 		for _, member := range members {
 			res = append(res, resp.MakeBulkData([]byte(member)))
 		}
-		return resp.MakeArrayData(res)
+		return resp.MakeSetData(res)
 	}
 
 	setSlice := make([]*Set, 0)
@@ -128,7 +116,7 @@ func sDiffSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.R
 	for _, member := range diffSet.Members() {
 		res = append(res, resp.MakeBulkData([]byte(member)))
 	}
-	return resp.MakeArrayData(res)
+	return resp.MakeSetData(res)
 }
 
 func sDiffStoreSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
@@ -136,9 +124,6 @@ func sDiffStoreSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) r
 		logger.Error("sDiffStoreSet Function: cmdName is not sdiffstore")
 		return resp.MakeErrorData("server error")
 	}
-	if len(cmd) < 3 {
-		return resp.MakeErrorData("wrong number of arguments for 'sdiffstore' command")
-	}
 
 	// first check if the destination  is a set. if not, return error immediately.
 	desKey := string(cmd[1])
@@ -216,10 +201,6 @@ func sInterSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) < 2 {
-		return resp.MakeErrorData("wrong number of arguments for 'sinter' command")
-	}
-
 	keys := make([]string, 0, len(cmd)-1)
 	for i := 1; i < len(cmd); i++ {
 		keys = append(keys, string(cmd[i]))
@@ -260,7 +241,7 @@ func sInterSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 		res = append(res, resp.MakeBulkData([]byte(member)))
 	}
 
-	return resp.MakeArrayData(res)
+	return resp.MakeSetData(res)
 }
 
 func sInterStoreSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
@@ -268,9 +249,6 @@ func sInterStoreSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn)
 		logger.Error("sInterStoreSet Function: cmdName is not sinterstore")
 		return resp.MakeErrorData("server error")
 	}
-	if len(cmd) < 3 {
-		return resp.MakeErrorData("wrong number of arguments for 'sinterstore' command")
-	}
 
 	// first check if the destination  is a set. if not, return error immediately.
 	desKey := string(cmd[1])
@@ -347,10 +325,6 @@ func sIsMemberSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) re
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) != 3 {
-		return resp.MakeErrorData("wrong number of arguments for 'sismember' command")
-	}
-
 	key := string(cmd[1])
 	val := string(cmd[2])
 
@@ -376,20 +350,16 @@ func sIsMemberSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) re
 }
 
 func sMembersSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
-	if len(cmd) != 2 {
-		return resp.MakeErrorData("wrong number of arguments for 'smembers' command")
-	}
-
 	key := string(cmd[1])
 	if !m.CheckTTL(key) {
-		return resp.MakeEmptyArrayData()
+		return resp.MakeSetData([]resp.RedisData{})
 	}
 
 	m.locks.RLock(key)
 	defer m.locks.RUnLock(key)
 	tem, ok := m.db.Get(key)
 	if !ok {
-		return resp.MakeEmptyArrayData()
+		return resp.MakeSetData([]resp.RedisData{})
 	}
 	set, ok := tem.(*Set)
 	if !ok {
@@ -402,14 +372,10 @@ func sMembersSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) res
 		res = append(res, resp.MakeStringData(member))
 	}
 
-	return resp.MakeArrayData(res)
+	return resp.MakeSetData(res)
 }
 
 func sMoveSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
-	if len(cmd) != 4 {
-		return resp.MakeErrorData("wrong number of arguments for 'smove' command")
-	}
-
 	srcKey := string(cmd[1])
 	desKey := string(cmd[2])
 	val := string(cmd[3])
@@ -465,7 +431,7 @@ func sPopSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.Re
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) != 2 && len(cmd) != 3 {
+	if len(cmd) > 3 {
 		return resp.MakeErrorData("wrong number of arguments for 'spop' command")
 	}
 
@@ -526,8 +492,7 @@ func sPopSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.Re
 }
 
 func sRandMemberSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
-
-	if len(cmd) != 2 && len(cmd) != 3 {
+	if len(cmd) > 3 {
 		return resp.MakeErrorData("wrong number of arguments for 'srandmember' command")
 	}
 
@@ -580,10 +545,6 @@ func sRemSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.Re
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) < 3 {
-		return resp.MakeErrorData("wrong number of arguments for 'srem' command")
-	}
-
 	key := string(cmd[1])
 
 	if !m.CheckTTL(key) {
@@ -625,10 +586,6 @@ func sUnionSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) < 2 {
-		return resp.MakeErrorData("wrong number of arguments for 'sunion' command")
-	}
-
 	keys := make([]string, 0)
 
 	for i := 1; i < len(cmd); i++ {
@@ -639,7 +596,7 @@ func sUnionSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 	}
 
 	if len(keys) == 0 {
-		return resp.MakeEmptyArrayData()
+		return resp.MakeSetData([]resp.RedisData{})
 	}
 
 	m.locks.RLockMulti(keys)
@@ -659,7 +616,7 @@ func sUnionSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 	}
 
 	if len(sets) == 0 {
-		return resp.MakeEmptyArrayData()
+		return resp.MakeSetData([]resp.RedisData{})
 	}
 
 	resSet := sets[0].Union(sets[1:]...)
@@ -667,7 +624,7 @@ func sUnionSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 	for _, member := range resSet.Members() {
 		res = append(res, resp.MakeBulkData([]byte(member)))
 	}
-	return resp.MakeArrayData(res)
+	return resp.MakeSetData(res)
 }
 
 func sUnionStoreSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
@@ -676,10 +633,6 @@ func sUnionStoreSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn)
 		return resp.MakeErrorData("server error")
 	}
 
-	if len(cmd) < 3 {
-		return resp.MakeErrorData("wrong number of arguments for 'sunionstore' command")
-	}
-
 	// first check if the destination type is a set. if not, return error immediately.
 	desKey := string(cmd[1])
 	m.CheckTTL(desKey)
@@ -750,19 +703,19 @@ func sUnionStoreSet(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn)
 //}
 
 func RegisterSetCommands() {
-	RegisterCommand("sadd", sAddSet)
-	RegisterCommand("scard", sCardSet)
-	RegisterCommand("sdiff", sDiffSet)
-	RegisterCommand("sdiffstore", sDiffStoreSet)
-	RegisterCommand("sinter", sInterSet)
-	RegisterCommand("sinterstore", sInterStoreSet)
-	RegisterCommand("sismember", sIsMemberSet)
-	RegisterCommand("smembers", sMembersSet)
-	RegisterCommand("smove", sMoveSet)
-	RegisterCommand("spop", sPopSet)
-	RegisterCommand("srandmember", sRandMemberSet)
-	RegisterCommand("srem", sRemSet)
-	RegisterCommand("sunion", sUnionSet)
-	RegisterCommand("sunionstore", sUnionStoreSet)
+	RegisterCommand("sadd", sAddSet, -3, CmdWrite, 1, 1, 1)
+	RegisterCommand("scard", sCardSet, 2, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("sdiff", sDiffSet, -2, CmdReadOnly, 1, -1, 1)
+	RegisterCommand("sdiffstore", sDiffStoreSet, -3, CmdWrite, 1, -1, 1)
+	RegisterCommand("sinter", sInterSet, -2, CmdReadOnly, 1, -1, 1)
+	RegisterCommand("sinterstore", sInterStoreSet, -3, CmdWrite, 1, -1, 1)
+	RegisterCommand("sismember", sIsMemberSet, 3, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("smembers", sMembersSet, 2, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("smove", sMoveSet, 4, CmdWrite, 1, 2, 1)
+	RegisterCommand("spop", sPopSet, -2, CmdWrite, 1, 1, 1)
+	RegisterCommand("srandmember", sRandMemberSet, -2, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("srem", sRemSet, -3, CmdWrite, 1, 1, 1)
+	RegisterCommand("sunion", sUnionSet, -2, CmdReadOnly, 1, -1, 1)
+	RegisterCommand("sunionstore", sUnionStoreSet, -3, CmdWrite, 1, -1, 1)
 	//RegisterCommand("sscan", sScanSet)
 }
@@ -22,9 +22,6 @@ func reverse[S ~[]E, E any](s S) S {
 }
 
 func zadd(ctx context.Context, m *MemDb, cmd cmdBytes, _ net.Conn) resp.RedisData {
-	if len(cmd) < 4 {
-		return resp.MakeWrongNumberArgs("zadd")
-	}
 	// convert bytes to strings
 	elems := make([]string, 0, len(cmd))
 	for _, b := range cmd {
@@ -162,9 +159,6 @@ func zadd(ctx context.Context, m *MemDb, cmd cmdBytes, _ net.Conn) resp.RedisDat
 }
 
 func zrange(ctx context.Context, m *MemDb, cmd cmdBytes, _ net.Conn) resp.RedisData {
-	if len(cmd) < 4 {
-		return resp.MakeWrongNumberArgs("zrange")
-	}
 	key := string(cmd[1])
 	var withscore, rev, byscore, bylex, limit bool
 	var offset, count int
@@ -363,13 +357,27 @@ func zrange(ctx context.Context, m *MemDb, cmd cmdBytes, _ net.Conn) resp.RedisD
 	if rev {
 		res = reverse[[]resp.RedisData](res)
 	}
+	if withscore {
+		return resp.MakeArrayData(res).WithRESP3(memberScorePairs(members, rev))
+	}
 	return resp.MakeArrayData(res)
 }
 
-func zrem(ctx context.Context, m *MemDb, cmd cmdBytes, _ net.Conn) resp.RedisData {
-	if len(cmd) < 3 {
-		return resp.MakeWrongNumberArgs("zrem")
+// memberScorePairs makes the RESP3 reply of WITHSCORES, an array of member-score pairs.
+func memberScorePairs(members []*SortedSetMember, rev bool) resp.RedisData {
+	pairs := make([]resp.RedisData, 0, len(members))
+	for _, member := range members {
+		pairs = append(pairs, resp.MakeArrayData([]resp.RedisData{
+			resp.MakeBulkData([]byte(member.name)), resp.MakeDoubleData(member.score),
+		}))
 	}
+	if rev {
+		pairs = reverse[[]resp.RedisData](pairs)
+	}
+	return resp.MakeArrayData(pairs)
+}
+
+func zrem(ctx context.Context, m *MemDb, cmd cmdBytes, _ net.Conn) resp.RedisData {
 	key := strings.ToLower(string(cmd[1]))
 	// retrieve the key
 	m.locks.Lock(key)
@@ -400,9 +408,6 @@ func zrem(ctx context.Context, m *MemDb, cmd cmdBytes, _ net.Conn) resp.RedisDat
 }
 
 func zrank(ctx context.Context, m *MemDb, cmd cmdBytes, _ net.Conn) resp.RedisData {
-	if len(cmd) != 3 {
-		return resp.MakeWrongNumberArgs("zrank")
-	}
 	key := strings.ToLower(string(cmd[1]))
 	name := strings.ToLower(string(cmd[2]))
 	// retrieve the key
@@ -426,9 +431,9 @@ func zrank(ctx context.Context, m *MemDb, cmd cmdBytes, _ net.Conn) resp.RedisDa
 }
 
 func RegisterSortedSetCommands() {
-	RegisterCommand("zadd", zadd)
-	RegisterCommand("zrange", zrange)
-	RegisterCommand("zrem", zrem)
-	RegisterCommand("zrank", zrank)
+	RegisterCommand("zadd", zadd, -4, CmdWrite, 1, 1, 1)
+	RegisterCommand("zrange", zrange, -4, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("zrem", zrem, -3, CmdWrite, 1, 1, 1)
+	RegisterCommand("zrank", zrank, 3, CmdReadOnly, 1, 1, 1)
 
 }
@@ -10,9 +10,6 @@ import (
 )
 
 func xadd(ctx context.Context, m *MemDb, cmd [][]byte, _ net.Conn) resp.RedisData {
-	if len(cmd) < 5 {
-		return resp.MakeWrongNumberArgs("xadd")
-	}
 	// parse args
 	var key = string(cmd[1])
 	var idx = 2
@@ -95,8 +92,9 @@ func xadd(ctx context.Context, m *MemDb, cmd [][]byte, _ net.Conn) resp.RedisDat
 			idx++
 		case "~":
 			wave = true
+			idx++
 		default:
-			// parse ID or determine auto ID here
+			// parse ID or determine auto ID here. "ms-*" only generates the sequence number
 			if string(cmd[idx]) != "*" {
 				trunks := strings.Split(string(cmd[idx]), "-")
 				if len(trunks) != 2 {
@@ -107,11 +105,13 @@ func xadd(ctx context.Context, m *MemDb, cmd [][]byte, _ net.Conn) resp.RedisDat
 					return resp.MakeErrorData("ERR Invalid stream ID specified as stream command argument")
 				}
 				ID.time = stamp
-				seqNum, err := strconv.ParseInt(trunks[1], 10, 64)
-				if err != nil {
-					return resp.MakeErrorData("ERR Invalid stream ID specified as stream command argument")
+				if trunks[1] != "*" {
+					seqNum, err := strconv.ParseInt(trunks[1], 10, 64)
+					if err != nil {
+						return resp.MakeErrorData("ERR Invalid stream ID specified as stream command argument")
+					}
+					ID.seqNum = seqNum
 				}
-				ID.seqNum = seqNum
 			}
 			isDone = true
 			idx++
@@ -194,9 +194,6 @@ func xadd(ctx context.Context, m *MemDb, cmd [][]byte, _ net.Conn) resp.RedisDat
 }
 
 func xrange(ctx context.Context, m *MemDb, cmd [][]byte, _ net.Conn) resp.RedisData {
-	if len(cmd) < 4 {
-		return resp.MakeWrongNumberArgs("xrange")
-	}
 	key := string(cmd[1])
 	var start, end *StreamID
 	start = &StreamID{}
@@ -256,6 +253,6 @@ func xrange(ctx context.Context, m *MemDb, cmd [][]byte, _ net.Conn) resp.RedisD
 }
 
 func RegisterStreamCommands() {
-	RegisterCommand("xadd", xadd)
-	RegisterCommand("xrange", xrange)
+	RegisterCommand("xadd", xadd, -5, CmdWrite, 1, 1, 1)
+	RegisterCommand("xrange", xrange, -4, CmdReadOnly, 1, 1, 1)
 }
@@ -34,13 +34,18 @@ func (s *Stream) AddEntry(ID *StreamID, val []string) error {
 	// lock map
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	// auto determine timestamp if necessary
+	// auto determine timestamp if necessary. never go backwards if the clock does
 	if ID.time == -1 {
 		ID.time = time.Now().UnixMilli()
+		if n := len(s.timeStamps); n > 0 && s.timeStamps[n-1].time > ID.time {
+			ID.time = s.timeStamps[n-1].time
+		}
 	}
 	// first entry
 	if len(s.timeStamps) == 0 {
-		ID.seqNum = 0
+		if ID.seqNum == -1 {
+			ID.seqNum = 0
+		}
 		s.timeStamps = append(s.timeStamps, ID)
 		s.entry[ID.Format()] = val
 		return nil
@@ -51,9 +56,13 @@ func (s *Stream) AddEntry(ID *StreamID, val []string) error {
 		return errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
 	}
 	// auto determine sequence number with same timestamp
-	if ID.time == top.time && ID.seqNum == -1 {
-		ID.seqNum = top.seqNum + 1
-	} else if ID.time == top.time && ID.seqNum < top.seqNum {
+	if ID.seqNum == -1 {
+		if ID.time == top.time {
+			ID.seqNum = top.seqNum + 1
+		} else {
+			ID.seqNum = 0
+		}
+	} else if ID.time == top.time && ID.seqNum <= top.seqNum {
 		return errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
 	}
 	s.timeStamps = append(s.timeStamps, ID)
@@ -61,6 +70,17 @@ func (s *Stream) AddEntry(ID *StreamID, val []string) error {
 	return nil
 }
 
+// LastID returns a copy of the ID of the last entry, or nil if the stream is empty.
+func (s *Stream) LastID() *StreamID {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if len(s.timeStamps) == 0 {
+		return nil
+	}
+	ID := *s.timeStamps[len(s.timeStamps)-1]
+	return &ID
+}
+
 // Range go over a specific interval of stream IDs and return all the entries with that range.
 // use -1 for range to infinity
 // Return: ID structures, slice of key-value pairs of each entry(2d slice)
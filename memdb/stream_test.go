@@ -59,3 +59,24 @@ func Test_xrange(t *testing.T) {
 		})
 	}
 }
+
+func TestXAddID(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemDb()
+	tooSmall := "-ERR The ID specified in XADD is equal or smaller than the target stream top item\r\n"
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"xadd s 5-3 f v", "$3\r\n5-3\r\n"},
+		{"xadd s 5-* f v", "$3\r\n5-4\r\n"},
+		{"xadd s 6-* f v", "$3\r\n6-0\r\n"},
+		{"xadd s 6-0 f v", tooSmall},
+		{"xadd s 4-* f v", tooSmall},
+	}
+	for _, tt := range tests {
+		if res := xadd(ctx, m, MakeCommandBytes(tt.cmd), nil); string(res.ToBytes()) != tt.want {
+			t.Errorf("%s = %q, want %q", tt.cmd, res.ToBytes(), tt.want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package memdb
 import (
 	"context"
 	"fmt"
+	"math"
 	"net"
 	"strconv"
 	"strings"
@@ -14,15 +15,12 @@ import (
 
 // string.go file implements the string commands of redis
 func setString(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
-	cmdKey := strings.ToLower(string(cmd[1]))
-	if len(cmd) < 3 {
-		return resp.MakeErrorData("error: commands is invalid")
-	}
+	cmdKey := string(cmd[1])
 
 	// check option params
 	var err error
-	var nx, xx, get, ex, px, keepttl, exat bool
-	var exval, exatval int64
+	var nx, xx, get, ex, px, keepttl, exat, pxat bool
+	var exval, exatval, pxatval int64
 	var millisecPx int64
 	// parse flags
 	for i := 3; i < len(cmd); i++ {
@@ -58,18 +56,44 @@ func setString(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 		case "px":
 			px = true
 			i++
+			if i >= len(cmd) {
+				return resp.MakeErrorData("error: commands is invalid")
+			}
 			millisecPx, err = strconv.ParseInt(string(cmd[i]), 10, 64)
 			if err != nil {
 				return resp.MakeErrorData("ERR value is not integer or out of range")
 			}
+		case "pxat":
+			pxat = true
+			i++
+			if i >= len(cmd) {
+				return resp.MakeErrorData("error: commands is invalid")
+			}
+			pxatval, err = strconv.ParseInt(string(cmd[i]), 10, 64)
+			if err != nil {
+				return resp.MakeErrorData("ERR value is not integer or out of range")
+			}
 		default:
 			return resp.MakeErrorData("Error unsupported option: " + string(cmd[i]))
 		}
 	}
 
-	if (nx && xx) || (ex && keepttl) || (ex && px) || (ex && exat) || (px && exat) {
+	expireOpts := 0
+	for _, opt := range []bool{ex, px, exat, pxat, keepttl} {
+		if opt {
+			expireOpts++
+		}
+	}
+	if (nx && xx) || expireOpts > 1 {
 		return resp.MakeErrorData("error: commands is invalid")
 	}
+	var expireAt int64
+	if expireOpts > 0 && !keepttl {
+		var errData resp.RedisData
+		if expireAt, errData = expireAtMs("set", ex, px, exat, exval, millisecPx, exatval, pxatval); errData != nil {
+			return errData
+		}
+	}
 
 	// will very likely change value, lock the db methods for atomic manipulations
 	m.locks.Lock(cmdKey)
@@ -123,17 +147,106 @@ func setString(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 		m.DelTTL(cmdKey)
 	}
 	// set ttl
-	if ex {
-		m.SetTTL(cmdKey, time.Now().Unix()+exval)
+	if expireAt > 0 {
+		m.SetTTL(cmdKey, expireAt)
 	}
-	if px {
-		m.SetTTL(cmdKey, time.Now().Unix()+millisecPx/1000)
+
+	return res
+}
+
+// expireAtMs converts the EX, PX, EXAT or PXAT option of SET and GETEX, whichever is set,
+// into an expiration unix time in milliseconds.
+func expireAtMs(cmdName string, ex, px, exat bool, exval, pxval, exatval, pxatval int64) (int64, resp.RedisData) {
+	now := time.Now().UnixMilli()
+	var val, at int64
+	switch {
+	case ex:
+		val, at = exval, now+exval*1000
+	case px:
+		val, at = pxval, now+pxval
+	case exat:
+		val, at = exatval, exatval*1000
+	default:
+		val, at = pxatval, pxatval
+	}
+	if val <= 0 || ((ex || exat) && val > (math.MaxInt64-now)/1000) || (px && val > math.MaxInt64-now) {
+		return 0, resp.MakeErrorData(fmt.Sprintf("ERR invalid expire time in '%s' command", cmdName))
+	}
+	return at, nil
+}
+
+// getExString returns the value of the key and sets or removes its TTL:
+// GETEX key [EX seconds | PX milliseconds | EXAT timestamp | PXAT timestamp | PERSIST].
+func getExString(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
+	key := string(cmd[1])
+	var err error
+	var ex, px, exat, pxat, persist bool
+	var exval, pxval, exatval, pxatval int64
+	for i := 2; i < len(cmd); i++ {
+		opt := strings.ToLower(string(cmd[i]))
+		switch opt {
+		case "persist":
+			persist = true
+			continue
+		case "ex", "px", "exat", "pxat":
+		default:
+			return resp.MakeErrorData("ERR syntax error")
+		}
+		i++
+		if i >= len(cmd) {
+			return resp.MakeErrorData("ERR syntax error")
+		}
+		var val int64
+		if val, err = strconv.ParseInt(string(cmd[i]), 10, 64); err != nil {
+			return resp.MakeErrorData("ERR value is not an integer or out of range")
+		}
+		switch opt {
+		case "ex":
+			ex, exval = true, val
+		case "px":
+			px, pxval = true, val
+		case "exat":
+			exat, exatval = true, val
+		case "pxat":
+			pxat, pxatval = true, val
+		}
 	}
-	if exat {
-		m.SetTTL(cmdKey, exatval)
+	expireOpts := 0
+	for _, opt := range []bool{ex, px, exat, pxat, persist} {
+		if opt {
+			expireOpts++
+		}
+	}
+	if expireOpts > 1 {
+		return resp.MakeErrorData("ERR syntax error")
+	}
+	var expireAt int64
+	if expireOpts > 0 && !persist {
+		var errData resp.RedisData
+		if expireAt, errData = expireAtMs("getex", ex, px, exat, exval, pxval, exatval, pxatval); errData != nil {
+			return errData
+		}
 	}
 
-	return res
+	if !m.CheckTTL(key) {
+		return resp.MakeBulkData(nil)
+	}
+	m.locks.Lock(key)
+	defer m.locks.UnLock(key)
+	val, ok := m.db.Get(key)
+	if !ok {
+		return resp.MakeBulkData(nil)
+	}
+	byteVal, ok := val.([]byte)
+	if !ok {
+		return resp.MakeErrorData("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	if persist {
+		m.DelTTL(key)
+	} else if expireAt > 0 {
+		m.SetTTL(key, expireAt)
+	}
+	return resp.MakeBulkData(byteVal)
 }
 
 func getString(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.RedisData {
@@ -141,9 +254,6 @@ func getString(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp.
 		logger.Error("getString func: cmdName != get")
 		return resp.MakeErrorData("Server error")
 	}
-	if len(cmd) != 2 {
-		return resp.MakeErrorData("error: commands is invalid")
-	}
 
 	key := string(cmd[1])
 
@@ -166,9 +276,6 @@ func getRangeString(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn)
 		logger.Error("getRangeString func: cmdName != getrange")
 		return resp.MakeErrorData("Server error")
 	}
-	if len(cmd) != 4 {
-		return resp.MakeErrorData("error: commands is invalid")
-	}
 
 	key := string(cmd[1])
 
@@ -216,9 +323,6 @@ func setRangeString(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn)
 		logger.Error("setRangeString func: cmdName != setrange")
 		return resp.MakeErrorData("Server error")
 	}
-	if len(cmd) != 4 {
-		return resp.MakeErrorData("error: commands is invalid")
-	}
 
 	offset, err := strconv.Atoi(string(cmd[2]))
 	if err != nil || offset < 0 {
@@ -260,9 +364,6 @@ func mGetString(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp
 		logger.Error("mGetString func: cmdName != mget")
 		return resp.MakeErrorData("Server error")
 	}
-	if len(cmd) < 2 {
-		return resp.MakeErrorData("error: commands is invalid")
-	}
 	res := make([]resp.RedisData, 0)
 	for i := 1; i < len(cmd); i++ {
 		key := string(cmd[i])
@@ -288,7 +389,7 @@ func mSetString(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp
 		logger.Error("mSetString func: cmdName != mset")
 		return resp.MakeErrorData("Server error")
 	}
-	if len(cmd) < 3 || len(cmd)&1 != 1 {
+	if len(cmd)&1 != 1 {
 		return resp.MakeErrorData("error: commands is invalid")
 	}
 	keys := make([]string, 0)
@@ -314,15 +415,12 @@ func setExString(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) res
 		logger.Error("setExString func: cmdName != setex")
 		return resp.MakeErrorData("Server error")
 	}
-	if len(cmd) != 4 {
-		return resp.MakeErrorData("error: commands is invalid")
-	}
 
 	ex, err := strconv.ParseInt(string(cmd[2]), 10, 64)
 	if err != nil {
 		return resp.MakeErrorData(fmt.Sprintf("error: %s is not a integer", string(cmd[2])))
 	}
-	ttl := time.Now().Unix() + ex
+	ttl := time.Now().UnixMilli() + ex*1000
 	key := string(cmd[1])
 	val := cmd[3]
 
@@ -339,9 +437,6 @@ func setNxString(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) res
 		logger.Error("setNxString func: cmdName != setnx")
 		return resp.MakeErrorData("Server error")
 	}
-	if len(cmd) != 3 {
-		return resp.MakeErrorData("error: commands is invalid")
-	}
 
 	key := string(cmd[1])
 	val := cmd[2]
@@ -358,9 +453,6 @@ func strLenString(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) re
 		logger.Error("strLenString func: cmdName != strlen")
 		return resp.MakeErrorData("Server error")
 	}
-	if len(cmd) != 2 {
-		return resp.MakeErrorData("error: commands is invalid")
-	}
 	key := string(cmd[1])
 
 	m.locks.RLock(key)
@@ -382,9 +474,6 @@ func incrString(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp
 		logger.Error("incrString func: cmdName != incr")
 		return resp.MakeErrorData("Server error")
 	}
-	if len(cmd) != 2 {
-		return resp.MakeErrorData("error: commands is invalid")
-	}
 	key := string(cmd[1])
 
 	m.locks.Lock(key)
@@ -412,9 +501,6 @@ func incrByString(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) re
 		logger.Error("incrByString func: cmdName != incrby")
 		return resp.MakeErrorData("Server error")
 	}
-	if len(cmd) != 3 {
-		return resp.MakeErrorData("error: commands is invalid")
-	}
 	key := string(cmd[1])
 	inc, err := strconv.ParseInt(string(cmd[2]), 10, 64)
 	if err != nil {
@@ -446,9 +532,6 @@ func decrString(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) resp
 		logger.Error("decrString func: cmdName != decr")
 		return resp.MakeErrorData("Server error")
 	}
-	if len(cmd) != 2 {
-		return resp.MakeErrorData("error: commands is invalid")
-	}
 	key := string(cmd[1])
 
 	m.locks.Lock(key)
@@ -476,9 +559,6 @@ func decrByString(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) re
 		logger.Error("decrByString func: cmdName != decrby")
 		return resp.MakeErrorData("Server error")
 	}
-	if len(cmd) != 3 {
-		return resp.MakeErrorData("error: commands is invalid")
-	}
 	key := string(cmd[1])
 	dec, err := strconv.ParseInt(string(cmd[2]), 10, 64)
 	if err != nil {
@@ -510,9 +590,6 @@ func incrByFloatString(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Con
 		logger.Error("incrByFloatString func: cmdName != incrbyfloat")
 		return resp.MakeErrorData("Server error")
 	}
-	if len(cmd) != 3 {
-		return resp.MakeErrorData("error: commands is invalid")
-	}
 
 	key := string(cmd[1])
 	inc, err := strconv.ParseFloat(string(cmd[2]), 64)
@@ -546,9 +623,6 @@ func appendString(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) re
 		logger.Error("appendString func: cmdName != append")
 		return resp.MakeErrorData("Server error")
 	}
-	if len(cmd) != 3 {
-		return resp.MakeErrorData("error: commands is invalid")
-	}
 	key := string(cmd[1])
 	val := cmd[2]
 
@@ -569,19 +643,20 @@ func appendString(ctx context.Context, m *MemDb, cmd [][]byte, conn net.Conn) re
 }
 
 func RegisterStringCommands() {
-	RegisterCommand("set", setString)
-	RegisterCommand("get", getString)
-	RegisterCommand("getrange", getRangeString)
-	RegisterCommand("setrange", setRangeString)
-	RegisterCommand("mget", mGetString)
-	RegisterCommand("mset", mSetString)
-	RegisterCommand("setex", setExString)
-	RegisterCommand("setnx", setNxString)
-	RegisterCommand("strlen", strLenString)
-	RegisterCommand("incr", incrString)
-	RegisterCommand("incrby", incrByString)
-	RegisterCommand("decr", decrString)
-	RegisterCommand("decrby", decrByString)
-	RegisterCommand("incrbyfloat", incrByFloatString)
-	RegisterCommand("append", appendString)
+	RegisterCommand("set", setString, -3, CmdWrite, 1, 1, 1)
+	RegisterCommand("get", getString, 2, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("getex", getExString, -2, CmdWrite, 1, 1, 1)
+	RegisterCommand("getrange", getRangeString, 4, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("setrange", setRangeString, 4, CmdWrite, 1, 1, 1)
+	RegisterCommand("mget", mGetString, -2, CmdReadOnly, 1, -1, 1)
+	RegisterCommand("mset", mSetString, -3, CmdWrite, 1, -1, 2)
+	RegisterCommand("setex", setExString, 4, CmdWrite, 1, 1, 1)
+	RegisterCommand("setnx", setNxString, 3, CmdWrite, 1, 1, 1)
+	RegisterCommand("strlen", strLenString, 2, CmdReadOnly, 1, 1, 1)
+	RegisterCommand("incr", incrString, 2, CmdWrite, 1, 1, 1)
+	RegisterCommand("incrby", incrByString, 3, CmdWrite, 1, 1, 1)
+	RegisterCommand("decr", decrString, 2, CmdWrite, 1, 1, 1)
+	RegisterCommand("decrby", decrByString, 3, CmdWrite, 1, 1, 1)
+	RegisterCommand("incrbyfloat", incrByFloatString, 3, CmdWrite, 1, 1, 1)
+	RegisterCommand("append", appendString, 3, CmdWrite, 1, 1, 1)
 }
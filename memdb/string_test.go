@@ -3,10 +3,12 @@ package memdb
 import (
 	"bytes"
 	"context"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/innovationb1ue/RedisGO/config"
+	"github.com/innovationb1ue/RedisGO/resp"
 )
 
 func init() {
@@ -38,7 +40,7 @@ func TestSetString(t *testing.T) {
 		t.Error("set value error")
 	}
 	ttl, ok := mem.ttlKeys.Get("a")
-	if !ok || ttl.(*TTLInfo).value-time.Now().Unix() > 100 || ttl.(*TTLInfo).value-time.Now().Unix() < 99 {
+	if !ok || ttl.(*TTLInfo).value-time.Now().UnixMilli() > 100000 || ttl.(*TTLInfo).value-time.Now().UnixMilli() < 99000 {
 		t.Error("set ttl error")
 	}
 
@@ -51,4 +53,53 @@ func TestSetString(t *testing.T) {
 	if !ok {
 		t.Error("set keepttl error")
 	}
+
+	// test opt pxat, kept in milliseconds
+	at := time.Now().UnixMilli() + 100500
+	res = setString(ctx, mem, [][]byte{[]byte("set"), []byte("a"), []byte("d"), []byte("pxat"), []byte(strconv.FormatInt(at, 10))}, nil)
+	if !bytes.Equal(res.ToBytes(), []byte("+OK\r\n")) {
+		t.Error("set reply error")
+	}
+	ttl, ok = mem.ttlKeys.Get("a")
+	if !ok || ttl.(*TTLInfo).value != at {
+		t.Error("set pxat error")
+	}
+	res = setString(ctx, mem, [][]byte{[]byte("set"), []byte("a"), []byte("d"), []byte("ex"), []byte("10"), []byte("pxat"), []byte(strconv.FormatInt(at, 10))}, nil)
+	if _, isErr := res.(*resp.ErrorData); !isErr {
+		t.Error("set should reject ex with pxat")
+	}
+}
+
+func TestGetExString(t *testing.T) {
+	mem := NewMemDb()
+	ctx := context.Background()
+	getex := func(cmd string) []byte {
+		return getExString(ctx, mem, MakeCommandBytes(cmd), nil).ToBytes()
+	}
+	if res := getex("getex a"); !bytes.Equal(res, []byte("$-1\r\n")) {
+		t.Errorf("getex of a missing key = %q", res)
+	}
+	setString(ctx, mem, MakeCommandBytes("set a v"), nil)
+	if res := getex("getex a px 100500"); !bytes.Equal(res, []byte("$1\r\nv\r\n")) {
+		t.Errorf("getex reply = %q", res)
+	}
+	ttl, ok := mem.ttlKeys.Get("a")
+	if !ok || ttl.(*TTLInfo).value-time.Now().UnixMilli() > 100500 || ttl.(*TTLInfo).value-time.Now().UnixMilli() < 100000 {
+		t.Error("getex px error")
+	}
+	at := time.Now().Add(time.Hour).UnixMilli()
+	getex("getex a pxat " + strconv.FormatInt(at, 10))
+	if ttl, ok = mem.ttlKeys.Get("a"); !ok || ttl.(*TTLInfo).value != at {
+		t.Error("getex pxat error")
+	}
+	getex("getex a persist")
+	if _, ok = mem.ttlKeys.Get("a"); ok {
+		t.Error("getex persist error")
+	}
+	if res := getex("getex a ex 0"); !bytes.Equal(res, []byte("-ERR invalid expire time in 'getex' command\r\n")) {
+		t.Errorf("getex with an invalid time = %q", res)
+	}
+	if res := getex("getex a ex 10 persist"); !bytes.Equal(res, []byte("-ERR syntax error\r\n")) {
+		t.Errorf("getex with two options = %q", res)
+	}
 }
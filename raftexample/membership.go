@@ -0,0 +1,510 @@
+package raftexample
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/client/pkg/v3/types"
+	"go.etcd.io/etcd/raft/v3"
+	"go.etcd.io/etcd/raft/v3/raftpb"
+)
+
+// membership.go keeps the members of the raft group by raft ID, with their raft URLs and client addresses.
+// The members change with the conf change entries of the log, and are kept in the raft snapshots with the data
+// of the state machine, so a node restarting or catching up from a snapshot knows the members added before it.
+//
+// The context of a conf change proposed by ChangeMembership tells the node that proposed it, so the proposer
+// is woken up once the change is applied:
+//
+//	confChangeMagic proposer seq url addr
+//
+// Conf changes proposed otherwise have the raft URL of the member as their context.
+
+// Member is a member of the raft group.
+type Member struct {
+	ID   uint64
+	URL  string // raft URL
+	Addr string // client address, empty if it's unknown
+}
+
+// MemberStatus is a member of the raft group as seen by this node.
+type MemberStatus struct {
+	Member
+	Role  string // leader, follower or learner
+	Match uint64 // last log index known to be replicated on the member, only known by the leader
+	// whether the member is connected to this node
+	Reachable bool
+}
+
+var (
+	ErrMemberExists  = errors.New("member already exists")
+	ErrMemberUnknown = errors.New("unknown member")
+	ErrMemberRemoved = errors.New("member was removed from the group, its ID can't be reused")
+	ErrURLExists     = errors.New("raft URL is already used by another member")
+	ErrNotLearner    = errors.New("member is not a learner")
+	ErrLearner       = errors.New("member is a learner")
+	ErrNotLeader     = errors.New("node is not the leader of the group")
+	// ErrLearnerNotReady is returned when promoting a learner that is behind the leader
+	ErrLearnerNotReady = errors.New("learner is not caught up with the leader yet")
+)
+
+// a learner is promoted once it replicated this ratio of the log of the leader
+const learnerReadyRatio = 0.9
+
+var (
+	confChangeMagic = []byte("\x00rgcc")
+	membersMagic    = []byte("\x00rgmembers")
+)
+
+// membership is the set of members of the raft group.
+type membership struct {
+	mu      sync.RWMutex
+	members map[uint64]*Member
+	removed map[uint64]struct{} // members removed from the group, whose IDs are never reused
+}
+
+func newMembership() *membership {
+	return &membership{members: make(map[uint64]*Member), removed: make(map[uint64]struct{})}
+}
+
+// seed adds the members of the initial peer list, whose raft IDs are their position from 1.
+func (ms *membership) seed(peers []string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for i, url := range peers {
+		if url != "" {
+			ms.members[uint64(i+1)] = &Member{ID: uint64(i + 1), URL: url}
+		}
+	}
+}
+
+func (ms *membership) get(id uint64) (Member, bool) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if m, ok := ms.members[id]; ok {
+		return *m, true
+	}
+	return Member{}, false
+}
+
+func (ms *membership) isRemoved(id uint64) bool {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	_, ok := ms.removed[id]
+	return ok
+}
+
+// list returns the members ordered by ID.
+func (ms *membership) list() []Member {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	res := make([]Member, 0, len(ms.members))
+	for _, m := range ms.members {
+		res = append(res, *m)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// nextID returns an ID that no member ever had.
+func (ms *membership) nextID() uint64 {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	var id uint64
+	for m := range ms.members {
+		if m > id {
+			id = m
+		}
+	}
+	for m := range ms.removed {
+		if m > id {
+			id = m
+		}
+	}
+	return id + 1
+}
+
+// check tells why a change of a committed conf change entry conflicts with the members, or returns nil.
+// An added member must have a new ID and a URL no other member has. The changes checked are the same on
+// every node, so a conflicting change is rejected by all of them, however the proposer picked the ID.
+func (ms *membership) check(change raftpb.ConfChangeSingle, url string) error {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if change.Type != raftpb.ConfChangeAddNode && change.Type != raftpb.ConfChangeAddLearnerNode {
+		return nil
+	}
+	// the adds without URL are the promotions of learners and the members of the initial peer list
+	if url == "" {
+		return nil
+	}
+	if _, ok := ms.removed[change.NodeID]; ok {
+		return ErrMemberRemoved
+	}
+	for _, m := range ms.members {
+		if m.ID == change.NodeID && m.URL != url {
+			return ErrMemberExists
+		}
+		if m.ID != change.NodeID && m.URL == url {
+			return ErrURLExists
+		}
+	}
+	return nil
+}
+
+// apply applies a change of a committed conf change entry. The URL and the address are kept
+// if the entry doesn't tell them.
+func (ms *membership) apply(change raftpb.ConfChangeSingle, url, addr string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	switch change.Type {
+	case raftpb.ConfChangeAddNode, raftpb.ConfChangeAddLearnerNode, raftpb.ConfChangeUpdateNode:
+		m, ok := ms.members[change.NodeID]
+		if !ok {
+			m = &Member{ID: change.NodeID}
+			ms.members[change.NodeID] = m
+		}
+		if url != "" {
+			m.URL = url
+		}
+		if addr != "" {
+			m.Addr = addr
+		}
+	case raftpb.ConfChangeRemoveNode:
+		delete(ms.members, change.NodeID)
+		ms.removed[change.NodeID] = struct{}{}
+	}
+}
+
+// wrapSnapshot prepends the members to the snapshot data of the state machine.
+func (ms *membership) wrapSnapshot(data []byte) []byte {
+	members := ms.list()
+	ms.mu.RLock()
+	removed := make([]uint64, 0, len(ms.removed))
+	for id := range ms.removed {
+		removed = append(removed, id)
+	}
+	ms.mu.RUnlock()
+	sort.Slice(removed, func(i, j int) bool { return removed[i] < removed[j] })
+
+	buf := append([]byte{}, membersMagic...)
+	var body []byte
+	body = binary.AppendUvarint(body, uint64(len(members)))
+	for _, m := range members {
+		body = binary.AppendUvarint(body, m.ID)
+		body = appendBytes(body, []byte(m.URL))
+		body = appendBytes(body, []byte(m.Addr))
+	}
+	body = binary.AppendUvarint(body, uint64(len(removed)))
+	for _, id := range removed {
+		body = binary.AppendUvarint(body, id)
+	}
+	buf = appendBytes(buf, body)
+	return append(buf, data...)
+}
+
+// restoreSnapshot replaces the members with the ones of the snapshot data and returns the data of the state machine.
+// The members are kept if the snapshot was taken before they were recorded in the snapshots.
+func (ms *membership) restoreSnapshot(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, membersMagic) {
+		return data, nil
+	}
+	d := &proposalDecoder{data: data[len(membersMagic):]}
+	body := &proposalDecoder{data: d.next(d.count())}
+	members := make(map[uint64]*Member)
+	n := body.count()
+	for i := 0; i < n; i++ {
+		m := &Member{ID: body.uvarint(), URL: string(body.bytes()), Addr: string(body.bytes())}
+		members[m.ID] = m
+	}
+	removed := make(map[uint64]struct{})
+	n = body.count()
+	for i := 0; i < n; i++ {
+		removed[body.uvarint()] = struct{}{}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if body.err != nil {
+		return nil, body.err
+	}
+	ms.mu.Lock()
+	ms.members, ms.removed = members, removed
+	ms.mu.Unlock()
+	return d.data, nil
+}
+
+// snapshotData returns the data of the state machine in the snapshot data.
+func snapshotData(data []byte) []byte {
+	if !bytes.HasPrefix(data, membersMagic) {
+		return data
+	}
+	d := &proposalDecoder{data: data[len(membersMagic):]}
+	d.next(d.count())
+	return d.data
+}
+
+// encodeConfChangeContext encodes the context of a conf change proposed by this node.
+func encodeConfChangeContext(proposer, seq uint64, url, addr string) []byte {
+	buf := append([]byte{}, confChangeMagic...)
+	buf = binary.AppendUvarint(buf, proposer)
+	buf = binary.AppendUvarint(buf, seq)
+	buf = appendBytes(buf, []byte(url))
+	return appendBytes(buf, []byte(addr))
+}
+
+// decodeConfChangeContext decodes the context of a conf change. proposer is 0 if the change wasn't proposed
+// by ChangeMembership.
+func decodeConfChangeContext(ctx []byte) (proposer, seq uint64, url, addr string) {
+	if !bytes.HasPrefix(ctx, confChangeMagic) {
+		return 0, 0, string(ctx), ""
+	}
+	d := &proposalDecoder{data: ctx[len(confChangeMagic):]}
+	proposer, seq = d.uvarint(), d.uvarint()
+	url, addr = string(d.bytes()), string(d.bytes())
+	if d.err != nil {
+		return 0, 0, "", ""
+	}
+	return proposer, seq, url, addr
+}
+
+// applyConfChange applies a committed conf change to raft, the members and the transport.
+// A change conflicting with the members is rejected as a whole, and its proposer gets the error.
+// It returns false if this node was removed from the group.
+func (rc *RaftNode) applyConfChange(cc raftpb.ConfChangeI) bool {
+	ccv2 := cc.AsV2()
+	proposer, seq, url, addr := decodeConfChangeContext(ccv2.Context)
+	for _, change := range ccv2.Changes {
+		if err := rc.members.check(change, url); err != nil {
+			// raft treats a rejected change as a noop, it must not be applied to it
+			if proposer == uint64(rc.id) {
+				rc.confWait.Trigger(seq, err)
+			}
+			return true
+		}
+	}
+	rc.confState = *rc.Node.ApplyConfChange(cc)
+	removed := false
+	for _, change := range ccv2.Changes {
+		rc.members.apply(change, url, addr)
+		if change.NodeID == uint64(rc.id) {
+			removed = change.Type == raftpb.ConfChangeRemoveNode
+			continue
+		}
+		switch change.Type {
+		case raftpb.ConfChangeAddNode, raftpb.ConfChangeAddLearnerNode:
+			if m, ok := rc.members.get(change.NodeID); ok && validURL(m.URL) {
+				rc.transport.AddPeer(types.ID(change.NodeID), []string{m.URL})
+			}
+		case raftpb.ConfChangeUpdateNode:
+			if validURL(url) {
+				rc.transport.UpdatePeer(types.ID(change.NodeID), []string{url})
+			}
+		case raftpb.ConfChangeRemoveNode:
+			rc.transport.RemovePeer(types.ID(change.NodeID))
+		}
+	}
+	if proposer == uint64(rc.id) {
+		rc.confWait.Trigger(seq, nil)
+	}
+	if removed {
+		log.Println("I've been removed from the cluster! Shutting down.")
+		return false
+	}
+	return true
+}
+
+// validURL tells whether url can be given to the transport, which panics on invalid URLs.
+func validURL(url string) bool {
+	if url == "" {
+		return false
+	}
+	_, err := types.NewURLs([]string{url})
+	return err == nil
+}
+
+// ChangeMembership proposes a change of the members and waits until this node applied it.
+// url and addr are the raft URL and the client address of an added or updated member.
+// A change conflicting with the members when it's applied returns the conflict, like ErrURLExists.
+func (rc *RaftNode) ChangeMembership(ctx context.Context, change raftpb.ConfChangeSingle, url, addr string) error {
+	if change.NodeID == raft.None {
+		return ErrMemberUnknown
+	}
+	rc.confMu.Lock()
+	defer rc.confMu.Unlock()
+	_, exists := rc.members.get(change.NodeID)
+	switch change.Type {
+	case raftpb.ConfChangeAddNode, raftpb.ConfChangeAddLearnerNode:
+		if rc.members.isRemoved(change.NodeID) {
+			return ErrMemberRemoved
+		}
+		if exists {
+			// a learner is promoted by adding it as a voter
+			if change.Type == raftpb.ConfChangeAddNode && rc.isLearner(change.NodeID) {
+				break
+			}
+			return ErrMemberExists
+		}
+		if !validURL(url) {
+			return fmt.Errorf("invalid raft URL %q", url)
+		}
+	case raftpb.ConfChangeUpdateNode:
+		if !exists {
+			return ErrMemberUnknown
+		}
+		if !validURL(url) {
+			return fmt.Errorf("invalid raft URL %q", url)
+		}
+	case raftpb.ConfChangeRemoveNode:
+		if !exists {
+			return ErrMemberUnknown
+		}
+	}
+	seq := rc.confSeq.Add(1)
+	applied := rc.confWait.Register(seq)
+	cc := raftpb.ConfChangeV2{
+		Changes: []raftpb.ConfChangeSingle{change},
+		Context: encodeConfChangeContext(uint64(rc.id), seq, url, addr),
+	}
+	if err := rc.Node.ProposeConfChange(ctx, cc); err != nil {
+		rc.confWait.Trigger(seq, nil)
+		return err
+	}
+	select {
+	case x := <-applied:
+		// the change was rejected when it was applied
+		if err, ok := x.(error); ok {
+			return err
+		}
+		return nil
+	case <-ctx.Done():
+		rc.confWait.Trigger(seq, nil)
+		return ctx.Err()
+	case <-rc.stopc:
+		return ErrStopped
+	}
+}
+
+// AddMember adds a member with a new raft ID, waits until the change is applied and returns the ID.
+func (rc *RaftNode) AddMember(ctx context.Context, url, addr string) (uint64, error) {
+	return rc.addWithNewID(ctx, raftpb.ConfChangeAddNode, url, addr)
+}
+
+// AddLearner adds a learner with a new raft ID, waits until the change is applied and returns the ID.
+// A learner receives the log but doesn't vote, so the group keeps its quorum while the learner catches up.
+func (rc *RaftNode) AddLearner(ctx context.Context, url, addr string) (uint64, error) {
+	return rc.addWithNewID(ctx, raftpb.ConfChangeAddLearnerNode, url, addr)
+}
+
+// addWithNewID adds a member with the next ID this node knows of. Another node may add a member with the same ID
+// at the same time, in which case the change applied last is rejected and the member is added again with a new ID.
+func (rc *RaftNode) addWithNewID(ctx context.Context, typ raftpb.ConfChangeType, url, addr string) (uint64, error) {
+	for {
+		id := rc.members.nextID()
+		err := rc.ChangeMembership(ctx, raftpb.ConfChangeSingle{Type: typ, NodeID: id}, url, addr)
+		if !errors.Is(err, ErrMemberExists) && !errors.Is(err, ErrMemberRemoved) {
+			return id, err
+		}
+	}
+}
+
+// PromoteMember makes a learner a voter once it caught up with the leader, and waits until the change is applied.
+// Only the leader knows how far the learner is, so it must be called on the leader.
+func (rc *RaftNode) PromoteMember(ctx context.Context, id uint64) error {
+	if _, ok := rc.members.get(id); !ok {
+		return ErrMemberUnknown
+	}
+	if !rc.isLearner(id) {
+		return ErrNotLearner
+	}
+	status := rc.Node.Status()
+	if status.RaftState != raft.StateLeader {
+		return ErrNotLeader
+	}
+	if float64(status.Progress[id].Match) < float64(status.Progress[status.ID].Match)*learnerReadyRatio {
+		return ErrLearnerNotReady
+	}
+	return rc.ChangeMembership(ctx, raftpb.ConfChangeSingle{Type: raftpb.ConfChangeAddNode, NodeID: id}, "", "")
+}
+
+// TransferLeadership makes a voter the leader of the group and waits until it's elected.
+// The request is forwarded to the leader if the node is a follower.
+func (rc *RaftNode) TransferLeadership(ctx context.Context, id uint64) error {
+	if _, ok := rc.members.get(id); !ok {
+		return ErrMemberUnknown
+	}
+	if rc.isLearner(id) {
+		return ErrLearner
+	}
+	// the leader gives up the transfer after an election timeout, so it's asked again until the member is elected
+	ticker := time.NewTicker(rc.opts.TickInterval)
+	defer ticker.Stop()
+	for {
+		lead := rc.Leader()
+		if lead == id {
+			return nil
+		}
+		if lead != raft.None {
+			rc.Node.TransferLeadership(ctx, lead, id)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-rc.stopc:
+			return ErrStopped
+		}
+	}
+}
+
+// isLearner tells whether the member with the given ID is a learner.
+func (rc *RaftNode) isLearner(id uint64) bool {
+	_, ok := rc.Node.Status().Config.Learners[id]
+	return ok
+}
+
+// RemoveMember removes a member and waits until the change is applied.
+func (rc *RaftNode) RemoveMember(ctx context.Context, id uint64) error {
+	return rc.ChangeMembership(ctx, raftpb.ConfChangeSingle{Type: raftpb.ConfChangeRemoveNode, NodeID: id}, "", "")
+}
+
+// Member returns the member with the given raft ID.
+func (rc *RaftNode) Member(id uint64) (Member, bool) {
+	return rc.members.get(id)
+}
+
+// Members returns the members ordered by ID.
+func (rc *RaftNode) Members() []Member {
+	return rc.members.list()
+}
+
+// MembersStatus returns the status of the members ordered by ID.
+func (rc *RaftNode) MembersStatus() []MemberStatus {
+	status := rc.Node.Status()
+	members := rc.members.list()
+	res := make([]MemberStatus, 0, len(members))
+	for _, m := range members {
+		s := MemberStatus{Member: m, Role: "follower"}
+		if _, ok := status.Config.Learners[m.ID]; ok {
+			s.Role = "learner"
+		} else if m.ID == status.Lead {
+			s.Role = "leader"
+		}
+		if pr, ok := status.Progress[m.ID]; ok {
+			s.Match = pr.Match
+		}
+		if m.ID == uint64(rc.id) {
+			s.Reachable = true
+		} else {
+			s.Reachable = !rc.transport.ActiveSince(types.ID(m.ID)).IsZero()
+		}
+		res = append(res, s)
+	}
+	return res
+}
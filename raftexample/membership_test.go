@@ -0,0 +1,333 @@
+package raftexample
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/raft/v3/raftpb"
+)
+
+func TestMembershipSnapshot(t *testing.T) {
+	ms := newMembership()
+	ms.seed([]string{"http://127.0.0.1:12379", "", "http://127.0.0.1:32379"})
+	ms.apply(raftpb.ConfChangeSingle{Type: raftpb.ConfChangeAddNode, NodeID: 4}, "http://127.0.0.1:42379", "127.0.0.1:6382")
+	ms.apply(raftpb.ConfChangeSingle{Type: raftpb.ConfChangeRemoveNode, NodeID: 3}, "", "")
+	if id := ms.nextID(); id != 5 {
+		t.Fatalf("nextID is %d, expected 5", id)
+	}
+
+	data := ms.wrapSnapshot([]byte("state machine"))
+	if string(snapshotData(data)) != "state machine" {
+		t.Fatalf("snapshot data is %q", snapshotData(data))
+	}
+	restored := newMembership()
+	restored.seed([]string{"http://127.0.0.1:2379"})
+	rest, err := restored.restoreSnapshot(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "state machine" {
+		t.Fatalf("restored data is %q", rest)
+	}
+	expected := []Member{
+		{ID: 1, URL: "http://127.0.0.1:12379"},
+		{ID: 4, URL: "http://127.0.0.1:42379", Addr: "127.0.0.1:6382"},
+	}
+	if !reflect.DeepEqual(restored.list(), expected) {
+		t.Fatalf("restored members are %v, expected %v", restored.list(), expected)
+	}
+	if !restored.isRemoved(3) || restored.isRemoved(2) {
+		t.Fatal("the removed members are not restored")
+	}
+
+	// snapshots without members keep the members of the peer list
+	old := newMembership()
+	old.seed([]string{"http://127.0.0.1:2379"})
+	if rest, err := old.restoreSnapshot([]byte("REDISGO")); err != nil || string(rest) != "REDISGO" {
+		t.Fatalf("restoring an old snapshot returned %q, %v", rest, err)
+	}
+	if len(old.list()) != 1 {
+		t.Fatalf("members are %v", old.list())
+	}
+	if _, err := old.restoreSnapshot(membersMagic); err == nil {
+		t.Fatal("a truncated snapshot should fail")
+	}
+}
+
+func TestMembershipCheck(t *testing.T) {
+	ms := newMembership()
+	ms.seed([]string{"http://127.0.0.1:12379", "http://127.0.0.1:22379"})
+	ms.apply(raftpb.ConfChangeSingle{Type: raftpb.ConfChangeRemoveNode, NodeID: 2}, "", "")
+	add := func(id uint64) raftpb.ConfChangeSingle {
+		return raftpb.ConfChangeSingle{Type: raftpb.ConfChangeAddNode, NodeID: id}
+	}
+	for _, tc := range []struct {
+		change raftpb.ConfChangeSingle
+		url    string
+		err    error
+	}{
+		{add(3), "http://127.0.0.1:32379", nil},
+		// another node added a member with the same ID first
+		{add(1), "http://127.0.0.1:32379", ErrMemberExists},
+		{add(2), "http://127.0.0.1:32379", ErrMemberRemoved},
+		{add(3), "http://127.0.0.1:12379", ErrURLExists},
+		// the initial peers and the promotions of the learners don't tell the URL
+		{add(1), "", nil},
+		// the same add applied again
+		{add(1), "http://127.0.0.1:12379", nil},
+		{raftpb.ConfChangeSingle{Type: raftpb.ConfChangeUpdateNode, NodeID: 1}, "http://127.0.0.1:42379", nil},
+	} {
+		if err := ms.check(tc.change, tc.url); !errors.Is(err, tc.err) {
+			t.Fatalf("checking %v %s returned %v, expected %v", tc.change, tc.url, err, tc.err)
+		}
+	}
+}
+
+func TestConfChangeContext(t *testing.T) {
+	proposer, seq, url, addr := decodeConfChangeContext(encodeConfChangeContext(2, 7, "http://127.0.0.1:22379", "127.0.0.1:6381"))
+	if proposer != 2 || seq != 7 || url != "http://127.0.0.1:22379" || addr != "127.0.0.1:6381" {
+		t.Fatalf("decoded %d %d %q %q", proposer, seq, url, addr)
+	}
+	// the context of the conf changes proposed by the older versions is the raft URL
+	proposer, _, url, _ = decodeConfChangeContext([]byte("http://127.0.0.1:22379"))
+	if proposer != 0 || url != "http://127.0.0.1:22379" {
+		t.Fatalf("decoded %d %q", proposer, url)
+	}
+}
+
+// testNode is a raft node run by a test, in the working directory of the test.
+type testNode struct {
+	rc       *RaftNode
+	proposeC chan *RaftProposal
+	errorC   <-chan error
+}
+
+func startTestNode(id int, peers []string, join bool) *testNode {
+	n := &testNode{proposeC: make(chan *RaftProposal)}
+	getSnapshot := func() ([]byte, error) { return nil, nil }
+	commitC, errorC, snapshotterReady, rc := NewRaftNode(id, peers[id-1], peers, join, getSnapshot, n.proposeC, make(chan raftpb.ConfChangeI))
+	<-snapshotterReady
+	n.rc, n.errorC = rc, errorC
+	go func() {
+		for commit := range commitC {
+			close(commit.ApplyDoneC)
+		}
+	}()
+	return n
+}
+
+func (n *testNode) stop() {
+	close(n.proposeC)
+	for range n.errorC {
+	}
+}
+
+// freeURLs returns raft URLs on free local ports.
+func freeURLs(t *testing.T, n int) []string {
+	urls := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, "http://"+ln.Addr().String())
+		ln.Close()
+	}
+	return urls
+}
+
+func TestLearnerAndLeadershipTransfer(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	peers := freeURLs(t, 3)
+	nodes := []*testNode{startTestNode(1, peers[:2], false), startTestNode(2, peers[:2], false)}
+	defer func() {
+		for _, n := range nodes {
+			n.stop()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := nodes[0].rc.ReadIndex(ctx); err != nil {
+		t.Fatalf("ReadIndex error: %v", err)
+	}
+	leader := nodes[nodes[0].rc.Leader()-1]
+	id, err := leader.rc.AddLearner(ctx, peers[2], "127.0.0.1:6383")
+	if err != nil || id != 3 {
+		t.Fatalf("AddLearner returned %d, %v", id, err)
+	}
+	// learners don't count as holding the entries
+	if n, err := leader.rc.Replicated(leader.rc.CommittedIndex()); err != nil || n != 1 {
+		t.Fatalf("Replicated returned %d, %v", n, err)
+	}
+	for _, n := range nodes {
+		if _, err := n.rc.Replicated(1); n != leader && !errors.Is(err, ErrNotLeader) {
+			t.Fatalf("Replicated on a follower returned %v", err)
+		}
+	}
+	// the learner didn't start yet
+	if err := leader.rc.PromoteMember(ctx, 3); !errors.Is(err, ErrLearnerNotReady) {
+		t.Fatalf("promoting a learner that is behind returned %v", err)
+	}
+	if err := leader.rc.TransferLeadership(ctx, 3); !errors.Is(err, ErrLearner) {
+		t.Fatalf("transferring the leadership to a learner returned %v", err)
+	}
+	nodes = append(nodes, startTestNode(3, peers, true))
+	for {
+		err := leader.rc.PromoteMember(ctx, 3)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrLearnerNotReady) {
+			t.Fatalf("PromoteMember error: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := leader.rc.PromoteMember(ctx, 3); !errors.Is(err, ErrNotLearner) {
+		t.Fatalf("promoting a voter returned %v", err)
+	}
+	for _, member := range leader.rc.MembersStatus() {
+		if member.Role == "learner" {
+			t.Fatalf("member %d is still a learner", member.ID)
+		}
+	}
+
+	// the transfer is asked to a follower, which forwards it to the leader
+	var target, follower *testNode
+	for _, n := range nodes {
+		if n == leader {
+			continue
+		}
+		if target == nil {
+			target = n
+		} else {
+			follower = n
+		}
+	}
+	if err := follower.rc.TransferLeadership(ctx, target.rc.ID()); err != nil {
+		t.Fatalf("TransferLeadership error: %v", err)
+	}
+	for target.rc.Leader() != target.rc.ID() || !target.rc.IsLeader() {
+		select {
+		case <-ctx.Done():
+			t.Fatal("the target was not elected")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestChangeMembership(t *testing.T) {
+	// the raft node keeps its wal and snapshots in the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := "http://" + ln.Addr().String()
+	ln.Close()
+
+	proposeC := make(chan *RaftProposal)
+	confChangeC := make(chan raftpb.ConfChangeI)
+	getSnapshot := func() ([]byte, error) { return nil, nil }
+	commitC, errorC, snapshotterReady, rc := NewRaftNode(1, peer, []string{peer}, false, getSnapshot, proposeC, confChangeC)
+	<-snapshotterReady
+	go func() {
+		for commit := range commitC {
+			close(commit.ApplyDoneC)
+		}
+	}()
+	defer func() {
+		close(proposeC)
+		for range errorC {
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// waits for the election of the node
+	if err := rc.ReadIndex(ctx); err != nil {
+		t.Fatalf("ReadIndex error: %v", err)
+	}
+	// a learner doesn't count in the quorum, so the group keeps committing without it
+	learner := raftpb.ConfChangeSingle{Type: raftpb.ConfChangeAddLearnerNode, NodeID: 2}
+	if err := rc.ChangeMembership(ctx, learner, "http://127.0.0.1:1", "127.0.0.1:6381"); err != nil {
+		t.Fatalf("ChangeMembership error: %v", err)
+	}
+	members := rc.MembersStatus()
+	if len(members) != 2 {
+		t.Fatalf("members are %v", members)
+	}
+	if members[0].Role != "leader" || !members[0].Reachable || members[0].Match == 0 {
+		t.Fatalf("leader status is %+v", members[0])
+	}
+	if members[1].Role != "learner" || members[1].URL != "http://127.0.0.1:1" || members[1].Addr != "127.0.0.1:6381" || members[1].Reachable {
+		t.Fatalf("learner status is %+v", members[1])
+	}
+	if err := rc.ChangeMembership(ctx, learner, "http://127.0.0.1:1", ""); !errors.Is(err, ErrMemberExists) {
+		t.Fatalf("adding an existing member returned %v", err)
+	}
+	if err := rc.ChangeMembership(ctx, raftpb.ConfChangeSingle{Type: raftpb.ConfChangeAddNode, NodeID: 3}, "127.0.0.1:1", ""); err == nil {
+		t.Fatal("adding a member with an invalid URL should fail")
+	}
+
+	if err := rc.RemoveMember(ctx, 2); err != nil {
+		t.Fatalf("RemoveMember error: %v", err)
+	}
+	if members := rc.Members(); len(members) != 1 || members[0].ID != 1 {
+		t.Fatalf("members are %v", members)
+	}
+	if !rc.IsIDRemoved(2) {
+		t.Fatal("the removed member is not reported as removed")
+	}
+	if err := rc.RemoveMember(ctx, 2); !errors.Is(err, ErrMemberUnknown) {
+		t.Fatalf("removing a removed member returned %v", err)
+	}
+	if err := rc.ChangeMembership(ctx, learner, "http://127.0.0.1:1", ""); !errors.Is(err, ErrMemberRemoved) {
+		t.Fatalf("adding a removed member returned %v", err)
+	}
+
+	// the members added at the same time get different IDs
+	var wg sync.WaitGroup
+	ids := make([]uint64, 4)
+	errs := make([]error, len(ids))
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i], errs[i] = rc.AddLearner(ctx, fmt.Sprintf("http://127.0.0.1:%d", i+2), "")
+		}(i)
+	}
+	wg.Wait()
+	seen := make(map[uint64]bool)
+	for i, id := range ids {
+		if errs[i] != nil || seen[id] {
+			t.Fatalf("AddLearner returned %d, %v", id, errs[i])
+		}
+		seen[id] = true
+	}
+	// the URL check is done when the change is applied too
+	if _, err := rc.AddLearner(ctx, "http://127.0.0.1:2", ""); !errors.Is(err, ErrURLExists) {
+		t.Fatalf("adding a URL twice returned %v", err)
+	}
+}
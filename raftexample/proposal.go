@@ -0,0 +1,216 @@
+package raftexample
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// proposal.go encodes the proposals into raft log entries. The arguments of the commands are kept
+// as they are, so values holding spaces, newlines or binary data are replicated exactly.
+//
+// An entry is a version byte followed by the fields of the proposal. Integers are uvarints,
+// strings and arguments are prefixed by their length and lists by their number of elements:
+//
+//	version flags id db args [batch watches]
+//
+// batch and watches are only present for transactions, which have flagMulti set.
+//
+// The proposals coalesced into a single entry are encoded as a list of encoded proposals
+// behind their own version byte. An entry holding a single proposal keeps the format above.
+//
+//	batchVersion proposals
+
+const (
+	proposalVersion = 1
+	batchVersion    = 2
+)
+
+// proposal flags
+const (
+	flagMulti = 1 << iota
+)
+
+var errProposalFormat = errors.New("bad proposal format")
+
+func (p *RaftProposal) ToBytes() []byte {
+	buf := make([]byte, 0, 64)
+	var flags uint64
+	if p.Multi {
+		flags |= flagMulti
+	}
+	buf = append(buf, proposalVersion)
+	buf = binary.AppendUvarint(buf, flags)
+	buf = appendBytes(buf, []byte(p.ID))
+	buf = binary.AppendUvarint(buf, uint64(p.DB))
+	buf = appendArgs(buf, p.Args)
+	if !p.Multi {
+		return buf
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(p.Batch)))
+	for _, args := range p.Batch {
+		buf = appendArgs(buf, args)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(p.Watches)))
+	for _, w := range p.Watches {
+		buf = binary.AppendUvarint(buf, uint64(w.DB))
+		buf = appendBytes(buf, []byte(w.Key))
+		buf = binary.BigEndian.AppendUint64(buf, w.Digest)
+	}
+	return buf
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func appendArgs(buf []byte, args [][]byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(args)))
+	for _, arg := range args {
+		buf = appendBytes(buf, arg)
+	}
+	return buf
+}
+
+// encodeBatch encodes the proposals encoded by ToBytes into a single entry.
+func encodeBatch(proposals [][]byte) []byte {
+	if len(proposals) == 1 {
+		return proposals[0]
+	}
+	size := 1 + binary.MaxVarintLen64
+	for _, p := range proposals {
+		size += binary.MaxVarintLen64 + len(p)
+	}
+	buf := make([]byte, 0, size)
+	buf = append(buf, batchVersion)
+	buf = binary.AppendUvarint(buf, uint64(len(proposals)))
+	for _, p := range proposals {
+		buf = appendBytes(buf, p)
+	}
+	return buf
+}
+
+// DecodeEntry decodes the proposals of a raft entry, which holds either a proposal or a batch of them.
+func DecodeEntry(data []byte) ([]*RaftProposal, error) {
+	if len(data) == 0 || data[0] != batchVersion {
+		p, err := DecodeProposal(data)
+		if err != nil {
+			return nil, err
+		}
+		return []*RaftProposal{p}, nil
+	}
+	d := &proposalDecoder{data: data[1:]}
+	n := d.count()
+	proposals := make([]*RaftProposal, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		p, err := DecodeProposal(d.next(d.count()))
+		if err != nil {
+			return nil, err
+		}
+		proposals = append(proposals, p)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(d.data) != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", errProposalFormat, len(d.data))
+	}
+	return proposals, nil
+}
+
+// DecodeProposal decodes a proposal encoded by ToBytes.
+func DecodeProposal(data []byte) (*RaftProposal, error) {
+	if len(data) == 0 || data[0] != proposalVersion {
+		return nil, fmt.Errorf("%w: unknown version", errProposalFormat)
+	}
+	d := &proposalDecoder{data: data[1:]}
+	p := &RaftProposal{}
+	flags := d.uvarint()
+	p.Multi = flags&flagMulti != 0
+	p.ID = string(d.bytes())
+	p.DB = int(d.uvarint())
+	p.Args = d.args()
+	if p.Multi {
+		n := d.count()
+		p.Batch = make([][][]byte, 0, n)
+		for i := 0; i < n; i++ {
+			p.Batch = append(p.Batch, d.args())
+		}
+		n = d.count()
+		for i := 0; i < n; i++ {
+			w := RaftWatch{DB: int(d.uvarint()), Key: string(d.bytes())}
+			w.Digest = binary.BigEndian.Uint64(d.next(8))
+			p.Watches = append(p.Watches, w)
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(d.data) != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", errProposalFormat, len(d.data))
+	}
+	return p, nil
+}
+
+// proposalDecoder reads the fields of a proposal. Once an error happens the reads return zero values
+// and err keeps the first error.
+type proposalDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *proposalDecoder) fail(msg string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", errProposalFormat, msg)
+	}
+	d.data = nil
+}
+
+func (d *proposalDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail("bad integer")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// count reads the length of a list or a string, which can not exceed the remaining data.
+func (d *proposalDecoder) count() int {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.fail("length out of range")
+		return 0
+	}
+	return int(n)
+}
+
+func (d *proposalDecoder) next(n int) []byte {
+	if n > len(d.data) {
+		d.fail("unexpected end of data")
+		return make([]byte, n)
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+// bytes returns a copy of the string, as the commands may modify their arguments once stored
+// while the entry is still held by the raft log.
+func (d *proposalDecoder) bytes() []byte {
+	return append([]byte{}, d.next(d.count())...)
+}
+
+func (d *proposalDecoder) args() [][]byte {
+	n := d.count()
+	if n == 0 {
+		return nil
+	}
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		args = append(args, d.bytes())
+	}
+	return args
+}
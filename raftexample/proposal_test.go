@@ -0,0 +1,174 @@
+package raftexample
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/raft/v3"
+)
+
+func TestProposalEncoding(t *testing.T) {
+	cases := []*RaftProposal{
+		{
+			ID:   "a84e0dd0",
+			DB:   3,
+			Args: [][]byte{[]byte("SET"), []byte("k"), []byte("hello world\r\n\x00\xff")},
+		},
+		{
+			ID:   "empty argument",
+			Args: [][]byte{[]byte("set"), []byte("k"), {}},
+		},
+		{
+			ID:    "transaction",
+			DB:    1,
+			Multi: true,
+			Batch: [][][]byte{
+				{[]byte("set"), []byte("k 1"), []byte("v\n1")},
+				{[]byte("select"), []byte("2")},
+				{[]byte("incr"), []byte("n")},
+			},
+			Watches: []RaftWatch{{DB: 1, Key: "k 1", Digest: 1<<64 - 1}, {DB: 2, Key: "n"}},
+		},
+	}
+	for _, p := range cases {
+		t.Run(p.ID, func(t *testing.T) {
+			decoded, err := DecodeProposal(p.ToBytes())
+			if err != nil {
+				t.Fatalf("DecodeProposal error: %v", err)
+			}
+			if !reflect.DeepEqual(p, decoded) {
+				t.Fatalf("decoded %+v, expected %+v", decoded, p)
+			}
+		})
+	}
+}
+
+func TestProposalEncoding_BadFormat(t *testing.T) {
+	data := (&RaftProposal{ID: "1", Args: [][]byte{[]byte("set"), []byte("k"), []byte("v")}}).ToBytes()
+	bad := [][]byte{
+		nil,
+		[]byte(`{"Data":"set k v","ID":"1"}`),
+		data[:len(data)-1],
+		append(append([]byte{}, data...), 0),
+		// an argument longer than the entry
+		{proposalVersion, 0, 1, '1', 0, 1, 0xff, 0x01},
+	}
+	for _, b := range bad {
+		if _, err := DecodeProposal(b); !errors.Is(err, errProposalFormat) {
+			t.Fatalf("DecodeProposal(%q) error = %v, expected %v", b, err, errProposalFormat)
+		}
+	}
+}
+
+func TestBatchEncoding(t *testing.T) {
+	proposals := []*RaftProposal{
+		{ID: "1", Args: [][]byte{[]byte("set"), []byte("k"), []byte("v")}},
+		{ID: "2", DB: 2, Args: [][]byte{[]byte("incr"), []byte("n")}},
+		{ID: "3", Multi: true, Batch: [][][]byte{{[]byte("del"), []byte("k")}}},
+	}
+	encoded := make([][]byte, 0, len(proposals))
+	for _, p := range proposals {
+		encoded = append(encoded, p.ToBytes())
+	}
+	decoded, err := DecodeEntry(encodeBatch(encoded))
+	if err != nil {
+		t.Fatalf("DecodeEntry error: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, proposals) {
+		t.Fatalf("decoded %+v, expected %+v", decoded, proposals)
+	}
+	// a single proposal keeps the format of the entries written before the batches
+	if single := encodeBatch(encoded[:1]); !reflect.DeepEqual(single, encoded[0]) {
+		t.Fatalf("a batch of a single proposal is encoded as %q", single)
+	}
+	decoded, err = DecodeEntry(encoded[0])
+	if err != nil || len(decoded) != 1 || !reflect.DeepEqual(decoded[0], proposals[0]) {
+		t.Fatalf("DecodeEntry returned %+v, %v", decoded, err)
+	}
+
+	data := encodeBatch(encoded)
+	bad := [][]byte{
+		data[:len(data)-1],
+		append(append([]byte{}, data...), 0),
+		// a proposal longer than the entry
+		{batchVersion, 1, 0xff, 0x01},
+		{batchVersion, 1, 1, 0xff},
+	}
+	for _, b := range bad {
+		if _, err := DecodeEntry(b); !errors.Is(err, errProposalFormat) {
+			t.Fatalf("DecodeEntry(%q) error = %v, expected %v", b, err, errProposalFormat)
+		}
+	}
+}
+
+// recordingNode records the entries proposed to raft.
+type recordingNode struct {
+	raft.Node
+	proposed [][]byte
+}
+
+func (n *recordingNode) Propose(_ context.Context, data []byte) error {
+	n.proposed = append(n.proposed, data)
+	return nil
+}
+
+func TestProposeBatch(t *testing.T) {
+	proposal := func(i int) *RaftProposal {
+		return &RaftProposal{ID: fmt.Sprint(i), Args: [][]byte{[]byte("incr"), []byte("n")}}
+	}
+	proposeC := make(chan *RaftProposal, 8)
+	node := &recordingNode{}
+	opts := DefaultRaftOptions()
+	opts.MaxBatchSize = 3
+	rc := &RaftNode{proposeC: proposeC, Node: node, opts: opts}
+	for i := 2; i <= 5; i++ {
+		proposeC <- proposal(i)
+	}
+	// the proposals waiting are coalesced up to MaxBatchSize
+	if !rc.proposeBatch(proposal(1)) || !rc.proposeBatch(<-proposeC) {
+		t.Fatal("proposeBatch returned false while proposeC is open")
+	}
+	var ids []string
+	for _, entry := range node.proposed {
+		proposals, err := DecodeEntry(entry)
+		if err != nil {
+			t.Fatalf("DecodeEntry error: %v", err)
+		}
+		ids = append(ids, "")
+		for _, p := range proposals {
+			ids[len(ids)-1] += p.ID
+		}
+	}
+	if !reflect.DeepEqual(ids, []string{"123", "45"}) {
+		t.Fatalf("proposed the entries %q", ids)
+	}
+
+	// a proposal waits MaxBatchDelay for others
+	rc.opts.MaxBatchDelay = 10 * time.Second
+	rc.opts.MaxBatchSize = 2
+	node.proposed = nil
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		proposeC <- proposal(7)
+	}()
+	start := time.Now()
+	rc.proposeBatch(proposal(6))
+	if proposals, _ := DecodeEntry(node.proposed[0]); len(proposals) != 2 || time.Since(start) > 5*time.Second {
+		t.Fatalf("proposed %d proposals after %v", len(proposals), time.Since(start))
+	}
+	// the proposals received before proposeC is closed are proposed
+	proposeC <- proposal(9)
+	close(proposeC)
+	rc.opts.MaxBatchSize = 3
+	node.proposed = nil
+	if rc.proposeBatch(proposal(8)) {
+		t.Fatal("proposeBatch returned true once proposeC is closed")
+	}
+	if proposals, _ := DecodeEntry(node.proposed[0]); len(proposals) != 2 {
+		t.Fatalf("proposed %d proposals", len(proposals))
+	}
+}
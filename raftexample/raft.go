@@ -16,17 +16,22 @@ package raftexample
 
 import (
 	"context"
-	"encoding/json"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.etcd.io/etcd/client/pkg/v3/fileutil"
 	"go.etcd.io/etcd/client/pkg/v3/types"
+	"go.etcd.io/etcd/pkg/v3/wait"
 	"go.etcd.io/etcd/raft/v3"
 	"go.etcd.io/etcd/raft/v3/raftpb"
 	"go.etcd.io/etcd/server/v3/etcdserver/api/rafthttp"
@@ -39,12 +44,27 @@ import (
 )
 
 type RaftCommit struct {
-	Data       []*RaftProposal
+	Data []*RaftProposal
+	// Snapshot is set when the node received a snapshot from the leader, which the state machine loads
+	// with RaftNode.Snapshot instead of applying Data
+	Snapshot   bool
 	ApplyDoneC chan<- struct{}
 }
 type RaftProposal struct {
-	Data string `json:"Data"`
-	ID   string `json:"ID"`
+	ID   string
+	DB   int      // index of the database the command runs on
+	Args [][]byte // the command and its arguments
+	// a transaction applies all the commands of Batch at once, unless a key in Watches was modified
+	Multi   bool
+	Batch   [][][]byte
+	Watches []RaftWatch
+}
+
+// RaftWatch is a key watched by a transaction and the digest of the key when it was watched.
+type RaftWatch struct {
+	DB     int
+	Key    string
+	Digest uint64
 }
 
 // RaftNode A key-value stream backed by raft
@@ -54,11 +74,12 @@ type RaftNode struct {
 	commitC     chan<- *RaftCommit        // entries committed to log (k,v)
 	errorC      chan<- error              // errors from raft session
 
-	id          int      // client ID for raft session
-	Peers       []string // raft peer URLs
-	join        bool     // Node is joining an existing cluster
-	waldir      string   // path to WAL directory
-	snapdir     string   // path to snapshot directory
+	id          int         // client ID for raft session
+	Peers       []string    // raft peer URLs the group started with
+	members     *membership // members of the group by raft ID
+	join        bool        // Node is joining an existing cluster
+	waldir      string      // path to WAL directory
+	snapdir     string      // path to snapshot directory
 	getSnapshot func() ([]byte, error)
 
 	confState     raftpb.ConfState
@@ -73,24 +94,96 @@ type RaftNode struct {
 	snapshotter      *snap.Snapshotter
 	snapshotterReady chan *snap.Snapshotter // signals when snapshotter is ready
 
-	snapCount uint64
+	opts      RaftOptions
 	transport *rafthttp.Transport
 	stopc     chan struct{} // signals proposal channel closed
 	httpstopc chan struct{} // signals http server to shutdown
 	httpdonec chan struct{} // signals http server shutdown complete
 
 	logger *zap.Logger
+
+	// linearizable reads
+	readID      atomic.Uint64          // ID of the last ReadIndex request
+	readMu      sync.Mutex             // protects readWaiters
+	readWaiters map[uint64]chan uint64 // ReadIndex requests waiting for their read index
+	appliedC    chan appliedBatch      // batches published to commitC, in order
+	applyWait   wait.WaitTime          // triggered with the index of the entries applied by the state machine
+	leaseExpire atomic.Int64           // unix nano until which the leadership of the node is known to be valid
+	leaderWait  time.Duration          // time a follower waits for the leader before starting an election
+
+	// membership changes
+	confSeq  atomic.Uint64 // sequence number of the last conf change proposed by ChangeMembership
+	confWait wait.Wait     // triggered with the sequence number of the conf changes applied
+	// raft drops a conf change proposed while another one is not applied yet,
+	// so ChangeMembership proposes one at a time
+	confMu sync.Mutex
+}
+
+// appliedBatch is a batch of entries published to commitC. The entries up to index are applied
+// to the state machine once done is closed.
+type appliedBatch struct {
+	done  <-chan struct{}
+	index uint64
+}
+
+// RaftOptions are the settings of a raft node.
+type RaftOptions struct {
+	Dir             string        // directory of the raft logs and snapshots, the working directory if empty
+	SnapCount       uint64        // applied entries between two snapshots
+	CatchUpEntries  uint64        // entries kept in memory after a snapshot, so slow followers catch up without it
+	TickInterval    time.Duration // duration of a raft tick
+	HeartbeatTicks  int           // ticks between the heartbeats of the leader
+	ElectionTicks   int           // ticks a follower waits for the leader before starting an election
+	MaxInflightMsgs int           // append messages sent to a follower without being acknowledged
+	MaxSizePerMsg   uint64        // size of the entries of an append message in bytes
+	MaxBatchSize    int           // proposals coalesced into a raft entry
+	MaxBatchDelay   time.Duration // time a proposal waits for others to join its entry
 }
 
-var defaultSnapshotCount uint64 = 10000
+// DefaultRaftOptions returns the settings used unless configured otherwise.
+func DefaultRaftOptions() RaftOptions {
+	return RaftOptions{
+		SnapCount:       10000,
+		CatchUpEntries:  10000,
+		TickInterval:    200 * time.Millisecond,
+		HeartbeatTicks:  1,
+		ElectionTicks:   10,
+		MaxInflightMsgs: 256,
+		MaxSizePerMsg:   1024 * 1024,
+		MaxBatchSize:    256,
+	}
+}
+
+// interval between the retries of a ReadIndex request, which raft drops when there is no leader
+const readIndexRetryInterval = 500 * time.Millisecond
+
+// ErrStopped is returned by the reads waiting on a stopped node.
+var ErrStopped = errors.New("raft node stopped")
 
 // NewRaftNode initiates a raft instance and returns a committed log entry
 // channel and error channel. Proposals for log updates are sent over the
 // provided the proposal channel. All log entries are replayed over the
-// RaftCommit channel, followed by a nil message (to indicate the channel is
-// current), then new log entries. To shutdown, close proposeC and read errorC.
+// RaftCommit channel, then new log entries, and the state machine closes the ApplyDoneC of each commit
+// once it's applied. To shutdown, close proposeC and read errorC.
 func NewRaftNode(id int, addr string, peers []string, join bool, getSnapshot func() ([]byte, error), proposeC <-chan *RaftProposal,
 	confChangeC <-chan raftpb.ConfChangeI) (<-chan *RaftCommit, <-chan error, <-chan *snap.Snapshotter, *RaftNode) {
+	return newRaftNode(fmt.Sprintf("raftexample-%d", id), DefaultRaftOptions(), id, addr, peers, join, getSnapshot, proposeC, confChangeC)
+}
+
+// NewRaftGroupNode is like NewRaftNode for the member of one of several raft groups running in a process,
+// with the given settings. The groups keep their logs in different directories, the first group keeping
+// the directories of NewRaftNode.
+func NewRaftGroupNode(group int, opts RaftOptions, id int, addr string, peers []string, join bool, getSnapshot func() ([]byte, error), proposeC <-chan *RaftProposal,
+	confChangeC <-chan raftpb.ConfChangeI) (<-chan *RaftCommit, <-chan error, <-chan *snap.Snapshotter, *RaftNode) {
+	name := fmt.Sprintf("raftexample-g%d-%d", group, id)
+	if group == 1 {
+		name = fmt.Sprintf("raftexample-%d", id)
+	}
+	return newRaftNode(name, opts, id, addr, peers, join, getSnapshot, proposeC, confChangeC)
+}
+
+func newRaftNode(name string, opts RaftOptions, id int, addr string, peers []string, join bool, getSnapshot func() ([]byte, error), proposeC <-chan *RaftProposal,
+	confChangeC <-chan raftpb.ConfChangeI) (<-chan *RaftCommit, <-chan error, <-chan *snap.Snapshotter, *RaftNode) {
 
 	commitC := make(chan *RaftCommit)
 	errorC := make(chan error)
@@ -102,11 +195,12 @@ func NewRaftNode(id int, addr string, peers []string, join bool, getSnapshot fun
 		errorC:      errorC,
 		id:          id,
 		Peers:       peers,
+		members:     newMembership(),
 		join:        join,
-		waldir:      fmt.Sprintf("raftexample-%d", id),
-		snapdir:     fmt.Sprintf("raftexample-%d-snap", id),
+		waldir:      filepath.Join(opts.Dir, name),
+		snapdir:     filepath.Join(opts.Dir, name+"-snap"),
 		getSnapshot: getSnapshot,
-		snapCount:   defaultSnapshotCount,
+		opts:        opts,
 		stopc:       make(chan struct{}),
 		httpstopc:   make(chan struct{}),
 		httpdonec:   make(chan struct{}),
@@ -114,6 +208,12 @@ func NewRaftNode(id int, addr string, peers []string, join bool, getSnapshot fun
 		logger: zap.NewExample(),
 
 		snapshotterReady: make(chan *snap.Snapshotter, 1),
+
+		readWaiters: make(map[uint64]chan uint64),
+		appliedC:    make(chan appliedBatch, 1024),
+		applyWait:   wait.NewTimeList(),
+		leaderWait:  time.Duration(opts.ElectionTicks) * opts.TickInterval,
+		confWait:    wait.New(),
 		// rest of structure populated after WAL replay
 	}
 	go rc.startRaft(addr)
@@ -167,49 +267,22 @@ func (rc *RaftNode) publishEntries(ents []raftpb.Entry) (<-chan struct{}, bool)
 				// ignore empty messages
 				break
 			}
-			var s = &RaftProposal{}
-			err := json.Unmarshal(ents[i].Data, s)
+			s, err := DecodeEntry(ents[i].Data)
 			if err != nil {
 				panic(err)
 			}
-			data = append(data, s)
+			data = append(data, s...)
 		case raftpb.EntryConfChange:
 			var cc raftpb.ConfChange
 			cc.Unmarshal(ents[i].Data)
-			rc.confState = *rc.Node.ApplyConfChange(cc)
-			switch cc.Type {
-			case raftpb.ConfChangeAddNode:
-				if len(cc.Context) > 0 {
-					peerURL := string(cc.Context)
-					rc.transport.AddPeer(types.ID(cc.NodeID), []string{peerURL})
-				}
-			case raftpb.ConfChangeRemoveNode:
-				if cc.NodeID == uint64(rc.id) {
-					log.Println("I've been removed from the cluster! Shutting down.")
-					return nil, false
-				}
-				rc.transport.RemovePeer(types.ID(cc.NodeID))
-				rc.Peers = append(rc.Peers[:cc.NodeID], rc.Peers[cc.NodeID+1:]...)
+			if !rc.applyConfChange(cc) {
+				return nil, false
 			}
 		case raftpb.EntryConfChangeV2:
 			var cc raftpb.ConfChangeV2
 			cc.Unmarshal(ents[i].Data)
-			rc.confState = *rc.Node.ApplyConfChange(cc)
-			for _, change := range cc.Changes {
-				switch change.Type {
-				case raftpb.ConfChangeAddNode:
-					if len(cc.Context) > 0 {
-						peerURL := string(cc.Context)
-						rc.transport.AddPeer(types.ID(change.NodeID), []string{peerURL})
-					}
-				case raftpb.ConfChangeRemoveNode:
-					if change.NodeID == uint64(rc.id) {
-						log.Println("I've been removed from the cluster! Shutting down.")
-						return nil, false
-					}
-					rc.transport.RemovePeer(types.ID(change.NodeID))
-					rc.Peers = append(rc.Peers[:change.NodeID], rc.Peers[change.NodeID+1:]...)
-				}
+			if !rc.applyConfChange(cc) {
+				return nil, false
 			}
 		}
 	}
@@ -219,7 +292,7 @@ func (rc *RaftNode) publishEntries(ents []raftpb.Entry) (<-chan struct{}, bool)
 	if len(data) > 0 {
 		applyDoneC = make(chan struct{}, 1)
 		select {
-		case rc.commitC <- &RaftCommit{data, applyDoneC}:
+		case rc.commitC <- &RaftCommit{Data: data, ApplyDoneC: applyDoneC}:
 		case <-rc.stopc:
 			return nil, false
 		}
@@ -227,6 +300,7 @@ func (rc *RaftNode) publishEntries(ents []raftpb.Entry) (<-chan struct{}, bool)
 
 	// after RaftCommit, update appliedIndex
 	rc.appliedIndex = ents[len(ents)-1].Index
+	rc.appliedC <- appliedBatch{done: applyDoneC, index: rc.appliedIndex}
 
 	return applyDoneC, true
 }
@@ -249,7 +323,7 @@ func (rc *RaftNode) loadSnapshot() *raftpb.Snapshot {
 // openWAL returns a WAL ready for reading.
 func (rc *RaftNode) openWAL(snapshot *raftpb.Snapshot) *wal.WAL {
 	if !wal.Exist(rc.waldir) {
-		if err := os.Mkdir(rc.waldir, 0750); err != nil {
+		if err := os.MkdirAll(rc.waldir, 0750); err != nil {
 			log.Fatalf("raftexample: cannot create dir for wal (%v)", err)
 		}
 
@@ -283,7 +357,11 @@ func (rc *RaftNode) replayWAL() *wal.WAL {
 		log.Fatalf("raftexample: failed to read WAL (%v)", err)
 	}
 	rc.raftStorage = raft.NewMemoryStorage()
+	rc.members.seed(rc.Peers)
 	if snapshot != nil {
+		if _, err := rc.members.restoreSnapshot(snapshot.Data); err != nil {
+			log.Fatalf("raftexample: failed to read the members of the snapshot (%v)", err)
+		}
 		rc.raftStorage.ApplySnapshot(*snapshot)
 	}
 	rc.raftStorage.SetHardState(st)
@@ -304,7 +382,7 @@ func (rc *RaftNode) writeError(err error) {
 
 func (rc *RaftNode) startRaft(addr string) {
 	if !fileutil.Exist(rc.snapdir) {
-		if err := os.Mkdir(rc.snapdir, 0750); err != nil {
+		if err := os.MkdirAll(rc.snapdir, 0750); err != nil {
 			log.Fatalf("raftexample: cannot create dir for snapshot (%v)", err)
 		}
 	}
@@ -313,9 +391,6 @@ func (rc *RaftNode) startRaft(addr string) {
 	oldwal := wal.Exist(rc.waldir)
 	rc.wal = rc.replayWAL()
 
-	// signal replay has finished
-	rc.snapshotterReady <- rc.snapshotter
-
 	// split peers
 	rpeers := make([]raft.Peer, len(rc.Peers))
 	for i := range rpeers {
@@ -323,12 +398,15 @@ func (rc *RaftNode) startRaft(addr string) {
 	}
 	c := &raft.Config{
 		ID:                        uint64(rc.id),
-		ElectionTick:              10,
-		HeartbeatTick:             1,
+		ElectionTick:              rc.opts.ElectionTicks,
+		HeartbeatTick:             rc.opts.HeartbeatTicks,
 		Storage:                   rc.raftStorage,
-		MaxSizePerMsg:             1024 * 1024,
-		MaxInflightMsgs:           256,
+		MaxSizePerMsg:             rc.opts.MaxSizePerMsg,
+		MaxInflightMsgs:           rc.opts.MaxInflightMsgs,
 		MaxUncommittedEntriesSize: 1 << 30,
+		// a leader that lost the quorum steps down, and the followers don't vote while they hear from the leader.
+		// the leader lease of LeaseRead relies on it.
+		CheckQuorum: true,
 	}
 
 	if oldwal || rc.join {
@@ -350,15 +428,19 @@ func (rc *RaftNode) startRaft(addr string) {
 	}
 
 	rc.transport.Start()
-	for i := range rc.Peers {
+	for _, m := range rc.members.list() {
 		// exclude self
-		if i+1 != rc.id && rc.Peers[i] != "" {
-			rc.transport.AddPeer(types.ID(i+1), []string{rc.Peers[i]})
+		if m.ID != uint64(rc.id) && validURL(m.URL) {
+			rc.transport.AddPeer(types.ID(m.ID), []string{m.URL})
 		}
 	}
 
 	go rc.serveRaft(addr)
+	go rc.serveApplied()
 	go rc.serveChannels()
+
+	// signal replay has finished and Node is ready to use
+	rc.snapshotterReady <- rc.snapshotter
 }
 
 // stop closes http, closes all channels, and stops raft.
@@ -386,17 +468,30 @@ func (rc *RaftNode) publishSnapshot(snapshotToSave raftpb.Snapshot) {
 	if snapshotToSave.Metadata.Index <= rc.appliedIndex {
 		log.Fatalf("snapshot index [%d] should > progress.appliedIndex [%d]", snapshotToSave.Metadata.Index, rc.appliedIndex)
 	}
-	rc.commitC <- nil // trigger kvstore to load snapshot
+	if _, err := rc.members.restoreSnapshot(snapshotToSave.Data); err != nil {
+		log.Fatalf("raftexample: failed to read the members of the snapshot (%v)", err)
+	}
+	for _, m := range rc.members.list() {
+		if m.ID != uint64(rc.id) && validURL(m.URL) {
+			rc.transport.AddPeer(types.ID(m.ID), []string{m.URL})
+		}
+	}
+	// the reads waiting for the entries of the snapshot are served once the state machine loaded it
+	applyDoneC := make(chan struct{}, 1)
+	select {
+	case rc.commitC <- &RaftCommit{Snapshot: true, ApplyDoneC: applyDoneC}:
+	case <-rc.stopc:
+		return
+	}
 
 	rc.confState = snapshotToSave.Metadata.ConfState
 	rc.snapshotIndex = snapshotToSave.Metadata.Index
 	rc.appliedIndex = snapshotToSave.Metadata.Index
+	rc.appliedC <- appliedBatch{done: applyDoneC, index: rc.appliedIndex}
 }
 
-var snapshotCatchUpEntriesN uint64 = 10000
-
 func (rc *RaftNode) maybeTriggerSnapshot(applyDoneC <-chan struct{}) {
-	if rc.appliedIndex-rc.snapshotIndex <= rc.snapCount {
+	if rc.appliedIndex-rc.snapshotIndex <= rc.opts.SnapCount {
 		return
 	}
 
@@ -414,6 +509,7 @@ func (rc *RaftNode) maybeTriggerSnapshot(applyDoneC <-chan struct{}) {
 	if err != nil {
 		log.Panic(err)
 	}
+	data = rc.members.wrapSnapshot(data)
 	snap, err := rc.raftStorage.CreateSnapshot(rc.appliedIndex, &rc.confState, data)
 	if err != nil {
 		panic(err)
@@ -423,8 +519,8 @@ func (rc *RaftNode) maybeTriggerSnapshot(applyDoneC <-chan struct{}) {
 	}
 
 	compactIndex := uint64(1)
-	if rc.appliedIndex > snapshotCatchUpEntriesN {
-		compactIndex = rc.appliedIndex - snapshotCatchUpEntriesN
+	if rc.appliedIndex > rc.opts.CatchUpEntries {
+		compactIndex = rc.appliedIndex - rc.opts.CatchUpEntries
 	}
 	if err := rc.raftStorage.Compact(compactIndex); err != nil {
 		panic(err)
@@ -442,10 +538,11 @@ func (rc *RaftNode) serveChannels() {
 	rc.confState = snap.Metadata.ConfState
 	rc.snapshotIndex = snap.Metadata.Index
 	rc.appliedIndex = snap.Metadata.Index
+	rc.applyWait.Trigger(rc.appliedIndex)
 
 	defer rc.wal.Close()
 
-	ticker := time.NewTicker(200 * time.Millisecond)
+	ticker := time.NewTicker(rc.opts.TickInterval)
 	defer ticker.Stop()
 
 	// send proposals over raft
@@ -455,11 +552,8 @@ func (rc *RaftNode) serveChannels() {
 		for rc.proposeC != nil && rc.confChangeC != nil {
 			select {
 			case proposal, ok := <-rc.proposeC:
-				if !ok {
+				if !ok || !rc.proposeBatch(proposal) {
 					rc.proposeC = nil
-				} else {
-					// blocks until accepted by raft state machine
-					rc.Node.Propose(context.TODO(), proposal.ToBytes())
 				}
 
 			case cc, ok := <-rc.confChangeC:
@@ -498,6 +592,7 @@ func (rc *RaftNode) serveChannels() {
 			}
 			rc.raftStorage.Append(rd.Entries)
 			rc.transport.Send(rc.processMessages(rd.Messages))
+			rc.publishReadStates(rd.ReadStates)
 			applyDoneC, ok := rc.publishEntries(rc.entriesToApply(rd.CommittedEntries))
 			if !ok {
 				rc.stop()
@@ -517,6 +612,45 @@ func (rc *RaftNode) serveChannels() {
 	}
 }
 
+// proposeBatch proposes first and the proposals sent after it as a single raft entry.
+// The proposals already waiting are coalesced, and more of them for up to MaxBatchDelay,
+// until the batch holds MaxBatchSize proposals or reaches MaxSizePerMsg bytes.
+// It returns false once proposeC is closed.
+func (rc *RaftNode) proposeBatch(first *RaftProposal) bool {
+	batch := [][]byte{first.ToBytes()}
+	size := uint64(len(batch[0]))
+	var timeout <-chan time.Time
+	if rc.opts.MaxBatchDelay > 0 {
+		timer := time.NewTimer(rc.opts.MaxBatchDelay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	open := true
+	for open && len(batch) < rc.opts.MaxBatchSize && size < rc.opts.MaxSizePerMsg {
+		var proposal *RaftProposal
+		if timeout == nil {
+			select {
+			case proposal, open = <-rc.proposeC:
+			default:
+			}
+		} else {
+			select {
+			case proposal, open = <-rc.proposeC:
+			case <-timeout:
+			}
+		}
+		if proposal == nil {
+			break
+		}
+		data := proposal.ToBytes()
+		batch = append(batch, data)
+		size += uint64(len(data))
+	}
+	// blocks until accepted by raft state machine
+	rc.Node.Propose(context.TODO(), encodeBatch(batch))
+	return open
+}
+
 // When there is a `raftpb.EntryConfChange` after creating the snapshot,
 // then the confState included in the snapshot is out of date. so We need
 // to update the confState before sending a snapshot to a follower.
@@ -549,19 +683,161 @@ func (rc *RaftNode) serveRaft(addr string) {
 	close(rc.httpdonec)
 }
 
+// serveApplied triggers applyWait as the state machine applies the published batches.
+// The batches are applied in order, so are they waited for.
+func (rc *RaftNode) serveApplied() {
+	for {
+		select {
+		case batch := <-rc.appliedC:
+			if batch.done != nil {
+				select {
+				case <-batch.done:
+				case <-rc.stopc:
+					return
+				}
+			}
+			rc.applyWait.Trigger(batch.index)
+		case <-rc.stopc:
+			return
+		}
+	}
+}
+
+// publishReadStates hands the read indexes confirmed by raft to the waiting ReadIndex requests.
+func (rc *RaftNode) publishReadStates(states []raft.ReadState) {
+	rc.readMu.Lock()
+	defer rc.readMu.Unlock()
+	for _, state := range states {
+		if len(state.RequestCtx) != 8 {
+			continue
+		}
+		if ch, ok := rc.readWaiters[binary.BigEndian.Uint64(state.RequestCtx)]; ok {
+			select {
+			case ch <- state.Index:
+			default:
+			}
+		}
+	}
+}
+
+// ReadIndex waits until the local state machine applied every entry committed when it was called,
+// so that a read served locally afterwards is linearizable. The leader confirms its leadership with
+// a quorum of the cluster for every call.
+func (rc *RaftNode) ReadIndex(ctx context.Context) error {
+	id := rc.readID.Add(1)
+	rctx := make([]byte, 8)
+	binary.BigEndian.PutUint64(rctx, id)
+	ch := make(chan uint64, 1)
+	rc.readMu.Lock()
+	rc.readWaiters[id] = ch
+	rc.readMu.Unlock()
+	defer func() {
+		rc.readMu.Lock()
+		delete(rc.readWaiters, id)
+		rc.readMu.Unlock()
+	}()
+
+	sent := time.Now()
+	if err := rc.Node.ReadIndex(ctx, rctx); err != nil {
+		return err
+	}
+	retry := time.NewTicker(readIndexRetryInterval)
+	defer retry.Stop()
+	for {
+		select {
+		case index := <-ch:
+			// the leadership was valid when the request was sent, and no other leader can be elected
+			// before the followers stop hearing from this one
+			if rc.IsLeader() {
+				rc.leaseExpire.Store(sent.Add(rc.leaderWait / 2).UnixNano())
+			}
+			return rc.waitApplied(ctx, index)
+		case <-retry.C:
+			if err := rc.Node.ReadIndex(ctx, rctx); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-rc.stopc:
+			return ErrStopped
+		}
+	}
+}
+
+// LeaseRead is like ReadIndex but skips the confirmation with the quorum while the leader lease of the node
+// is valid. It relies on the clocks of the nodes running at about the same rate. Followers hold no lease
+// and always confirm with the leader.
+func (rc *RaftNode) LeaseRead(ctx context.Context) error {
+	if time.Now().UnixNano() < rc.leaseExpire.Load() && rc.IsLeader() {
+		return rc.waitApplied(ctx, rc.Node.Status().Commit)
+	}
+	return rc.ReadIndex(ctx)
+}
+
+// Snapshot returns the latest snapshot of the node. The state machine restores it when the node starts
+// and when commitC yields nil, after the node received a snapshot from the leader.
+// The data of the snapshot is the one of the state machine, without the members of the group.
+func (rc *RaftNode) Snapshot() (raftpb.Snapshot, error) {
+	snapshot, err := rc.raftStorage.Snapshot()
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot.Data = snapshotData(snapshot.Data)
+	return snapshot, nil
+}
+
+func (rc *RaftNode) IsLeader() bool {
+	return rc.Node.Status().RaftState == raft.StateLeader
+}
+
+// Leader returns the ID of the current leader known by the node, or raft.None during an election.
+func (rc *RaftNode) Leader() uint64 {
+	return rc.Node.Status().Lead
+}
+
+// ID returns the raft ID of the node.
+func (rc *RaftNode) ID() uint64 {
+	return uint64(rc.id)
+}
+
+// CommittedIndex returns the index of the last entry the node knows to be committed.
+func (rc *RaftNode) CommittedIndex() uint64 {
+	return rc.Node.Status().Commit
+}
+
+// Replicated returns the number of voters other than this node whose log holds the entries up to index.
+// Only the leader tracks the logs of the other members, so it must be called on the leader.
+func (rc *RaftNode) Replicated(index uint64) (int, error) {
+	status := rc.Node.Status()
+	if status.RaftState != raft.StateLeader {
+		return 0, ErrNotLeader
+	}
+	n := 0
+	for id := range status.Config.Voters.IDs() {
+		if id != status.ID && status.Progress[id].Match >= index {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// waitApplied waits until the state machine applied the entries up to index.
+func (rc *RaftNode) waitApplied(ctx context.Context, index uint64) error {
+	select {
+	case <-rc.applyWait.Wait(index):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-rc.stopc:
+		return ErrStopped
+	}
+}
+
 func (rc *RaftNode) Process(ctx context.Context, m raftpb.Message) error {
 	return rc.Node.Step(ctx, m)
 }
-func (rc *RaftNode) IsIDRemoved(id uint64) bool  { return false }
+func (rc *RaftNode) IsIDRemoved(id uint64) bool  { return rc.members.isRemoved(id) }
 func (rc *RaftNode) ReportUnreachable(id uint64) { rc.Node.ReportUnreachable(id) }
 func (rc *RaftNode) ReportSnapshot(id uint64, status raft.SnapshotStatus) {
 	rc.Node.ReportSnapshot(id, status)
 }
-
-func (p *RaftProposal) ToBytes() []byte {
-	res, err := json.Marshal(p)
-	if err != nil {
-		panic(err)
-	}
-	return res
-}
@@ -15,9 +15,15 @@
 package raftexample
 
 import (
+	"bytes"
+	"context"
+	"net"
+	"os"
 	"reflect"
 	"testing"
+	"time"
 
+	"go.etcd.io/etcd/pkg/v3/wait"
 	"go.etcd.io/etcd/raft/v3/raftpb"
 )
 
@@ -128,3 +134,104 @@ func TestProcessMessages(t *testing.T) {
 		})
 	}
 }
+
+func TestPublishSnapshot(t *testing.T) {
+	commitC := make(chan *RaftCommit)
+	rc := &RaftNode{
+		commitC:   commitC,
+		members:   newMembership(),
+		stopc:     make(chan struct{}),
+		appliedC:  make(chan appliedBatch, 16),
+		applyWait: wait.NewTimeList(),
+	}
+	defer close(rc.stopc)
+	go rc.serveApplied()
+	go rc.publishSnapshot(raftpb.Snapshot{Data: []byte("data"), Metadata: raftpb.SnapshotMetadata{Index: 10}})
+
+	commit := <-commitC
+	if !commit.Snapshot {
+		t.Fatalf("commit %+v is not a snapshot", commit)
+	}
+	// the entries of the snapshot are not applied until the state machine loaded it
+	select {
+	case <-rc.applyWait.Wait(10):
+		t.Fatal("the snapshot is applied before the state machine loaded it")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(commit.ApplyDoneC)
+	select {
+	case <-rc.applyWait.Wait(10):
+	case <-time.After(5 * time.Second):
+		t.Fatal("the snapshot is not applied after the state machine loaded it")
+	}
+}
+
+func TestReadIndex(t *testing.T) {
+	// the raft node keeps its wal and snapshots in the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := "http://" + ln.Addr().String()
+	ln.Close()
+
+	proposeC := make(chan *RaftProposal)
+	confChangeC := make(chan raftpb.ConfChangeI)
+	getSnapshot := func() ([]byte, error) { return nil, nil }
+	commitC, errorC, snapshotterReady, rc := NewRaftNode(1, peer, []string{peer}, false, getSnapshot, proposeC, confChangeC)
+	<-snapshotterReady
+	applied := make(chan string, 16)
+	go func() {
+		for commit := range commitC {
+			// a slow state machine, the reads must wait for it
+			time.Sleep(100 * time.Millisecond)
+			for _, proposal := range commit.Data {
+				applied <- string(bytes.Join(proposal.Args, []byte(" ")))
+			}
+			close(commit.ApplyDoneC)
+		}
+	}()
+	defer func() {
+		close(proposeC)
+		for range errorC {
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// waits for the election of the node
+	if err := rc.ReadIndex(ctx); err != nil {
+		t.Fatalf("ReadIndex error: %v", err)
+	}
+	committed := rc.Node.Status().Commit
+	proposeC <- &RaftProposal{ID: "1", Args: [][]byte{[]byte("set"), []byte("k"), []byte("v")}}
+	// the read index covers the proposal once it's committed, so the read waits until it's applied
+	for rc.Node.Status().Commit == committed {
+		time.Sleep(time.Millisecond)
+	}
+	if err := rc.ReadIndex(ctx); err != nil {
+		t.Fatalf("ReadIndex error: %v", err)
+	}
+	select {
+	case data := <-applied:
+		if data != "set k v" {
+			t.Fatalf("applied %q, expected %q", data, "set k v")
+		}
+	default:
+		t.Fatal("ReadIndex returned before the proposal was applied")
+	}
+	if !rc.IsLeader() || rc.leaseExpire.Load() <= time.Now().UnixNano() {
+		t.Fatal("ReadIndex on the leader should extend its lease")
+	}
+	if err := rc.LeaseRead(ctx); err != nil {
+		t.Fatalf("LeaseRead error: %v", err)
+	}
+}
@@ -2,9 +2,8 @@ package resp
 
 import (
 	"bufio"
+	"bytes"
 	"context"
-	"errors"
-	"fmt"
 	"io"
 	"strconv"
 
@@ -14,22 +13,81 @@ import (
 // resp package for parsing redis serialization protocol.
 // Check https://redis.io/docs/reference/protocol-spec/ for the protocol details.
 
+// ProtocolError is the error of a malformed message. The stream can't be parsed any further after it,
+// so the server replies with it and closes the connection.
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
 type ParsedRes struct {
 	Data RedisData
 	Err  error
 }
 
+// Limits bounds the messages of a stream, so that a client can't make the server allocate more memory than
+// configured by announcing a huge bulk string or array. The zero value of a limit means its default.
+type Limits struct {
+	MaxBulkLen     int64 // size in bytes of the largest bulk string
+	MaxMultiBulk   int   // number of elements of the largest array
+	MaxQueryBuffer int64 // size in bytes of the largest message
+}
+
+// DefaultLimits are the limits of Redis: proto-max-bulk-len 512mb and client-query-buffer-limit 1gb.
+var DefaultLimits = Limits{
+	MaxBulkLen:     512 * 1024 * 1024,
+	MaxMultiBulk:   1024 * 1024,
+	MaxQueryBuffer: 1024 * 1024 * 1024,
+}
+
+const (
+	// maxInlineLen bounds the lines: the inline commands and the headers, like PROTO_INLINE_MAX_SIZE of Redis.
+	maxInlineLen = 64 * 1024
+	// bulkPreallocLen is the size of the bulk strings read into a buffer allocated at once. The larger ones
+	// are read into a growing buffer, so the memory is only allocated as the data arrives.
+	bulkPreallocLen = 64 * 1024
+)
+
+// orDefault replaces the unset limits by the defaults.
+func (l Limits) orDefault() Limits {
+	if l.MaxBulkLen <= 0 {
+		l.MaxBulkLen = DefaultLimits.MaxBulkLen
+	}
+	if l.MaxMultiBulk <= 0 {
+		l.MaxMultiBulk = DefaultLimits.MaxMultiBulk
+	}
+	if l.MaxQueryBuffer <= 0 {
+		l.MaxQueryBuffer = DefaultLimits.MaxQueryBuffer
+	}
+	return l
+}
+
 type readState struct {
 	bulkLen   int64
 	arrayLen  int
 	multiLine bool
 	arrayData *ArrayData
 	inArray   bool
+	queryLen  int64 // bytes read of the current message
+	limits    Limits
+}
+
+// reset prepares the state for the next message.
+func (s *readState) reset() {
+	*s = readState{limits: s.limits}
 }
 
 func ParseStream(ctx context.Context, reader io.Reader) <-chan *ParsedRes {
+	return ParseStreamWithLimits(ctx, reader, DefaultLimits)
+}
+
+// ParseStreamWithLimits is ParseStream with the limits of the messages of a client.
+func ParseStreamWithLimits(ctx context.Context, reader io.Reader, limits Limits) <-chan *ParsedRes {
 	ch := make(chan *ParsedRes)
-	go parse(ctx, reader, ch)
+	go parse(ctx, reader, ch, limits)
 	return ch
 }
 
@@ -53,9 +111,9 @@ func ReadAll(r io.Reader) ([]byte, error) {
 	}
 }
 
-func parse(ctx context.Context, reader io.Reader, ch chan<- *ParsedRes) {
+func parse(ctx context.Context, reader io.Reader, ch chan<- *ParsedRes, limits Limits) {
 	bufReader := bufio.NewReaderSize(reader, 4096) // 4096 is the default bufio buffer size, might change to a smaller number by configuration
-	state := new(readState)
+	state := &readState{limits: limits}
 	for {
 		// continuously read until client sent EOF to disconnect
 		var res RedisData
@@ -72,20 +130,19 @@ func parse(ctx context.Context, reader io.Reader, ch chan<- *ParsedRes) {
 				}
 				close(ch)
 				return
-			} else {
-				// server side shut down
-				if ctx.Err() != nil {
-					close(ch)
-					return
-				}
-				// Protocol error
-				logger.Error(err)
-				ch <- &ParsedRes{
-					Err: err,
-				}
-				*state = readState{}
 			}
-			continue
+			// server side shut down
+			if ctx.Err() != nil {
+				close(ch)
+				return
+			}
+			// Protocol error, the start of the next message can't be found after it
+			logger.Error(err)
+			ch <- &ParsedRes{
+				Err: err,
+			}
+			close(ch)
+			return
 		}
 		// parse the read messages
 		// if msg is an array or a bulk string, then parse their header first.
@@ -101,20 +158,21 @@ func parse(ctx context.Context, reader io.Reader, ch chan<- *ParsedRes) {
 					ch <- &ParsedRes{
 						Err: err,
 					}
-					*state = readState{}
+					close(ch)
+					return
 				} else {
 					if state.arrayLen == -1 {
 						// null array
 						ch <- &ParsedRes{
 							Data: MakeArrayData(nil),
 						}
-						*state = readState{}
+						state.reset()
 					} else if state.arrayLen == 0 {
 						// empty array
 						ch <- &ParsedRes{
 							Data: MakeArrayData([]RedisData{}),
 						}
-						*state = readState{}
+						state.reset()
 					}
 				}
 				// continue to read the array elements
@@ -128,7 +186,8 @@ func parse(ctx context.Context, reader io.Reader, ch chan<- *ParsedRes) {
 					ch <- &ParsedRes{
 						Err: err,
 					}
-					*state = readState{}
+					close(ch)
+					return
 				} else {
 					if state.bulkLen == -1 {
 						// null bulk string (nil)
@@ -143,19 +202,30 @@ func parse(ctx context.Context, reader io.Reader, ch chan<- *ParsedRes) {
 									Data: state.arrayData,
 									Err:  nil,
 								}
-								*state = readState{}
+								state.reset()
 							}
 						} else {
 							ch <- &ParsedRes{
 								Data: res,
 							}
+							state.reset()
 						}
 					}
 				}
 				continue
 			default:
-				// text (not been used)
-				res, err = parseSingleLine(msg)
+				if state.inArray || msg[0] == '+' || msg[0] == '-' || msg[0] == ':' {
+					// the elements of nested arrays and the single line replies
+					res, err = parseSingleLine(msg)
+				} else {
+					// inline command, as typed in telnet
+					res, err = parseInline(msg)
+					if err == nil && res == nil {
+						// empty line
+						state.reset()
+						continue
+					}
+				}
 			}
 		} else {
 			// parse multiple lines: bulk string (binary safe)
@@ -170,8 +240,8 @@ func parse(ctx context.Context, reader io.Reader, ch chan<- *ParsedRes) {
 			ch <- &ParsedRes{
 				Err: err,
 			}
-			*state = readState{}
-			continue
+			close(ch)
+			return
 		}
 
 		// Struct parsed data as an array or a single data, and put it into channel.
@@ -184,7 +254,7 @@ func parse(ctx context.Context, reader io.Reader, ch chan<- *ParsedRes) {
 					Data: state.arrayData,
 					Err:  nil,
 				}
-				*state = readState{}
+				state.reset()
 				continue
 			}
 		} else {
@@ -193,6 +263,7 @@ func parse(ctx context.Context, reader io.Reader, ch chan<- *ParsedRes) {
 				Data: res,
 				Err:  err,
 			}
+			state.reset()
 		}
 
 	}
@@ -208,25 +279,46 @@ func readLine(reader *bufio.Reader, state *readState) ([]byte, error) {
 	var err error
 	if state.multiLine && state.bulkLen >= 0 {
 		// read bulk line, binary safety. read exactly {bulkLen} bytes from the reader.
-		msg = make([]byte, state.bulkLen+2) // +2 is for the space of "\r\n"
-		_, err = io.ReadFull(reader, msg)
+		n := state.bulkLen + 2 // +2 is for the space of "\r\n"
+		if n <= bulkPreallocLen {
+			msg = make([]byte, n)
+			_, err = io.ReadFull(reader, msg)
+		} else {
+			buf := bytes.NewBuffer(make([]byte, 0, bulkPreallocLen))
+			_, err = io.CopyN(buf, reader, n)
+			msg = buf.Bytes()
+		}
 		if err != nil {
 			return nil, err
 		}
 		state.bulkLen = 0
 		if msg[len(msg)-1] != '\n' || msg[len(msg)-2] != '\r' {
-			return nil, errors.New(fmt.Sprintf("Protocol error. Stream message %s is invalid.", string(msg)))
+			return nil, &ProtocolError{"invalid bulk string ending"}
 		}
 	} else {
-		// read normal line
-		msg, err = reader.ReadBytes('\n')
-		if err != nil {
-			return msg, err
+		// read normal line, at most maxInlineLen bytes
+		for {
+			line, err := reader.ReadSlice('\n')
+			msg = append(msg, line...)
+			if len(msg) > maxInlineLen+2 {
+				return nil, &ProtocolError{"too big inline request"}
+			}
+			if err == nil {
+				break
+			}
+			if err != bufio.ErrBufferFull {
+				return msg, err
+			}
 		}
-		if len(msg) == 0 || msg[len(msg)-2] != '\r' {
-			return nil, errors.New(fmt.Sprintf("Protocol error. Stream message %s is invalid.", string(msg)))
+		if len(msg) < 2 || msg[len(msg)-2] != '\r' {
+			// the lines typed in telnet may end with "\n" alone
+			msg = append(msg[:len(msg)-1], '\r', '\n')
 		}
 	}
+	state.queryLen += int64(len(msg))
+	if state.queryLen > state.limits.orDefault().MaxQueryBuffer {
+		return nil, &ProtocolError{"query buffer limit reached"}
+	}
 	return msg, nil
 }
 
@@ -234,7 +326,7 @@ func parseSingleLine(msg []byte) (RedisData, error) {
 	// msg is like "*This is a string. \r\n"
 	msgType := msg[0]
 	if len(msg) < 3 {
-		return nil, errors.New("msg too short, possibly due to a http connection to redis port. ")
+		return nil, &ProtocolError{"message too short"}
 	}
 	// the actual string content without the first indicator and \r\n at the end
 	msgData := string(msg[1 : len(msg)-2])
@@ -252,7 +344,7 @@ func parseSingleLine(msg []byte) (RedisData, error) {
 		data, err := strconv.ParseInt(msgData, 10, 64)
 		if err != nil {
 			logger.Error("Cant phrase int64 from " + msgData + " where error: " + string(msg))
-			return nil, err
+			return nil, &ProtocolError{"invalid integer"}
 		}
 		res = MakeIntData(data)
 	default:
@@ -262,7 +354,7 @@ func parseSingleLine(msg []byte) (RedisData, error) {
 	// likely never be nil
 	if res == nil {
 		logger.Error("Protocol error: parseSingleLine get nil data")
-		return nil, errors.New("Protocol error: " + string(msg))
+		return nil, &ProtocolError{"invalid message"}
 	}
 	return res, nil
 }
@@ -270,7 +362,7 @@ func parseSingleLine(msg []byte) (RedisData, error) {
 // parseMultiLine parses the second part of a single command string. i.e. the "incr\r\n" in "$4\r\nincr\r\n"
 func parseMultiLine(msg []byte) (RedisData, error) {
 	if len(msg) < 2 {
-		return nil, errors.New("protocol error: invalid bulk string")
+		return nil, &ProtocolError{"invalid bulk string"}
 	}
 	// discard "\r\n" at the end
 	msgData := msg[:len(msg)-2]
@@ -278,11 +370,121 @@ func parseMultiLine(msg []byte) (RedisData, error) {
 	return res, nil
 }
 
+// parseInline parses an inline command, the arguments separated by spaces of a line like "SET key \"a value\"\r\n".
+// The arguments may be quoted like in redis-cli: double-quoted strings support the escapes \n, \r, \t, \b, \a
+// and \xhh, and single-quoted strings only \'. It returns nil for an empty line.
+func parseInline(msg []byte) (RedisData, error) {
+	args, err := splitArgs(msg[:len(msg)-2])
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, nil
+	}
+	data := make([]RedisData, 0, len(args))
+	for _, arg := range args {
+		data = append(data, MakeBulkData(arg))
+	}
+	return MakeArrayData(data), nil
+}
+
+// splitArgs splits a line into arguments like sdssplitargs of Redis.
+func splitArgs(line []byte) ([][]byte, error) {
+	args := make([][]byte, 0)
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		arg := make([]byte, 0)
+		inq, insq := false, false // in double quotes, in single quotes
+		for done := false; !done; {
+			if i == len(line) {
+				if inq || insq {
+					return nil, &ProtocolError{"unbalanced quotes in request"}
+				}
+				break
+			}
+			c := line[i]
+			switch {
+			case inq:
+				if c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+					b, _ := strconv.ParseUint(string(line[i+2:i+4]), 16, 8)
+					arg = append(arg, byte(b))
+					i += 3
+				} else if c == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						arg = append(arg, '\n')
+					case 'r':
+						arg = append(arg, '\r')
+					case 't':
+						arg = append(arg, '\t')
+					case 'b':
+						arg = append(arg, '\b')
+					case 'a':
+						arg = append(arg, '\a')
+					default:
+						arg = append(arg, line[i])
+					}
+				} else if c == '"' {
+					// the closing quote must be followed by a space or nothing
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, &ProtocolError{"unbalanced quotes in request"}
+					}
+					done = true
+				} else {
+					arg = append(arg, c)
+				}
+			case insq:
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					arg = append(arg, '\'')
+					i++
+				} else if c == '\'' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, &ProtocolError{"unbalanced quotes in request"}
+					}
+					done = true
+				} else {
+					arg = append(arg, c)
+				}
+			default:
+				switch c {
+				case ' ', '\n', '\r', '\t', '\v', '\f':
+					done = true
+				case '"':
+					inq = true
+				case '\'':
+					insq = true
+				default:
+					arg = append(arg, c)
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		args = append(args, arg)
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\v' || c == '\f'
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
 func parseArrayHeader(msg []byte, state *readState) error {
 	// get the array length
 	arrayLen, err := strconv.Atoi(string(msg[1 : len(msg)-2]))
-	if err != nil || arrayLen < 0 {
-		return errors.New("Protocol error: " + string(msg))
+	if err != nil || arrayLen < -1 || arrayLen > state.limits.orDefault().MaxMultiBulk {
+		return &ProtocolError{"invalid multibulk length"}
 	}
 	state.arrayLen = arrayLen
 	state.inArray = true
@@ -294,8 +496,12 @@ func parseBulkHeader(msg []byte, state *readState) error {
 	// typically read bulk string which might contains "\r\n"
 	// get length
 	bulkLen, err := strconv.ParseInt(string(msg[1:len(msg)-2]), 10, 64)
-	if err != nil || bulkLen < -1 {
-		return errors.New("Protocol error: " + string(msg))
+	if err != nil || bulkLen < -1 || bulkLen > state.limits.orDefault().MaxBulkLen {
+		return &ProtocolError{"invalid bulk length"}
+	}
+	// the bulk string is not read if it would exceed the query buffer limit
+	if state.queryLen+bulkLen+2 > state.limits.orDefault().MaxQueryBuffer {
+		return &ProtocolError{"query buffer limit reached"}
 	}
 	// indicate length and indicate the read function not to stop when encountering "\r\n" till the length exhausted.
 	state.bulkLen = bulkLen
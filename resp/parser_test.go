@@ -295,3 +295,193 @@ func TestParseStream(t *testing.T) {
 		k++
 	}
 }
+
+func TestParseInline(t *testing.T) {
+	tests := []struct {
+		line string
+		args []string
+	}{
+		{"PING\r\n", []string{"PING"}},
+		{"  set key  value \r\n", []string{"set", "key", "value"}},
+		{"set \"a key\" 'a value'\r\n", []string{"set", "a key", "a value"}},
+		{"set k \"\\x41\\n\\\"\\q\"\r\n", []string{"set", "k", "A\n\"q"}},
+		{"set k 'it\\'s \\n'\r\n", []string{"set", "k", "it's \\n"}},
+		{"set k \"\"\r\n", []string{"set", "k", ""}},
+	}
+	for _, test := range tests {
+		res, err := parseInline([]byte(test.line))
+		if err != nil {
+			t.Error(fmt.Sprintf("parseInline(%q) error: %v", test.line, err))
+			continue
+		}
+		cmd := res.(*ArrayData).ToCommand()
+		if len(cmd) != len(test.args) {
+			t.Error(fmt.Sprintf("parseInline(%q) == %q | expect: %q", test.line, cmd, test.args))
+			continue
+		}
+		for i, arg := range test.args {
+			if string(cmd[i]) != arg {
+				t.Error(fmt.Sprintf("parseInline(%q) == %q | expect: %q", test.line, cmd, test.args))
+			}
+		}
+	}
+	res, err := parseInline([]byte(" \t\r\n"))
+	if res != nil || err != nil {
+		t.Error(fmt.Sprintf("parseInline(empty line) == %v, %v | expect: nil, nil", res, err))
+	}
+	for _, line := range []string{"set k \"v\r\n", "set k 'v\r\n", "set k \"v\"x\r\n", "set k 'v'x\r\n"} {
+		if res, err := parseInline([]byte(line)); res != nil || err == nil {
+			t.Error(fmt.Sprintf("parseInline(%q) == %v, %v | expect: nil, error", line, res, err))
+		}
+	}
+}
+
+func TestParseStreamInline(t *testing.T) {
+	data := []byte("PING\n\r\nset k 'v'\r\n*1\r\n$4\r\nPING\r\nget \"k\r\n")
+	ch := ParseStream(context.Background(), bytes.NewReader(data))
+	var cmds []string
+	var err error
+	for parseRes := range ch {
+		if parseRes.Err != nil {
+			err = parseRes.Err
+			break
+		}
+		cmds = append(cmds, string(bytes.Join(parseRes.Data.(*ArrayData).ToCommand(), []byte(" "))))
+	}
+	if len(cmds) != 3 || cmds[0] != "PING" || cmds[1] != "set k v" || cmds[2] != "PING" {
+		t.Error(fmt.Sprintf("parsed commands == %q | expect: PING, set k v, PING", cmds))
+	}
+	// the stream ends at a protocol error
+	if _, ok := err.(*ProtocolError); !ok {
+		t.Error(fmt.Sprintf("parse error == %v | expect: protocol error", err))
+	}
+	if _, ok := <-ch; ok {
+		t.Error("the stream should be closed after a protocol error")
+	}
+}
+
+func TestParseStreamLimits(t *testing.T) {
+	limits := Limits{MaxBulkLen: 16, MaxMultiBulk: 3, MaxQueryBuffer: 64}
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{"*1\r\n$17\r\n", "Protocol error: invalid bulk length"},
+		{"$9999999999\r\n", "Protocol error: invalid bulk length"},
+		{"*4\r\n", "Protocol error: invalid multibulk length"},
+		{"*3\r\n$16\r\n0123456789abcdef\r\n$16\r\n0123456789abcdef\r\n$16\r\n", "Protocol error: query buffer limit reached"},
+		{string(bytes.Repeat([]byte("a"), maxInlineLen+1)) + "\r\n", "Protocol error: too big inline request"},
+	}
+	for _, test := range tests {
+		ch := ParseStreamWithLimits(context.Background(), bytes.NewReader([]byte(test.data)), limits)
+		parseRes := <-ch
+		if parseRes.Err == nil || parseRes.Err.Error() != test.err {
+			t.Error(fmt.Sprintf("parse(%.20q) == %v, %v | expect: %s", test.data, parseRes.Data, parseRes.Err, test.err))
+		}
+	}
+
+	// the limits apply to each message, not to the whole stream
+	data := bytes.Repeat([]byte("*2\r\n$3\r\nget\r\n$16\r\n0123456789abcdef\r\n"), 10)
+	n := 0
+	for parseRes := range ParseStreamWithLimits(context.Background(), bytes.NewReader(data), limits) {
+		if parseRes.Err != nil {
+			if parseRes.Err != io.EOF {
+				t.Error(parseRes.Err)
+			}
+			break
+		}
+		n++
+	}
+	if n != 10 {
+		t.Error(fmt.Sprintf("parsed %d messages | expect: 10", n))
+	}
+
+	// the large bulk strings are read as they arrive
+	value := bytes.Repeat([]byte("v"), 3*bulkPreallocLen)
+	data = MakeArrayData([]RedisData{MakeBulkData([]byte("set")), MakeBulkData([]byte("k")), MakeBulkData(value)}).ToBytes()
+	parseRes := <-ParseStream(context.Background(), bytes.NewReader(data))
+	if parseRes.Err != nil || !bytes.Equal(parseRes.Data.(*ArrayData).ToCommand()[2], value) {
+		t.Error(fmt.Sprintf("parse large bulk string error: %v", parseRes.Err))
+	}
+}
+
+// FuzzParseStream checks that the parser never panics nor hangs on any input, and that the commands
+// it returns are encoded back into the same commands.
+func FuzzParseStream(f *testing.F) {
+	seeds := []string{
+		"*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n",
+		"*-1\r\n*0\r\n$-1\r\n",
+		"*2\r\n*3\r\n:1\r\n:2\r\n:3\r\n*2\r\n+Hello\r\n-World\r\n",
+		"PING\r\nset k \"a\\x41\\n\" 'b\\'c'\n",
+		"*1\r\n$9999999999\r\n",
+		"$3\r\nabc\r\n:2a\r\n",
+		"set k \"v\r\n",
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+	limits := Limits{MaxBulkLen: 1024, MaxMultiBulk: 64, MaxQueryBuffer: 4096}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for parseRes := range ParseStreamWithLimits(context.Background(), bytes.NewReader(data), limits) {
+			if parseRes.Err != nil {
+				break
+			}
+			array, ok := parseRes.Data.(*ArrayData)
+			if !ok || array.Data() == nil {
+				continue
+			}
+			cmd := array.ToCommand()
+			args := make([]RedisData, 0, len(cmd))
+			for _, arg := range cmd {
+				args = append(args, MakeBulkData(arg))
+			}
+			again := <-ParseStream(context.Background(), bytes.NewReader(MakeArrayData(args).ToBytes()))
+			if again.Err != nil {
+				t.Fatalf("parse %q again error: %v", cmd, again.Err)
+			}
+			cmdAgain := again.Data.(*ArrayData).ToCommand()
+			if len(cmdAgain) != len(cmd) {
+				t.Fatalf("parse %q again == %q", cmd, cmdAgain)
+			}
+			for i := range cmd {
+				if !bytes.Equal(cmd[i], cmdAgain[i]) {
+					t.Fatalf("parse %q again == %q", cmd, cmdAgain)
+				}
+			}
+		}
+	})
+}
+
+// FuzzParseInline checks that the arguments of an inline command, once quoted, are parsed into themselves.
+func FuzzParseInline(f *testing.F) {
+	for _, seed := range []string{"PING", "set k v", "set \"a b\" 'c d'", "\"\\x4a\\t\\\"\"", "'\\''", "a\"b c\"", "\"v"} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		args, err := splitArgs(line)
+		if err != nil {
+			return
+		}
+		quoted := make([]byte, 0)
+		for _, arg := range args {
+			quoted = append(quoted, '"')
+			for _, c := range arg {
+				if c == '"' || c == '\\' || c < ' ' || c > '~' {
+					quoted = append(quoted, []byte(fmt.Sprintf("\\x%02x", c))...)
+				} else {
+					quoted = append(quoted, c)
+				}
+			}
+			quoted = append(quoted, '"', ' ')
+		}
+		again, err := splitArgs(quoted)
+		if err != nil || len(again) != len(args) {
+			t.Fatalf("splitArgs(%q) == %q, %v | expect: %q", quoted, again, err, args)
+		}
+		for i := range args {
+			if !bytes.Equal(args[i], again[i]) {
+				t.Fatalf("splitArgs(%q) == %q | expect: %q", quoted, again, args)
+			}
+		}
+	})
+}
@@ -0,0 +1,330 @@
+package resp
+
+import (
+	"bytes"
+	"io"
+)
+
+// reader.go implements Reader, which reads the commands of a client straight from a buffer reused across commands.
+// Unlike ParseStream it runs in the goroutine of its caller and returns the arguments of the commands without
+// wrapping them into RedisData, so that a pipeline of commands costs neither a goroutine switch nor an allocation
+// per argument.
+
+const (
+	// readerBufSize is the initial size of the buffer of a Reader.
+	readerBufSize = 16 * 1024
+	// readerMaxIdleBuf is the size above which the buffer is released once the commands in it are served.
+	readerMaxIdleBuf = 4 * readerBufSize
+	// bigArgLen is the length from which an argument is read into its own slice instead of the buffer,
+	// directly from the connection once the buffer is drained.
+	bigArgLen = 32 * 1024
+	// maxEmptyReads is the number of reads returning no data and no error after which a Reader gives up.
+	maxEmptyReads = 100
+)
+
+// Reader reads the commands of a client: arrays of bulk strings or inline commands.
+// The commands are parsed in a buffer reused across commands, and each command is copied out of it at once:
+// the small arguments of a command share a single allocation, and the large ones are read into their own slices.
+// The arguments belong to the caller, they are not modified by the next reads.
+type Reader struct {
+	rd     io.Reader
+	limits Limits
+	buf    []byte
+	r, w   int // buf[r:w] is read from rd but not parsed yet
+	// the command being parsed, which may span several reads
+	start   int       // position of the command in buf
+	argc    int       // arguments announced by the multibulk header, 0 before the header is parsed
+	bulkLen int       // length of the next argument, -1 before its header is parsed
+	args    []argSpan // arguments parsed so far
+	big     []byte    // the large argument being read
+	bigSize int64     // bytes of the large arguments read straight into their slices, which are not in buf
+}
+
+// argSpan is an argument of the command being parsed: either n bytes at off in buf from the start of the command,
+// or a large argument read into its own slice.
+type argSpan struct {
+	off, n int
+	big    []byte
+}
+
+// NewReader returns a Reader of the commands sent on rd, within the limits.
+func NewReader(rd io.Reader, limits Limits) *Reader {
+	return &Reader{
+		rd:      rd,
+		limits:  limits.orDefault(),
+		buf:     make([]byte, readerBufSize),
+		bulkLen: -1,
+	}
+}
+
+// Buffered returns the number of bytes read from the connection but not parsed yet.
+// The commands of a pipeline are all served once it returns 0.
+func (r *Reader) Buffered() int {
+	return r.w - r.r
+}
+
+// ReadCommand returns the next command. The empty commands, like empty lines, are skipped.
+// It returns io.EOF once the client disconnected, and a *ProtocolError if the command is malformed or exceeds
+// the limits, after which nothing else can be read.
+func (r *Reader) ReadCommand() ([][]byte, error) {
+	for {
+		cmd, done, err := r.parse()
+		if err != nil {
+			return nil, err
+		}
+		if done && cmd != nil {
+			return cmd, nil
+		}
+		if !done {
+			if err := r.fill(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// parse parses the command in the buffer. It returns false if the buffer does not hold the whole command yet,
+// and a nil command for the empty commands.
+func (r *Reader) parse() ([][]byte, bool, error) {
+	if r.argc == 0 {
+		if r.r == r.w {
+			return nil, false, nil
+		}
+		r.start = r.r
+		if r.buf[r.r] != '*' {
+			return r.parseInline()
+		}
+		line, ok, err := r.readLine("too big mbulk count string")
+		if !ok || err != nil {
+			return nil, false, err
+		}
+		n, ok := parseLen(line[1:])
+		if !ok || n > int64(r.limits.MaxMultiBulk) {
+			return nil, false, &ProtocolError{"invalid multibulk length"}
+		}
+		if n <= 0 {
+			r.reset()
+			return nil, true, nil
+		}
+		r.argc = int(n)
+	}
+	for len(r.args) < r.argc {
+		if r.bulkLen < 0 {
+			if r.r == r.w {
+				return nil, false, nil
+			}
+			if r.buf[r.r] != '$' {
+				return nil, false, &ProtocolError{"expected '$', got '" + string(r.buf[r.r]) + "'"}
+			}
+			line, ok, err := r.readLine("too big bulk count string")
+			if !ok || err != nil {
+				return nil, false, err
+			}
+			n, ok := parseLen(line[1:])
+			if !ok || n < 0 || n > r.limits.MaxBulkLen {
+				return nil, false, &ProtocolError{"invalid bulk length"}
+			}
+			// the argument is not read if it would exceed the query buffer limit
+			if r.querySize()+n+2 > r.limits.MaxQueryBuffer {
+				return nil, false, &ProtocolError{"query buffer limit reached"}
+			}
+			r.bulkLen = int(n)
+			if r.bulkLen >= bigArgLen {
+				r.big = make([]byte, 0, bigArgLen)
+			}
+		}
+		if r.big != nil {
+			// the part of the large argument in the buffer is moved into its slice
+			n := r.w - r.r
+			if rest := r.bulkLen - len(r.big); n > rest {
+				n = rest
+			}
+			r.big = appendGrow(r.big, r.buf[r.r:r.r+n], r.bulkLen)
+			r.r += n
+			if len(r.big) < r.bulkLen || r.w-r.r < 2 {
+				return nil, false, nil
+			}
+		} else if r.w-r.r < r.bulkLen+2 {
+			return nil, false, nil
+		}
+		end := r.r + r.bulkLen
+		if r.big != nil {
+			end = r.r
+		}
+		if r.buf[end] != '\r' || r.buf[end+1] != '\n' {
+			return nil, false, &ProtocolError{"invalid bulk string ending"}
+		}
+		if r.big != nil {
+			r.args = append(r.args, argSpan{big: r.big})
+			r.big = nil
+		} else {
+			r.args = append(r.args, argSpan{off: r.r - r.start, n: r.bulkLen})
+		}
+		r.r = end + 2
+		r.bulkLen = -1
+	}
+	cmd := r.command()
+	r.reset()
+	return cmd, true, nil
+}
+
+// parseInline parses an inline command, whose arguments are split like in splitArgs.
+func (r *Reader) parseInline() ([][]byte, bool, error) {
+	line, ok, err := r.readLine("too big inline request")
+	if !ok || err != nil {
+		return nil, false, err
+	}
+	args, err := splitArgs(line)
+	if err != nil {
+		return nil, false, err
+	}
+	r.reset()
+	if len(args) == 0 {
+		return nil, true, nil
+	}
+	return args, true, nil
+}
+
+// readLine returns the line at the read position without its line ending, "\r\n" or "\n" alone.
+// It returns false if the buffer does not hold the whole line yet, and a protocol error with the message
+// if the line is longer than maxInlineLen.
+func (r *Reader) readLine(tooBig string) ([]byte, bool, error) {
+	i := bytes.IndexByte(r.buf[r.r:r.w], '\n')
+	if i < 0 {
+		if r.w-r.r > maxInlineLen {
+			return nil, false, &ProtocolError{tooBig}
+		}
+		return nil, false, nil
+	}
+	if i > maxInlineLen+1 {
+		return nil, false, &ProtocolError{tooBig}
+	}
+	line := r.buf[r.r : r.r+i]
+	r.r += i + 1
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, true, nil
+}
+
+// querySize returns the bytes of the command read so far.
+func (r *Reader) querySize() int64 {
+	return int64(r.r-r.start) + r.bigSize
+}
+
+// command copies the arguments of the parsed command out of the buffer.
+func (r *Reader) command() [][]byte {
+	size := 0
+	for _, arg := range r.args {
+		size += arg.n
+	}
+	arena := make([]byte, size)
+	cmd := make([][]byte, len(r.args))
+	for i, arg := range r.args {
+		if arg.big != nil {
+			cmd[i] = arg.big
+			continue
+		}
+		pos := r.start + arg.off
+		n := copy(arena, r.buf[pos:pos+arg.n])
+		// the capacity is cut so that appending to an argument never overwrites the next one
+		cmd[i] = arena[:n:n]
+		arena = arena[n:]
+	}
+	return cmd
+}
+
+// reset prepares the parsing of the next command.
+func (r *Reader) reset() {
+	r.argc = 0
+	r.bulkLen = -1
+	r.args = r.args[:0]
+	r.big = nil
+	r.bigSize = 0
+	r.start = r.r
+	if r.r == r.w {
+		r.r, r.w, r.start = 0, 0, 0
+		if len(r.buf) > readerMaxIdleBuf {
+			r.buf = make([]byte, readerBufSize)
+		}
+	}
+}
+
+// fill reads more data from the connection, straight into the large argument being read if the buffer is drained.
+func (r *Reader) fill() error {
+	for i := 0; i < maxEmptyReads; i++ {
+		var n int
+		var err error
+		if r.big != nil && len(r.big) < r.bulkLen && r.r == r.w {
+			r.big = appendGrow(r.big, nil, r.bulkLen)
+			n, err = r.rd.Read(r.big[len(r.big):cap(r.big)])
+			r.big = r.big[:len(r.big)+n]
+			r.bigSize += int64(n)
+		} else {
+			r.makeRoom()
+			n, err = r.rd.Read(r.buf[r.w:])
+			r.w += n
+		}
+		if n > 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return io.ErrNoProgress
+}
+
+// makeRoom makes room at the end of the buffer, by moving the command being parsed to the front,
+// or by growing the buffer if the command fills it.
+func (r *Reader) makeRoom() {
+	if r.w < len(r.buf) {
+		return
+	}
+	buf := r.buf
+	if r.start == 0 {
+		buf = make([]byte, 2*len(r.buf))
+	}
+	copy(buf, r.buf[r.start:r.w])
+	r.r -= r.start
+	r.w -= r.start
+	r.start = 0
+	r.buf = buf
+}
+
+// appendGrow appends data to arg, growing it by doubling up to size bytes. It always leaves room
+// for more data if arg is shorter than size.
+func appendGrow(arg []byte, data []byte, size int) []byte {
+	if need := len(arg) + len(data); need > cap(arg) || (need < size && need == cap(arg)) {
+		newCap := 2 * cap(arg)
+		if newCap < need {
+			newCap = need
+		}
+		if newCap > size {
+			newCap = size
+		}
+		grown := make([]byte, len(arg), newCap)
+		copy(grown, arg)
+		arg = grown
+	}
+	return append(arg, data...)
+}
+
+// parseLen parses the length of a header, a non-negative number or -1. It returns false if it's not a number.
+// The lengths are at most 18 digits long, so they never overflow.
+func parseLen(b []byte) (int64, bool) {
+	if len(b) == 0 || len(b) > 18 {
+		return 0, false
+	}
+	if len(b) == 2 && b[0] == '-' && b[1] == '1' {
+		return -1, true
+	}
+	var n int64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int64(c-'0')
+	}
+	return n, true
+}
@@ -0,0 +1,185 @@
+package resp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// readCommands reads all the commands of data and the error ending them.
+func readCommands(rd io.Reader, limits Limits) ([][][]byte, error) {
+	r := NewReader(rd, limits)
+	var cmds [][][]byte
+	for {
+		cmd, err := r.ReadCommand()
+		if err != nil {
+			return cmds, err
+		}
+		cmds = append(cmds, cmd)
+	}
+}
+
+func joinCommands(cmds [][][]byte) []string {
+	res := make([]string, 0, len(cmds))
+	for _, cmd := range cmds {
+		res = append(res, string(bytes.Join(cmd, []byte(" "))))
+	}
+	return res
+}
+
+func TestReader(t *testing.T) {
+	big := strings.Repeat("v", 3*bigArgLen+5)
+	data := "*3\r\n$3\r\nset\r\n$1\r\nk\r\n$0\r\n\r\n" +
+		"*0\r\n*-1\r\n\r\n" +
+		"PING\n" +
+		"set k \"a b\"\r\n" +
+		"*3\r\n$3\r\nset\r\n$3\r\nbig\r\n$" + fmt.Sprint(len(big)) + "\r\n" + big + "\r\n" +
+		"*1\r\n$4\r\nPING\r\n"
+	expect := []string{"set k ", "PING", "set k a b", "set big " + big, "PING"}
+	// the commands are the same whether they arrive at once or byte by byte
+	for _, rd := range []io.Reader{strings.NewReader(data), iotest.OneByteReader(strings.NewReader(data)), iotest.HalfReader(strings.NewReader(data))} {
+		cmds, err := readCommands(rd, Limits{})
+		if err != io.EOF {
+			t.Error(fmt.Sprintf("ReadCommand() error == %v | expect: EOF", err))
+		}
+		got := joinCommands(cmds)
+		if len(got) != len(expect) {
+			t.Fatal(fmt.Sprintf("read %d commands | expect: %d", len(got), len(expect)))
+		}
+		for i := range expect {
+			if got[i] != expect[i] {
+				t.Error(fmt.Sprintf("command %d == %.40q | expect: %.40q", i, got[i], expect[i]))
+			}
+		}
+	}
+
+	// the arguments are not modified by the next reads, nor by appending to the previous arguments
+	r := NewReader(strings.NewReader("*2\r\n$3\r\nget\r\n$1\r\na\r\n*2\r\n$3\r\nget\r\n$1\r\nb\r\n"), Limits{})
+	first, _ := r.ReadCommand()
+	_ = append(first[0], 'x')
+	second, _ := r.ReadCommand()
+	if string(first[0]) != "get" || string(first[1]) != "a" || string(second[1]) != "b" {
+		t.Error(fmt.Sprintf("commands == %q, %q | expect: [get a], [get b]", first, second))
+	}
+	if r.Buffered() != 0 {
+		t.Error(fmt.Sprintf("Buffered() == %d | expect: 0", r.Buffered()))
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	limits := Limits{MaxBulkLen: 16, MaxMultiBulk: 3, MaxQueryBuffer: 64}
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{"*1\r\n$17\r\n", "Protocol error: invalid bulk length"},
+		{"*1\r\n$-1\r\n", "Protocol error: invalid bulk length"},
+		{"*1\r\n$9999999999999999999999\r\n", "Protocol error: invalid bulk length"},
+		{"*4\r\n", "Protocol error: invalid multibulk length"},
+		{"*x\r\n", "Protocol error: invalid multibulk length"},
+		{"*1\r\n:1\r\n", "Protocol error: expected '$', got ':'"},
+		{"*1\r\n$1\r\nab\r\n", "Protocol error: invalid bulk string ending"},
+		{"*3\r\n$16\r\n0123456789abcdef\r\n$16\r\n0123456789abcdef\r\n$16\r\n", "Protocol error: query buffer limit reached"},
+		{"set k 'v\r\n", "Protocol error: unbalanced quotes in request"},
+		{strings.Repeat("a", maxInlineLen+1), "Protocol error: too big inline request"},
+		{"*" + strings.Repeat("1", maxInlineLen+1), "Protocol error: too big mbulk count string"},
+	}
+	for _, test := range tests {
+		cmds, err := readCommands(strings.NewReader(test.data), limits)
+		if len(cmds) != 0 || err == nil || err.Error() != test.err {
+			t.Error(fmt.Sprintf("read %.20q == %q, %v | expect: %s", test.data, cmds, err, test.err))
+		}
+		if _, ok := err.(*ProtocolError); !ok {
+			t.Error(fmt.Sprintf("read %.20q error %v is not a protocol error", test.data, err))
+		}
+	}
+
+	// a command cut by the disconnection of the client
+	cmds, err := readCommands(strings.NewReader("*2\r\n$3\r\nget\r\n$1\r\n"), limits)
+	if len(cmds) != 0 || err != io.EOF {
+		t.Error(fmt.Sprintf("read cut command == %q, %v | expect: EOF", cmds, err))
+	}
+}
+
+// FuzzReader checks that the Reader never panics nor hangs on any input, that the commands it reads don't depend
+// on how the input is split by the reads, and that they are encoded back into the same commands.
+func FuzzReader(f *testing.F) {
+	seeds := []string{
+		"*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n",
+		"*0\r\n*-1\r\n\r\n*1\r\n$0\r\n\r\n",
+		"PING\r\nset k \"a\\x41\\n\" 'b\\'c'\n",
+		"*1\r\n$9999999999\r\n",
+		"*2\r\n$3\r\nget\r\n:1\r\n",
+		"set k \"v\r\n",
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+	limits := Limits{MaxBulkLen: 1024, MaxMultiBulk: 64, MaxQueryBuffer: 4096}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cmds, err := readCommands(bytes.NewReader(data), limits)
+		cmdsByByte, errByByte := readCommands(iotest.OneByteReader(bytes.NewReader(data)), limits)
+		if fmt.Sprint(err) != fmt.Sprint(errByByte) || fmt.Sprintf("%q", cmds) != fmt.Sprintf("%q", cmdsByByte) {
+			t.Fatalf("read %q at once == %q, %v | byte by byte == %q, %v", data, cmds, err, cmdsByByte, errByByte)
+		}
+		for _, cmd := range cmds {
+			args := make([]RedisData, 0, len(cmd))
+			for _, arg := range cmd {
+				args = append(args, MakeBulkData(arg))
+			}
+			again, err := NewReader(bytes.NewReader(MakeArrayData(args).ToBytes()), Limits{}).ReadCommand()
+			if err != nil || fmt.Sprintf("%q", again) != fmt.Sprintf("%q", cmd) {
+				t.Fatalf("read %q again == %q, %v", cmd, again, err)
+			}
+		}
+	})
+}
+
+// pipeline returns n pipelined SET commands with a value of the given size.
+func pipeline(n int, size int) []byte {
+	value := bytes.Repeat([]byte("v"), size)
+	cmd := MakeArrayData([]RedisData{MakeBulkData([]byte("SET")), MakeBulkData([]byte("key:000000")), MakeBulkData(value)}).ToBytes()
+	return bytes.Repeat(cmd, n)
+}
+
+// BenchmarkParseStream and BenchmarkReader compare ParseStream, a goroutine sending each parsed command through
+// a channel, with a Reader parsing the commands in the goroutine of the caller.
+func BenchmarkParseStream(b *testing.B) {
+	for _, size := range []int{16, 1024} {
+		data := pipeline(16, size)
+		b.Run(fmt.Sprintf("value=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				for parseRes := range ParseStream(context.Background(), bytes.NewReader(data)) {
+					if parseRes.Err != nil {
+						break
+					}
+					_ = parseRes.Data.(*ArrayData).ToCommand()
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReader(b *testing.B) {
+	for _, size := range []int{16, 1024} {
+		data := pipeline(16, size)
+		b.Run(fmt.Sprintf("value=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				r := NewReader(bytes.NewReader(data), Limits{})
+				for {
+					if _, err := r.ReadCommand(); err != nil {
+						break
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package resp
+
+import (
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// resp3.go implements the data types added by RESP3. A connection speaks RESP2 until the client switches
+// to RESP3 with HELLO 3, so every type also has a RESP2 form: ToBytes returns the RESP2 form,
+// and the RESP3 form is returned by ToRESP3Bytes for the types whose forms differ.
+
+// RESP3Data is implemented by the data whose RESP3 form differs from its RESP2 form.
+type RESP3Data interface {
+	ToRESP3Bytes() []byte
+}
+
+// ProtocolConn is implemented by the connections that know the protocol version negotiated by their client.
+type ProtocolConn interface {
+	Protocol() int
+}
+
+// ConnProtocol returns the protocol version negotiated on conn, 2 if it does not implement ProtocolConn.
+func ConnProtocol(conn any) int {
+	if pc, ok := conn.(ProtocolConn); ok {
+		return pc.Protocol()
+	}
+	return 2
+}
+
+// Encode returns data in the form of the given protocol version, 2 or 3.
+func Encode(data RedisData, proto int) []byte {
+	if proto >= 3 {
+		if d, ok := data.(RESP3Data); ok {
+			return d.ToRESP3Bytes()
+		}
+	}
+	return data.ToBytes()
+}
+
+// encodeAggregate encodes the elements of an aggregate type in RESP3 after its header.
+func encodeAggregate(prefix byte, length int, elems []RedisData) []byte {
+	res := []byte(string(prefix) + strconv.Itoa(length) + CRLF)
+	for _, v := range elems {
+		res = append(res, Encode(v, 3)...)
+	}
+	return res
+}
+
+func (r *BulkData) ToRESP3Bytes() []byte {
+	if r.data == nil {
+		return []byte("_" + CRLF)
+	}
+	return r.ToBytes()
+}
+
+func (r *ArrayData) ToRESP3Bytes() []byte {
+	if r.resp3 != nil {
+		return Encode(r.resp3, 3)
+	}
+	if r.data == nil {
+		return []byte("_" + CRLF)
+	}
+	return encodeAggregate('*', len(r.data), r.data)
+}
+
+// WithRESP3 sets the reply sent instead of the array to the RESP3 connections, for the replies whose shape
+// changes with the protocol, like the member-score pairs of ZRANGE WITHSCORES.
+func (r *ArrayData) WithRESP3(data RedisData) *ArrayData {
+	r.resp3 = data
+	return r
+}
+
+// MapData is a map of keys to values, a flat array of the keys and values in RESP2.
+type MapData struct {
+	data []RedisData // keys and values interleaved
+}
+
+// MakeMapData makes a map from its keys and values interleaved.
+func MakeMapData(data []RedisData) *MapData {
+	return &MapData{
+		data: data,
+	}
+}
+
+func (r *MapData) ToBytes() []byte {
+	return MakeArrayData(r.data).ToBytes()
+}
+
+func (r *MapData) ToRESP3Bytes() []byte {
+	return encodeAggregate('%', len(r.data)/2, r.data)
+}
+
+func (r *MapData) Data() []RedisData {
+	return r.data
+}
+
+func (r *MapData) ByteData() []byte {
+	return MakeArrayData(r.data).ByteData()
+}
+
+func (r *MapData) String() string {
+	return MakeArrayData(r.data).String()
+}
+
+// SetData is an unordered collection of distinct elements, an array in RESP2.
+type SetData struct {
+	data []RedisData
+}
+
+func MakeSetData(data []RedisData) *SetData {
+	return &SetData{
+		data: data,
+	}
+}
+
+func (r *SetData) ToBytes() []byte {
+	return MakeArrayData(r.data).ToBytes()
+}
+
+func (r *SetData) ToRESP3Bytes() []byte {
+	return encodeAggregate('~', len(r.data), r.data)
+}
+
+func (r *SetData) Data() []RedisData {
+	return r.data
+}
+
+func (r *SetData) ByteData() []byte {
+	return MakeArrayData(r.data).ByteData()
+}
+
+func (r *SetData) String() string {
+	return MakeArrayData(r.data).String()
+}
+
+// PushData is an out of band message like the messages of the subscribed channels, an array in RESP2.
+type PushData struct {
+	data []RedisData
+}
+
+func MakePushData(data []RedisData) *PushData {
+	return &PushData{
+		data: data,
+	}
+}
+
+func (r *PushData) ToBytes() []byte {
+	return MakeArrayData(r.data).ToBytes()
+}
+
+func (r *PushData) ToRESP3Bytes() []byte {
+	return encodeAggregate('>', len(r.data), r.data)
+}
+
+func (r *PushData) Data() []RedisData {
+	return r.data
+}
+
+func (r *PushData) ByteData() []byte {
+	return MakeArrayData(r.data).ByteData()
+}
+
+func (r *PushData) String() string {
+	return MakeArrayData(r.data).String()
+}
+
+// DoubleData is a floating point number, a bulk string in RESP2.
+type DoubleData struct {
+	data float64
+}
+
+func MakeDoubleData(data float64) *DoubleData {
+	return &DoubleData{
+		data: data,
+	}
+}
+
+// format returns the number the way RESP3 writes it, which is also the bulk string of RESP2.
+func (r *DoubleData) format() string {
+	switch {
+	case math.IsInf(r.data, 1):
+		return "inf"
+	case math.IsInf(r.data, -1):
+		return "-inf"
+	case math.IsNaN(r.data):
+		return "nan"
+	}
+	return strconv.FormatFloat(r.data, 'f', -1, 64)
+}
+
+func (r *DoubleData) ToBytes() []byte {
+	return MakeBulkData([]byte(r.format())).ToBytes()
+}
+
+func (r *DoubleData) ToRESP3Bytes() []byte {
+	return []byte("," + r.format() + CRLF)
+}
+
+func (r *DoubleData) Data() float64 {
+	return r.data
+}
+
+func (r *DoubleData) ByteData() []byte {
+	return []byte(r.format())
+}
+
+func (r *DoubleData) String() string {
+	return r.format()
+}
+
+// BooleanData is true or false, the integer 1 or 0 in RESP2.
+type BooleanData struct {
+	data bool
+}
+
+func MakeBooleanData(data bool) *BooleanData {
+	return &BooleanData{
+		data: data,
+	}
+}
+
+func (r *BooleanData) int() *IntData {
+	if r.data {
+		return MakeIntData(1)
+	}
+	return MakeIntData(0)
+}
+
+func (r *BooleanData) ToBytes() []byte {
+	return r.int().ToBytes()
+}
+
+func (r *BooleanData) ToRESP3Bytes() []byte {
+	if r.data {
+		return []byte("#t" + CRLF)
+	}
+	return []byte("#f" + CRLF)
+}
+
+func (r *BooleanData) Data() bool {
+	return r.data
+}
+
+func (r *BooleanData) ByteData() []byte {
+	return r.int().ByteData()
+}
+
+func (r *BooleanData) String() string {
+	return r.int().String()
+}
+
+// NullData is the null of RESP3, the null bulk string in RESP2.
+type NullData struct{}
+
+func MakeNullData() *NullData {
+	return &NullData{}
+}
+
+func (r *NullData) ToBytes() []byte {
+	return NIL
+}
+
+func (r *NullData) ToRESP3Bytes() []byte {
+	return []byte("_" + CRLF)
+}
+
+func (r *NullData) ByteData() []byte {
+	return nil
+}
+
+func (r *NullData) String() string {
+	return ""
+}
+
+// BigNumberData is an integer out of the range of 64 bits, a bulk string in RESP2.
+type BigNumberData struct {
+	data *big.Int
+}
+
+func MakeBigNumberData(data *big.Int) *BigNumberData {
+	return &BigNumberData{
+		data: data,
+	}
+}
+
+func (r *BigNumberData) ToBytes() []byte {
+	return MakeBulkData([]byte(r.data.String())).ToBytes()
+}
+
+func (r *BigNumberData) ToRESP3Bytes() []byte {
+	return []byte("(" + r.data.String() + CRLF)
+}
+
+func (r *BigNumberData) Data() *big.Int {
+	return r.data
+}
+
+func (r *BigNumberData) ByteData() []byte {
+	return []byte(r.data.String())
+}
+
+func (r *BigNumberData) String() string {
+	return r.data.String()
+}
+
+// VerbatimData is a string meant to be shown to the user as is, like the reply of INFO,
+// along with its format: txt for plain text or mkd for markdown. It's a bulk string in RESP2.
+type VerbatimData struct {
+	format string
+	data   string
+}
+
+func MakeVerbatimData(format, data string) *VerbatimData {
+	return &VerbatimData{
+		format: format,
+		data:   data,
+	}
+}
+
+func (r *VerbatimData) ToBytes() []byte {
+	return MakeBulkData([]byte(r.data)).ToBytes()
+}
+
+func (r *VerbatimData) ToRESP3Bytes() []byte {
+	return []byte("=" + strconv.Itoa(len(r.format)+1+len(r.data)) + CRLF + r.format + ":" + r.data + CRLF)
+}
+
+func (r *VerbatimData) Data() string {
+	return r.data
+}
+
+func (r *VerbatimData) ByteData() []byte {
+	return []byte(r.data)
+}
+
+func (r *VerbatimData) String() string {
+	return r.data
+}
@@ -0,0 +1,46 @@
+package resp
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/big"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	bulk := func(s string) RedisData { return MakeBulkData([]byte(s)) }
+	huge, _ := new(big.Int).SetString("3492890328409238509324850943850943825024385", 10)
+	tests := []struct {
+		data  RedisData
+		resp2 string
+		resp3 string
+	}{
+		{MakeMapData([]RedisData{bulk("a"), MakeIntData(1)}), "*2\r\n$1\r\na\r\n:1\r\n", "%1\r\n$1\r\na\r\n:1\r\n"},
+		{MakeSetData([]RedisData{bulk("a")}), "*1\r\n$1\r\na\r\n", "~1\r\n$1\r\na\r\n"},
+		{MakePushData([]RedisData{bulk("message")}), "*1\r\n$7\r\nmessage\r\n", ">1\r\n$7\r\nmessage\r\n"},
+		{MakeDoubleData(1.5), "$3\r\n1.5\r\n", ",1.5\r\n"},
+		{MakeDoubleData(math.Inf(-1)), "$4\r\n-inf\r\n", ",-inf\r\n"},
+		{MakeBooleanData(true), ":1\r\n", "#t\r\n"},
+		{MakeBooleanData(false), ":0\r\n", "#f\r\n"},
+		{MakeNullData(), "$-1\r\n", "_\r\n"},
+		{MakeBigNumberData(huge), "$43\r\n" + huge.String() + "\r\n", "(" + huge.String() + "\r\n"},
+		{MakeVerbatimData("txt", "Some string"), "$11\r\nSome string\r\n", "=15\r\ntxt:Some string\r\n"},
+		{MakeBulkData(nil), "$-1\r\n", "_\r\n"},
+		{&ArrayData{}, "*-1\r\n", "_\r\n"},
+		// the elements of an aggregate are encoded in the protocol of the aggregate
+		{MakeArrayData([]RedisData{MakeDoubleData(2), MakeBulkData(nil)}), "*2\r\n$1\r\n2\r\n$-1\r\n", "*2\r\n,2\r\n_\r\n"},
+		{MakeArrayData([]RedisData{bulk("m"), bulk("1")}).WithRESP3(MakeArrayData([]RedisData{
+			MakeArrayData([]RedisData{bulk("m"), MakeDoubleData(1)}),
+		})), "*2\r\n$1\r\nm\r\n$1\r\n1\r\n", "*1\r\n*2\r\n$1\r\nm\r\n,1\r\n"},
+		{MakeStringData("OK"), "+OK\r\n", "+OK\r\n"},
+	}
+	for _, tt := range tests {
+		if got := Encode(tt.data, 2); !bytes.Equal(got, []byte(tt.resp2)) {
+			t.Error(fmt.Sprintf("Encode(%v, 2) == %q | expect: %q", tt.data, got, tt.resp2))
+		}
+		if got := Encode(tt.data, 3); !bytes.Equal(got, []byte(tt.resp3)) {
+			t.Error(fmt.Sprintf("Encode(%v, 3) == %q | expect: %q", tt.data, got, tt.resp3))
+		}
+	}
+}
@@ -38,7 +38,8 @@ type ErrorData struct {
 
 // ArrayData do not implement ByteData()
 type ArrayData struct {
-	data []RedisData
+	data  []RedisData
+	resp3 RedisData // reply to the RESP3 connections if its shape differs, see WithRESP3
 }
 
 type PlainData struct {
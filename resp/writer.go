@@ -0,0 +1,95 @@
+package resp
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// writer.go implements Writer, which buffers the replies of a client so that the replies of the commands
+// of a pipeline are sent with a single write once the pipeline is served, instead of a write per reply.
+
+// writerBufSize is the size of the buffer of a Writer. The replies larger than it are written directly.
+const writerBufSize = 16 * 1024
+
+// Writer buffers the replies written to a connection until Flush. It's safe for concurrent use: the data
+// written by other goroutines with Write, like the messages of the subscribed channels, is sent right away
+// and after the replies buffered before it.
+type Writer struct {
+	mu  sync.Mutex
+	w   *bufio.Writer
+	num []byte // scratch space to format the numbers
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w:   bufio.NewWriterSize(w, writerBufSize),
+		num: make([]byte, 0, 20),
+	}
+}
+
+// WriteData buffers a reply in the form of the given protocol version. The simple replies are encoded
+// straight into the buffer.
+func (w *Writer) WriteData(data RedisData, proto int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch d := data.(type) {
+	case *StringData:
+		w.w.WriteByte('+')
+		w.w.WriteString(d.data)
+		w.w.WriteString(CRLF)
+	case *ErrorData:
+		w.w.WriteByte('-')
+		w.w.WriteString(d.data)
+		w.w.WriteString(CRLF)
+	case *IntData:
+		w.writeNumber(':', d.data)
+	case *BulkData:
+		if d.data == nil {
+			w.w.Write(Encode(data, proto))
+			break
+		}
+		w.writeNumber('$', int64(len(d.data)))
+		w.w.Write(d.data)
+		w.w.WriteString(CRLF)
+	default:
+		w.w.Write(Encode(data, proto))
+	}
+	// the errors of a bufio.Writer are sticky, so the first one is returned by the last write
+	_, err := w.w.Write(nil)
+	return err
+}
+
+// writeNumber writes a line of the prefix and the number.
+func (w *Writer) writeNumber(prefix byte, n int64) {
+	w.w.WriteByte(prefix)
+	w.num = strconv.AppendInt(w.num[:0], n, 10)
+	w.w.Write(w.num)
+	w.w.WriteString(CRLF)
+}
+
+// Write sends p after the buffered replies.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, err := w.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, w.w.Flush()
+}
+
+// Flush sends the buffered replies.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Flush()
+}
+
+// Buffered returns the number of bytes of the replies not sent yet.
+func (w *Writer) Buffered() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Buffered()
+}
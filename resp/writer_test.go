@@ -0,0 +1,111 @@
+package resp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/big"
+	"testing"
+)
+
+// countingWriter counts the writes, which are syscalls on a connection.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestWriter(t *testing.T) {
+	replies := []RedisData{
+		MakeStringData("OK"),
+		MakeErrorData("ERR failed"),
+		MakeIntData(-42),
+		MakeBulkData([]byte("hello")),
+		MakeBulkData([]byte{}),
+		MakeBulkData(nil),
+		MakeArrayData([]RedisData{MakeBulkData([]byte("a")), MakeIntData(1)}),
+		MakeMapData([]RedisData{MakeBulkData([]byte("k")), MakeDoubleData(1.5)}),
+		MakeBigNumberData(big.NewInt(7)),
+	}
+	for _, proto := range []int{2, 3} {
+		out := new(countingWriter)
+		w := NewWriter(out)
+		expect := make([]byte, 0)
+		for _, reply := range replies {
+			if err := w.WriteData(reply, proto); err != nil {
+				t.Error(err)
+			}
+			expect = append(expect, Encode(reply, proto)...)
+		}
+		if out.writes != 0 || w.Buffered() != len(expect) {
+			t.Error(fmt.Sprintf("%d writes and %d bytes buffered before Flush | expect: 0 and %d", out.writes, w.Buffered(), len(expect)))
+		}
+		if err := w.Flush(); err != nil {
+			t.Error(err)
+		}
+		if out.writes != 1 || !bytes.Equal(out.Bytes(), expect) {
+			t.Error(fmt.Sprintf("written %q in %d writes | expect: %q in 1 write", out.Bytes(), out.writes, expect))
+		}
+	}
+
+	// Write sends the data after the buffered replies
+	out := new(countingWriter)
+	w := NewWriter(out)
+	_ = w.WriteData(MakeStringData("OK"), 2)
+	if _, err := w.Write([]byte(":1\r\n")); err != nil {
+		t.Error(err)
+	}
+	if out.String() != "+OK\r\n:1\r\n" || w.Buffered() != 0 {
+		t.Error(fmt.Sprintf("written %q | expect: +OK, :1", out.String()))
+	}
+
+	// the errors of the connection are returned
+	w = NewWriter(errWriter{})
+	_ = w.WriteData(MakeStringData("OK"), 2)
+	if err := w.Flush(); err != io.ErrClosedPipe {
+		t.Error(fmt.Sprintf("Flush() == %v | expect: %v", err, io.ErrClosedPipe))
+	}
+	if err := w.WriteData(MakeStringData("OK"), 2); err != io.ErrClosedPipe {
+		t.Error(fmt.Sprintf("WriteData() == %v | expect: %v", err, io.ErrClosedPipe))
+	}
+}
+
+type errWriter struct{}
+
+func (errWriter) Write([]byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// BenchmarkReplies and BenchmarkWriter compare writing each reply of a pipeline of 16 commands to the connection
+// with buffering them and flushing once. writes/op counts the writes to the connection.
+func BenchmarkReplies(b *testing.B) {
+	out := new(countingWriter)
+	reply := MakeStringData("OK")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 16; j++ {
+			_, _ = out.Write(Encode(reply, 2))
+		}
+		out.Reset()
+	}
+	b.ReportMetric(float64(out.writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkWriter(b *testing.B) {
+	out := new(countingWriter)
+	w := NewWriter(out)
+	reply := MakeStringData("OK")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 16; j++ {
+			_ = w.WriteData(reply, 2)
+		}
+		_ = w.Flush()
+		out.Reset()
+	}
+	b.ReportMetric(float64(out.writes)/float64(b.N), "writes/op")
+}
@@ -0,0 +1,699 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/innovationb1ue/RedisGO/logger"
+	"github.com/innovationb1ue/RedisGO/memdb"
+	"github.com/innovationb1ue/RedisGO/resp"
+)
+
+// aof.go implements the append only file persistence.
+// Every successful write command is appended to the file in RESP form and
+// the file is replayed through the command table when the server starts.
+
+const (
+	fsyncAlways   = "always"
+	fsyncEverySec = "everysec"
+	fsyncNo       = "no"
+)
+
+var errAOFFormat = errors.New("ERR bad file format reading the append only file")
+
+// aof is the writer side of the append only file.
+type aof struct {
+	mu    sync.Mutex
+	file  *os.File
+	fsync string
+	curDB int   // database of the last appended command. -1 forces a SELECT before the next command
+	size  int64 // current size of the file in bytes
+	dirty bool  // data has been written since the last fsync
+	// offset of the replication stream up to which the commands are fsynced, for the everysec policy
+	fsynced int64
+	// size of the file after the last rewrite, used by the automatic rewrite
+	baseSize int64
+	// commands appended while a rewrite is running. nil if there is no rewrite
+	rewriteBuf []byte
+}
+
+func (m *Manager) aofPath() string {
+	return filepath.Join(m.cfg.Dir, m.cfg.AppendFilename)
+}
+
+// openAOF opens the file for appending and creates it if not exists.
+func openAOF(path string, fsync string) (*aof, error) {
+	fl, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fl.Stat()
+	if err != nil {
+		_ = fl.Close()
+		return nil, err
+	}
+	return &aof{file: fl, fsync: fsync, curDB: -1, size: info.Size(), baseSize: info.Size()}, nil
+}
+
+// aofEntry is a command to log and the database it ran on.
+type aofEntry struct {
+	dbIdx int
+	cmd   [][]byte
+}
+
+// append writes the commands to the file. More than one command is wrapped in MULTI and EXEC,
+// so the replay applies all or none of them.
+func (a *aof) append(entries ...aofEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	buf, dbIdx := appendEntries(make([]byte, 0, 64), a.curDB, entries)
+	if a.rewriteBuf != nil {
+		a.rewriteBuf = append(a.rewriteBuf, buf...)
+	}
+	n, err := a.file.Write(buf)
+	a.size += int64(n)
+	if err != nil {
+		// the database of the partially written command is unknown now
+		a.curDB = -1
+		return err
+	}
+	a.curDB = dbIdx
+	if a.fsync == fsyncAlways {
+		return a.file.Sync()
+	}
+	a.dirty = true
+	return nil
+}
+
+// sync flushes the written data to disk if there is any. The commands fed to the replication stream
+// up to offset were written before, so they are on disk afterwards.
+func (a *aof) sync(offset int64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.dirty {
+		a.dirty = false
+		if err := a.file.Sync(); err != nil {
+			return err
+		}
+	}
+	if offset > a.fsynced {
+		a.fsynced = offset
+	}
+	return nil
+}
+
+// fsyncedOffset returns the offset of the replication stream up to which the commands are fsynced.
+func (a *aof) fsyncedOffset() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.fsynced
+}
+
+// syncLoop fsyncs the file once per second for the everysec policy, and wakes up the clients waiting
+// in WAITAOF afterwards.
+func (a *aof) syncLoop(ctx context.Context, r *replication) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// the commands are appended to the file before they are fed to the stream
+			if err := a.sync(r.getOffset()); err != nil {
+				logger.Error("fsync append only file error: ", err)
+			} else {
+				r.wakeWaiters()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *aof) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err := a.file.Sync()
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// startRewrite starts collecting the appended commands for a rewrite.
+func (a *aof) startRewrite() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// the rewritten file does not know the current database, so select it again before the next command
+	a.curDB = -1
+	a.rewriteBuf = make([]byte, 0, 1024)
+}
+
+// finishRewrite appends the commands collected during the rewrite to the rewritten file tmp,
+// replaces the old file with it and continues appending to it.
+func (a *aof) finishRewrite(tmp *os.File, path string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	buf := a.rewriteBuf
+	a.rewriteBuf = nil
+	if _, err := tmp.Write(buf); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if err = a.file.Close(); err != nil {
+		logger.Error("closing old append only file error: ", err)
+	}
+	a.file = tmp
+	a.size = info.Size()
+	a.baseSize = a.size
+	a.dirty = false
+	return nil
+}
+
+// abortRewrite stops collecting commands after a failed rewrite.
+func (a *aof) abortRewrite() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rewriteBuf = nil
+}
+
+// sizes returns the current size and the size after the last rewrite.
+func (a *aof) sizes() (int64, int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.size, a.baseSize
+}
+
+// appendEntries appends the commands to buf, selecting their databases when they differ from curDB,
+// and returns the database of the last command. More than one command is wrapped in MULTI and EXEC.
+func appendEntries(buf []byte, curDB int, entries []aofEntry) ([]byte, int) {
+	if len(entries) > 1 {
+		buf = appendCommand(buf, [][]byte{[]byte("MULTI")})
+	}
+	for _, entry := range entries {
+		if entry.dbIdx != curDB {
+			buf = appendCommand(buf, [][]byte{[]byte("SELECT"), []byte(strconv.Itoa(entry.dbIdx))})
+			curDB = entry.dbIdx
+		}
+		buf = appendCommand(buf, entry.cmd)
+	}
+	if len(entries) > 1 {
+		buf = appendCommand(buf, [][]byte{[]byte("EXEC")})
+	}
+	return buf, curDB
+}
+
+// appendCommand appends the RESP array form of cmd to buf.
+func appendCommand(buf []byte, cmd [][]byte) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(cmd)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range cmd {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// propagatedCommand returns the form of a successfully executed write command to log and replicate,
+// or nil if nothing changed. The commands are rewritten to have the same effect whenever they are replayed:
+// blocking commands to their non-blocking form, the random pops to the removal of the popped members and
+// the relative expiration times to absolute ones. now is the unix time in milliseconds the command ran at.
+func propagatedCommand(db *memdb.MemDb, cmd [][]byte, res resp.RedisData, now int64) [][]byte {
+	switch strings.ToLower(string(cmd[0])) {
+	case "blpop", "brpop":
+		// BLPOP returns the key and the value, or a nil reply on timeout
+		arr, ok := res.(*resp.ArrayData)
+		if !ok || len(arr.Data()) != 2 {
+			return nil
+		}
+		popCmd := "LPOP"
+		if strings.ToLower(string(cmd[0])) == "brpop" {
+			popCmd = "RPOP"
+		}
+		return [][]byte{[]byte(popCmd), arr.Data()[0].ByteData()}
+	case "spop":
+		// SPOP returns a member, or an array of members with a count
+		var members []resp.RedisData
+		switch popped := res.(type) {
+		case *resp.ArrayData:
+			members = popped.Data()
+		case *resp.BulkData:
+			if popped.ByteData() != nil {
+				members = []resp.RedisData{popped}
+			}
+		}
+		if len(members) == 0 {
+			return nil
+		}
+		srem := [][]byte{[]byte("SREM"), cmd[1]}
+		for _, member := range members {
+			srem = append(srem, member.ByteData())
+		}
+		return srem
+	case "xadd":
+		// XADD returns the ID of the new entry, or a nil reply if NOMKSTREAM found no stream
+		id, ok := res.(*resp.BulkData)
+		if !ok || id.ByteData() == nil {
+			return nil
+		}
+		return memdb.WithXAddID(cmd, id.ByteData())
+	}
+	return db.RewriteForReplication(cmd, now)
+}
+
+// propagate feeds the executed write commands to the append only file and the replicas.
+func (m *Manager) propagate(entries ...aofEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	if m.aof != nil {
+		if err := m.aof.append(entries...); err != nil {
+			logger.Error("write append only file error: ", err)
+		}
+	}
+	m.repl.feed(entries)
+}
+
+// initAOF restores the dataset from the append only file and opens it for appending.
+// If the file does not exist yet, the dataset is loaded from the snapshot and written into a new append only file,
+// so turning on appendonly for an existing dataset does not lose it.
+func (m *Manager) initAOF(ctx context.Context) error {
+	_, err := os.Stat(m.aofPath())
+	if errors.Is(err, os.ErrNotExist) {
+		if err = m.loadRDB(); err != nil {
+			return err
+		}
+		if err = m.rewriteAOF(); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else if err = m.loadAOF(); err != nil {
+		return err
+	}
+	return m.startAOF(ctx)
+}
+
+// aofCapture is the copy of the dataset taken by a running rewrite. The keys are captured one at a time while
+// the clients keep writing: a write captures the keys it changes before changing them, so every key is captured
+// in its state before the writes collected in the rewrite buffer, as if the whole dataset was copied at once
+// when the rewrite started.
+type aofCapture struct {
+	mu       sync.Mutex
+	buf      []byte
+	curDB    int                   // database of the last captured key
+	captured []map[string]struct{} // keys captured in each database
+	done     bool                  // set once every key is captured
+}
+
+func newAOFCapture(databases int) *aofCapture {
+	c := &aofCapture{
+		buf:      make([]byte, 0, 4096),
+		curDB:    -1,
+		captured: make([]map[string]struct{}, databases),
+	}
+	for i := range c.captured {
+		c.captured[i] = make(map[string]struct{})
+	}
+	return c
+}
+
+// captureKeys appends the commands rebuilding the keys that are not captured yet. The keys that don't exist
+// are captured as well, the commands creating them are in the rewrite buffer.
+// The caller holds the keys exclusively, so that they don't change while they are captured.
+func (c *aofCapture) captureKeys(db *memdb.MemDb, dbIdx int, keys []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return
+	}
+	for _, key := range keys {
+		if _, ok := c.captured[dbIdx][key]; ok {
+			continue
+		}
+		c.captured[dbIdx][key] = struct{}{}
+		_ = db.RewriteKey(key, func(cmd [][]byte) error {
+			if c.curDB != dbIdx {
+				c.buf = appendCommand(c.buf, [][]byte{[]byte("SELECT"), []byte(strconv.Itoa(dbIdx))})
+				c.curDB = dbIdx
+			}
+			c.buf = appendCommand(c.buf, cmd)
+			return nil
+		})
+	}
+}
+
+// finish returns the commands rebuilding the captured dataset. The writes don't capture keys anymore.
+func (c *aofCapture) finish() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done = true
+	return c.buf
+}
+
+// captureForRewrite captures the keys a write is about to change for the running rewrite, if any.
+// The caller holds the keys exclusively and writeMu for reading.
+func (m *Manager) captureForRewrite(dbIdx int, keys []string) {
+	if capture := m.aofCapture.Load(); capture != nil {
+		capture.captureKeys(m.DBs[dbIdx], dbIdx, keys)
+	}
+}
+
+// rewriteAOF replaces the append only file with the shortest command stream that rebuilds the current dataset.
+// Writes are paused only while the rewrite starts collecting them. The keys are then captured one at a time
+// concurrently with other clients, and the commands executed in the meantime are appended to the new file
+// before swapping.
+func (m *Manager) rewriteAOF() error {
+	start := time.Now()
+	capture := newAOFCapture(len(m.DBs))
+	// every write either precedes the rewrite, or captures its keys and is collected by the rewrite buffer
+	m.writeMu.Lock()
+	m.aofCapture.Store(capture)
+	if m.aof != nil {
+		m.aof.startRewrite()
+	}
+	m.writeMu.Unlock()
+	for idx, db := range m.DBs {
+		m.writeMu.RLock()
+		keys := db.Keys()
+		m.writeMu.RUnlock()
+		for _, key := range keys {
+			m.txLocks[idx].Lock(key)
+			m.writeMu.RLock()
+			capture.captureKeys(db, idx, []string{key})
+			m.writeMu.RUnlock()
+			m.txLocks[idx].UnLock(key)
+		}
+	}
+	buf := capture.finish()
+	m.aofCapture.Store(nil)
+
+	err := m.writeRewrittenAOF(buf)
+	if err != nil {
+		if m.aof != nil {
+			m.aof.abortRewrite()
+		}
+		return err
+	}
+	logger.Info("append only file rewritten: ", time.Since(start).Seconds(), " seconds")
+	return nil
+}
+
+func (m *Manager) writeRewrittenAOF(buf []byte) error {
+	tmp, err := os.CreateTemp(m.cfg.Dir, "temp-rewriteaof-*.aof")
+	if err != nil {
+		return err
+	}
+	// remove the temp file if anything goes wrong. it's a no-op after renaming.
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if err = tmp.Chmod(0644); err == nil {
+		_, err = tmp.Write(buf)
+	}
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	// without an open append only file there are no concurrent writes to merge
+	if m.aof == nil {
+		err = tmp.Sync()
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		return os.Rename(tmp.Name(), m.aofPath())
+	}
+	if err = m.aof.finishRewrite(tmp, m.aofPath()); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	return nil
+}
+
+// bgRewriteAOF starts a rewrite in the background.
+// It returns false if another rewrite is in progress.
+func (m *Manager) bgRewriteAOF() bool {
+	if !atomic.CompareAndSwapInt32(&m.aofRewriting, 0, 1) {
+		return false
+	}
+	go func() {
+		defer atomic.StoreInt32(&m.aofRewriting, 0)
+		if err := m.rewriteAOF(); err != nil {
+			logger.Error("background append only file rewriting error: ", err)
+		}
+	}()
+	return true
+}
+
+// checkAOFRewrite triggers a background rewrite when the file grew enough since the last rewrite.
+func (m *Manager) checkAOFRewrite() {
+	if m.aof == nil || m.cfg.AOFRewritePerc <= 0 || atomic.LoadInt32(&m.aofRewriting) == 1 {
+		return
+	}
+	size, base := m.aof.sizes()
+	if size < m.cfg.AOFRewriteMinSize {
+		return
+	}
+	if base == 0 {
+		base = 1
+	}
+	if growth := (size - base) * 100 / base; growth >= int64(m.cfg.AOFRewritePerc) {
+		logger.Info("append only file grew by ", growth, "%. Rewriting...")
+		m.bgRewriteAOF()
+	}
+}
+
+func (m *Manager) BgRewriteAOF(cmd [][]byte) resp.RedisData {
+	if !m.bgRewriteAOF() {
+		return resp.MakeErrorData("ERR Background append only file rewriting already in progress")
+	}
+	return resp.MakeStringData("Background append only file rewriting started")
+}
+
+// startAOF opens the append only file and starts the fsync worker.
+func (m *Manager) startAOF(ctx context.Context) error {
+	a, err := openAOF(m.aofPath(), m.cfg.AppendFsync)
+	if err != nil {
+		return err
+	}
+	m.aof = a
+	if a.fsync == fsyncEverySec {
+		go a.syncLoop(ctx, m.repl)
+	}
+	return nil
+}
+
+// aofFsyncedOffset returns the offset of the replication stream up to which the commands are fsynced to the
+// append only file. The always policy fsyncs every command before it's fed to the stream, and the no policy
+// leaves the fsyncs to the operating system, so the commands count as soon as they are written.
+func (m *Manager) aofFsyncedOffset() int64 {
+	if m.aof.fsync == fsyncEverySec {
+		return m.aof.fsyncedOffset()
+	}
+	return m.repl.getOffset()
+}
+
+// stopAOF flushes and closes the append only file.
+func (m *Manager) stopAOF() {
+	if m.aof == nil {
+		return
+	}
+	if err := m.aof.close(); err != nil {
+		logger.Error("closing append only file error: ", err)
+	}
+}
+
+// loadAOF replays the append only file into the databases if it exists.
+// A command cut off at the end of the file, which happens when the server crashed in the middle
+// of a write, is dropped and the file is truncated to the last complete command.
+func (m *Manager) loadAOF() error {
+	fl, err := os.Open(m.aofPath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	start := time.Now()
+	valid, err := m.replayAOF(fl)
+	_ = fl.Close()
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		logger.Warning("append only file is truncated, discarding the incomplete command after offset ", valid)
+		if err = os.Truncate(m.aofPath(), valid); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return fmt.Errorf("%w at offset %d: %s", errAOFFormat, valid, err)
+	}
+	logger.Info("DB loaded from append only file: ", time.Since(start).Seconds(), " seconds")
+	return nil
+}
+
+// replayAOF executes all the commands read from r and returns the offset after the last complete command.
+// A transaction without its EXEC counts as incomplete.
+func (m *Manager) replayAOF(r io.Reader) (int64, error) {
+	reader := &aofReader{r: bufio.NewReader(r)}
+	db := m.DBs[0]
+	// commands of the current transaction, nil outside MULTI
+	var tx [][][]byte
+	var txStart int64
+	for {
+		start := reader.valid
+		cmd, err := reader.readCommand()
+		if tx != nil && (err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF)) {
+			return txStart, io.ErrUnexpectedEOF
+		}
+		if err == io.EOF {
+			return reader.valid, nil
+		}
+		if err != nil {
+			return reader.valid, err
+		}
+		switch strings.ToLower(string(cmd[0])) {
+		case "multi":
+			tx, txStart = make([][][]byte, 0), start
+			continue
+		case "exec":
+			if tx == nil {
+				return reader.valid, errors.New("EXEC without MULTI")
+			}
+			for _, txCmd := range tx {
+				if db, err = m.replayCommand(db, txCmd); err != nil {
+					return reader.valid, err
+				}
+			}
+			tx = nil
+			continue
+		}
+		if tx != nil {
+			tx = append(tx, cmd)
+			continue
+		}
+		if db, err = m.replayCommand(db, cmd); err != nil {
+			return reader.valid, err
+		}
+	}
+}
+
+// replayCommand executes a command read from the append only file on db and returns the database for the next command.
+func (m *Manager) replayCommand(db *memdb.MemDb, cmd [][]byte) (*memdb.MemDb, error) {
+	cmdName := strings.ToLower(string(cmd[0]))
+	if cmdName == "select" {
+		idx, err := strconv.Atoi(string(cmd[len(cmd)-1]))
+		if err != nil || idx < 0 || idx >= len(m.DBs) {
+			return nil, fmt.Errorf("invalid SELECT %q", cmd[len(cmd)-1])
+		}
+		return m.DBs[idx], nil
+	}
+	command, ok := memdb.CmdTable[cmdName]
+	if !ok || command.Executor == nil {
+		return nil, fmt.Errorf("unknown command %q", cmdName)
+	}
+	// the executors rely on the arity of the command
+	if !command.CheckArity(len(cmd)) {
+		return nil, fmt.Errorf("wrong number of arguments for %q", cmdName)
+	}
+	if res := command.Executor(context.Background(), db, cmd, nil); res != nil {
+		if errData, isErr := res.(*resp.ErrorData); isErr {
+			logger.Error("replay ", cmdName, " from append only file error: ", errData.Error())
+		}
+	}
+	return db, nil
+}
+
+// aofReader reads RESP arrays of bulk strings and keeps the offset of the last complete command.
+type aofReader struct {
+	r      *bufio.Reader
+	offset int64 // bytes consumed so far
+	valid  int64 // offset after the last complete command
+}
+
+// readCommand returns io.EOF when the file ends between two commands
+// and io.ErrUnexpectedEOF when it ends in the middle of one.
+func (r *aofReader) readCommand() ([][]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return nil, fmt.Errorf("expect '*', got %q", line)
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid array length %q", line)
+	}
+	cmd := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		line, err = r.readLine()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("expect '$', got %q", line)
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid bulk length %q", line)
+		}
+		arg := make([]byte, size+2)
+		read, err := io.ReadFull(r.r, arg)
+		r.offset += int64(read)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, errors.New("bulk string is not terminated by CRLF")
+		}
+		cmd = append(cmd, arg[:size])
+	}
+	r.valid = r.offset
+	return cmd, nil
+}
+
+// readLine reads a line terminated by CRLF and strips the terminator.
+func (r *aofReader) readLine() ([]byte, error) {
+	line, err := r.r.ReadBytes('\n')
+	r.offset += int64(len(line))
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errors.New("line is not terminated by CRLF")
+	}
+	return line[:len(line)-2], nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/innovationb1ue/RedisGO/config"
+	"github.com/innovationb1ue/RedisGO/logger"
+	"github.com/innovationb1ue/RedisGO/memdb"
+	"github.com/innovationb1ue/RedisGO/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	config.Configures = &config.Config{ShardNum: 100}
+	err := logger.SetUp(&config.Config{LogLevel: "debug", LogDir: "/tmp"})
+	if err != nil {
+		fmt.Println("logger setup error")
+	}
+	logger.Disable()
+	memdb.RegisterKeyCommands()
+	memdb.RegisterStringCommands()
+	memdb.RegisterListCommands()
+	memdb.RegisterSetCommands()
+	memdb.RegisterHashCommands()
+	memdb.RegisterSortedSetCommands()
+	memdb.RegisterStreamCommands()
+	memdb.RegisterDumpCommands()
+	memdb.RegisterPubSubCommands()
+	RegisterServerCommands()
+}
+
+func newAOFTestManager(dir string) *Manager {
+	return NewManager(&config.Config{
+		Databases:      2,
+		Dir:            dir,
+		DBFilename:     "dump.rdb",
+		AppendOnly:     true,
+		AppendFilename: "appendonly.aof",
+		AppendFsync:    fsyncAlways,
+	})
+}
+
+func TestAOF_Replay(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	mgr := newAOFTestManager(dir)
+	c := mgr.newFakeClient(0)
+	assert.Nil(t, mgr.startAOF(ctx))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("set k v"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("rpush list a b c"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("blpop list 1"))
+	// read commands and failed writes are not logged
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("get k"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("incr k"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("select 1"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("hset hash f v"))
+	mgr.stopAOF()
+
+	restored := newAOFTestManager(dir)
+	rc := restored.newFakeClient(0)
+	assert.Nil(t, restored.loadAOF())
+	assert.Equal(t, []byte("$1\r\nv\r\n"), restored.ExecCommand(ctx, rc, memdb.MakeCommandBytes("get k")).ToBytes())
+	assert.Equal(t, []byte("*2\r\n$1\r\nb\r\n$1\r\nc\r\n"), restored.ExecCommand(ctx, rc, memdb.MakeCommandBytes("lrange list 0 -1")).ToBytes())
+	assert.Equal(t, []byte(":0\r\n"), restored.ExecCommand(ctx, rc, memdb.MakeCommandBytes("exists hash")).ToBytes())
+	restored.ExecCommand(ctx, rc, memdb.MakeCommandBytes("select 1"))
+	assert.Equal(t, []byte("$1\r\nv\r\n"), restored.ExecCommand(ctx, rc, memdb.MakeCommandBytes("hget hash f")).ToBytes())
+}
+
+func TestAOF_TruncatedTail(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	mgr := newAOFTestManager(dir)
+	c := mgr.newFakeClient(0)
+	assert.Nil(t, mgr.startAOF(ctx))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("set k1 v1"))
+	mgr.stopAOF()
+	info, err := os.Stat(mgr.aofPath())
+	assert.Nil(t, err)
+	// simulate a crash in the middle of writing a command
+	fl, err := os.OpenFile(mgr.aofPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = fl.WriteString("*3\r\n$3\r\nset\r\n$2\r\nk2\r\n$2\r\nv")
+	assert.Nil(t, err)
+	assert.Nil(t, fl.Close())
+
+	restored := newAOFTestManager(dir)
+	rc := restored.newFakeClient(0)
+	assert.Nil(t, restored.loadAOF())
+	assert.Equal(t, []byte("$2\r\nv1\r\n"), restored.ExecCommand(ctx, rc, memdb.MakeCommandBytes("get k1")).ToBytes())
+	assert.Equal(t, []byte("$-1\r\n"), restored.ExecCommand(ctx, rc, memdb.MakeCommandBytes("get k2")).ToBytes())
+	truncated, err := os.Stat(mgr.aofPath())
+	assert.Nil(t, err)
+	assert.Equal(t, info.Size(), truncated.Size())
+}
+
+func TestAOF_BadFormat(t *testing.T) {
+	dir := t.TempDir()
+	mgr := newAOFTestManager(dir)
+	assert.Nil(t, os.WriteFile(mgr.aofPath(), []byte("*1\r\n$4\r\nping\r\ngarbage\r\n"), 0644))
+	assert.ErrorIs(t, mgr.loadAOF(), errAOFFormat)
+	// the commands are checked against their arity before they are replayed
+	assert.Nil(t, os.WriteFile(mgr.aofPath(), []byte("*1\r\n$3\r\nget\r\n"), 0644))
+	assert.NotNil(t, mgr.loadAOF())
+}
+
+func TestAOF_ConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	mgr := newAOFTestManager(dir)
+	assert.Nil(t, mgr.startAOF(ctx))
+	// the writes to a key are logged in the order they are executed
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := mgr.newFakeClient(0)
+			for j := 0; j < 50; j++ {
+				mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes(fmt.Sprintf("rpush list %d-%d", i, j)))
+			}
+		}(i)
+	}
+	wg.Wait()
+	mgr.stopAOF()
+
+	restored := newAOFTestManager(dir)
+	assert.Nil(t, restored.loadAOF())
+	lrange := memdb.MakeCommandBytes("lrange list 0 -1")
+	assert.Equal(t, mgr.ExecCommand(ctx, mgr.newFakeClient(0), lrange).ToBytes(), restored.ExecCommand(ctx, restored.newFakeClient(0), lrange).ToBytes())
+}
+
+func TestAOF_Rewrite(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	mgr := newAOFTestManager(dir)
+	c := mgr.newFakeClient(0)
+	assert.Nil(t, mgr.startAOF(ctx))
+	for i := 0; i < 100; i++ {
+		mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("incr counter"))
+	}
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("rpush list a b c"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("expire list 100"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("select 1"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("zadd zset 1 a 2.5 b"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("xadd stream 1-1 f v"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("xadd stream 2-1 f v"))
+	before, _ := mgr.aof.sizes()
+
+	assert.Nil(t, mgr.rewriteAOF())
+	size, base := mgr.aof.sizes()
+	assert.Less(t, size, before)
+	assert.Equal(t, size, base)
+	// writes after the rewrite go to the new file
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("sadd set m"))
+	mgr.stopAOF()
+
+	restored := newAOFTestManager(dir)
+	rc := restored.newFakeClient(0)
+	assert.Nil(t, restored.loadAOF())
+	assert.Equal(t, []byte("$3\r\n100\r\n"), restored.ExecCommand(ctx, rc, memdb.MakeCommandBytes("get counter")).ToBytes())
+	assert.Equal(t, []byte("*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n"), restored.ExecCommand(ctx, rc, memdb.MakeCommandBytes("lrange list 0 -1")).ToBytes())
+	ttl := restored.ExecCommand(ctx, rc, memdb.MakeCommandBytes("ttl list")).ToBytes()
+	assert.Contains(t, [][]byte{[]byte(":100\r\n"), []byte(":99\r\n")}, ttl)
+	restored.ExecCommand(ctx, rc, memdb.MakeCommandBytes("select 1"))
+	assert.Equal(t, []byte(":1\r\n"), restored.ExecCommand(ctx, rc, memdb.MakeCommandBytes("zrank zset b")).ToBytes())
+	assert.Equal(t, 2, len(restored.ExecCommand(ctx, rc, memdb.MakeCommandBytes("xrange stream - +")).(*resp.ArrayData).Data()))
+	assert.Equal(t, []byte(":1\r\n"), restored.ExecCommand(ctx, rc, memdb.MakeCommandBytes("sismember set m")).ToBytes())
+}
+
+func TestAOF_RewriteConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	mgr := newAOFTestManager(dir)
+	assert.Nil(t, mgr.startAOF(ctx))
+	c := mgr.newFakeClient(0)
+	for i := 0; i < 1000; i++ {
+		mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes(fmt.Sprintf("set key:%d %d", i, i)))
+	}
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("rpush list a b"))
+	blocked := mgr.newFakeClient(0)
+	popped := make(chan []byte, 1)
+	go func() { popped <- mgr.ExecCommand(ctx, blocked, memdb.MakeCommandBytes("blpop empty 5")).ToBytes() }()
+	waitFor(t, "the blocked client", func() bool { return blocked.hasFlag(clientBlocked) })
+
+	// the writes during the rewrite are neither lost nor applied twice
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := mgr.newFakeClient(0)
+			for j := 0; ; j++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes(fmt.Sprintf("incr key:%d", (i*250+j)%1000)))
+				mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("incr counter"))
+				mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("lmove list list right left"))
+			}
+		}(i)
+	}
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("rpush empty v"))
+	assert.Nil(t, mgr.rewriteAOF())
+	close(done)
+	wg.Wait()
+	assert.Equal(t, []byte("*2\r\n+empty\r\n$1\r\nv\r\n"), <-popped)
+	mgr.stopAOF()
+
+	restored := newAOFTestManager(dir)
+	assert.Nil(t, restored.loadAOF())
+	rc := restored.newFakeClient(0)
+	cmds := []string{"get counter", "lrange list 0 -1", "exists empty"}
+	for i := 0; i < 1000; i++ {
+		cmds = append(cmds, fmt.Sprintf("get key:%d", i))
+	}
+	for _, cmd := range cmds {
+		assert.Equal(t, mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes(cmd)).ToBytes(), restored.ExecCommand(ctx, rc, memdb.MakeCommandBytes(cmd)).ToBytes(), cmd)
+	}
+}
+
+func TestAOF_RewriteWithoutFile(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	mgr := newAOFTestManager(dir)
+	c := mgr.newFakeClient(0)
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("set k v"))
+	// the dataset is written into a new file when the append only file is missing
+	assert.Nil(t, mgr.initAOF(ctx))
+	mgr.stopAOF()
+
+	restored := newAOFTestManager(dir)
+	rc := restored.newFakeClient(0)
+	assert.Nil(t, restored.loadAOF())
+	assert.Equal(t, []byte("$1\r\nv\r\n"), restored.ExecCommand(ctx, rc, memdb.MakeCommandBytes("get k")).ToBytes())
+}
+
+func TestAOF_Transaction(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	mgr := newAOFTestManager(dir)
+	c := mgr.newFakeClient(0)
+	assert.Nil(t, mgr.startAOF(ctx))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("set k1 v1"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("multi"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("set k2 v2"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("select 1"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("set k3 v3"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("exec"))
+	mgr.stopAOF()
+	data, err := os.ReadFile(mgr.aofPath())
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nset\r\n$2\r\nk2\r\n$2\r\nv2\r\n*2\r\n$6\r\nSELECT\r\n$1\r\n1\r\n")
+
+	restored := newAOFTestManager(dir)
+	rc := restored.newFakeClient(1)
+	assert.Nil(t, restored.loadAOF())
+	assert.Equal(t, []byte("$2\r\nv3\r\n"), restored.ExecCommand(ctx, rc, memdb.MakeCommandBytes("get k3")).ToBytes())
+
+	// a transaction without EXEC is discarded as a whole
+	assert.Nil(t, os.WriteFile(mgr.aofPath(), data[:len(data)-len("*1\r\n$4\r\nEXEC\r\n")], 0644))
+	restored = newAOFTestManager(dir)
+	rc = restored.newFakeClient(0)
+	assert.Nil(t, restored.loadAOF())
+	assert.Equal(t, []byte("$2\r\nv1\r\n"), restored.ExecCommand(ctx, rc, memdb.MakeCommandBytes("get k1")).ToBytes())
+	assert.Equal(t, []byte("$-1\r\n"), restored.ExecCommand(ctx, rc, memdb.MakeCommandBytes("get k2")).ToBytes())
+	info, err := os.Stat(mgr.aofPath())
+	assert.Nil(t, err)
+	assert.Less(t, info.Size(), int64(len(data)-len("*1\r\n$4\r\nEXEC\r\n")))
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/innovationb1ue/RedisGO/logger"
+	"github.com/innovationb1ue/RedisGO/memdb"
+	"github.com/innovationb1ue/RedisGO/resp"
+)
+
+// client.go holds the per-connection states of the clients.
+
+// client flags
+const (
+	clientBlocked   uint32 = 1 << iota // waiting in a blocking command
+	clientPubSub                       // subscribed to channels
+	clientMulti                        // inside a MULTI block
+	clientDirtyCAS                     // a watched key was modified, EXEC will fail
+	clientDirtyExec                    // a command failed to queue, EXEC will fail
+	clientAsking                       // sent ASKING, the next command may access a slot being imported
+	clientReplica                      // a replica receiving the replication stream
+	clientMaster                       // applies the replication stream of the master
+)
+
+// read modes of the clients in cluster mode
+const (
+	readLinearizable = iota // confirm every read with a raft ReadIndex
+	readLease               // skip the confirmation while the leader lease is valid
+	readStale               // read the local state, which may lag behind the cluster
+)
+
+var readModeNames = []string{"linearizable", "lease", "stale"}
+
+// Client is a connection to the server and the states bound to it.
+type Client struct {
+	ID    int64
+	conn  net.Conn
+	out   *resp.Writer // buffered replies, written to the connection once the pipeline of the client is served
+	ctime time.Time
+	// the fields below are only modified by the goroutine serving the client,
+	// mu protects them against readers from other connections like CLIENT LIST
+	mu       sync.Mutex
+	db       *memdb.MemDb
+	dbIdx    int
+	name     string
+	lastCmd  string
+	lastTime time.Time
+	flags    uint32
+	proto    int // protocol version of the replies, 2 or 3 once negotiated by HELLO
+	// the fields below are only accessed by the goroutine serving the client
+	queue    [][][]byte   // commands queued after MULTI
+	watched  []watchedKey // keys watched by WATCH
+	readMode int          // consistency of the reads in cluster mode
+	txGroup  *raftGroup   // raft group of the keys watched and queued by the client in cluster mode
+	replPort int          // port a replica listens on, announced by REPLCONF listening-port
+	// offset of the replication stream after the last write of the client, waited for by WAIT
+	woff int64
+	// raft group of the last write of the client in cluster mode, waited for by WAIT
+	writeGroup *raftGroup
+}
+
+// newClient creates a client for conn and registers it to the Manager.
+func (m *Manager) newClient(conn net.Conn) *Client {
+	c := m.newFakeClient(0)
+	c.ID = m.nextClientID.Add(1)
+	c.out = resp.NewWriter(conn)
+	c.conn = &clientConn{Conn: conn, c: c}
+	m.clients.Store(c.ID, c)
+	return c
+}
+
+// newFakeClient creates a client without a connection to execute commands internally, for example
+// when applying raft entries. Fake clients are not registered to the Manager.
+func (m *Manager) newFakeClient(dbIdx int) *Client {
+	now := time.Now()
+	return &Client{
+		ctime:    now,
+		db:       m.DBs[dbIdx],
+		dbIdx:    dbIdx,
+		lastCmd:  "NULL",
+		lastTime: now,
+		proto:    2,
+	}
+}
+
+// clientConn is the connection of a client, which tells the protocol version of the client
+// to the MemDb commands writing to the connection, like the messages of the subscribed channels.
+// The writes are sent after the buffered replies of the client.
+type clientConn struct {
+	net.Conn
+	c *Client
+}
+
+func (conn *clientConn) Protocol() int {
+	return conn.c.protocol()
+}
+
+func (conn *clientConn) Write(p []byte) (int, error) {
+	return conn.c.out.Write(p)
+}
+
+// flushReplies sends the buffered replies of the client.
+func (c *Client) flushReplies() {
+	if c.out == nil {
+		return
+	}
+	if err := c.out.Flush(); err != nil {
+		logger.Error("write response to ", c.conn.RemoteAddr().String(), " error: ", err.Error())
+	}
+}
+
+func (m *Manager) removeClient(c *Client) {
+	m.clients.Delete(c.ID)
+	m.unwatchAll(c)
+	m.repl.removeReplica(c)
+}
+
+func (c *Client) selectDB(db *memdb.MemDb, idx int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.db = db
+	c.dbIdx = idx
+}
+
+// startCommand records the command the client is executing.
+func (c *Client) startCommand(cmdName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastCmd = cmdName
+	c.lastTime = time.Now()
+}
+
+func (c *Client) setFlag(flag uint32, on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if on {
+		c.flags |= flag
+	} else {
+		c.flags &^= flag
+	}
+}
+
+func (c *Client) hasFlag(flag uint32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flags&flag != 0
+}
+
+func (c *Client) setName(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.name = name
+}
+
+func (c *Client) getName() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.name
+}
+
+func (c *Client) setProtocol(proto int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.proto = proto
+}
+
+func (c *Client) protocol() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.proto
+}
+
+// checkClientName checks that the name can be printed in CLIENT LIST without breaking the format.
+func checkClientName(name string) resp.RedisData {
+	for _, ch := range name {
+		if ch <= ' ' || ch > '~' {
+			return resp.MakeErrorData("ERR Client names cannot contain spaces, newlines or special characters.")
+		}
+	}
+	return nil
+}
+
+// info returns the description of the client in the CLIENT LIST format.
+func (c *Client) info() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	flags := ""
+	if c.flags&clientBlocked != 0 {
+		flags += "b"
+	}
+	if c.flags&clientPubSub != 0 {
+		flags += "P"
+	}
+	if c.flags&clientMulti != 0 {
+		flags += "x"
+	}
+	if c.flags&clientReplica != 0 {
+		flags += "S"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+	addr := ""
+	if c.conn != nil {
+		addr = c.conn.RemoteAddr().String()
+	}
+	now := time.Now()
+	return fmt.Sprintf("id=%d addr=%s name=%s age=%d idle=%d flags=%s db=%d cmd=%s resp=%d",
+		c.ID, addr, c.name, int64(now.Sub(c.ctime).Seconds()), int64(now.Sub(c.lastTime).Seconds()), flags, c.dbIdx, c.lastCmd, c.proto)
+}
+
+// ClientCommand handles the CLIENT subcommands.
+func (m *Manager) ClientCommand(c *Client, cmd [][]byte) resp.RedisData {
+	if len(cmd) < 2 {
+		return resp.MakeWrongNumberArgs("client")
+	}
+	switch subCmd := strings.ToLower(string(cmd[1])); subCmd {
+	case "id":
+		if len(cmd) != 2 {
+			return resp.MakeWrongNumberArgs("client|id")
+		}
+		return resp.MakeIntData(c.ID)
+	case "getname":
+		if len(cmd) != 2 {
+			return resp.MakeWrongNumberArgs("client|getname")
+		}
+		name := c.getName()
+		if name == "" {
+			return resp.MakeBulkData(nil)
+		}
+		return resp.MakeBulkData([]byte(name))
+	case "setname":
+		if len(cmd) != 3 {
+			return resp.MakeWrongNumberArgs("client|setname")
+		}
+		name := string(cmd[2])
+		if errData := checkClientName(name); errData != nil {
+			return errData
+		}
+		c.setName(name)
+		return resp.MakeStringData("OK")
+	case "list":
+		if len(cmd) != 2 {
+			return resp.MakeWrongNumberArgs("client|list")
+		}
+		clients := make([]*Client, 0)
+		m.clients.Range(func(_, value any) bool {
+			clients = append(clients, value.(*Client))
+			return true
+		})
+		sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+		var builder strings.Builder
+		for _, client := range clients {
+			builder.WriteString(client.info())
+			builder.WriteByte('\n')
+		}
+		return resp.MakeVerbatimData("txt", builder.String())
+	case "info":
+		if len(cmd) != 2 {
+			return resp.MakeWrongNumberArgs("client|info")
+		}
+		return resp.MakeVerbatimData("txt", c.info()+"\n")
+	case "readmode":
+		if len(cmd) > 3 {
+			return resp.MakeWrongNumberArgs("client|readmode")
+		}
+		if len(cmd) == 2 {
+			return resp.MakeBulkData([]byte(readModeNames[c.readMode]))
+		}
+		mode := strings.ToLower(string(cmd[2]))
+		for i, name := range readModeNames {
+			if mode == name {
+				c.readMode = i
+				return resp.MakeStringData("OK")
+			}
+		}
+		return resp.MakeErrorData("ERR read mode should be linearizable, lease or stale")
+	default:
+		return resp.MakeErrorData("ERR unknown subcommand '" + subCmd + "'. Try CLIENT ID, GETNAME, SETNAME, LIST, INFO or READMODE.")
+	}
+}
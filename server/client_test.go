@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/innovationb1ue/RedisGO/memdb"
+	"github.com/innovationb1ue/RedisGO/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_SelectIsPerConnection(t *testing.T) {
+	ctx := context.Background()
+	mgr := newAOFTestManager(t.TempDir())
+	c1, c2 := mgr.newFakeClient(0), mgr.newFakeClient(0)
+	assert.Equal(t, []byte("+OK\r\n"), mgr.ExecCommand(ctx, c1, memdb.MakeCommandBytes("select 1")).ToBytes())
+	mgr.ExecCommand(ctx, c1, memdb.MakeCommandBytes("set k db1"))
+	mgr.ExecCommand(ctx, c2, memdb.MakeCommandBytes("set k db0"))
+	assert.Equal(t, []byte("$3\r\ndb1\r\n"), mgr.ExecCommand(ctx, c1, memdb.MakeCommandBytes("get k")).ToBytes())
+	assert.Equal(t, []byte("$3\r\ndb0\r\n"), mgr.ExecCommand(ctx, c2, memdb.MakeCommandBytes("get k")).ToBytes())
+}
+
+func TestClient_Command(t *testing.T) {
+	ctx := context.Background()
+	mgr := newAOFTestManager(t.TempDir())
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	c := mgr.newClient(server)
+	defer mgr.removeClient(c)
+
+	assert.Equal(t, []byte("$-1\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("client getname")).ToBytes())
+	assert.Equal(t, []byte("+OK\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("client setname worker")).ToBytes())
+	assert.Equal(t, []byte("$6\r\nworker\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("client getname")).ToBytes())
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("select 1"))
+	list := string(mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("client list")).ByteData())
+	assert.True(t, strings.Contains(list, "name=worker"), list)
+	assert.True(t, strings.Contains(list, "db=1 cmd=client"), list)
+	_, isErr := mgr.ExecCommand(ctx, c, [][]byte{[]byte("client"), []byte("setname"), []byte("a b")}).(*resp.ErrorData)
+	assert.True(t, isErr)
+
+	assert.Equal(t, []byte("$12\r\nlinearizable\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("client readmode")).ToBytes())
+	assert.Equal(t, []byte("+OK\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("client readmode STALE")).ToBytes())
+	assert.Equal(t, readStale, c.readMode)
+	_, isErr = mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("client readmode eventual")).(*resp.ErrorData)
+	assert.True(t, isErr)
+}
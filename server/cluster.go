@@ -0,0 +1,580 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/innovationb1ue/RedisGO/config"
+	"github.com/innovationb1ue/RedisGO/logger"
+	"github.com/innovationb1ue/RedisGO/memdb"
+	"github.com/innovationb1ue/RedisGO/raftexample"
+	"github.com/innovationb1ue/RedisGO/resp"
+	"go.etcd.io/etcd/raft/v3"
+	"go.etcd.io/etcd/raft/v3/raftpb"
+	"go.etcd.io/etcd/server/v3/etcdserver/api/snap"
+)
+
+// cluster.go splits the keyspace of a cluster into hash slots served by independent raft groups.
+// A node runs a replica of every group it's a member of, each with its own Manager, and routes the commands
+// of the clients to the group serving their slot, or redirects the clients to the nodes of the other groups.
+
+// raftGroup is a raft group serving some of the hash slots.
+type raftGroup struct {
+	id        int // position of the group in the cluster config, from 1
+	cfg       config.ShardConfig
+	raftAddrs []string // raft URLs of the members in the config by raft ID - 1
+	kvAddrs   []string // client addresses of the members in the config by raft ID - 1
+	// the fields below are only set if the node is a member of the group
+	mgr         *Manager
+	node        *raftexample.RaftNode
+	proposeC    chan *raftexample.RaftProposal
+	confChangeC chan raftpb.ConfChangeI
+	results     *proposalResults
+	stopExpire  context.CancelFunc
+	expireDone  chan struct{}
+}
+
+// Cluster routes the commands of the clients to the raft groups serving their hash slots.
+type Cluster struct {
+	cfg    *config.Config
+	groups []*raftGroup
+	home   *raftGroup // first group the node is a member of, which runs the commands without keys
+	filter *middleware
+	// slotMu protects the slot states below, which are changed by CLUSTER SETSLOT
+	slotMu    sync.RWMutex
+	slots     [clusterSlots]*raftGroup // group serving every slot
+	migrating map[int]*raftGroup       // slots moving from a group of this node to another group
+	importing map[int]*raftGroup       // slots moving into a group of this node
+	// closed once any raft group stops
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// newCluster starts a replica of every raft group the node is a member of.
+func newCluster(ctx context.Context, cfg *config.Config) (*Cluster, error) {
+	cl, err := makeCluster(cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range cl.groups {
+		if g.cfg.NodeID == 0 {
+			continue
+		}
+		logger.Info("starting raft group ", g.id)
+		if err := cl.startGroup(ctx, g); err != nil {
+			cl.stop()
+			return nil, err
+		}
+		if cl.home == nil {
+			cl.home = g
+		}
+	}
+	return cl, nil
+}
+
+// makeCluster builds the routing of the slots to the raft groups of the config, without starting them.
+func makeCluster(cfg *config.Config) (*Cluster, error) {
+	cl := &Cluster{
+		cfg:       cfg,
+		migrating: make(map[int]*raftGroup),
+		importing: make(map[int]*raftGroup),
+		stopped:   make(chan struct{}),
+	}
+	for i, shard := range cfg.Shards {
+		g := &raftGroup{
+			id:        i + 1,
+			cfg:       shard,
+			raftAddrs: splitAddrs(shard.PeerAddrs),
+			kvAddrs:   splitAddrs(shard.PeerKVAddrs),
+		}
+		cl.groups = append(cl.groups, g)
+		// the slots were validated with the config
+		ranges, _ := shard.SlotRanges()
+		for _, r := range ranges {
+			for slot := r[0]; slot <= r[1]; slot++ {
+				cl.slots[slot] = g
+			}
+		}
+	}
+	if err := cl.loadSlots(); err != nil {
+		return nil, err
+	}
+	cl.filter = newMiddleware()
+	cl.filter.Add(ClusterCmdFilter)
+	return cl, nil
+}
+
+// startGroup starts the raft node and the state machine of a group.
+func (cl *Cluster) startGroup(ctx context.Context, g *raftGroup) error {
+	groupCfg := *cl.cfg
+	groupCfg.PeerAddrs = g.cfg.PeerAddrs
+	groupCfg.PeerKVAddrs = g.cfg.PeerKVAddrs
+	groupCfg.NodeID = g.cfg.NodeID
+	groupCfg.RaftAddr = g.cfg.RaftAddr
+	groupCfg.JoinCluster = g.cfg.JoinCluster
+	g.mgr = NewManager(&groupCfg)
+	g.proposeC = make(chan *raftexample.RaftProposal)
+	g.confChangeC = make(chan raftpb.ConfChangeI)
+	g.results = newProposalResults()
+	var commitC <-chan *raftexample.RaftCommit
+	var errorC <-chan error
+	var snapshotterReady <-chan *snap.Snapshotter
+	peers := strings.Split(g.cfg.PeerAddrs, ",")
+	commitC, errorC, snapshotterReady, g.node = raftexample.NewRaftGroupNode(g.id, raftOptions(&cl.cfg.Raft), g.cfg.NodeID, g.cfg.RaftAddr, peers,
+		g.cfg.JoinCluster, g.mgr.clusterSnapshot, g.proposeC, g.confChangeC)
+	<-snapshotterReady
+	for _, db := range g.mgr.DBs {
+		db.Raft = g.node
+		// expired keys are deleted by the leader through the raft log
+		db.SetPassiveExpire(true)
+	}
+	// restore the dataset from the last snapshot, the entries after it are replayed through commitC
+	if err := g.mgr.loadClusterSnapshot(g.node); err != nil {
+		logger.Error("loading raft snapshot of group ", g.id, " error: ", err)
+		return err
+	}
+	go handleClusterCommits(ctx, commitC, g.mgr, g.results, errorC)
+	go func() {
+		<-errorC
+		cl.stopOnce.Do(func() { close(cl.stopped) })
+	}()
+	var expireCtx context.Context
+	expireCtx, g.stopExpire = context.WithCancel(ctx)
+	g.expireDone = make(chan struct{})
+	go func() {
+		defer close(g.expireDone)
+		g.mgr.clusterExpireCron(expireCtx, g.node, g.proposeC)
+	}()
+	return nil
+}
+
+// raftOptions returns the settings of the raft nodes, which were validated with the config.
+func raftOptions(cfg *config.RaftConfig) raftexample.RaftOptions {
+	return raftexample.RaftOptions{
+		Dir:             cfg.Dir,
+		SnapCount:       cfg.SnapCount,
+		CatchUpEntries:  cfg.CatchUpEntries,
+		TickInterval:    time.Duration(cfg.TickMs) * time.Millisecond,
+		HeartbeatTicks:  cfg.HeartbeatTicks,
+		ElectionTicks:   cfg.ElectionTicks,
+		MaxInflightMsgs: cfg.MaxInflightMsgs,
+		MaxSizePerMsg:   cfg.MaxSizePerMsg,
+		MaxBatchSize:    cfg.MaxBatchSize,
+		MaxBatchDelay:   time.Duration(cfg.MaxBatchDelayUs) * time.Microsecond,
+	}
+}
+
+// stop shuts down the raft groups. No client may propose anymore.
+func (cl *Cluster) stop() {
+	for _, g := range cl.groups {
+		if g.stopExpire != nil {
+			g.stopExpire()
+			<-g.expireDone
+		}
+		if g.proposeC != nil {
+			close(g.proposeC)
+			close(g.confChangeC)
+		}
+	}
+}
+
+// Handle serves the commands of a client in cluster mode.
+func (cl *Cluster) Handle(ctx context.Context, conn net.Conn) {
+	// gracefully close the tcp connection to client
+	defer func() {
+		err := conn.Close()
+		if err != nil {
+			logger.Error(err)
+		}
+	}()
+	c := cl.home.mgr.newClient(conn)
+	defer func() {
+		if c.txGroup != nil {
+			c.txGroup.mgr.unwatchAll(c)
+		}
+		cl.home.mgr.removeClient(c)
+	}()
+	defer closeOnDone(ctx, conn)()
+	// the replies of the writes are written once they are applied, while the next commands are served
+	out := newReplyWriter(c.out)
+	defer out.close()
+	rd := resp.NewReader(conn, cl.home.mgr.protoLimits())
+	for {
+		// cmd is a complete command read from client
+		cmd, err := rd.ReadCommand()
+		if err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				logger.Info("Close connection ", conn.RemoteAddr().String())
+			} else if errData := protocolErrorReply(err); errData != nil {
+				logger.Info("Close connection ", conn.RemoteAddr().String(), " after ", err.Error())
+				out.write(errData, c.protocol(), true)
+			} else {
+				logger.Error("Handle connection ", conn.RemoteAddr().String(), " error: ", err.Error())
+			}
+			return
+		}
+		// get command passed through filters
+		var res resp.RedisData
+		cmd, err = cl.filter.Filter(cmd)
+		if err != nil {
+			logger.Error("filter error ", err)
+			res = resp.MakeErrorData("command does not pass checks")
+		} else {
+			if !pipelined(c, cmd) {
+				out.flush()
+			}
+			res = cl.execCommand(ctx, c, cmd)
+		}
+		if res == nil {
+			res = resp.MakeErrorData("unknown error")
+		}
+		// the replies of a pipeline are written at once, when all its commands are served
+		out.write(res, c.protocol(), rd.Buffered() == 0)
+	}
+}
+
+// execCommand runs a command of the client on the group serving its keys.
+func (cl *Cluster) execCommand(ctx context.Context, c *Client, cmd [][]byte) resp.RedisData {
+	cmdName := strings.ToLower(string(cmd[0]))
+	switch cmdName {
+	case "cluster":
+		c.startCommand(cmdName)
+		return cl.clusterCommand(ctx, c, cmd)
+	case "asking":
+		c.startCommand(cmdName)
+		c.setFlag(clientAsking, true)
+		return resp.MakeStringData("OK")
+	case "wait", "waitaof":
+		// wait for the group of the last write of the client
+		if g := c.writeGroup; g != nil && !c.hasFlag(clientMulti) {
+			c.selectDB(g.mgr.DBs[c.dbIdx], c.dbIdx)
+			return g.execCommand(ctx, c, cmd)
+		}
+	}
+	// ASKING only applies to the next command
+	asking := c.hasFlag(clientAsking)
+	c.setFlag(clientAsking, false)
+	g, errData := cl.route(c, cmd, asking)
+	if errData != nil {
+		// a command that fails to queue makes the whole transaction fail
+		if c.hasFlag(clientMulti) {
+			c.setFlag(clientDirtyExec, true)
+		}
+		return errData
+	}
+	if len(memdb.CommandKeys(cmd)) > 0 && (c.hasFlag(clientMulti) || cmdName == "watch") {
+		c.txGroup = g
+	}
+	c.selectDB(g.mgr.DBs[c.dbIdx], c.dbIdx)
+	return g.execCommand(ctx, c, cmd)
+}
+
+// route finds the group of this node that runs the command, or returns the error redirecting the client.
+// All the keys of a command, and of a transaction, must be served by the same group.
+func (cl *Cluster) route(c *Client, cmd [][]byte, asking bool) (*raftGroup, resp.RedisData) {
+	keys := memdb.CommandKeys(cmd)
+	if len(keys) == 0 {
+		// the commands of a transaction run in the group of its keys
+		if c.txGroup != nil && (c.hasFlag(clientMulti) || isTransactionCommand(strings.ToLower(string(cmd[0])))) {
+			return c.txGroup, nil
+		}
+		return cl.home, nil
+	}
+	cl.slotMu.RLock()
+	defer cl.slotMu.RUnlock()
+	slot := keyHashSlot([]byte(keys[0]))
+	g := cl.slots[slot]
+	for _, key := range keys[1:] {
+		if cl.slots[keyHashSlot([]byte(key))] != g {
+			return nil, resp.MakeErrorData("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+	}
+	if target, ok := cl.importing[slot]; ok && asking {
+		g = target
+	} else if target, ok := cl.migrating[slot]; ok && g.mgr != nil {
+		// the keys that were moved already are served by the target group
+		g.mgr.writeMu.RLock()
+		defer g.mgr.writeMu.RUnlock()
+		for _, key := range keys {
+			if !g.mgr.DBs[c.dbIdx].Exists(key) {
+				addr := target.addr()
+				if addr == "" {
+					return nil, resp.MakeErrorData(fmt.Sprintf("CLUSTERDOWN Hash slot %d is migrating to a group without address", slot))
+				}
+				return nil, resp.MakeErrorData(fmt.Sprintf("ASK %d %s", slot, addr))
+			}
+		}
+	}
+	if c.txGroup != nil && c.txGroup != g {
+		return nil, resp.MakeErrorData("CROSSSLOT Keys in request don't hash to the same slot")
+	}
+	if g.mgr == nil {
+		addr := g.addr()
+		if addr == "" {
+			return nil, resp.MakeErrorData(fmt.Sprintf("CLUSTERDOWN Hash slot %d is served by a group without address", slot))
+		}
+		return nil, resp.MakeErrorData(fmt.Sprintf("MOVED %d %s", slot, addr))
+	}
+	return g, nil
+}
+
+// isTransactionCommand tells whether the command ends or changes the transaction of the client.
+func isTransactionCommand(cmdName string) bool {
+	return cmdName == "exec" || cmdName == "discard" || cmdName == "unwatch"
+}
+
+// pipelined tells whether the command is a write proposed without reading the data of this node, which
+// may run before the previous writes of the client are applied. The other commands wait for them.
+func pipelined(c *Client, cmd [][]byte) bool {
+	cmdName := strings.ToLower(string(cmd[0]))
+	if c.hasFlag(clientMulti) || isLocalCommand(cmdName) {
+		return false
+	}
+	switch cmdName {
+	case "cluster", "asking", "spop", "migrate":
+		return false
+	}
+	command, errData := lookupCommand(cmd)
+	return errData == nil && !command.HasFlag(memdb.CmdReadOnly)
+}
+
+// execCommand runs a command of the client on the group. Writes are proposed to raft,
+// reads and the connection states are served by this node. The reply of a write is
+// a pendingProposal, which waits for the write to be applied when it's read.
+func (g *raftGroup) execCommand(ctx context.Context, c *Client, cmd [][]byte) resp.RedisData {
+	m := g.mgr
+	// connection states like the selected database and the queued transaction are local to this node.
+	cmdName := strings.ToLower(string(cmd[0]))
+	cmdID := uuid.NewString()
+	var proposal *raftexample.RaftProposal
+	var finish func(resp.RedisData) resp.RedisData
+	switch {
+	case cmdName == "exec" && len(cmd) == 1 && c.hasFlag(clientMulti):
+		// propose the whole transaction as a single entry
+		queue, ok := m.endMulti(c)
+		var errData resp.RedisData
+		if !ok {
+			errData = resp.MakeErrorData("EXECABORT Transaction discarded because of previous errors.")
+		} else if errData = m.leaderRedirect(transactionKeys(queue)); errData == nil {
+			proposal = m.transactionProposal(c, cmdID, queue)
+		}
+		m.unwatchAll(c)
+		if errData != nil {
+			return errData
+		}
+	case c.hasFlag(clientMulti) || isLocalCommand(cmdName):
+		return m.ExecCommand(ctx, c, cmd)
+	default:
+		// reject the invalid commands before proposing them
+		command, errData := lookupCommand(cmd)
+		if errData != nil {
+			return errData
+		}
+		// read-only commands don't change the state machine and are served locally
+		if command.HasFlag(memdb.CmdReadOnly) {
+			return m.clusterRead(ctx, c, cmd)
+		}
+		// writes are proposed by the leader
+		if errData := m.leaderRedirect(command.Keys(cmd)); errData != nil {
+			return errData
+		}
+		var res resp.RedisData
+		proposal, finish, res = m.clusterProposal(ctx, c, cmdID, cmd)
+		if proposal == nil {
+			return res
+		}
+	}
+	c.writeGroup = g
+	return m.propose(ctx, g.proposeC, g.results, proposal, finish)
+}
+
+// leader returns the raft ID of the leader of the group, or raft.None if it's unknown.
+// Only the groups the node is a member of know their leader.
+func (g *raftGroup) leader() uint64 {
+	if g.node == nil {
+		return raft.None
+	}
+	return g.node.Leader()
+}
+
+// master returns the raft ID of the member presented as the master of the group to the clients:
+// the leader if it's known, otherwise the first member.
+func (g *raftGroup) master() uint64 {
+	if lead := g.leader(); lead != raft.None {
+		return lead
+	}
+	if members := g.members(); len(members) > 0 {
+		return members[0].id
+	}
+	return raft.None
+}
+
+// groupMember is a member of a raft group.
+type groupMember struct {
+	id       uint64
+	raftAddr string
+	kvAddr   string
+}
+
+// members returns the members of the group ordered by raft ID. The groups the node is a member of
+// also know the members added or removed since the cluster config was written.
+func (g *raftGroup) members() []groupMember {
+	if g.node == nil {
+		res := make([]groupMember, 0, len(g.raftAddrs))
+		for i, addr := range g.raftAddrs {
+			res = append(res, groupMember{id: uint64(i + 1), raftAddr: addr, kvAddr: g.configKVAddr(uint64(i + 1))})
+		}
+		return res
+	}
+	members := g.node.Members()
+	res := make([]groupMember, 0, len(members))
+	for _, member := range members {
+		kvAddr := member.Addr
+		if kvAddr == "" {
+			kvAddr = g.configKVAddr(member.ID)
+		}
+		res = append(res, groupMember{id: member.ID, raftAddr: member.URL, kvAddr: kvAddr})
+	}
+	return res
+}
+
+// member returns the member of the group with the given raft ID.
+func (g *raftGroup) member(id uint64) (groupMember, bool) {
+	for _, member := range g.members() {
+		if member.id == id {
+			return member, true
+		}
+	}
+	return groupMember{}, false
+}
+
+// addr returns the client address the commands of the group are redirected to, or an empty string if it's unknown.
+func (g *raftGroup) addr() string {
+	return g.kvAddr(g.master())
+}
+
+// kvAddr returns the client address of a member, or an empty string if it's unknown.
+func (g *raftGroup) kvAddr(id uint64) string {
+	member, _ := g.member(id)
+	return member.kvAddr
+}
+
+// configKVAddr returns the client address of a member in the cluster config, or an empty string if it's unknown.
+func (g *raftGroup) configKVAddr(id uint64) string {
+	if id == 0 || id > uint64(len(g.kvAddrs)) {
+		return ""
+	}
+	return g.kvAddrs[id-1]
+}
+
+// leaderRedirect returns the error redirecting the client to the raft leader if this node isn't the leader,
+// or nil if the command can be proposed here. keys are the keys of the command.
+// If the client address of the leader is not configured, the proposal is left to raft to forward.
+func (m *Manager) leaderRedirect(keys []string) resp.RedisData {
+	node := m.DBs[0].Raft
+	lead := node.Leader()
+	if lead == node.ID() {
+		return nil
+	}
+	if lead == raft.None {
+		return resp.MakeErrorData("TRYAGAIN The cluster is electing a leader, please retry later")
+	}
+	addr := m.peerKVAddr(lead)
+	if addr == "" {
+		return nil
+	}
+	slot := 0
+	if len(keys) > 0 {
+		slot = keyHashSlot([]byte(keys[0]))
+	}
+	return resp.MakeErrorData(fmt.Sprintf("MOVED %d %s", slot, addr))
+}
+
+// peerKVAddr returns the client address of the raft peer with the given ID, or an empty string if it's unknown.
+// The address a member was added with is preferred to the one of the config.
+func (m *Manager) peerKVAddr(id uint64) string {
+	if node := m.DBs[0].Raft; node != nil {
+		if member, ok := node.Member(id); ok && member.Addr != "" {
+			return member.Addr
+		}
+	}
+	addrs := splitAddrs(m.cfg.PeerKVAddrs)
+	if id == 0 || id > uint64(len(addrs)) {
+		return ""
+	}
+	return addrs[id-1]
+}
+
+// splitAddrs splits a comma separated list of addresses.
+func splitAddrs(s string) []string {
+	if s == "" {
+		return nil
+	}
+	addrs := strings.Split(s, ",")
+	for i := range addrs {
+		addrs[i] = strings.TrimSpace(addrs[i])
+	}
+	return addrs
+}
+
+// slotsPath is the file keeping the slots assigned by CLUSTER SETSLOT NODE, which override the cluster config.
+func (cl *Cluster) slotsPath() string {
+	return filepath.Join(cl.cfg.Dir, fmt.Sprintf("cluster-slots-%d.json", cl.cfg.Port))
+}
+
+// loadSlots applies the slots assigned by CLUSTER SETSLOT NODE before the node restarted.
+func (cl *Cluster) loadSlots() error {
+	data, err := os.ReadFile(cl.slotsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	assigned := make(map[string]int)
+	if err := json.Unmarshal(data, &assigned); err != nil {
+		return fmt.Errorf("invalid slots file %s: %w", cl.slotsPath(), err)
+	}
+	for slotStr, groupID := range assigned {
+		slot, err := strconv.Atoi(slotStr)
+		if err != nil || slot < 0 || slot >= clusterSlots || groupID < 1 || groupID > len(cl.groups) {
+			return fmt.Errorf("invalid slot assignment %s => %d in %s", slotStr, groupID, cl.slotsPath())
+		}
+		cl.slots[slot] = cl.groups[groupID-1]
+	}
+	return nil
+}
+
+// saveSlots persists the slots served by a different group than in the cluster config. slotMu must be held.
+func (cl *Cluster) saveSlots() error {
+	assigned := make(map[string]int)
+	for i, shard := range cl.cfg.Shards {
+		ranges, _ := shard.SlotRanges()
+		for _, r := range ranges {
+			for slot := r[0]; slot <= r[1]; slot++ {
+				if cl.slots[slot] != cl.groups[i] {
+					assigned[strconv.Itoa(slot)] = cl.slots[slot].id
+				}
+			}
+		}
+	}
+	data, err := json.Marshal(assigned)
+	if err != nil {
+		return err
+	}
+	tmp := cl.slotsPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cl.slotsPath())
+}
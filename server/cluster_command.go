@@ -0,0 +1,609 @@
+package server
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/innovationb1ue/RedisGO/raftexample"
+	"github.com/innovationb1ue/RedisGO/resp"
+	"go.etcd.io/etcd/raft/v3"
+)
+
+// cluster_command.go implements the CLUSTER command. Every member of every raft group is presented
+// to the clients as a node of a Redis Cluster, the leader of a group being the master of its slots.
+
+// slotRun is a range of slots served by the same group.
+type slotRun struct {
+	start, end int
+	g          *raftGroup
+}
+
+// nodeName returns the ID of a member of a raft group, derived from its raft URL.
+func nodeName(raftAddr string) string {
+	sum := sha1.Sum([]byte(raftAddr))
+	return hex.EncodeToString(sum[:])
+}
+
+// memberName returns the ID of the member of the group with the given raft ID.
+func (g *raftGroup) memberName(id uint64) string {
+	member, _ := g.member(id)
+	return nodeName(member.raftAddr)
+}
+
+// slotRuns returns the ranges of slots served by the same group, in order.
+func (cl *Cluster) slotRuns() []slotRun {
+	cl.slotMu.RLock()
+	defer cl.slotMu.RUnlock()
+	runs := make([]slotRun, 0, len(cl.groups))
+	for slot, g := range cl.slots {
+		if n := len(runs); n > 0 && runs[n-1].g == g {
+			runs[n-1].end = slot
+			continue
+		}
+		runs = append(runs, slotRun{start: slot, end: slot, g: g})
+	}
+	return runs
+}
+
+// findNode returns the group and the raft ID of the node with the given ID.
+func (cl *Cluster) findNode(name string) (*raftGroup, uint64) {
+	for _, g := range cl.groups {
+		for _, member := range g.members() {
+			if nodeName(member.raftAddr) == name {
+				return g, member.id
+			}
+		}
+	}
+	return nil, 0
+}
+
+// splitHostPort splits a client address into its ip and port. The port is 0 if the address is invalid.
+func splitHostPort(addr string) (string, int) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+
+// raftPort returns the port of a raft URL, which is reported as the cluster bus port.
+func raftPort(raftAddr string) int {
+	idx := strings.LastIndex(raftAddr, ":")
+	if idx < 0 {
+		return 0
+	}
+	port, _ := strconv.Atoi(raftAddr[idx+1:])
+	return port
+}
+
+// clusterCommand handles the CLUSTER command and its subcommands.
+func (cl *Cluster) clusterCommand(ctx context.Context, c *Client, cmd [][]byte) resp.RedisData {
+	if len(cmd) < 2 {
+		return resp.MakeWrongNumberArgs("cluster")
+	}
+	switch subCmd := strings.ToLower(string(cmd[1])); subCmd {
+	case "keyslot":
+		if len(cmd) != 3 {
+			return resp.MakeWrongNumberArgs("cluster|keyslot")
+		}
+		return resp.MakeIntData(int64(keyHashSlot(cmd[2])))
+	case "myid":
+		if len(cmd) != 2 {
+			return resp.MakeWrongNumberArgs("cluster|myid")
+		}
+		return resp.MakeBulkData([]byte(cl.home.memberName(uint64(cl.home.cfg.NodeID))))
+	case "info":
+		if len(cmd) != 2 {
+			return resp.MakeWrongNumberArgs("cluster|info")
+		}
+		return cl.clusterInfo()
+	case "slots":
+		if len(cmd) != 2 {
+			return resp.MakeWrongNumberArgs("cluster|slots")
+		}
+		return cl.clusterSlots()
+	case "shards":
+		if len(cmd) != 2 {
+			return resp.MakeWrongNumberArgs("cluster|shards")
+		}
+		return cl.clusterShards()
+	case "nodes":
+		if len(cmd) != 2 {
+			return resp.MakeWrongNumberArgs("cluster|nodes")
+		}
+		return resp.MakeBulkData([]byte(cl.clusterNodes()))
+	case "countkeysinslot":
+		if len(cmd) != 3 {
+			return resp.MakeWrongNumberArgs("cluster|countkeysinslot")
+		}
+		slot, errData := parseSlot(cmd[2])
+		if errData != nil {
+			return errData
+		}
+		return resp.MakeIntData(int64(len(cl.keysInSlot(c.dbIdx, slot, -1))))
+	case "getkeysinslot":
+		if len(cmd) != 4 {
+			return resp.MakeWrongNumberArgs("cluster|getkeysinslot")
+		}
+		slot, errData := parseSlot(cmd[2])
+		if errData != nil {
+			return errData
+		}
+		count, err := strconv.Atoi(string(cmd[3]))
+		if err != nil || count < 0 {
+			return resp.MakeErrorData("ERR Invalid number of keys")
+		}
+		keys := cl.keysInSlot(c.dbIdx, slot, count)
+		res := make([]resp.RedisData, 0, len(keys))
+		for _, key := range keys {
+			res = append(res, resp.MakeBulkData([]byte(key)))
+		}
+		return resp.MakeArrayData(res)
+	case "setslot":
+		return cl.setSlot(cmd)
+	case "meet":
+		return cl.clusterMeet(ctx, cmd, false)
+	case "addlearner":
+		return cl.clusterMeet(ctx, cmd, true)
+	case "promote":
+		return cl.clusterPromote(ctx, cmd)
+	case "failover":
+		return cl.clusterFailover(ctx, cmd)
+	case "forget":
+		return cl.clusterForget(ctx, cmd)
+	case "members":
+		return cl.clusterMembers(cmd)
+	default:
+		return resp.MakeErrorData(fmt.Sprintf("ERR unknown subcommand '%s'. Try CLUSTER HELP.", subCmd))
+	}
+}
+
+// parseSlot parses the slot argument of a CLUSTER subcommand.
+func parseSlot(arg []byte) (int, resp.RedisData) {
+	slot, err := strconv.Atoi(string(arg))
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		return 0, resp.MakeErrorData("ERR Invalid or out of range slot")
+	}
+	return slot, nil
+}
+
+// clusterInfo replies to CLUSTER INFO. The groups of the other nodes are always reported as healthy.
+func (cl *Cluster) clusterInfo() resp.RedisData {
+	nodes := 0
+	for _, g := range cl.groups {
+		nodes += len(g.members())
+	}
+	state := "ok"
+	for _, g := range cl.groups {
+		if g.node != nil && g.leader() == raft.None {
+			state = "fail"
+		}
+	}
+	info := fmt.Sprintf("cluster_enabled:1\r\ncluster_state:%s\r\ncluster_slots_assigned:%d\r\ncluster_slots_ok:%d\r\n"+
+		"cluster_slots_pfail:0\r\ncluster_slots_fail:0\r\ncluster_known_nodes:%d\r\ncluster_size:%d\r\n",
+		state, clusterSlots, clusterSlots, nodes, len(cl.groups))
+	return resp.MakeBulkData([]byte(info))
+}
+
+// clusterSlots replies to CLUSTER SLOTS. The master of every range is followed by the other members of its group.
+func (cl *Cluster) clusterSlots() resp.RedisData {
+	res := make([]resp.RedisData, 0)
+	for _, run := range cl.slotRuns() {
+		master := run.g.master()
+		members := run.g.members()
+		ordered := make([]groupMember, 0, len(members))
+		for _, member := range members {
+			if member.id == master {
+				ordered = append([]groupMember{member}, ordered...)
+			} else {
+				ordered = append(ordered, member)
+			}
+		}
+		entry := []resp.RedisData{resp.MakeIntData(int64(run.start)), resp.MakeIntData(int64(run.end))}
+		for _, member := range ordered {
+			ip, port := splitHostPort(member.kvAddr)
+			if port == 0 {
+				continue
+			}
+			entry = append(entry, resp.MakeArrayData([]resp.RedisData{
+				resp.MakeBulkData([]byte(ip)),
+				resp.MakeIntData(int64(port)),
+				resp.MakeBulkData([]byte(nodeName(member.raftAddr))),
+			}))
+		}
+		res = append(res, resp.MakeArrayData(entry))
+	}
+	return resp.MakeArrayData(res)
+}
+
+// clusterShards replies to CLUSTER SHARDS, with one shard per raft group.
+func (cl *Cluster) clusterShards() resp.RedisData {
+	runs := cl.slotRuns()
+	res := make([]resp.RedisData, 0, len(cl.groups))
+	for _, g := range cl.groups {
+		slots := make([]resp.RedisData, 0)
+		for _, run := range runs {
+			if run.g == g {
+				slots = append(slots, resp.MakeIntData(int64(run.start)), resp.MakeIntData(int64(run.end)))
+			}
+		}
+		master := g.master()
+		members := g.members()
+		nodes := make([]resp.RedisData, 0, len(members))
+		for _, member := range members {
+			ip, port := splitHostPort(member.kvAddr)
+			role := "replica"
+			if member.id == master {
+				role = "master"
+			}
+			nodes = append(nodes, resp.MakeArrayData([]resp.RedisData{
+				resp.MakeBulkData([]byte("id")), resp.MakeBulkData([]byte(nodeName(member.raftAddr))),
+				resp.MakeBulkData([]byte("port")), resp.MakeIntData(int64(port)),
+				resp.MakeBulkData([]byte("ip")), resp.MakeBulkData([]byte(ip)),
+				resp.MakeBulkData([]byte("endpoint")), resp.MakeBulkData([]byte(ip)),
+				resp.MakeBulkData([]byte("role")), resp.MakeBulkData([]byte(role)),
+				resp.MakeBulkData([]byte("replication-offset")), resp.MakeIntData(0),
+				resp.MakeBulkData([]byte("health")), resp.MakeBulkData([]byte("online")),
+			}))
+		}
+		res = append(res, resp.MakeArrayData([]resp.RedisData{
+			resp.MakeBulkData([]byte("slots")), resp.MakeArrayData(slots),
+			resp.MakeBulkData([]byte("nodes")), resp.MakeArrayData(nodes),
+		}))
+	}
+	return resp.MakeArrayData(res)
+}
+
+// clusterNodes returns the reply of CLUSTER NODES, with the slots of a group on the line of its master.
+// The config epoch of a node is the ID of its group.
+func (cl *Cluster) clusterNodes() string {
+	runs := cl.slotRuns()
+	cl.slotMu.RLock()
+	defer cl.slotMu.RUnlock()
+	var sb strings.Builder
+	for _, g := range cl.groups {
+		master := g.master()
+		for _, member := range g.members() {
+			id := member.id
+			ip, port := splitHostPort(member.kvAddr)
+			myself := g.mgr != nil && uint64(g.cfg.NodeID) == id
+			flags, masterName := "slave", g.memberName(master)
+			if id == master {
+				flags, masterName = "master", "-"
+			}
+			if myself {
+				flags = "myself," + flags
+			}
+			sb.WriteString(fmt.Sprintf("%s %s:%d@%d %s %s 0 0 %d connected", nodeName(member.raftAddr), ip, port,
+				raftPort(member.raftAddr), flags, masterName, g.id))
+			if id == master {
+				for _, run := range runs {
+					if run.g != g {
+						continue
+					}
+					if run.start == run.end {
+						sb.WriteString(fmt.Sprintf(" %d", run.start))
+					} else {
+						sb.WriteString(fmt.Sprintf(" %d-%d", run.start, run.end))
+					}
+				}
+			}
+			if myself {
+				for slot, target := range cl.migrating {
+					if cl.slots[slot] == g {
+						sb.WriteString(fmt.Sprintf(" [%d->-%s]", slot, target.memberName(target.master())))
+					}
+				}
+				for slot, target := range cl.importing {
+					if target == g {
+						source := cl.slots[slot]
+						sb.WriteString(fmt.Sprintf(" [%d-<-%s]", slot, source.memberName(source.master())))
+					}
+				}
+			}
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
+
+// keysInSlot returns at most count keys of the database hashing to the slot, or all of them if count is negative.
+// Only the slots served by a group of this node have keys.
+func (cl *Cluster) keysInSlot(dbIdx int, slot int, count int) []string {
+	cl.slotMu.RLock()
+	g := cl.slots[slot]
+	cl.slotMu.RUnlock()
+	keys := make([]string, 0)
+	if g.mgr == nil {
+		return keys
+	}
+	g.mgr.writeMu.RLock()
+	defer g.mgr.writeMu.RUnlock()
+	for _, key := range g.mgr.DBs[dbIdx].Keys() {
+		if count >= 0 && len(keys) >= count {
+			break
+		}
+		if keyHashSlot([]byte(key)) == slot {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// holdsKeysInSlot tells whether any database of m has a key hashing to the slot.
+func (m *Manager) holdsKeysInSlot(slot int) bool {
+	m.writeMu.RLock()
+	defer m.writeMu.RUnlock()
+	for _, db := range m.DBs {
+		for _, key := range db.Keys() {
+			if keyHashSlot([]byte(key)) == slot {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setSlot handles CLUSTER SETSLOT, which moves slots between the groups.
+// MIGRATING and IMPORTING only change the routing of this node, while NODE assigns the slot to a group
+// and is persisted, so it must be sent to every node of the cluster.
+func (cl *Cluster) setSlot(cmd [][]byte) resp.RedisData {
+	if len(cmd) < 4 {
+		return resp.MakeWrongNumberArgs("cluster|setslot")
+	}
+	slot, errData := parseSlot(cmd[2])
+	if errData != nil {
+		return errData
+	}
+	action := strings.ToLower(string(cmd[3]))
+	var g *raftGroup
+	if action == "stable" {
+		if len(cmd) != 4 {
+			return resp.MakeErrorData("ERR syntax error")
+		}
+	} else {
+		if len(cmd) != 5 {
+			return resp.MakeErrorData("ERR syntax error")
+		}
+		if g, _ = cl.findNode(string(cmd[4])); g == nil {
+			return resp.MakeErrorData(fmt.Sprintf("ERR I don't know about node %s", cmd[4]))
+		}
+	}
+	cl.slotMu.Lock()
+	defer cl.slotMu.Unlock()
+	owner := cl.slots[slot]
+	switch action {
+	case "migrating":
+		if owner.mgr == nil {
+			return resp.MakeErrorData(fmt.Sprintf("ERR I'm not the owner of hash slot %d", slot))
+		}
+		if g == owner {
+			return resp.MakeErrorData("ERR Target node is the owner of the hash slot")
+		}
+		cl.migrating[slot] = g
+	case "importing":
+		// the slot is imported by the first group of this node other than the source
+		var target *raftGroup
+		for _, local := range cl.groups {
+			if local.mgr != nil && local != g {
+				target = local
+				break
+			}
+		}
+		if target == nil {
+			return resp.MakeErrorData("ERR I'm not a member of any group other than the source")
+		}
+		if target == owner {
+			return resp.MakeErrorData(fmt.Sprintf("ERR I'm already the owner of hash slot %d", slot))
+		}
+		cl.importing[slot] = target
+	case "stable":
+		delete(cl.migrating, slot)
+		delete(cl.importing, slot)
+	case "node":
+		if owner.mgr != nil && g != owner && owner.mgr.holdsKeysInSlot(slot) {
+			return resp.MakeErrorData(fmt.Sprintf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot))
+		}
+		cl.slots[slot] = g
+		delete(cl.migrating, slot)
+		delete(cl.importing, slot)
+		if err := cl.saveSlots(); err != nil {
+			return resp.MakeErrorData("ERR saving the slots failed: " + err.Error())
+		}
+	default:
+		return resp.MakeErrorData("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+	return resp.MakeStringData("OK")
+}
+
+// localGroup returns the group with the given ID, which the node must be a member of.
+func (cl *Cluster) localGroup(arg []byte) (*raftGroup, resp.RedisData) {
+	id, err := strconv.Atoi(string(arg))
+	if err != nil || id < 1 || id > len(cl.groups) {
+		return nil, resp.MakeErrorData("ERR Invalid or out of range group")
+	}
+	g := cl.groups[id-1]
+	if g.node == nil {
+		return nil, resp.MakeErrorData(fmt.Sprintf("ERR I'm not a member of group %d", id))
+	}
+	return g, nil
+}
+
+// membershipError returns the reply of a membership change that failed.
+func membershipError(err error) resp.RedisData {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return resp.MakeErrorData("ERR Timed out waiting for the membership change to apply, it may be applied later")
+	}
+	return resp.MakeErrorData("ERR " + err.Error())
+}
+
+// clusterMeet handles CLUSTER MEET raft-url [host:port [group]], which adds a member to a group of this node,
+// the first one by default. It replies with the raft ID of the new member once the change is applied,
+// which the member is started with to join the group.
+// CLUSTER ADDLEARNER takes the same arguments and adds a learner, which is promoted once it caught up.
+func (cl *Cluster) clusterMeet(ctx context.Context, cmd [][]byte, learner bool) resp.RedisData {
+	if len(cmd) < 3 || len(cmd) > 5 {
+		return resp.MakeWrongNumberArgs("cluster|" + strings.ToLower(string(cmd[1])))
+	}
+	g := cl.home
+	var addr string
+	if len(cmd) >= 4 {
+		addr = string(cmd[3])
+		if _, port := splitHostPort(addr); port == 0 {
+			return resp.MakeErrorData(fmt.Sprintf("ERR Invalid node address specified: %s", addr))
+		}
+	}
+	if len(cmd) == 5 {
+		var errData resp.RedisData
+		if g, errData = cl.localGroup(cmd[4]); errData != nil {
+			return errData
+		}
+	}
+	url := string(cmd[2])
+	// fails early, the URL is checked again when the change is applied in case another node adds it meanwhile
+	for _, member := range g.members() {
+		if member.raftAddr == url {
+			return resp.MakeErrorData(fmt.Sprintf("ERR %s is already a member of group %d", url, g.id))
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, clusterProposeTimeout)
+	defer cancel()
+	var id uint64
+	var err error
+	if learner {
+		id, err = g.node.AddLearner(ctx, url, addr)
+	} else {
+		id, err = g.node.AddMember(ctx, url, addr)
+	}
+	if err != nil {
+		return membershipError(err)
+	}
+	return resp.MakeIntData(int64(id))
+}
+
+// clusterForget handles CLUSTER FORGET node-id, which removes a member from its group once the change is applied.
+// The node must be a member of the group too.
+func (cl *Cluster) clusterForget(ctx context.Context, cmd [][]byte) resp.RedisData {
+	if len(cmd) != 3 {
+		return resp.MakeWrongNumberArgs("cluster|forget")
+	}
+	g, id, errData := cl.memberGroup(cmd[2])
+	if errData != nil {
+		return errData
+	}
+	if id == g.node.ID() {
+		return resp.MakeErrorData("ERR I tried hard but I can't forget myself...")
+	}
+	ctx, cancel := context.WithTimeout(ctx, clusterProposeTimeout)
+	defer cancel()
+	if err := g.node.RemoveMember(ctx, id); err != nil {
+		return membershipError(err)
+	}
+	return resp.MakeStringData("OK")
+}
+
+// memberGroup returns the group and the raft ID of the node with the given ID, which must be a member of
+// a group of this node.
+func (cl *Cluster) memberGroup(name []byte) (*raftGroup, uint64, resp.RedisData) {
+	g, id := cl.findNode(string(name))
+	if g == nil {
+		return nil, 0, resp.MakeErrorData(fmt.Sprintf("ERR Unknown node %s", name))
+	}
+	if g.node == nil {
+		return nil, 0, resp.MakeErrorData(fmt.Sprintf("ERR I'm not a member of group %d", g.id))
+	}
+	return g, id, nil
+}
+
+// clusterPromote handles CLUSTER PROMOTE node-id, which makes a learner a voter of its group once it caught up
+// with the leader. It must be sent to the leader of the group.
+func (cl *Cluster) clusterPromote(ctx context.Context, cmd [][]byte) resp.RedisData {
+	if len(cmd) != 3 {
+		return resp.MakeWrongNumberArgs("cluster|promote")
+	}
+	g, id, errData := cl.memberGroup(cmd[2])
+	if errData != nil {
+		return errData
+	}
+	ctx, cancel := context.WithTimeout(ctx, clusterProposeTimeout)
+	defer cancel()
+	err := g.node.PromoteMember(ctx, id)
+	if errors.Is(err, raftexample.ErrNotLeader) {
+		return resp.MakeErrorData(fmt.Sprintf("ERR I'm not the leader of group %d, the leader is %s", g.id, g.addr()))
+	} else if err != nil {
+		return membershipError(err)
+	}
+	return resp.MakeStringData("OK")
+}
+
+// clusterFailover handles CLUSTER FAILOVER [node-id], which transfers the leadership of a group to one of its voters
+// and replies once it's elected. Without node-id, this node takes over the leadership of its first group.
+func (cl *Cluster) clusterFailover(ctx context.Context, cmd [][]byte) resp.RedisData {
+	if len(cmd) > 3 {
+		return resp.MakeWrongNumberArgs("cluster|failover")
+	}
+	g, id := cl.home, uint64(cl.home.cfg.NodeID)
+	if len(cmd) == 3 {
+		var errData resp.RedisData
+		if g, id, errData = cl.memberGroup(cmd[2]); errData != nil {
+			return errData
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, clusterProposeTimeout)
+	defer cancel()
+	if err := g.node.TransferLeadership(ctx, id); errors.Is(err, context.DeadlineExceeded) {
+		return resp.MakeErrorData("ERR Timed out waiting for the election of the new leader")
+	} else if err != nil {
+		return resp.MakeErrorData("ERR " + err.Error())
+	}
+	return resp.MakeStringData("OK")
+}
+
+// clusterMembers handles CLUSTER MEMBERS [group], which reports the members of a group of this node
+// as seen by this node, the first group by default.
+func (cl *Cluster) clusterMembers(cmd [][]byte) resp.RedisData {
+	if len(cmd) > 3 {
+		return resp.MakeWrongNumberArgs("cluster|members")
+	}
+	g := cl.home
+	if len(cmd) == 3 {
+		var errData resp.RedisData
+		if g, errData = cl.localGroup(cmd[2]); errData != nil {
+			return errData
+		}
+	}
+	members := g.node.MembersStatus()
+	res := make([]resp.RedisData, 0, len(members))
+	for _, member := range members {
+		kvAddr := member.Addr
+		if kvAddr == "" {
+			kvAddr = g.configKVAddr(member.ID)
+		}
+		res = append(res, memberStatusReply(nodeName(member.URL), kvAddr, member))
+	}
+	return resp.MakeArrayData(res)
+}
+
+// memberStatusReply returns the fields of a member reported by CLUSTER MEMBERS.
+func memberStatusReply(name, kvAddr string, member raftexample.MemberStatus) resp.RedisData {
+	reachable := int64(0)
+	if member.Reachable {
+		reachable = 1
+	}
+	return resp.MakeArrayData([]resp.RedisData{
+		resp.MakeBulkData([]byte("id")), resp.MakeBulkData([]byte(name)),
+		resp.MakeBulkData([]byte("raft-id")), resp.MakeIntData(int64(member.ID)),
+		resp.MakeBulkData([]byte("raft-url")), resp.MakeBulkData([]byte(member.URL)),
+		resp.MakeBulkData([]byte("endpoint")), resp.MakeBulkData([]byte(kvAddr)),
+		resp.MakeBulkData([]byte("role")), resp.MakeBulkData([]byte(member.Role)),
+		resp.MakeBulkData([]byte("match-index")), resp.MakeIntData(int64(member.Match)),
+		resp.MakeBulkData([]byte("reachable")), resp.MakeIntData(reachable),
+	})
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/innovationb1ue/RedisGO/config"
+	"github.com/innovationb1ue/RedisGO/memdb"
+	"github.com/innovationb1ue/RedisGO/resp"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCluster_PeerKVAddr(t *testing.T) {
+	mgr := newAOFTestManager(t.TempDir())
+	assert.Equal(t, "", mgr.peerKVAddr(1))
+	mgr.cfg.PeerKVAddrs = "127.0.0.1:6380, 127.0.0.1:6381"
+	assert.Equal(t, "127.0.0.1:6380", mgr.peerKVAddr(1))
+	assert.Equal(t, "127.0.0.1:6381", mgr.peerKVAddr(2))
+	assert.Equal(t, "", mgr.peerKVAddr(3))
+	assert.Equal(t, "", mgr.peerKVAddr(0))
+}
+
+// newTestCluster builds a cluster of two groups without raft, where this node only serves the first group.
+func newTestCluster(dir string) *Cluster {
+	cfg := &config.Config{
+		Databases: 1,
+		Dir:       dir,
+		Port:      6380,
+		IsCluster: true,
+		Shards: []config.ShardConfig{
+			{Slots: "0-8191", PeerAddrs: "http://127.0.0.1:16380", PeerKVAddrs: "127.0.0.1:6380", NodeID: 1},
+			{Slots: "8192-16383", PeerAddrs: "http://127.0.0.1:16381,http://127.0.0.1:16382", PeerKVAddrs: "127.0.0.1:6381,127.0.0.1:6382"},
+		},
+	}
+	cl, err := makeCluster(cfg)
+	if err != nil {
+		panic(err)
+	}
+	cl.home = cl.groups[0]
+	cl.home.mgr = NewManager(cfg)
+	return cl
+}
+
+func TestCluster_Route(t *testing.T) {
+	cl := newTestCluster(t.TempDir())
+	c := cl.home.mgr.newFakeClient(0)
+	// bar hashes to slot 5061 and foo to slot 12182
+	g, errData := cl.route(c, memdb.MakeCommandBytes("get bar"), false)
+	assert.Nil(t, errData)
+	assert.Equal(t, cl.home, g)
+	_, errData = cl.route(c, memdb.MakeCommandBytes("get foo"), false)
+	assert.Equal(t, "MOVED 12182 127.0.0.1:6381", string(errData.ByteData()))
+	_, errData = cl.route(c, memdb.MakeCommandBytes("mget bar foo"), false)
+	assert.Equal(t, "CROSSSLOT Keys in request don't hash to the same slot", string(errData.ByteData()))
+	g, errData = cl.route(c, memdb.MakeCommandBytes("mget {foo}bar {foo}baz"), false)
+	assert.Equal(t, "MOVED 12182 127.0.0.1:6381", string(errData.ByteData()))
+	assert.Nil(t, g)
+	g, errData = cl.route(c, memdb.MakeCommandBytes("ping"), false)
+	assert.Nil(t, errData)
+	assert.Equal(t, cl.home, g)
+}
+
+func TestCluster_Migrate(t *testing.T) {
+	dir := t.TempDir()
+	cl := newTestCluster(dir)
+	c := cl.home.mgr.newFakeClient(0)
+	target := cl.groups[1].memberName(1)
+	assert.Equal(t, "OK", string(cl.clusterCommand(context.Background(), c, memdb.MakeCommandBytes("cluster setslot 5061 migrating "+target)).ByteData()))
+	// the keys missing from the slot were moved already
+	_, errData := cl.route(c, memdb.MakeCommandBytes("get bar"), false)
+	assert.Equal(t, "ASK 5061 127.0.0.1:6381", string(errData.ByteData()))
+	cl.home.mgr.DBs[0].ExecCommand(context.Background(), memdb.MakeCommandBytes("set bar v"), nil)
+	g, errData := cl.route(c, memdb.MakeCommandBytes("get bar"), false)
+	assert.Nil(t, errData)
+	assert.Equal(t, cl.home, g)
+	assert.Equal(t, int64(1), cl.clusterCommand(context.Background(), c, memdb.MakeCommandBytes("cluster countkeysinslot 5061")).(*resp.IntData).Data())
+	// the slot can't be assigned while it has keys here
+	res := cl.clusterCommand(context.Background(), c, memdb.MakeCommandBytes("cluster setslot 5061 node "+target))
+	assert.IsType(t, &resp.ErrorData{}, res)
+	cl.home.mgr.DBs[0].ExecCommand(context.Background(), memdb.MakeCommandBytes("del bar"), nil)
+	assert.Equal(t, "OK", string(cl.clusterCommand(context.Background(), c, memdb.MakeCommandBytes("cluster setslot 5061 node "+target)).ByteData()))
+	_, errData = cl.route(c, memdb.MakeCommandBytes("get bar"), false)
+	assert.Equal(t, "MOVED 5061 127.0.0.1:6381", string(errData.ByteData()))
+	// the assignment survives a restart
+	cl = newTestCluster(dir)
+	_, errData = cl.route(c, memdb.MakeCommandBytes("get bar"), false)
+	assert.Equal(t, "MOVED 5061 127.0.0.1:6381", string(errData.ByteData()))
+	assert.Len(t, cl.clusterSlots().(*resp.ArrayData).Data(), 4)
+}
+
+func TestCluster_Command(t *testing.T) {
+	cl := newTestCluster(t.TempDir())
+	c := cl.home.mgr.newFakeClient(0)
+	assert.Equal(t, int64(12182), cl.clusterCommand(context.Background(), c, memdb.MakeCommandBytes("cluster keyslot foo")).(*resp.IntData).Data())
+	assert.Equal(t, int64(12182), cl.clusterCommand(context.Background(), c, memdb.MakeCommandBytes("cluster keyslot {foo}bar")).(*resp.IntData).Data())
+	myID := string(cl.clusterCommand(context.Background(), c, memdb.MakeCommandBytes("cluster myid")).ByteData())
+	assert.Equal(t, nodeName("http://127.0.0.1:16380"), myID)
+
+	slots := cl.clusterCommand(context.Background(), c, memdb.MakeCommandBytes("cluster slots")).(*resp.ArrayData).Data()
+	assert.Len(t, slots, 2)
+	second := slots[1].(*resp.ArrayData).Data()
+	assert.Len(t, second, 4)
+	assert.Equal(t, int64(8192), second[0].(*resp.IntData).Data())
+	assert.Equal(t, int64(16383), second[1].(*resp.IntData).Data())
+	master := second[2].(*resp.ArrayData).Data()
+	assert.Equal(t, "127.0.0.1", string(master[0].ByteData()))
+	assert.Equal(t, int64(6381), master[1].(*resp.IntData).Data())
+
+	nodes := strings.Split(strings.TrimSpace(string(cl.clusterCommand(context.Background(), c, memdb.MakeCommandBytes("cluster nodes")).ByteData())), "\n")
+	assert.Len(t, nodes, 3)
+	assert.Equal(t, myID+" 127.0.0.1:6380@16380 myself,master - 0 0 1 connected 0-8191", nodes[0])
+	assert.Equal(t, cl.groups[1].memberName(2)+" 127.0.0.1:6382@16382 slave "+cl.groups[1].memberName(1)+" 0 0 2 connected", nodes[2])
+
+	shards := cl.clusterCommand(context.Background(), c, memdb.MakeCommandBytes("cluster shards")).(*resp.ArrayData).Data()
+	assert.Len(t, shards, 2)
+	assert.IsType(t, &resp.ErrorData{}, cl.clusterCommand(context.Background(), c, memdb.MakeCommandBytes("cluster setslot 16384 stable")))
+	assert.IsType(t, &resp.ErrorData{}, cl.clusterCommand(context.Background(), c, memdb.MakeCommandBytes("cluster setslot 1 node unknown")))
+
+	// the members are only changed through the groups of this node
+	res := cl.clusterCommand(context.Background(), c, memdb.MakeCommandBytes("cluster meet http://127.0.0.1:16383 127.0.0.1:6383 2"))
+	assert.Equal(t, "ERR I'm not a member of group 2", string(res.ByteData()))
+	res = cl.clusterCommand(context.Background(), c, memdb.MakeCommandBytes("cluster meet http://127.0.0.1:16383 6383"))
+	assert.Equal(t, "ERR Invalid node address specified: 6383", string(res.ByteData()))
+	res = cl.clusterCommand(context.Background(), c, memdb.MakeCommandBytes("cluster forget "+cl.groups[1].memberName(2)))
+	assert.Equal(t, "ERR I'm not a member of group 2", string(res.ByteData()))
+	res = cl.clusterCommand(context.Background(), c, memdb.MakeCommandBytes("cluster forget unknown"))
+	assert.Equal(t, "ERR Unknown node unknown", string(res.ByteData()))
+	res = cl.clusterCommand(context.Background(), c, memdb.MakeCommandBytes("cluster promote unknown"))
+	assert.Equal(t, "ERR Unknown node unknown", string(res.ByteData()))
+	res = cl.clusterCommand(context.Background(), c, memdb.MakeCommandBytes("cluster failover "+cl.groups[1].memberName(1)))
+	assert.Equal(t, "ERR I'm not a member of group 2", string(res.ByteData()))
+}
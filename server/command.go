@@ -0,0 +1,135 @@
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/innovationb1ue/RedisGO/memdb"
+	"github.com/innovationb1ue/RedisGO/resp"
+)
+
+// command.go registers the commands executed by the Manager and implements the COMMAND command,
+// which lets the client libraries discover the arity, flags and key positions of every command.
+
+// RegisterServerCommands registers the metadata of the commands handled by the Manager instead of a MemDb.
+func RegisterServerCommands() {
+	memdb.RegisterCommand("select", nil, 2, 0, 0, 0, 0)
+	memdb.RegisterCommand("client", nil, -2, 0, 0, 0, 0)
+	memdb.RegisterCommand("command", nil, -1, 0, 0, 0, 0)
+	memdb.RegisterCommand("save", nil, 1, memdb.CmdAdmin, 0, 0, 0)
+	memdb.RegisterCommand("bgsave", nil, 1, memdb.CmdAdmin, 0, 0, 0)
+	memdb.RegisterCommand("lastsave", nil, 1, 0, 0, 0, 0)
+	memdb.RegisterCommand("bgrewriteaof", nil, 1, memdb.CmdAdmin, 0, 0, 0)
+	memdb.RegisterCommand("multi", nil, 1, 0, 0, 0, 0)
+	memdb.RegisterCommand("exec", nil, 1, 0, 0, 0, 0)
+	memdb.RegisterCommand("discard", nil, 1, 0, 0, 0, 0)
+	memdb.RegisterCommand("watch", nil, -2, 0, 1, -1, 1)
+	memdb.RegisterCommand("unwatch", nil, 1, 0, 0, 0, 0)
+	memdb.RegisterCommand("migrate", nil, -6, memdb.CmdWrite, 3, 3, 1)
+	memdb.CmdTable["migrate"].GetKeys = migrateKeys
+	memdb.RegisterCommand("cluster", nil, -2, 0, 0, 0, 0)
+	memdb.RegisterCommand("asking", nil, 1, 0, 0, 0, 0)
+	memdb.RegisterCommand("replicaof", nil, 3, memdb.CmdAdmin, 0, 0, 0)
+	memdb.RegisterCommand("slaveof", nil, 3, memdb.CmdAdmin, 0, 0, 0)
+	memdb.RegisterCommand("psync", nil, 3, memdb.CmdAdmin, 0, 0, 0)
+	memdb.RegisterCommand("replconf", nil, -1, memdb.CmdAdmin, 0, 0, 0)
+	memdb.RegisterCommand("role", nil, 1, 0, 0, 0, 0)
+	memdb.RegisterCommand("info", nil, -1, 0, 0, 0, 0)
+	memdb.RegisterCommand("wait", nil, 3, 0, 0, 0, 0)
+	memdb.RegisterCommand("waitaof", nil, 4, 0, 0, 0, 0)
+	memdb.RegisterCommand("hello", nil, -1, 0, 0, 0, 0)
+}
+
+// lookupCommand finds the command and checks its number of arguments.
+func lookupCommand(cmd [][]byte) (*memdb.Command, resp.RedisData) {
+	cmdName := strings.ToLower(string(cmd[0]))
+	command, ok := memdb.CmdTable[cmdName]
+	if !ok {
+		return nil, resp.MakeErrorData("ERR unknown command ", cmdName)
+	}
+	if !command.CheckArity(len(cmd)) {
+		return nil, resp.MakeWrongNumberArgs(cmdName)
+	}
+	return command, nil
+}
+
+// Command handles the COMMAND command and its subcommands.
+func (m *Manager) Command(cmd [][]byte) resp.RedisData {
+	if len(cmd) == 1 {
+		names := make([]string, 0, len(memdb.CmdTable))
+		for name := range memdb.CmdTable {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		res := make([]resp.RedisData, 0, len(names))
+		for _, name := range names {
+			res = append(res, commandInfo(memdb.CmdTable[name]))
+		}
+		return resp.MakeArrayData(res)
+	}
+	switch subCmd := strings.ToLower(string(cmd[1])); subCmd {
+	case "count":
+		if len(cmd) != 2 {
+			return resp.MakeWrongNumberArgs("command|count")
+		}
+		return resp.MakeIntData(int64(len(memdb.CmdTable)))
+	case "info":
+		res := make([]resp.RedisData, 0, len(cmd)-2)
+		for _, name := range cmd[2:] {
+			if command, ok := memdb.CmdTable[strings.ToLower(string(name))]; ok {
+				res = append(res, commandInfo(command))
+			} else {
+				res = append(res, resp.MakeArrayData(nil))
+			}
+		}
+		return resp.MakeArrayData(res)
+	case "getkeys":
+		if len(cmd) < 3 {
+			return resp.MakeWrongNumberArgs("command|getkeys")
+		}
+		command, ok := memdb.CmdTable[strings.ToLower(string(cmd[2]))]
+		if !ok {
+			return resp.MakeErrorData("ERR Invalid command specified")
+		}
+		if !command.CheckArity(len(cmd) - 2) {
+			return resp.MakeErrorData("ERR Invalid number of arguments specified for command")
+		}
+		keys := command.Keys(cmd[2:])
+		if len(keys) == 0 {
+			return resp.MakeErrorData("ERR The command has no key arguments")
+		}
+		res := make([]resp.RedisData, 0, len(keys))
+		for _, key := range keys {
+			res = append(res, resp.MakeBulkData([]byte(key)))
+		}
+		return resp.MakeArrayData(res)
+	default:
+		return resp.MakeErrorData("ERR unknown subcommand '" + subCmd + "'. Try COMMAND COUNT, INFO or GETKEYS.")
+	}
+}
+
+// commandInfo describes a command in the format of the COMMAND reply:
+// name, arity, flags, first key, last key, key step, ACL categories, tips, key specs and subcommands.
+func commandInfo(command *memdb.Command) resp.RedisData {
+	flags := make([]resp.RedisData, 0)
+	categories := make([]resp.RedisData, 0)
+	for _, name := range command.FlagNames() {
+		flags = append(flags, resp.MakeStringData(name))
+		if name == "readonly" {
+			name = "read"
+		}
+		categories = append(categories, resp.MakeStringData("@"+name))
+	}
+	return resp.MakeArrayData([]resp.RedisData{
+		resp.MakeBulkData([]byte(command.Name)),
+		resp.MakeIntData(int64(command.Arity)),
+		resp.MakeArrayData(flags),
+		resp.MakeIntData(int64(command.FirstKey)),
+		resp.MakeIntData(int64(command.LastKey)),
+		resp.MakeIntData(int64(command.KeyStep)),
+		resp.MakeArrayData(categories),
+		resp.MakeArrayData([]resp.RedisData{}),
+		resp.MakeArrayData([]resp.RedisData{}),
+		resp.MakeArrayData([]resp.RedisData{}),
+	})
+}
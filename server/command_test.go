@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/innovationb1ue/RedisGO/memdb"
+	"github.com/innovationb1ue/RedisGO/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommand_Arity(t *testing.T) {
+	ctx := context.Background()
+	mgr := newAOFTestManager(t.TempDir())
+	c := mgr.newFakeClient(0)
+	assert.Equal(t, []byte("-ERR wrong number of arguments for 'get' command\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("get a b")).ToBytes())
+	assert.Equal(t, []byte("-ERR wrong number of arguments for 'hset' command\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("hset h f")).ToBytes())
+	assert.Equal(t, []byte("-ERR wrong number of arguments for 'select' command\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("select")).ToBytes())
+	// a command with a wrong number of arguments fails the transaction
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("multi"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("set k v"))
+	_, isErr := mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("incr k 1")).(*resp.ErrorData)
+	assert.True(t, isErr)
+	assert.Equal(t, []byte("-EXECABORT Transaction discarded because of previous errors.\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("exec")).ToBytes())
+	assert.Equal(t, []byte("$-1\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("get k")).ToBytes())
+}
+
+func TestCommand_Info(t *testing.T) {
+	ctx := context.Background()
+	mgr := newAOFTestManager(t.TempDir())
+	c := mgr.newFakeClient(0)
+	count := mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("command count")).(*resp.IntData).Data()
+	assert.Equal(t, int64(len(memdb.CmdTable)), count)
+	assert.Equal(t, int(count), len(mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("command")).(*resp.ArrayData).Data()))
+
+	info := mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("command info mset nosuchcommand")).(*resp.ArrayData).Data()
+	assert.Equal(t, 2, len(info))
+	assert.Equal(t, []byte("*10\r\n$4\r\nmset\r\n:-3\r\n*1\r\n+write\r\n:1\r\n:-1\r\n:2\r\n*1\r\n+@write\r\n*0\r\n*0\r\n*0\r\n"), info[0].ToBytes())
+	assert.Equal(t, []byte("*-1\r\n"), info[1].ToBytes())
+	blpop := mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("command info blpop")).(*resp.ArrayData).Data()[0].(*resp.ArrayData).Data()
+	assert.Equal(t, []byte("*2\r\n+write\r\n+blocking\r\n"), blpop[2].ToBytes())
+}
+
+func TestCommand_GetKeys(t *testing.T) {
+	ctx := context.Background()
+	mgr := newAOFTestManager(t.TempDir())
+	c := mgr.newFakeClient(0)
+	assert.Equal(t, []byte("*2\r\n$2\r\nk1\r\n$2\r\nk2\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("command getkeys mset k1 v1 k2 v2")).ToBytes())
+	assert.Equal(t, []byte("*2\r\n$1\r\na\r\n$1\r\nb\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("command getkeys blpop a b 0")).ToBytes())
+	assert.Equal(t, []byte("*1\r\n$1\r\nk\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("command getkeys set k v")).ToBytes())
+	assert.Equal(t, []byte("-ERR The command has no key arguments\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("command getkeys ping")).ToBytes())
+	assert.Equal(t, []byte("-ERR Invalid number of arguments specified for command\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("command getkeys get")).ToBytes())
+	assert.Equal(t, []byte("-ERR Invalid command specified\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("command getkeys nosuchcommand k")).ToBytes())
+}
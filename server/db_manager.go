@@ -2,25 +2,51 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"github.com/google/uuid"
 	"github.com/innovationb1ue/RedisGO/config"
 	"github.com/innovationb1ue/RedisGO/logger"
 	"github.com/innovationb1ue/RedisGO/memdb"
-	"github.com/innovationb1ue/RedisGO/raftexample"
 	"github.com/innovationb1ue/RedisGO/resp"
-	"go.etcd.io/etcd/raft/v3/raftpb"
 	"io"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Manager handles all client requests to the server
 // It holds multiple MemDb instances
 type Manager struct {
-	CurrentDB *memdb.MemDb
-	DBs       []*memdb.MemDb
+	DBs     []*memdb.MemDb
+	cfg     *config.Config
+	clients sync.Map // connected clients by ID
+	// ID of the last connected client
+	nextClientID atomic.Int64
+	// persistence states
+	dirty    int64      // number of writes since the last successful save
+	lastSave int64      // unix time of the last successful save
+	bgSaving int32      // set to 1 while a background save is running
+	saveMu   sync.Mutex // serializes snapshot writers
+	aof      *aof       // append only file. nil if disabled
+	// set to 1 while the append only file is being rewritten
+	aofRewriting int32
+	// the dataset captured by the running rewrite. nil if there is none
+	aofCapture atomic.Pointer[aofCapture]
+	// held by the commands while executing and logging, and exclusively by the append only file
+	// rewrite to start collecting the writes and by the raft snapshot restore to swap the dataset
+	writeMu sync.RWMutex
+	// transaction locks of every database
+	txLocks []*memdb.Locks
+	// clients watching each key
+	watchers map[watchedKeyID]map[*Client]struct{}
+	watchMu  sync.Mutex
+	// master-replica replication
+	repl *replication
+	// time the server started at
+	startTime time.Time
 }
 
 type MemStorageStats struct {
@@ -30,13 +56,31 @@ type MemStorageStats struct {
 // NewManager creates a default Manager
 func NewManager(cfg *config.Config) *Manager {
 	DBs := make([]*memdb.MemDb, cfg.Databases)
+	txLocks := make([]*memdb.Locks, cfg.Databases)
 	for i := 0; i < cfg.Databases; i++ {
 		DBs[i] = memdb.NewMemDb()
+		txLocks[i] = memdb.NewLocks(txLockCount)
 	}
-	return &Manager{
-		CurrentDB: DBs[0],
+	m := &Manager{
 		DBs:       DBs,
+		cfg:       cfg,
+		lastSave:  time.Now().Unix(),
+		txLocks:   txLocks,
+		watchers:  make(map[watchedKeyID]map[*Client]struct{}),
+		repl:      newReplication(cfg.ReplBacklogSize),
+		startTime: time.Now(),
 	}
+	for i, db := range DBs {
+		dbIdx := i
+		db.SetExpireHook(func(key string) { m.expired(dbIdx, key) })
+	}
+	return m
+}
+
+// expired replicates the deletion of a key that expired by the local clock.
+func (m *Manager) expired(dbIdx int, key string) {
+	m.touchKeys(dbIdx, []string{key})
+	m.propagate(aofEntry{dbIdx: dbIdx, cmd: [][]byte{[]byte("DEL"), []byte(key)}})
 }
 
 // Handle distributes all the client command to execute
@@ -48,108 +92,283 @@ func (m *Manager) Handle(ctx context.Context, conn net.Conn) {
 			logger.Error(err)
 		}
 	}()
-	// create a goroutine that reads from the client and pump data into ch
-	ch := resp.ParseStream(ctx, conn)
-	// parsedRes is a complete command read from client
+	c := m.newClient(conn)
+	defer m.removeClient(c)
+	defer closeOnDone(ctx, conn)()
+	rd := resp.NewReader(conn, m.protoLimits())
 	for {
-		select {
-		case parsedRes := <-ch:
-			// handle errors
-			if parsedRes.Err != nil {
-				if parsedRes.Err == io.EOF {
-					logger.Info("Close connection ", conn.RemoteAddr().String())
-				} else {
-					logger.Panic("Handle connection ", conn.RemoteAddr().String(), " panic: ", parsedRes.Err.Error())
-				}
-				return
-			}
-			// empty msg
-			if parsedRes.Data == nil {
-				logger.Error("empty parsedRes.Data from ", conn.RemoteAddr().String())
-				continue
-			}
-			// handling array command
-			arrayData, ok := parsedRes.Data.(*resp.ArrayData)
-			if !ok {
-				logger.Error("parsedRes.Data is not ArrayData from ", conn.RemoteAddr().String())
-				continue
-			}
-			// extract [][]bytes command
-			cmd := arrayData.ToCommand()
-			// run the string command when in standalone mode
-			// also pass connection as an argument since the command may block and return continuous messages
-			res := m.ExecCommand(ctx, cmd, conn)
-			// return result
-			if res != nil {
-				_, err := conn.Write(res.ToBytes())
-				if err != nil {
-					logger.Error("write response to ", conn.RemoteAddr().String(), " error: ", err.Error())
-				}
+		// cmd is a complete command read from client
+		cmd, err := rd.ReadCommand()
+		if err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				logger.Info("Close connection ", conn.RemoteAddr().String())
+			} else if errData := protocolErrorReply(err); errData != nil {
+				logger.Info("Close connection ", conn.RemoteAddr().String(), " after ", err.Error())
+				_ = c.out.WriteData(errData, c.protocol())
+				c.flushReplies()
 			} else {
-				// return error
-				errData := resp.MakeErrorData("unknown error")
-				_, err := conn.Write(errData.ToBytes())
-				if err != nil {
-					logger.Error("write response to ", conn.RemoteAddr().String(), " error: ", err.Error())
-				}
+				logger.Error("Handle connection ", conn.RemoteAddr().String(), " error: ", err.Error())
 			}
-		case <-ctx.Done():
 			return
 		}
+		// run the string command when in standalone mode
+		// also pass connection as an argument since the command may block and return continuous messages
+		res := m.ExecCommand(ctx, c, cmd)
+		// the connection of a replica only carries the replication stream after PSYNC
+		if c.hasFlag(clientReplica) {
+			continue
+		}
+		if res == nil {
+			res = resp.MakeErrorData("unknown error")
+		}
+		if err := c.out.WriteData(res, c.protocol()); err != nil {
+			logger.Error("write response to ", conn.RemoteAddr().String(), " error: ", err.Error())
+			return
+		}
+		// the replies of a pipeline are written at once, when all its commands are served
+		if rd.Buffered() == 0 {
+			if err := c.out.Flush(); err != nil {
+				logger.Error("write response to ", conn.RemoteAddr().String(), " error: ", err.Error())
+				return
+			}
+		}
+	}
+}
+
+// closeOnDone closes the connection when the server shuts down, which stops the reads of its commands.
+// The returned function stops watching the server once the connection is served.
+func closeOnDone(ctx context.Context, conn net.Conn) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// protoLimits returns the limits of the requests of the clients.
+func (m *Manager) protoLimits() resp.Limits {
+	return resp.Limits{
+		MaxBulkLen:     m.cfg.ProtoMaxBulkLen,
+		MaxMultiBulk:   m.cfg.ProtoMaxMultiBulk,
+		MaxQueryBuffer: m.cfg.QueryBufLimit,
 	}
 }
 
-func (m *Manager) ExecCommand(ctx context.Context, cmd [][]byte, conn net.Conn) resp.RedisData {
+// protocolErrorReply returns the error replied to a client whose request is malformed,
+// nil if err is not a protocol error.
+func protocolErrorReply(err error) *resp.ErrorData {
+	var protoErr *resp.ProtocolError
+	if !errors.As(err, &protoErr) {
+		return nil
+	}
+	return resp.MakeErrorData("ERR " + protoErr.Error())
+}
+
+// ExecCommand executes a command for the client on its selected database.
+func (m *Manager) ExecCommand(ctx context.Context, c *Client, cmd [][]byte) resp.RedisData {
 	if len(cmd) == 0 {
 		return nil
 	}
-	var res resp.RedisData
 	cmdName := strings.ToLower(string(cmd[0]))
-	// global commands
+	c.startCommand(cmdName)
+	command, errData := lookupCommand(cmd)
+	if errData == nil && command.HasFlag(memdb.CmdWrite) && m.readOnly() && !c.hasFlag(clientMaster) {
+		errData = resp.MakeErrorData("READONLY You can't write against a read only replica.")
+	}
+	if errData != nil {
+		// a command that fails to queue makes the whole transaction fail
+		if c.hasFlag(clientMulti) {
+			c.setFlag(clientDirtyExec, true)
+		}
+		return errData
+	}
+	// transaction commands
 	switch cmdName {
-	case "select":
-		return m.Select(cmd)
+	case "multi":
+		return m.Multi(c, cmd)
+	case "exec":
+		return m.Exec(ctx, c, cmd)
+	case "discard":
+		return m.Discard(c, cmd)
+	case "watch":
+		return m.Watch(c, cmd)
 	}
-	// get the command from hash table and execute it.
-	command, ok := memdb.CmdTable[cmdName]
-	if !ok {
-		res = resp.MakeErrorData("ERR unknown command ", cmdName)
-	} else {
-		res = command.Executor(ctx, m.CurrentDB, cmd, conn)
+	if c.hasFlag(clientMulti) {
+		return m.queueCommand(c, cmd)
 	}
-	return res
+	return m.execCommand(ctx, c, cmd, false)
 }
 
-func (m *Manager) ExecStrCommand(ctx context.Context, cmdStr string, conn net.Conn) resp.RedisData {
-	cmd := strings.Split(cmdStr, " ")
-	if len(cmd) == 0 {
-		return nil
+// execCommand executes a single command. inExec is true for the commands queued by a transaction,
+// which run under the locks taken by EXEC and are logged to the append only file by EXEC at once.
+func (m *Manager) execCommand(ctx context.Context, c *Client, cmd [][]byte, inExec bool) resp.RedisData {
+	command, errData := lookupCommand(cmd)
+	if errData != nil {
+		return errData
 	}
-	var res resp.RedisData
-	cmdName := strings.ToLower(cmd[0])
+	cmdName := command.Name
 	// global commands
-	byteCmd := make([][]byte, 0)
-	for _, s := range cmd {
-		byteCmd = append(byteCmd, []byte(s))
-	}
 	switch cmdName {
 	case "select":
-		return m.Select(byteCmd)
+		return m.Select(c, cmd)
+	case "client":
+		return m.ClientCommand(c, cmd)
+	case "save":
+		return m.Save(cmd)
+	case "bgsave":
+		return m.BgSave(cmd)
+	case "lastsave":
+		return m.LastSave(cmd)
+	case "bgrewriteaof":
+		return m.BgRewriteAOF(cmd)
+	case "unwatch":
+		return m.Unwatch(c, cmd)
+	case "command":
+		return m.Command(cmd)
+	case "migrate":
+		return m.Migrate(ctx, c, cmd)
+	case "replicaof", "slaveof":
+		return m.ReplicaOf(ctx, cmd)
+	case "psync":
+		return m.Psync(c, cmd)
+	case "replconf":
+		return m.ReplConf(c, cmd)
+	case "role":
+		return m.Role(cmd)
+	case "info":
+		return m.Info(cmd)
+	case "wait":
+		return m.Wait(ctx, c, cmd, inExec)
+	case "waitaof":
+		return m.WaitAOF(ctx, c, cmd, inExec)
+	case "hello":
+		return m.Hello(c, cmd)
+	case "cluster", "asking":
+		// served by the Cluster in cluster mode
+		return resp.MakeErrorData("ERR This instance has cluster support disabled")
+	}
+	isWrite := command.HasFlag(memdb.CmdWrite)
+	keys := command.Keys(cmd)
+	isBlocking := command.HasFlag(memdb.CmdBlocking)
+	if isBlocking && !inExec {
+		// the replies of the commands before are not held back while the client is blocked
+		c.flushReplies()
+		c.setFlag(clientBlocked, true)
+		defer c.setFlag(clientBlocked, false)
+		return m.blockingPop(ctx, c, cmd, keys)
+	} else if cmdName == "subscribe" {
+		c.setFlag(clientPubSub, true)
+		defer c.setFlag(clientPubSub, false)
+	}
+	if !inExec {
+		// the writes hold their keys until they are propagated, so that the append only file and the replicas
+		// get the writes to a key in the order they are executed
+		if len(keys) > 0 && isWrite {
+			m.txLocks[c.dbIdx].LockMulti(keys)
+			defer m.txLocks[c.dbIdx].UnLockMulti(keys)
+		} else if len(keys) > 0 {
+			m.txLocks[c.dbIdx].RLockMulti(keys)
+			defer m.txLocks[c.dbIdx].RUnLockMulti(keys)
+		}
+		m.writeMu.RLock()
+		defer m.writeMu.RUnlock()
+		if isWrite && len(keys) > 0 {
+			m.captureForRewrite(c.dbIdx, keys)
+		}
 	}
-	// get the command from hash table and execute it.
-	command, ok := memdb.CmdTable[cmdName]
-	if !ok {
-		res = resp.MakeErrorData("ERR unknown command ", cmdName)
+	var res resp.RedisData
+	now := time.Now().UnixMilli()
+	if isBlocking {
+		res = m.popNonBlocking(ctx, c, cmd)
 	} else {
-		res = command.Executor(ctx, m.CurrentDB, byteCmd, conn)
+		res = command.Executor(ctx, c.db.Lookup(keys, isWrite), cmd, c.conn)
+	}
+	if _, isErr := res.(*resp.ErrorData); !isErr && isWrite {
+		m.written(c, cmd, keys, res, now, inExec)
 	}
 	return res
 }
 
-func (m *Manager) Select(cmd [][]byte) resp.RedisData {
-	if len(cmd) != 2 {
-		return resp.MakeWrongNumberArgs("select")
+// written counts a successful write for the save points, fails the transactions watching the keys
+// and logs it to the append only file. The writes of a transaction are logged by EXEC at once.
+func (m *Manager) written(c *Client, cmd [][]byte, keys []string, res resp.RedisData, now int64, inExec bool) {
+	atomic.AddInt64(&m.dirty, 1)
+	m.touchKeys(c.dbIdx, keys)
+	if inExec {
+		return
+	}
+	if propagated := propagatedCommand(c.db, cmd, res, now); propagated != nil {
+		m.propagate(aofEntry{dbIdx: c.dbIdx, cmd: propagated})
+		c.woff = m.repl.getOffset()
+	}
+}
+
+// blockingPopInterval is the time between two attempts of a blocked BLPOP or BRPOP to pop from its lists.
+const blockingPopInterval = 100 * time.Millisecond
+
+// blockingPop serves BLPOP and BRPOP, which wait until one of their lists has an element or the timeout.
+// A blocked client holds no lock while it waits: each attempt to pop takes the locks of a write,
+// so that the pop is propagated in order and never overlaps a snapshot load or an append only file rewrite.
+func (m *Manager) blockingPop(ctx context.Context, c *Client, cmd [][]byte, keys []string) resp.RedisData {
+	timeout, err := strconv.Atoi(string(cmd[len(cmd)-1]))
+	if err != nil {
+		return resp.MakeErrorData("ERR timeout is not a float or out of range")
+	}
+	var expired <-chan time.Time
+	if timeout != 0 {
+		timer := time.NewTimer(time.Duration(timeout) * time.Second)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	ticker := time.NewTicker(blockingPopInterval)
+	defer ticker.Stop()
+	for {
+		if res := m.tryPop(ctx, c, cmd, keys); res != nil {
+			return res
+		}
+		select {
+		case <-ticker.C:
+		case <-expired:
+			return resp.MakeBulkData(nil)
+		case <-ctx.Done():
+			return resp.MakeBulkData(nil)
+		}
+	}
+}
+
+// tryPop pops an element from the first non-empty list of a BLPOP or BRPOP. It returns nil if the lists are empty.
+// The client is unblocked with an error if this node became a read-only replica while it waited,
+// since the lists are the ones of the master from then on.
+func (m *Manager) tryPop(ctx context.Context, c *Client, cmd [][]byte, keys []string) resp.RedisData {
+	m.txLocks[c.dbIdx].LockMulti(keys)
+	defer m.txLocks[c.dbIdx].UnLockMulti(keys)
+	m.writeMu.RLock()
+	defer m.writeMu.RUnlock()
+	if m.readOnly() && !c.hasFlag(clientMaster) {
+		return resp.MakeErrorData("UNBLOCKED force unblock from blocking operation, instance state changed (master -> replica?)")
+	}
+	m.captureForRewrite(c.dbIdx, keys)
+	now := time.Now().UnixMilli()
+	res := m.popNonBlocking(ctx, c, cmd)
+	if bulk, ok := res.(*resp.BulkData); ok && bulk.ByteData() == nil {
+		return nil
+	}
+	if _, isErr := res.(*resp.ErrorData); !isErr {
+		m.written(c, cmd, keys, res, now, false)
 	}
+	return res
+}
+
+// ExecClusterCommand executes a command committed by raft on the given database.
+func (m *Manager) ExecClusterCommand(ctx context.Context, dbIdx int, cmd [][]byte) resp.RedisData {
+	return m.ExecCommand(ctx, m.newFakeClient(dbIdx), cmd)
+}
+
+func (m *Manager) Select(c *Client, cmd [][]byte) resp.RedisData {
 	dbIdx, err := strconv.Atoi(string(cmd[1]))
 	if err != nil {
 		return resp.MakeErrorData("ERR value is not an integer or out of range")
@@ -157,104 +376,52 @@ func (m *Manager) Select(cmd [][]byte) resp.RedisData {
 	if dbIdx >= len(m.DBs) || dbIdx < 0 {
 		return resp.MakeErrorData(fmt.Sprintf("ERR DB index is out of range with maximum %d", len(m.DBs)))
 	}
-	m.CurrentDB = m.DBs[dbIdx]
+	c.selectDB(m.DBs[dbIdx], dbIdx)
 	return resp.MakeStringData("OK")
 }
 
-// HandleCluster handle the client commands from cli (tcp connection stream).
-func (m *Manager) HandleCluster(ctx context.Context, conn net.Conn, proposeC chan<- *raftexample.RaftProposal, confChangeC chan<- raftpb.ConfChangeI, callback map[string]chan resp.RedisData, filter *middleware) {
-	// gracefully close the tcp connection to client
-	defer func() {
-		err := conn.Close()
-		if err != nil {
-			logger.Error(err)
-		}
-	}()
-	// create a goroutine that reads from the client and pump data into ch
-	ch := resp.ParseStream(ctx, conn)
+// localCommands are executed on the node the client connects to instead of being proposed to the cluster.
+var localCommands = map[string]struct{}{
+	"rconf": {}, "member": {}, "select": {}, "client": {}, "command": {}, "multi": {}, "exec": {}, "discard": {}, "watch": {}, "unwatch": {},
+	"replicaof": {}, "slaveof": {}, "psync": {}, "replconf": {}, "role": {}, "info": {}, "wait": {}, "waitaof": {},
+	"hello": {},
+}
 
-	ctx = context.WithValue(ctx, "confChangeC", confChangeC)
-	// parsedRes is a complete command read from client
-	for {
-		select {
-		case parsedRes := <-ch:
-			// handle errors
-			if parsedRes.Err != nil {
-				if parsedRes.Err == io.EOF {
-					logger.Info("Close connection ", conn.RemoteAddr().String())
-				} else {
-					logger.Panic("Handle connection ", conn.RemoteAddr().String(), " panic: ", parsedRes.Err.Error())
-				}
-				return
-			}
-			// empty msg
-			if parsedRes.Data == nil {
-				logger.Error("empty parsedRes.Data from ", conn.RemoteAddr().String())
-				continue
-			}
-			// handling array command
-			arrayData, ok := parsedRes.Data.(*resp.ArrayData)
-			if !ok {
-				logger.Error("parsedRes.Data is not ArrayData from ", conn.RemoteAddr().String())
-				continue
-			}
-			// extract [][]bytes command
-			cmd := arrayData.ToCommand()
-			// get command passed through filters
-			var err error
-			cmd, err = filter.Filter(cmd)
-			if err != nil {
-				logger.Error("filter error ", err)
-				// return error
-				errData := resp.MakeErrorData("command does not pass checks")
-				_, err := conn.Write(errData.ToBytes())
-				if err != nil {
-					logger.Error("write response to ", conn.RemoteAddr().String(), " error: ", err.Error())
-				}
-				continue
-			}
-			cmdStrings := arrayData.ToStringCommand()
+func isLocalCommand(cmdName string) bool {
+	_, ok := localCommands[cmdName]
+	return ok
+}
 
-			// confChange command
-			// todo: temporary workaround for confChange propose
-			// might treat the rconf command as a normal command and wait for master to accept it and return response
-			if cmdStrings[0] == "rconf" {
-				res := m.ExecCommand(ctx, cmd, conn)
-				_, err := conn.Write(res.ToBytes())
-				if err != nil {
-					logger.Error("write response to ", conn.RemoteAddr().String(), " error: ", err.Error())
-				}
-				continue
-			}
+const (
+	// clusterReadTimeout bounds the time a read waits for the cluster to confirm it.
+	clusterReadTimeout = 5 * time.Second
+	// clusterProposeTimeout bounds the time a write waits for the cluster to commit and apply it.
+	clusterProposeTimeout = 5 * time.Second
+)
 
-			// proposeC command to raft cluster
-			cmdID := uuid.NewString()
-			callback[cmdID] = make(chan resp.RedisData)
-			// todo: decide which command needs to be proposed to cluster
-			// For example, query command does not need to be proposed.
-			proposal := &raftexample.RaftProposal{
-				Data: strings.Join(cmdStrings, " "),
-				ID:   cmdID,
-			}
-			proposeC <- proposal
-			res := <-callback[cmdID]
-			delete(callback, cmdID)
-			// return result
-			if res != nil {
-				_, err := conn.Write(res.ToBytes())
-				if err != nil {
-					logger.Error("write response to ", conn.RemoteAddr().String(), " error: ", err.Error())
-				}
-			} else {
-				// return error
-				errData := resp.MakeErrorData("unknown error")
-				_, err := conn.Write(errData.ToBytes())
-				if err != nil {
-					logger.Error("write response to ", conn.RemoteAddr().String(), " error: ", err.Error())
-				}
-			}
-		case <-ctx.Done():
-			return
-		}
+// clusterRead executes a read-only command locally with the consistency of the read mode of the client.
+func (m *Manager) clusterRead(ctx context.Context, c *Client, cmd [][]byte) resp.RedisData {
+	if errData := m.confirmRead(ctx, c); errData != nil {
+		return errData
+	}
+	return m.ExecCommand(ctx, c, cmd)
+}
+
+// confirmRead waits until the local data reflects the writes committed before, following the read mode of the client.
+func (m *Manager) confirmRead(ctx context.Context, c *Client) resp.RedisData {
+	if c.readMode == readStale {
+		return nil
+	}
+	readCtx, cancel := context.WithTimeout(ctx, clusterReadTimeout)
+	defer cancel()
+	var err error
+	if c.readMode == readLease {
+		err = c.db.Raft.LeaseRead(readCtx)
+	} else {
+		err = c.db.Raft.ReadIndex(readCtx)
+	}
+	if err != nil {
+		return resp.MakeErrorData("ERR failed to confirm the read with the cluster: " + err.Error())
 	}
+	return nil
 }
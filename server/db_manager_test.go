@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/innovationb1ue/RedisGO/memdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandle_InlineCommands(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mgr := newAOFTestManager(t.TempDir())
+	server, client := net.Pipe()
+	defer client.Close()
+	go mgr.Handle(ctx, server)
+	rd := bufio.NewReader(client)
+	send := func(line string) string {
+		_, err := client.Write([]byte(line))
+		assert.Nil(t, err)
+		reply, err := rd.ReadString('\n')
+		assert.Nil(t, err)
+		return reply
+	}
+
+	assert.Equal(t, "+PONG\r\n", send("PING\r\n"))
+	// the lines typed in telnet may end with \n alone, and the empty lines are skipped
+	assert.Equal(t, "+OK\r\n", send("\r\n\n set  k \"a\\tb\"\n"))
+	assert.Equal(t, "$3\r\n", send("get k\r\n"))
+	line, _ := rd.ReadString('\n')
+	assert.Equal(t, "a\tb\r\n", line)
+	// the inline commands may be mixed with the commands in arrays
+	assert.Equal(t, ":1\r\n", send("*2\r\n$3\r\ndel\r\n$1\r\nk\r\n"))
+
+	// a protocol error is replied before the connection is closed
+	assert.Equal(t, "-ERR Protocol error: unbalanced quotes in request\r\n", send("set k \"v\r\n"))
+	_, err := rd.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestHandle_ProtoLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mgr := newAOFTestManager(t.TempDir())
+	mgr.cfg.ProtoMaxBulkLen = 16
+	mgr.cfg.ProtoMaxMultiBulk = 3
+	tests := map[string]string{
+		"*2\r\n$3\r\nget\r\n$17\r\n": "-ERR Protocol error: invalid bulk length\r\n",
+		"*4\r\n":                     "-ERR Protocol error: invalid multibulk length\r\n",
+		"*1\r\n$9999999999\r\n":      "-ERR Protocol error: invalid bulk length\r\n",
+	}
+	for request, expect := range tests {
+		server, client := net.Pipe()
+		go mgr.Handle(ctx, server)
+		rd := bufio.NewReader(client)
+		_, err := client.Write([]byte(request))
+		assert.Nil(t, err)
+		reply, err := rd.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, expect, reply)
+		// the client is disconnected
+		_, err = rd.ReadString('\n')
+		assert.Equal(t, io.EOF, err)
+		client.Close()
+	}
+}
+
+func TestHandle_Pipeline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mgr := newAOFTestManager(t.TempDir())
+	server, client := net.Pipe()
+	defer client.Close()
+	go mgr.Handle(ctx, server)
+	rd := bufio.NewReader(client)
+
+	// the replies of a pipeline are written together
+	_, err := client.Write([]byte("set k 1\r\nincr k\r\n*2\r\n$3\r\nget\r\n$1\r\nk\r\n"))
+	assert.Nil(t, err)
+	replies := make([]byte, len("+OK\r\n:2\r\n$1\r\n2\r\n"))
+	_, err = io.ReadFull(rd, replies)
+	assert.Nil(t, err)
+	assert.Equal(t, "+OK\r\n:2\r\n$1\r\n2\r\n", string(replies))
+
+	// the replies before a blocking command are not held back while it waits
+	go func() {
+		_, err := client.Write([]byte("set k 3\r\nblpop list 0\r\n"))
+		assert.Nil(t, err)
+	}()
+	reply, err := rd.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "+OK\r\n", reply)
+	go mgr.ExecCommand(ctx, mgr.newFakeClient(0), [][]byte{[]byte("rpush"), []byte("list"), []byte("v")})
+	replies = make([]byte, len("*2\r\n+list\r\n$1\r\nv\r\n"))
+	_, err = io.ReadFull(rd, replies)
+	assert.Nil(t, err)
+	assert.Equal(t, "*2\r\n+list\r\n$1\r\nv\r\n", string(replies))
+
+	// the server shutting down disconnects the client
+	cancel()
+	_, err = rd.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestBlockingPop(t *testing.T) {
+	ctx := context.Background()
+	mgr := newAOFTestManager(t.TempDir())
+	c := mgr.newFakeClient(0)
+	pop := func(cmd string) <-chan string {
+		resC := make(chan string, 1)
+		go func() { resC <- string(mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes(cmd)).ToBytes()) }()
+		return resC
+	}
+	mgr.ExecCommand(ctx, mgr.newFakeClient(0), memdb.MakeCommandBytes("rpush list a"))
+	assert.Equal(t, "*2\r\n+list\r\n$1\r\na\r\n", <-pop("blpop empty list 1"))
+	assert.Equal(t, "$-1\r\n", <-pop("brpop empty 1"))
+
+	// a blocked client pops from the dataset loaded from a snapshot while it waits
+	src := newAOFTestManager(t.TempDir())
+	src.ExecCommand(ctx, src.newFakeClient(0), memdb.MakeCommandBytes("rpush list b c"))
+	data, err := memdb.Snapshot(src.DBs)
+	assert.Nil(t, err)
+	resC := pop("brpop list 5")
+	waitFor(t, "the blocked client", func() bool { return c.hasFlag(clientBlocked) })
+	mgr.writeMu.Lock()
+	assert.Nil(t, memdb.LoadSnapshot(data, mgr.DBs))
+	mgr.writeMu.Unlock()
+	assert.Equal(t, "*2\r\n+list\r\n$1\r\nc\r\n", <-resC)
+}
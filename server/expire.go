@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/innovationb1ue/RedisGO/memdb"
+)
+
+// expire.go runs the active expire cycle of the databases in standalone mode. In cluster mode the leader
+// deletes the expired keys through the raft log instead, see clusterExpireCron.
+
+// expireFastCycleInterval is the time between two fast cycles while the databases are behind.
+const expireFastCycleInterval = 2 * time.Millisecond
+
+// expireCron runs a slow cycle every memdb.ExpireCycleInterval, and fast cycles in between
+// while the slow cycles don't keep up with the expired keys.
+func (m *Manager) expireCron(ctx context.Context) {
+	ticker := time.NewTicker(memdb.ExpireCycleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		behind := m.activeExpireCycle(memdb.ExpireSlowCycleBudget)
+		for behind {
+			select {
+			case <-ticker.C:
+				// the next slow cycle is due
+				behind = m.activeExpireCycle(memdb.ExpireSlowCycleBudget)
+			case <-time.After(expireFastCycleInterval):
+				behind = m.activeExpireCycle(memdb.ExpireFastCycleBudget)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// activeExpireCycle deletes the expired keys of the databases within the budget
+// and returns whether any database has too many expired keys left.
+func (m *Manager) activeExpireCycle(budget time.Duration) bool {
+	// the deletions are propagated like the writes of the clients
+	m.writeMu.RLock()
+	defer m.writeMu.RUnlock()
+	deadline := time.Now().Add(budget)
+	behind := false
+	for _, db := range m.DBs {
+		if db.ActiveExpireCycle(deadline) {
+			behind = true
+		}
+	}
+	return behind
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/innovationb1ue/RedisGO/resp"
+)
+
+// hello.go implements HELLO, which switches a connection between RESP2 and RESP3.
+// The replies of a RESP3 connection use the richer types of RESP3, like the maps of HGETALL
+// and the push messages of the subscribed channels.
+
+// serverVersion is the version of Redis whose commands RedisGO follows, reported by HELLO.
+const serverVersion = "7.0.0"
+
+// Hello handles HELLO [protover [AUTH username password] [SETNAME clientname]]. It switches the connection to the
+// protocol version and replies with the properties of the connection in that version. There are no passwords,
+// so AUTH only accepts the default user.
+func (m *Manager) Hello(c *Client, cmd [][]byte) resp.RedisData {
+	proto := c.protocol()
+	if len(cmd) > 1 {
+		v, err := strconv.Atoi(string(cmd[1]))
+		if err != nil {
+			return resp.MakeErrorData("ERR Protocol version is not an integer or out of range")
+		}
+		if v < 2 || v > 3 {
+			return resp.MakeErrorData("NOPROTO unsupported protocol version")
+		}
+		proto = v
+	}
+	// the options are all checked before any of them applies
+	var name string
+	var setName bool
+	for i := 2; i < len(cmd); i++ {
+		opt := strings.ToLower(string(cmd[i]))
+		more := len(cmd) - i - 1
+		switch {
+		case opt == "auth" && more >= 2:
+			if string(cmd[i+1]) != "default" {
+				return resp.MakeErrorData("WRONGPASS invalid username-password pair or user is disabled.")
+			}
+			i += 2
+		case opt == "setname" && more >= 1:
+			name, setName = string(cmd[i+1]), true
+			if errData := checkClientName(name); errData != nil {
+				return errData
+			}
+			i++
+		default:
+			return resp.MakeErrorData("ERR Syntax error in HELLO option '" + string(cmd[i]) + "'")
+		}
+	}
+	if setName {
+		c.setName(name)
+	}
+	c.setProtocol(proto)
+
+	mode := "standalone"
+	if m.cfg.IsCluster {
+		mode = "cluster"
+	}
+	role := "master"
+	if m.repl.currentLink() != nil {
+		role = "replica"
+	}
+	return resp.MakeMapData([]resp.RedisData{
+		resp.MakeBulkData([]byte("server")), resp.MakeBulkData([]byte("redis")),
+		resp.MakeBulkData([]byte("version")), resp.MakeBulkData([]byte(serverVersion)),
+		resp.MakeBulkData([]byte("proto")), resp.MakeIntData(int64(proto)),
+		resp.MakeBulkData([]byte("id")), resp.MakeIntData(c.ID),
+		resp.MakeBulkData([]byte("mode")), resp.MakeBulkData([]byte(mode)),
+		resp.MakeBulkData([]byte("role")), resp.MakeBulkData([]byte(role)),
+		resp.MakeBulkData([]byte("modules")), resp.MakeEmptyArrayData(),
+	})
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/innovationb1ue/RedisGO/memdb"
+	"github.com/innovationb1ue/RedisGO/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHello(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mgr := newAOFTestManager(t.TempDir())
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	c := mgr.newClient(server)
+	defer mgr.removeClient(c)
+	exec := func(cmd string) string {
+		return string(resp.Encode(mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes(cmd)), c.protocol()))
+	}
+
+	assert.Equal(t, "-NOPROTO unsupported protocol version\r\n", exec("hello 4"))
+	assert.Equal(t, "-ERR Protocol version is not an integer or out of range\r\n", exec("hello three"))
+	assert.Equal(t, "-WRONGPASS invalid username-password pair or user is disabled.\r\n", exec("hello 3 auth admin secret"))
+	assert.Equal(t, "-ERR Syntax error in HELLO option 'setname'\r\n", exec("hello 3 setname"))
+	// a failed HELLO changes nothing
+	assert.Equal(t, 2, c.protocol())
+
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("hset hash f v"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("sadd set a"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("zadd zset 1.5 m"))
+	assert.Equal(t, "*2\r\n$1\r\nf\r\n$1\r\nv\r\n", exec("hgetall hash"))
+	assert.Equal(t, "*2\r\n$1\r\nm\r\n$8\r\n1.500000\r\n", exec("zrange zset 0 100 withscores"))
+
+	id := strconv.FormatInt(c.ID, 10)
+	assert.Equal(t, "%7\r\n$6\r\nserver\r\n$5\r\nredis\r\n$7\r\nversion\r\n$5\r\n"+serverVersion+"\r\n"+
+		"$5\r\nproto\r\n:3\r\n$2\r\nid\r\n:"+id+"\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n"+
+		"$4\r\nrole\r\n$6\r\nmaster\r\n$7\r\nmodules\r\n*0\r\n", exec("hello 3 auth default anything setname worker"))
+	assert.Equal(t, "worker", c.getName())
+	assert.Equal(t, "%1\r\n$1\r\nf\r\n$1\r\nv\r\n", exec("hgetall hash"))
+	assert.Equal(t, "~1\r\n+a\r\n", exec("smembers set"))
+	assert.Equal(t, "*1\r\n*2\r\n$1\r\nm\r\n,1.5\r\n", exec("zrange zset 0 100 withscores"))
+	assert.Equal(t, "_\r\n", exec("get nokey"))
+	assert.Contains(t, exec("client info"), "=")
+
+	// the messages of the subscribed channels are push messages
+	assert.Equal(t, ">3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n", exec("subscribe ch"))
+	go mgr.ExecCommand(ctx, mgr.newFakeClient(0), memdb.MakeCommandBytes("publish ch hi"))
+	msg := make([]byte, len(">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n"))
+	_, err := io.ReadFull(client, msg)
+	assert.Nil(t, err)
+	assert.Equal(t, ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n", string(msg))
+
+	// HELLO 2 switches back
+	assert.Contains(t, exec("hello 2"), "*14\r\n")
+	assert.Equal(t, "$-1\r\n", exec("get nokey"))
+}
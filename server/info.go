@@ -0,0 +1,174 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/innovationb1ue/RedisGO/resp"
+)
+
+// info.go implements the INFO command, which reports the states of the server in sections of field:value lines.
+
+// infoSection is a section of the INFO reply.
+type infoSection struct {
+	name  string
+	write func(m *Manager, b *strings.Builder)
+}
+
+// infoSections are the sections in the order they are reported.
+var infoSections = []infoSection{
+	{"server", (*Manager).infoServer},
+	{"clients", (*Manager).infoClients},
+	{"persistence", (*Manager).infoPersistence},
+	{"stats", (*Manager).infoStats},
+	{"replication", (*Manager).infoReplication},
+}
+
+// Info handles INFO [section ...]. All the sections are reported without arguments or with all, default or everything.
+func (m *Manager) Info(cmd [][]byte) resp.RedisData {
+	wanted := make(map[string]bool)
+	for _, arg := range cmd[1:] {
+		wanted[strings.ToLower(string(arg))] = true
+	}
+	all := len(wanted) == 0 || wanted["all"] || wanted["default"] || wanted["everything"]
+	var b strings.Builder
+	for _, section := range infoSections {
+		if !all && !wanted[section.name] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + strings.ToUpper(section.name[:1]) + section.name[1:] + "\r\n")
+		section.write(m, &b)
+	}
+	return resp.MakeVerbatimData("txt", b.String())
+}
+
+// infoField writes a field:value line.
+func infoField(b *strings.Builder, name string, value any) {
+	fmt.Fprintf(b, "%s:%v\r\n", name, value)
+}
+
+func (m *Manager) infoServer(b *strings.Builder) {
+	mode := "standalone"
+	if m.cfg.IsCluster {
+		mode = "cluster"
+	}
+	uptime := time.Since(m.startTime)
+	infoField(b, "redis_mode", mode)
+	infoField(b, "process_id", os.Getpid())
+	infoField(b, "tcp_port", m.cfg.Port)
+	infoField(b, "uptime_in_seconds", int64(uptime.Seconds()))
+	infoField(b, "uptime_in_days", int64(uptime.Hours()/24))
+}
+
+func (m *Manager) infoClients(b *strings.Builder) {
+	connected, blocked := 0, 0
+	m.clients.Range(func(_, value any) bool {
+		connected++
+		if value.(*Client).hasFlag(clientBlocked) {
+			blocked++
+		}
+		return true
+	})
+	infoField(b, "connected_clients", connected)
+	infoField(b, "blocked_clients", blocked)
+}
+
+func (m *Manager) infoPersistence(b *strings.Builder) {
+	infoField(b, "rdb_changes_since_last_save", atomic.LoadInt64(&m.dirty))
+	infoField(b, "rdb_bgsave_in_progress", atomic.LoadInt32(&m.bgSaving))
+	infoField(b, "rdb_last_save_time", atomic.LoadInt64(&m.lastSave))
+	aofEnabled := 0
+	if m.aof != nil {
+		aofEnabled = 1
+	}
+	infoField(b, "aof_enabled", aofEnabled)
+	infoField(b, "aof_rewrite_in_progress", atomic.LoadInt32(&m.aofRewriting))
+}
+
+func (m *Manager) infoStats(b *strings.Builder) {
+	var expired, volatile, timeCapReached int64
+	var stale float64
+	// the keys of the databases are swapped under the write lock when a snapshot is loaded
+	m.writeMu.RLock()
+	defer m.writeMu.RUnlock()
+	for _, db := range m.DBs {
+		stats := db.ExpireStats()
+		expired += stats.Expired
+		volatile += stats.Volatile
+		timeCapReached += stats.TimeCapReached
+		// the estimates of the databases are weighted by their number of keys with a TTL
+		stale += stats.StalePerc * float64(stats.Volatile)
+	}
+	if volatile > 0 {
+		stale /= float64(volatile)
+	}
+	infoField(b, "expired_keys", expired)
+	infoField(b, "expired_stale_perc", fmt.Sprintf("%.2f", stale))
+	infoField(b, "expired_time_cap_reached_count", timeCapReached)
+}
+
+func (m *Manager) infoReplication(b *strings.Builder) {
+	r := m.repl
+	link := r.currentLink()
+	if link == nil {
+		infoField(b, "role", "master")
+	} else {
+		host, port := link.hostPort()
+		state := link.getState()
+		infoField(b, "role", "slave")
+		infoField(b, "master_host", host)
+		infoField(b, "master_port", port)
+		if state == linkConnected {
+			infoField(b, "master_link_status", "up")
+		} else {
+			infoField(b, "master_link_status", "down")
+		}
+		infoField(b, "master_last_io_seconds_ago", int64(time.Since(link.lastIOTime()).Seconds()))
+		if state == linkSync {
+			infoField(b, "master_sync_in_progress", 1)
+		} else {
+			infoField(b, "master_sync_in_progress", 0)
+		}
+		infoField(b, "slave_repl_offset", r.getOffset())
+		readOnly := 0
+		if m.cfg.ReplicaReadOnly {
+			readOnly = 1
+		}
+		infoField(b, "slave_read_only", readOnly)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	infoField(b, "connected_slaves", len(r.replicas))
+	now := time.Now()
+	for i, rc := range r.sortedReplicasLocked() {
+		host, port, _ := net.SplitHostPort(rc.addr)
+		infoField(b, fmt.Sprintf("slave%d", i), fmt.Sprintf("ip=%s,port=%s,state=%s,offset=%d,lag=%d",
+			host, port, rc.state, rc.ack, int64(now.Sub(rc.ackTime).Seconds())))
+	}
+	secondID := r.id2
+	if secondID == "" {
+		secondID = strings.Repeat("0", 40)
+	}
+	infoField(b, "master_replid", r.id)
+	infoField(b, "master_replid2", secondID)
+	infoField(b, "master_repl_offset", r.offset)
+	infoField(b, "second_repl_offset", r.secondOffset)
+	if r.backlog == nil {
+		infoField(b, "repl_backlog_active", 0)
+		infoField(b, "repl_backlog_size", r.backlogSize)
+		infoField(b, "repl_backlog_first_byte_offset", 0)
+		infoField(b, "repl_backlog_histlen", 0)
+		return
+	}
+	infoField(b, "repl_backlog_active", 1)
+	infoField(b, "repl_backlog_size", len(r.backlog.buf))
+	infoField(b, "repl_backlog_first_byte_offset", r.offset-r.backlog.histlen+1)
+	infoField(b, "repl_backlog_histlen", r.backlog.histlen)
+}
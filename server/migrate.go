@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/innovationb1ue/RedisGO/memdb"
+	"github.com/innovationb1ue/RedisGO/raftexample"
+	"github.com/innovationb1ue/RedisGO/resp"
+)
+
+// migrate.go implements MIGRATE, which moves keys to another instance with DUMP payloads and RESTORE.
+
+// migrateArgs are the parsed arguments of MIGRATE host port key|"" db timeout [COPY] [REPLACE] [KEYS key...].
+type migrateArgs struct {
+	addr          string
+	db            int
+	timeout       time.Duration
+	copy, replace bool
+	keys          []string
+}
+
+// parseMigrateArgs parses the arguments of MIGRATE, which satisfies the arity of the command.
+func parseMigrateArgs(cmd [][]byte) (*migrateArgs, resp.RedisData) {
+	args := &migrateArgs{addr: net.JoinHostPort(string(cmd[1]), string(cmd[2]))}
+	db, err := strconv.Atoi(string(cmd[4]))
+	if err != nil || db < 0 {
+		return nil, resp.MakeErrorData("ERR value is not an integer or out of range")
+	}
+	args.db = db
+	timeout, err := strconv.ParseInt(string(cmd[5]), 10, 64)
+	if err != nil {
+		return nil, resp.MakeErrorData("ERR value is not an integer or out of range")
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+	args.timeout = time.Duration(timeout) * time.Millisecond
+	for i := 6; i < len(cmd); i++ {
+		switch strings.ToLower(string(cmd[i])) {
+		case "copy":
+			args.copy = true
+		case "replace":
+			args.replace = true
+		case "keys":
+			if len(cmd[3]) != 0 {
+				return nil, resp.MakeErrorData("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			for _, key := range cmd[i+1:] {
+				args.keys = append(args.keys, string(key))
+			}
+			i = len(cmd)
+		default:
+			return nil, resp.MakeErrorData("ERR syntax error")
+		}
+	}
+	if args.keys == nil {
+		args.keys = []string{string(cmd[3])}
+	}
+	return args, nil
+}
+
+// migrateKeys returns the keys of MIGRATE.
+func migrateKeys(cmd [][]byte) []string {
+	for i := 6; i < len(cmd); i++ {
+		if strings.ToLower(string(cmd[i])) == "keys" {
+			keys := make([]string, 0, len(cmd)-i-1)
+			for _, key := range cmd[i+1:] {
+				keys = append(keys, string(key))
+			}
+			return keys
+		}
+	}
+	return []string{string(cmd[3])}
+}
+
+// transferKeys restores the keys of db on the target instance, and returns the keys it accepted and the MIGRATE reply.
+// The keys missing from db are skipped.
+func transferKeys(ctx context.Context, db *memdb.MemDb, args *migrateArgs) ([]string, resp.RedisData) {
+	keys := make([]string, 0, len(args.keys))
+	var request []byte
+	request = append(request, makeCommand("SELECT", strconv.Itoa(args.db)).ToBytes()...)
+	for _, key := range args.keys {
+		payload, expireAt, ok := db.Dump(key)
+		if !ok {
+			continue
+		}
+		keys = append(keys, key)
+		// the expiration time is sent as is, so the key expires at the same time on the target
+		restore := []string{"RESTORE", key, strconv.FormatInt(expireAt, 10), string(payload), "ABSTTL"}
+		if args.replace {
+			restore = append(restore, "REPLACE")
+		}
+		request = append(request, makeCommand(restore...).ToBytes()...)
+	}
+	if len(keys) == 0 {
+		return nil, resp.MakeStringData("NOKEY")
+	}
+	conn, err := net.DialTimeout("tcp", args.addr, args.timeout)
+	if err != nil {
+		return nil, resp.MakeErrorData("IOERR error or timeout connecting to the client")
+	}
+	defer conn.Close()
+	// stop the parser before closing the connection
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if err := conn.SetDeadline(time.Now().Add(args.timeout)); err != nil {
+		return nil, resp.MakeErrorData("IOERR " + err.Error())
+	}
+	if _, err := conn.Write(request); err != nil {
+		return nil, resp.MakeErrorData("IOERR error or timeout writing to target instance")
+	}
+	replies := resp.ParseStream(ctx, conn)
+	moved := make([]string, 0, len(keys))
+	var errData resp.RedisData
+	// the first reply is the one of SELECT
+	for i := -1; i < len(keys); i++ {
+		reply := <-replies
+		if reply.Err != nil {
+			return moved, resp.MakeErrorData("IOERR error or timeout reading from target instance")
+		}
+		if e, ok := reply.Data.(*resp.ErrorData); ok {
+			if errData == nil {
+				errData = resp.MakeErrorData("ERR Target instance replied with error: " + string(e.ByteData()))
+			}
+		} else if i >= 0 {
+			moved = append(moved, keys[i])
+		}
+	}
+	if errData != nil {
+		return moved, errData
+	}
+	return moved, resp.MakeStringData("OK")
+}
+
+// makeCommand builds a command as an array of bulk strings.
+func makeCommand(args ...string) *resp.ArrayData {
+	data := make([]resp.RedisData, 0, len(args))
+	for _, arg := range args {
+		data = append(data, resp.MakeBulkData([]byte(arg)))
+	}
+	return resp.MakeArrayData(data)
+}
+
+// Migrate moves keys to another instance. The keys are locked until they are deleted,
+// so no other client modifies them in the meantime.
+func (m *Manager) Migrate(ctx context.Context, c *Client, cmd [][]byte) resp.RedisData {
+	args, errData := parseMigrateArgs(cmd)
+	if errData != nil {
+		return errData
+	}
+	m.txLocks[c.dbIdx].LockMulti(args.keys)
+	defer m.txLocks[c.dbIdx].UnLockMulti(args.keys)
+	m.writeMu.RLock()
+	defer m.writeMu.RUnlock()
+	m.captureForRewrite(c.dbIdx, args.keys)
+	moved, res := transferKeys(ctx, c.db, args)
+	if args.copy || len(moved) == 0 {
+		return res
+	}
+	del := [][]byte{[]byte("DEL")}
+	for _, key := range moved {
+		del = append(del, []byte(key))
+	}
+	c.db.ExecCommand(ctx, del, nil)
+	atomic.AddInt64(&m.dirty, 1)
+	m.touchKeys(c.dbIdx, moved)
+	m.propagate(aofEntry{dbIdx: c.dbIdx, cmd: del})
+	return res
+}
+
+// migrateProposal moves keys to another instance from this node, then proposes to delete the moved keys.
+// The deletion watches the keys, so a key modified while it was moved is kept.
+func (m *Manager) migrateProposal(ctx context.Context, c *Client, id string, cmd [][]byte) (*raftexample.RaftProposal, func(resp.RedisData) resp.RedisData, resp.RedisData) {
+	args, errData := parseMigrateArgs(cmd)
+	if errData != nil {
+		return nil, nil, errData
+	}
+	if errData := m.confirmRead(ctx, c); errData != nil {
+		return nil, nil, errData
+	}
+	digests := make(map[string]uint64, len(args.keys))
+	for _, key := range args.keys {
+		digests[key] = c.db.KeyDigest(key)
+	}
+	moved, res := transferKeys(ctx, c.db, args)
+	if args.copy || len(moved) == 0 {
+		return nil, nil, res
+	}
+	proposal := &raftexample.RaftProposal{
+		ID:    id,
+		DB:    c.dbIdx,
+		Multi: true,
+		Batch: make([][][]byte, 0, 1),
+	}
+	del := [][]byte{[]byte("del")}
+	for _, key := range moved {
+		del = append(del, []byte(key))
+		proposal.Watches = append(proposal.Watches, raftexample.RaftWatch{DB: c.dbIdx, Key: key, Digest: digests[key]})
+	}
+	proposal.Batch = append(proposal.Batch, del)
+	// the keys are on the target already, only a failure to propose the deletion is reported
+	finish := func(deleted resp.RedisData) resp.RedisData {
+		if errData, ok := deleted.(*resp.ErrorData); ok {
+			return errData
+		}
+		return res
+	}
+	return proposal, finish, nil
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/innovationb1ue/RedisGO/memdb"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveTestManager serves the clients of mgr on a local port and returns the port.
+func serveTestManager(t *testing.T, ctx context.Context, mgr *Manager) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go mgr.Handle(ctx, conn)
+		}
+	}()
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestMigrate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	src, dst := newAOFTestManager(t.TempDir()), newAOFTestManager(t.TempDir())
+	port := serveTestManager(t, ctx, dst)
+	c, d := src.newFakeClient(0), dst.newFakeClient(1)
+	exec := func(mgr *Manager, c *Client, cmd string) string {
+		return string(mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes(cmd)).ToBytes())
+	}
+	exec(src, c, "set k v")
+	exec(src, c, "expire k 100")
+	exec(src, c, "rpush list a b")
+	assert.Equal(t, "+OK\r\n", exec(src, c, "migrate 127.0.0.1 "+port+" k 1 1000"))
+	assert.Equal(t, "$-1\r\n", exec(src, c, "get k"))
+	assert.Equal(t, "$1\r\nv\r\n", exec(dst, d, "get k"))
+	assert.Equal(t, ":100\r\n", exec(dst, d, "ttl k"))
+	assert.Equal(t, "+NOKEY\r\n", exec(src, c, "migrate 127.0.0.1 "+port+" k 1 1000"))
+
+	// the keys are kept with COPY, and existing keys are only overwritten with REPLACE
+	exec(src, c, "set k v2")
+	assert.Equal(t, "+OK\r\n", exec(src, c, "migrate 127.0.0.1 "+port+" list 1 1000 copy"))
+	assert.Equal(t, "*2\r\n$1\r\na\r\n$1\r\nb\r\n", exec(src, c, "lrange list 0 -1"))
+	assert.Equal(t, "*2\r\n$1\r\na\r\n$1\r\nb\r\n", exec(dst, d, "lrange list 0 -1"))
+	assert.Equal(t, "-ERR Target instance replied with error: BUSYKEY Target key name already exists.\r\n",
+		exec(src, c, "migrate 127.0.0.1 "+port+" k 1 1000"))
+	assert.Equal(t, "$2\r\nv2\r\n", exec(src, c, "get k"))
+	cmd := [][]byte{[]byte("migrate"), []byte("127.0.0.1"), []byte(port), []byte(""), []byte("1"), []byte("1000"),
+		[]byte("replace"), []byte("keys"), []byte("k"), []byte("list"), []byte("missing")}
+	assert.Equal(t, "+OK\r\n", string(src.ExecCommand(ctx, c, cmd).ToBytes()))
+	assert.Equal(t, ":0\r\n", exec(src, c, "exists k list"))
+	assert.Equal(t, "$2\r\nv2\r\n", exec(dst, d, "get k"))
+	assert.Equal(t, []string{"k", "list", "missing"}, memdb.CommandKeys(cmd))
+
+	assert.Equal(t, "-ERR syntax error\r\n", exec(src, c, "migrate 127.0.0.1 "+port+" k 1 1000 nope"))
+	exec(src, c, "set k v")
+	assert.Equal(t, "-IOERR error or timeout connecting to the client\r\n", exec(src, c, "migrate 127.0.0.1 1 k 1 1000"))
+	assert.Equal(t, "$1\r\nv\r\n", exec(src, c, "get k"))
+	exec(src, c, "multi")
+	assert.Equal(t, "-ERR MIGRATE is not allowed in transactions\r\n", exec(src, c, "migrate 127.0.0.1 "+port+" k 1 1000"))
+}
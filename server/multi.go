@@ -0,0 +1,299 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/innovationb1ue/RedisGO/memdb"
+	"github.com/innovationb1ue/RedisGO/raftexample"
+	"github.com/innovationb1ue/RedisGO/resp"
+)
+
+// multi.go implements transactions: MULTI, EXEC, DISCARD, WATCH and UNWATCH.
+// Every keyed command holds the read side of the transaction locks of its keys while executing,
+// and EXEC holds the write side of the locks of all the keys of the transaction, so the
+// queued commands run without any other command touching their keys in between.
+
+// number of transaction locks per database
+const txLockCount = 1024
+
+// watchedKeyID identifies a key of a database.
+type watchedKeyID struct {
+	db  int
+	key string
+}
+
+// watchedKey is a key watched by a client.
+type watchedKey struct {
+	watchedKeyID
+	// digest of the key when it was watched. only used in cluster mode,
+	// where the modification of the key is checked when the transaction is applied
+	digest uint64
+}
+
+func (m *Manager) Multi(c *Client, cmd [][]byte) resp.RedisData {
+	if c.hasFlag(clientMulti) {
+		return resp.MakeErrorData("ERR MULTI calls can not be nested")
+	}
+	c.setFlag(clientMulti, true)
+	return resp.MakeStringData("OK")
+}
+
+func (m *Manager) Discard(c *Client, cmd [][]byte) resp.RedisData {
+	if !c.hasFlag(clientMulti) {
+		return resp.MakeErrorData("ERR DISCARD without MULTI")
+	}
+	m.endMulti(c)
+	m.unwatchAll(c)
+	return resp.MakeStringData("OK")
+}
+
+func (m *Manager) Exec(ctx context.Context, c *Client, cmd [][]byte) resp.RedisData {
+	if !c.hasFlag(clientMulti) {
+		return resp.MakeErrorData("ERR EXEC without MULTI")
+	}
+	queue, ok := m.endMulti(c)
+	defer m.unwatchAll(c)
+	if !ok {
+		return resp.MakeErrorData("EXECABORT Transaction discarded because of previous errors.")
+	}
+	return m.execQueued(ctx, c, queue, c.watched, func() bool { return c.hasFlag(clientDirtyCAS) })
+}
+
+func (m *Manager) Watch(c *Client, cmd [][]byte) resp.RedisData {
+	if c.hasFlag(clientMulti) {
+		return resp.MakeErrorData("ERR WATCH inside MULTI is not allowed")
+	}
+	// writeMu is always taken before watchMu
+	m.writeMu.RLock()
+	defer m.writeMu.RUnlock()
+	m.watchMu.Lock()
+	defer m.watchMu.Unlock()
+	for _, arg := range cmd[1:] {
+		id := watchedKeyID{db: c.dbIdx, key: string(arg)}
+		if _, ok := m.watchers[id][c]; ok {
+			continue
+		}
+		watched := watchedKey{watchedKeyID: id}
+		if m.cfg.IsCluster {
+			watched.digest = c.db.KeyDigest(id.key)
+		}
+		c.watched = append(c.watched, watched)
+		if m.watchers[id] == nil {
+			m.watchers[id] = make(map[*Client]struct{})
+		}
+		m.watchers[id][c] = struct{}{}
+	}
+	return resp.MakeStringData("OK")
+}
+
+func (m *Manager) Unwatch(c *Client, cmd [][]byte) resp.RedisData {
+	m.unwatchAll(c)
+	return resp.MakeStringData("OK")
+}
+
+// unwatchAll forgets all the keys watched by the client.
+func (m *Manager) unwatchAll(c *Client) {
+	m.watchMu.Lock()
+	defer m.watchMu.Unlock()
+	for _, watched := range c.watched {
+		delete(m.watchers[watched.watchedKeyID], c)
+		if len(m.watchers[watched.watchedKeyID]) == 0 {
+			delete(m.watchers, watched.watchedKeyID)
+		}
+	}
+	c.watched = nil
+	c.txGroup = nil
+	c.setFlag(clientDirtyCAS, false)
+}
+
+// touchAllKeys marks all the clients watching keys, after the whole dataset was replaced.
+func (m *Manager) touchAllKeys() {
+	m.watchMu.Lock()
+	defer m.watchMu.Unlock()
+	for _, clients := range m.watchers {
+		for c := range clients {
+			c.setFlag(clientDirtyCAS, true)
+		}
+	}
+}
+
+// touchKeys marks the clients watching the modified keys, so their transactions will fail.
+func (m *Manager) touchKeys(dbIdx int, keys []string) {
+	m.watchMu.Lock()
+	defer m.watchMu.Unlock()
+	if len(m.watchers) == 0 {
+		return
+	}
+	for _, key := range keys {
+		for c := range m.watchers[watchedKeyID{db: dbIdx, key: key}] {
+			c.setFlag(clientDirtyCAS, true)
+		}
+	}
+}
+
+// queueCommand queues a command received inside a MULTI block. The command was already checked by ExecCommand.
+func (m *Manager) queueCommand(c *Client, cmd [][]byte) resp.RedisData {
+	// SPOP picks its members on the node proposing it, which can't be done for a queued command
+	if m.cfg.IsCluster && strings.ToLower(string(cmd[0])) == "spop" {
+		c.setFlag(clientDirtyExec, true)
+		return resp.MakeErrorData("ERR SPOP is not allowed in transactions in cluster mode")
+	}
+	// MIGRATE talks to another instance while holding the locks of its keys, and deletes the keys by itself
+	if strings.ToLower(string(cmd[0])) == "migrate" {
+		c.setFlag(clientDirtyExec, true)
+		return resp.MakeErrorData("ERR MIGRATE is not allowed in transactions")
+	}
+	// the replication commands and SAVE wait for the locks held by EXEC
+	switch strings.ToLower(string(cmd[0])) {
+	case "replicaof", "slaveof", "psync", "save":
+		c.setFlag(clientDirtyExec, true)
+		return resp.MakeErrorData("ERR Command not allowed inside a transaction")
+	case "wait", "waitaof":
+		// a transaction is applied by every member of the raft group, while only the leader knows the logs of the others
+		if m.cfg.IsCluster {
+			c.setFlag(clientDirtyExec, true)
+			return resp.MakeErrorData("ERR Command not allowed inside a transaction in cluster mode")
+		}
+	}
+	c.queue = append(c.queue, cmd)
+	return resp.MakeStringData("QUEUED")
+}
+
+// endMulti leaves the MULTI block and returns the queued commands.
+// It returns false if any command failed to queue.
+func (m *Manager) endMulti(c *Client) ([][][]byte, bool) {
+	queue := c.queue
+	ok := !c.hasFlag(clientDirtyExec)
+	c.queue = nil
+	c.setFlag(clientMulti|clientDirtyExec, false)
+	return queue, ok
+}
+
+// execQueued runs the queued commands atomically for the client and returns the EXEC reply.
+// aborted is checked once all the keys are locked and makes EXEC reply nil if it returns true.
+func (m *Manager) execQueued(ctx context.Context, c *Client, queue [][][]byte, watched []watchedKey, aborted func() bool) resp.RedisData {
+	// collect the keys of every database touched by the transaction, following the queued SELECTs
+	keys := make(map[int][]string)
+	for _, w := range watched {
+		keys[w.db] = append(keys[w.db], w.key)
+	}
+	dbIdx := c.dbIdx
+	for _, cmd := range queue {
+		cmdName := strings.ToLower(string(cmd[0]))
+		if cmdName == "select" && len(cmd) == 2 {
+			if idx, err := strconv.Atoi(string(cmd[1])); err == nil && idx >= 0 && idx < len(m.DBs) {
+				dbIdx = idx
+			}
+			continue
+		}
+		keys[dbIdx] = append(keys[dbIdx], memdb.CommandKeys(cmd)...)
+	}
+	dbs := make([]int, 0, len(keys))
+	for idx := range keys {
+		dbs = append(dbs, idx)
+	}
+	// always lock the databases in the same order to avoid deadlocks
+	sort.Ints(dbs)
+	for _, idx := range dbs {
+		m.txLocks[idx].LockMulti(keys[idx])
+	}
+	defer func() {
+		for _, idx := range dbs {
+			m.txLocks[idx].UnLockMulti(keys[idx])
+		}
+	}()
+	if aborted() {
+		return resp.MakeArrayData(nil)
+	}
+	m.writeMu.RLock()
+	defer m.writeMu.RUnlock()
+	for _, idx := range dbs {
+		m.captureForRewrite(idx, keys[idx])
+	}
+	results := make([]resp.RedisData, 0, len(queue))
+	entries := make([]aofEntry, 0)
+	for _, cmd := range queue {
+		now := time.Now().UnixMilli()
+		res := m.execCommand(ctx, c, cmd, true)
+		if res == nil {
+			res = resp.MakeErrorData("unknown error")
+		}
+		results = append(results, res)
+		if _, isErr := res.(*resp.ErrorData); !isErr && memdb.IsWriteCommand(strings.ToLower(string(cmd[0]))) {
+			if propagated := propagatedCommand(c.db, cmd, res, now); propagated != nil {
+				entries = append(entries, aofEntry{dbIdx: c.dbIdx, cmd: propagated})
+			}
+		}
+	}
+	if len(entries) > 0 {
+		m.propagate(entries...)
+		c.woff = m.repl.getOffset()
+	}
+	return resp.MakeArrayData(results)
+}
+
+// popNonBlocking pops from the first non-empty list of a BLPOP or BRPOP without blocking, as they do inside
+// a transaction. It returns a nil reply if the lists are empty.
+func (m *Manager) popNonBlocking(ctx context.Context, c *Client, cmd [][]byte) resp.RedisData {
+	popCmd := "lpop"
+	if strings.ToLower(string(cmd[0])) == "brpop" {
+		popCmd = "rpop"
+	}
+	for _, key := range cmd[1 : len(cmd)-1] {
+		res := memdb.CmdTable[popCmd].Executor(ctx, c.db, [][]byte{[]byte(popCmd), key}, nil)
+		if bulk, ok := res.(*resp.BulkData); ok && bulk.ByteData() != nil {
+			return resp.MakeArrayData([]resp.RedisData{resp.MakeStringData(string(key)), bulk})
+		} else if !ok {
+			return res
+		}
+	}
+	return resp.MakeBulkData(nil)
+}
+
+// transactionKeys returns the keys of the queued commands of a transaction.
+func transactionKeys(queue [][][]byte) []string {
+	keys := make([]string, 0)
+	for _, cmd := range queue {
+		keys = append(keys, memdb.CommandKeys(cmd)...)
+	}
+	return keys
+}
+
+// transactionProposal turns the MULTI block of the client into a single raft proposal.
+func (m *Manager) transactionProposal(c *Client, id string, queue [][][]byte) *raftexample.RaftProposal {
+	proposal := &raftexample.RaftProposal{
+		ID:    id,
+		DB:    c.dbIdx,
+		Multi: true,
+		Batch: m.transactionCommands(c, queue),
+	}
+	for _, w := range c.watched {
+		proposal.Watches = append(proposal.Watches, raftexample.RaftWatch{DB: w.db, Key: w.key, Digest: w.digest})
+	}
+	return proposal
+}
+
+// applyTransaction executes a transaction committed by raft.
+// The transaction is aborted if any watched key changed since the client watched it.
+func (m *Manager) applyTransaction(ctx context.Context, proposal *raftexample.RaftProposal) resp.RedisData {
+	c := m.newFakeClient(proposal.DB)
+	watched := make([]watchedKey, 0, len(proposal.Watches))
+	for _, w := range proposal.Watches {
+		if w.DB < 0 || w.DB >= len(m.DBs) {
+			return resp.MakeErrorData("ERR DB index is out of range")
+		}
+		watched = append(watched, watchedKey{watchedKeyID: watchedKeyID{db: w.DB, key: w.Key}, digest: w.Digest})
+	}
+	return m.execQueued(ctx, c, proposal.Batch, watched, func() bool {
+		for _, w := range watched {
+			if m.DBs[w.db].KeyDigest(w.key) != w.digest {
+				return true
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/innovationb1ue/RedisGO/memdb"
+	"github.com/innovationb1ue/RedisGO/raftexample"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMulti_Exec(t *testing.T) {
+	ctx := context.Background()
+	mgr := newAOFTestManager(t.TempDir())
+	c := mgr.newFakeClient(0)
+	assert.Equal(t, []byte("+OK\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("multi")).ToBytes())
+	assert.Equal(t, []byte("+QUEUED\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("set k v")).ToBytes())
+	assert.Equal(t, []byte("+QUEUED\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("select 1")).ToBytes())
+	assert.Equal(t, []byte("+QUEUED\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("rpush list a")).ToBytes())
+	assert.Equal(t, []byte("+QUEUED\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("blpop empty list 0")).ToBytes())
+	assert.Equal(t, []byte("+QUEUED\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("incr k")).ToBytes())
+	res := mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("exec")).ToBytes()
+	assert.Equal(t, "*5\r\n+OK\r\n+OK\r\n:1\r\n*2\r\n+list\r\n$1\r\na\r\n:1\r\n", string(res))
+	// the SELECT inside the transaction changes the database of the client
+	assert.Equal(t, []byte("$1\r\n1\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("get k")).ToBytes())
+	assert.Equal(t, []byte("-ERR EXEC without MULTI\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("exec")).ToBytes())
+}
+
+func TestMulti_DiscardAndAbort(t *testing.T) {
+	ctx := context.Background()
+	mgr := newAOFTestManager(t.TempDir())
+	c := mgr.newFakeClient(0)
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("multi"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("set k v"))
+	assert.Equal(t, []byte("+OK\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("discard")).ToBytes())
+	assert.Equal(t, []byte("$-1\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("get k")).ToBytes())
+
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("multi"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("set k v"))
+	assert.Equal(t, []byte("-ERR unknown command nosuchcmd\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("nosuchcmd")).ToBytes())
+	assert.Equal(t, []byte("-EXECABORT Transaction discarded because of previous errors.\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("exec")).ToBytes())
+	assert.Equal(t, []byte("$-1\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("get k")).ToBytes())
+}
+
+func TestMulti_Watch(t *testing.T) {
+	ctx := context.Background()
+	mgr := newAOFTestManager(t.TempDir())
+	c1, c2 := mgr.newFakeClient(0), mgr.newFakeClient(0)
+	// a watched key modified by another client aborts the transaction
+	mgr.ExecCommand(ctx, c1, memdb.MakeCommandBytes("watch k"))
+	mgr.ExecCommand(ctx, c2, memdb.MakeCommandBytes("set k other"))
+	mgr.ExecCommand(ctx, c1, memdb.MakeCommandBytes("multi"))
+	mgr.ExecCommand(ctx, c1, memdb.MakeCommandBytes("set k mine"))
+	assert.Equal(t, []byte("*-1\r\n"), mgr.ExecCommand(ctx, c1, memdb.MakeCommandBytes("exec")).ToBytes())
+	assert.Equal(t, []byte("$5\r\nother\r\n"), mgr.ExecCommand(ctx, c1, memdb.MakeCommandBytes("get k")).ToBytes())
+
+	// EXEC unwatches all the keys
+	mgr.ExecCommand(ctx, c2, memdb.MakeCommandBytes("set k other"))
+	mgr.ExecCommand(ctx, c1, memdb.MakeCommandBytes("multi"))
+	mgr.ExecCommand(ctx, c1, memdb.MakeCommandBytes("set k mine"))
+	assert.Equal(t, []byte("*1\r\n+OK\r\n"), mgr.ExecCommand(ctx, c1, memdb.MakeCommandBytes("exec")).ToBytes())
+
+	// keys of other databases are not affected
+	mgr.ExecCommand(ctx, c1, memdb.MakeCommandBytes("watch k"))
+	mgr.ExecCommand(ctx, c2, memdb.MakeCommandBytes("select 1"))
+	mgr.ExecCommand(ctx, c2, memdb.MakeCommandBytes("set k other"))
+	mgr.ExecCommand(ctx, c1, memdb.MakeCommandBytes("multi"))
+	assert.Equal(t, []byte("*0\r\n"), mgr.ExecCommand(ctx, c1, memdb.MakeCommandBytes("exec")).ToBytes())
+	assert.Empty(t, mgr.watchers)
+}
+
+func TestMulti_ClusterProposal(t *testing.T) {
+	ctx := context.Background()
+	mgr := newAOFTestManager(t.TempDir())
+	mgr.cfg.IsCluster = true
+	c := mgr.newFakeClient(0)
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("watch k"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("multi"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("set k v"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("incr n"))
+	queue, ok := mgr.endMulti(c)
+	assert.True(t, ok)
+	proposal := mgr.transactionProposal(c, "id", queue)
+	assert.Equal(t, [][][]byte{memdb.MakeCommandBytes("set k v"), memdb.MakeCommandBytes("incr n")}, proposal.Batch)
+	assert.Equal(t, []raftexample.RaftWatch{{DB: 0, Key: "k", Digest: 0}}, proposal.Watches)
+	proposal, err := raftexample.DecodeProposal(proposal.ToBytes())
+	assert.Nil(t, err)
+
+	// the watched key is unchanged when the entry is applied
+	assert.Equal(t, []byte("*2\r\n+OK\r\n:1\r\n"), mgr.applyTransaction(ctx, proposal).ToBytes())
+	// the watched key changed since it was watched
+	assert.Equal(t, []byte("*-1\r\n"), mgr.applyTransaction(ctx, proposal).ToBytes())
+	assert.Equal(t, []byte("$1\r\n1\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("get n")).ToBytes())
+}
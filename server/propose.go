@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/innovationb1ue/RedisGO/logger"
+	"github.com/innovationb1ue/RedisGO/raftexample"
+	"github.com/innovationb1ue/RedisGO/resp"
+)
+
+// propose.go sends the writes of the clients to raft and hands them the results once the proposals are applied.
+// A client may send more writes before the results of its previous ones are known, the replies are written
+// in the order of the commands anyway.
+
+// proposalResults routes the results of the applied proposals to the clients waiting for them.
+// The waiters are registered by the goroutines of the clients and triggered by the goroutine applying the commits.
+type proposalResults struct {
+	mu      sync.Mutex
+	waiters map[string]chan resp.RedisData
+}
+
+func newProposalResults() *proposalResults {
+	return &proposalResults{waiters: make(map[string]chan resp.RedisData)}
+}
+
+// register returns the channel receiving the result of the proposal with the given ID.
+func (r *proposalResults) register(id string) <-chan resp.RedisData {
+	// buffered, so that applying the entry never blocks on a client that stopped waiting
+	resC := make(chan resp.RedisData, 1)
+	r.mu.Lock()
+	r.waiters[id] = resC
+	r.mu.Unlock()
+	return resC
+}
+
+// cancel forgets the proposal with the given ID, whose result is no longer waited for.
+func (r *proposalResults) cancel(id string) {
+	r.mu.Lock()
+	delete(r.waiters, id)
+	r.mu.Unlock()
+}
+
+// trigger hands the result of an applied proposal to its waiter, if the proposal was sent by this node.
+func (r *proposalResults) trigger(id string, res resp.RedisData) {
+	r.mu.Lock()
+	resC, ok := r.waiters[id]
+	delete(r.waiters, id)
+	r.mu.Unlock()
+	if ok {
+		resC <- res
+	}
+}
+
+// pendingProposal is a proposal sent to raft whose result is not known yet. It's a RedisData
+// standing for the reply of the command, and reading the reply waits for the proposal to be applied.
+type pendingProposal struct {
+	ctx     context.Context
+	id      string
+	results *proposalResults
+	resC    <-chan resp.RedisData
+	timeout *time.Timer
+	finish  func(resp.RedisData) resp.RedisData // converts the result into the reply, may be nil
+	once    sync.Once
+	res     resp.RedisData
+}
+
+// propose sends the proposal to raft. It gives up after clusterProposeTimeout, in which case
+// the command may or may not be applied later.
+func (m *Manager) propose(ctx context.Context, proposeC chan<- *raftexample.RaftProposal, results *proposalResults,
+	proposal *raftexample.RaftProposal, finish func(resp.RedisData) resp.RedisData) resp.RedisData {
+	p := &pendingProposal{
+		ctx:     ctx,
+		id:      proposal.ID,
+		results: results,
+		resC:    results.register(proposal.ID),
+		timeout: time.NewTimer(clusterProposeTimeout),
+		finish:  finish,
+	}
+	var errData resp.RedisData
+	select {
+	case proposeC <- proposal:
+		return p
+	case <-p.timeout.C:
+		errData = resp.MakeErrorData("TRYAGAIN Timed out proposing the command to the cluster")
+	case <-ctx.Done():
+		errData = resp.MakeErrorData("ERR server is shutting down")
+	}
+	results.cancel(proposal.ID)
+	p.timeout.Stop()
+	return errData
+}
+
+// result waits for the proposal to be applied and returns the reply of the command.
+func (p *pendingProposal) result() resp.RedisData {
+	p.once.Do(func() {
+		defer p.timeout.Stop()
+		select {
+		case p.res = <-p.resC:
+		default:
+			select {
+			case p.res = <-p.resC:
+			case <-p.timeout.C:
+				p.results.cancel(p.id)
+				p.res = resp.MakeErrorData("ERR Timed out waiting for the cluster to apply the command, it may be applied later")
+				return
+			case <-p.ctx.Done():
+				p.results.cancel(p.id)
+				p.res = resp.MakeErrorData("ERR server is shutting down")
+				return
+			}
+		}
+		if p.finish != nil {
+			p.res = p.finish(p.res)
+		}
+	})
+	return p.res
+}
+
+func (p *pendingProposal) ToBytes() []byte      { return p.result().ToBytes() }
+func (p *pendingProposal) ToRESP3Bytes() []byte { return resp.Encode(p.result(), 3) }
+func (p *pendingProposal) ByteData() []byte     { return p.result().ByteData() }
+func (p *pendingProposal) String() string       { return p.result().String() }
+
+// maxPendingReplies bounds the replies of a client waiting to be written. The client goroutine
+// stops reading commands once it's reached.
+const maxPendingReplies = 1024
+
+// replyWriter writes the replies of a client in the order of its commands. The replies of the writes
+// are written once raft applied them, while the goroutine of the client serves the next commands.
+type replyWriter struct {
+	out     *resp.Writer
+	replies chan queuedReply
+	pending sync.WaitGroup // replies not written yet
+	done    chan struct{}
+}
+
+// queuedReply is a reply and the protocol version it's written in, which is
+// the version of the client when the command ran, before any later HELLO.
+type queuedReply struct {
+	res   resp.RedisData
+	proto int
+	last  bool // the reply of the last command of a pipeline, after which the replies are flushed
+}
+
+func newReplyWriter(out *resp.Writer) *replyWriter {
+	w := &replyWriter{
+		out:     out,
+		replies: make(chan queuedReply, maxPendingReplies),
+		done:    make(chan struct{}),
+	}
+	go w.serve()
+	return w
+}
+
+func (w *replyWriter) serve() {
+	defer close(w.done)
+	for reply := range w.replies {
+		res := reply.res
+		// the proposal is waited for before taking the lock of the writer, which the other writers of the connection share
+		if p, ok := res.(*pendingProposal); ok {
+			res = p.result()
+		}
+		err := w.out.WriteData(res, reply.proto)
+		if err == nil && reply.last {
+			err = w.out.Flush()
+		}
+		if err != nil {
+			logger.Error("write response error: ", err.Error())
+		}
+		w.pending.Done()
+	}
+}
+
+// write queues the reply of a command, which may be a pending proposal. The replies are sent once
+// the reply of the last command of the pipeline is written.
+func (w *replyWriter) write(res resp.RedisData, proto int, last bool) {
+	w.pending.Add(1)
+	w.replies <- queuedReply{res: res, proto: proto, last: last}
+}
+
+// flush waits until the queued replies are written, so the writes of the client are applied, and sends them.
+func (w *replyWriter) flush() {
+	w.pending.Wait()
+	if err := w.out.Flush(); err != nil {
+		logger.Error("write response error: ", err.Error())
+	}
+}
+
+// close writes the queued replies and stops the writer.
+func (w *replyWriter) close() {
+	close(w.replies)
+	<-w.done
+	_ = w.out.Flush()
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/innovationb1ue/RedisGO/raftexample"
+	"github.com/innovationb1ue/RedisGO/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPropose_Results(t *testing.T) {
+	results := newProposalResults()
+	// the results are triggered from another goroutine than the waiters
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			resC := results.register(id)
+			go results.trigger(id, resp.MakeStringData(id))
+			assert.Equal(t, id, (<-resC).String())
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+	assert.Equal(t, 0, len(results.waiters))
+	// the proposals of the other nodes and the cancelled ones have no waiter
+	results.register("cancelled")
+	results.cancel("cancelled")
+	results.trigger("cancelled", resp.MakeStringData("OK"))
+	assert.Equal(t, 0, len(results.waiters))
+}
+
+func TestPropose_PipelinedReplies(t *testing.T) {
+	ctx := context.Background()
+	mgr := newAOFTestManager(t.TempDir())
+	results := newProposalResults()
+	proposeC := make(chan *raftexample.RaftProposal, 8)
+	server, client := net.Pipe()
+	defer client.Close()
+	out := newReplyWriter(resp.NewWriter(server))
+
+	// the proposals are applied in reverse order, the replies are written in the order of the commands
+	for i := 1; i <= 3; i++ {
+		id := strconv.Itoa(i)
+		finish := func(res resp.RedisData) resp.RedisData { return resp.MakeStringData(id + res.String()) }
+		out.write(mgr.propose(ctx, proposeC, results, &raftexample.RaftProposal{ID: id}, finish), 2, false)
+	}
+	out.write(resp.MakeStringData("local"), 2, true)
+	go func() {
+		for i := 3; i >= 1; i-- {
+			results.trigger(strconv.Itoa(i), resp.MakeStringData("applied"))
+		}
+		out.flush()
+		out.close()
+		server.Close()
+	}()
+	replies, err := io.ReadAll(client)
+	assert.Nil(t, err)
+	assert.Equal(t, "+1applied\r\n+2applied\r\n+3applied\r\n+local\r\n", string(replies))
+	assert.Equal(t, 3, len(proposeC))
+
+	// a proposal that can't be sent is not waited for
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	res := mgr.propose(cancelled, make(chan *raftexample.RaftProposal), results, &raftexample.RaftProposal{ID: "4"}, nil)
+	assert.Equal(t, "ERR server is shutting down", fmt.Sprint(res))
+	assert.Equal(t, 0, len(results.waiters))
+}
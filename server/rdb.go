@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/innovationb1ue/RedisGO/logger"
+	"github.com/innovationb1ue/RedisGO/memdb"
+	"github.com/innovationb1ue/RedisGO/resp"
+)
+
+// rdb.go implements the point-in-time snapshot persistence of all databases held by the Manager.
+
+func (m *Manager) rdbPath() string {
+	return filepath.Join(m.cfg.Dir, m.cfg.DBFilename)
+}
+
+// saveRDB writes a snapshot of all databases to disk.
+// The snapshot is written to a temp file first and then renamed,
+// so a crash in the middle never leaves a broken snapshot behind.
+func (m *Manager) saveRDB() error {
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+	// the snapshot is taken while no command runs, so the commands changing several keys are in it as a whole
+	m.writeMu.Lock()
+	dirty := atomic.LoadInt64(&m.dirty)
+	snapshot, err := memdb.Snapshot(m.DBs)
+	m.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(m.cfg.Dir, "temp-*.rdb")
+	if err != nil {
+		return err
+	}
+	// remove the temp file if anything goes wrong. it's a no-op after renaming.
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	_, err = tmp.Write(snapshot)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), m.rdbPath()); err != nil {
+		return err
+	}
+	atomic.AddInt64(&m.dirty, -dirty)
+	atomic.StoreInt64(&m.lastSave, time.Now().Unix())
+	logger.Info("DB saved on disk")
+	return nil
+}
+
+// bgSaveRDB starts a snapshot in the background.
+// It returns false if another background save is in progress.
+func (m *Manager) bgSaveRDB() bool {
+	if !atomic.CompareAndSwapInt32(&m.bgSaving, 0, 1) {
+		return false
+	}
+	go func() {
+		defer atomic.StoreInt32(&m.bgSaving, 0)
+		if err := m.saveRDB(); err != nil {
+			logger.Error("background saving error: ", err)
+		}
+	}()
+	return true
+}
+
+// loadRDB loads the snapshot file into the databases if it exists.
+func (m *Manager) loadRDB() error {
+	fl, err := os.Open(m.rdbPath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer func() {
+		_ = fl.Close()
+	}()
+	start := time.Now()
+	if err = memdb.ReadRDB(fl, m.DBs); err != nil {
+		return err
+	}
+	logger.Info("DB loaded from disk: ", time.Since(start).Seconds(), " seconds")
+	return nil
+}
+
+// serverCron runs the periodic tasks of the server such as the automatic snapshots and rewrites.
+func (m *Manager) serverCron(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.checkSaveParams()
+			m.checkAOFRewrite()
+			m.replicationCron()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkSaveParams triggers a background save when any of the configured save points is reached.
+func (m *Manager) checkSaveParams() {
+	dirty := atomic.LoadInt64(&m.dirty)
+	elapsed := time.Now().Unix() - atomic.LoadInt64(&m.lastSave)
+	for _, param := range m.cfg.SaveParams {
+		if dirty >= int64(param.Changes) && elapsed >= int64(param.Seconds) && dirty > 0 {
+			logger.Info(param.Changes, " changes in ", param.Seconds, " seconds. Saving...")
+			m.bgSaveRDB()
+			return
+		}
+	}
+}
+
+func (m *Manager) Save(cmd [][]byte) resp.RedisData {
+	if atomic.LoadInt32(&m.bgSaving) == 1 {
+		return resp.MakeErrorData("ERR Background save already in progress")
+	}
+	if err := m.saveRDB(); err != nil {
+		logger.Error("save error: ", err)
+		return resp.MakeErrorData("ERR ", err.Error())
+	}
+	return resp.MakeStringData("OK")
+}
+
+func (m *Manager) BgSave(cmd [][]byte) resp.RedisData {
+	if !m.bgSaveRDB() {
+		return resp.MakeErrorData("ERR Background save already in progress")
+	}
+	return resp.MakeStringData("Background saving started")
+}
+
+func (m *Manager) LastSave(cmd [][]byte) resp.RedisData {
+	return resp.MakeIntData(atomic.LoadInt64(&m.lastSave))
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/innovationb1ue/RedisGO/memdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRDB_BgSaveConcurrentRenames(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	mgr := newAOFTestManager(dir)
+	const keys = 100
+	for i := 0; i < keys; i++ {
+		mgr.ExecCommand(ctx, mgr.newFakeClient(0), memdb.MakeCommandBytes(fmt.Sprintf("set a%d v", i)))
+	}
+	// every key is renamed back and forth while the snapshots are taken
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := mgr.newFakeClient(0)
+			for !stop.Load() {
+				for j := i; j < keys; j += 4 {
+					mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes(fmt.Sprintf("rename a%d b%d", j, j)))
+					mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes(fmt.Sprintf("rename b%d a%d", j, j)))
+				}
+			}
+		}(i)
+	}
+	c := mgr.newFakeClient(0)
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, []byte("+Background saving started\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("bgsave")).ToBytes())
+		waitFor(t, "the background save", func() bool { return atomic.LoadInt32(&mgr.bgSaving) == 0 })
+		restored := newAOFTestManager(dir)
+		assert.Nil(t, restored.loadRDB())
+		// each key is in the snapshot under one of its names
+		assert.Equal(t, keys, len(restored.DBs[0].Keys()))
+	}
+	stop.Store(true)
+	wg.Wait()
+}
+
+func TestRDB_SaveInTransaction(t *testing.T) {
+	ctx := context.Background()
+	mgr := newAOFTestManager(t.TempDir())
+	c := mgr.newFakeClient(0)
+	// SAVE would wait for the locks held by EXEC
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("multi"))
+	assert.Equal(t, []byte("-ERR Command not allowed inside a transaction\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("save")).ToBytes())
+	assert.Equal(t, []byte("-EXECABORT Transaction discarded because of previous errors.\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("exec")).ToBytes())
+	assert.Equal(t, []byte("+OK\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("save")).ToBytes())
+}
@@ -0,0 +1,386 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/innovationb1ue/RedisGO/logger"
+	"github.com/innovationb1ue/RedisGO/memdb"
+)
+
+// replica.go implements the replica side of the master-replica replication. The replica connects to its master,
+// asks for the stream with PSYNC, loads the snapshot of a full sync and then applies the commands of the stream.
+// It reconnects when the link breaks and continues from the offset it reached.
+
+// states of the link to the master, as reported by ROLE
+const (
+	linkConnect    = "connect"    // waiting to connect
+	linkConnecting = "connecting" // connecting and handshaking
+	linkSync       = "sync"       // receiving the snapshot of a full sync
+	linkConnected  = "connected"  // applying the stream
+)
+
+const (
+	// replicaRetryInterval is the time between two attempts to connect to the master.
+	replicaRetryInterval = time.Second
+	// replicaAckInterval is the time between two acknowledgements of the processed offset to the master.
+	replicaAckInterval = time.Second
+)
+
+// masterLink is the link of a replica to its master.
+type masterLink struct {
+	addr   string
+	cancel context.CancelFunc
+	done   chan struct{} // closed when the link is stopped
+	mu     sync.Mutex
+	state  string
+	lastIO time.Time // time of the last data received from the master
+	// connection to the master while connected, writes are serialized by writeMu
+	conn    net.Conn
+	writeMu sync.Mutex
+}
+
+func (l *masterLink) getState() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state
+}
+
+func (l *masterLink) setState(state string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.state = state
+	l.lastIO = time.Now()
+}
+
+func (l *masterLink) lastIOTime() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastIO
+}
+
+func (l *masterLink) hostPort() (string, int) {
+	host, port, _ := net.SplitHostPort(l.addr)
+	n, _ := strconv.Atoi(port)
+	return host, n
+}
+
+// send writes a command to the master.
+func (l *masterLink) send(args ...string) error {
+	cmd := make([][]byte, 0, len(args))
+	for _, arg := range args {
+		cmd = append(cmd, []byte(arg))
+	}
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	_, err := l.conn.Write(appendCommand(nil, cmd))
+	return err
+}
+
+// linkConn drops the link when the master is silent or doesn't read for longer than timeout.
+type linkConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *linkConn) Read(p []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *linkConn) Write(p []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+func (r *replication) currentLink() *masterLink {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.link
+}
+
+// replicate makes this node a replica of the master at addr. The writes of the clients are
+// rejected from now on, and the keys only expire when the master deletes them.
+func (m *Manager) replicate(ctx context.Context, addr string) {
+	m.stopReplicaLink()
+	ctx, cancel := context.WithCancel(ctx)
+	link := &masterLink{addr: addr, cancel: cancel, done: make(chan struct{}), state: linkConnect}
+	r := m.repl
+	r.mu.Lock()
+	r.link = link
+	r.replicating.Store(true)
+	r.mu.Unlock()
+	for _, db := range m.DBs {
+		db.SetPassiveExpire(true)
+	}
+	logger.Info("replicating the master at ", addr)
+	go m.replicaLoop(ctx, link)
+}
+
+// stopReplicaLink stops the link to the master and waits until it stopped applying the stream.
+func (m *Manager) stopReplicaLink() {
+	r := m.repl
+	r.mu.Lock()
+	link := r.link
+	r.link = nil
+	r.mu.Unlock()
+	if link != nil {
+		link.cancel()
+		<-link.done
+	}
+}
+
+// replicaLoop keeps the link to the master until ctx is canceled.
+func (m *Manager) replicaLoop(ctx context.Context, link *masterLink) {
+	defer close(link.done)
+	for {
+		err := m.syncWithMaster(ctx, link)
+		link.setState(linkConnect)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Warning("replication link to ", link.addr, " broken: ", err)
+		select {
+		case <-time.After(replicaRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// syncWithMaster connects to the master, synchronizes the dataset and applies the stream until the link breaks.
+func (m *Manager) syncWithMaster(ctx context.Context, link *masterLink) error {
+	link.setState(linkConnecting)
+	timeout := time.Duration(m.cfg.ReplTimeout) * time.Second
+	conn, err := net.DialTimeout("tcp", link.addr, timeout)
+	if err != nil {
+		return err
+	}
+	// close the connection to stop reading when the link is stopped
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stopped:
+		}
+		_ = conn.Close()
+	}()
+	lc := &linkConn{Conn: conn, timeout: timeout}
+	link.writeMu.Lock()
+	link.conn = lc
+	link.writeMu.Unlock()
+	rd := bufio.NewReader(lc)
+	request := func(args ...string) (string, error) {
+		if err := link.send(args...); err != nil {
+			return "", err
+		}
+		return readReplyLine(rd)
+	}
+	if reply, err := request("PING"); err != nil {
+		return err
+	} else if strings.HasPrefix(reply, "-") {
+		return fmt.Errorf("master replied to PING: %s", reply[1:])
+	}
+	// older masters may not know the options, which are not required
+	if _, err := request("REPLCONF", "listening-port", strconv.Itoa(m.cfg.Port)); err != nil {
+		return err
+	}
+	if _, err := request("REPLCONF", "capa", "psync2"); err != nil {
+		return err
+	}
+	id, offset := m.repl.psyncArgs()
+	reply, err := request("PSYNC", id, strconv.FormatInt(offset+1, 10))
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(reply)
+	switch {
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		masterOffset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid FULLRESYNC reply %q", reply)
+		}
+		link.setState(linkSync)
+		snapshot, err := readSnapshot(rd)
+		if err != nil {
+			return err
+		}
+		if err = m.loadFromMaster(ctx, snapshot, fields[1], masterOffset); err != nil {
+			return err
+		}
+		logger.Info("full resynchronization with the master done, ", len(snapshot), " bytes loaded")
+	case len(fields) >= 1 && fields[0] == "+CONTINUE":
+		if len(fields) > 1 {
+			m.repl.continueWith(fields[1])
+		}
+		logger.Info("partial resynchronization with the master from offset ", offset+1)
+	default:
+		return fmt.Errorf("master replied to PSYNC: %s", reply)
+	}
+	link.setState(linkConnected)
+	go link.ackLoop(m.replicaAck, stopped)
+	return m.applyStream(ctx, link, rd)
+}
+
+// psyncArgs returns the replication ID and the offset this node continues from.
+func (r *replication) psyncArgs() (string, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.id, r.offset
+}
+
+// continueWith adopts the new ID of the master, which continues the stream after a promotion.
+func (r *replication) continueWith(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id == r.id {
+		return
+	}
+	r.id2, r.secondOffset = r.id, r.offset+1
+	r.id = id
+}
+
+// readReplyLine reads a reply of a single line and strips its terminator.
+func readReplyLine(rd *bufio.Reader) (string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readSnapshot reads the snapshot sent after +FULLRESYNC, a bulk string without the trailing CRLF.
+// A master may send newlines to keep the link alive until the snapshot is ready.
+func readSnapshot(rd *bufio.Reader) ([]byte, error) {
+	for {
+		line, err := readReplyLine(rd)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			continue
+		}
+		size, err := strconv.Atoi(strings.TrimPrefix(line, "$"))
+		if line[0] != '$' || err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid snapshot header %q", line)
+		}
+		snapshot := make([]byte, size)
+		if _, err = io.ReadFull(rd, snapshot); err != nil {
+			return nil, err
+		}
+		return snapshot, nil
+	}
+}
+
+// loadFromMaster replaces the dataset with the snapshot of the master, which is followed by the stream at offset.
+// The replicas of this node need a full sync as well, so they are disconnected.
+func (m *Manager) loadFromMaster(ctx context.Context, snapshot []byte, id string, offset int64) error {
+	m.writeMu.Lock()
+	if err := memdb.LoadSnapshot(snapshot, m.DBs); err != nil {
+		m.writeMu.Unlock()
+		return err
+	}
+	m.touchAllKeys()
+	r := m.repl
+	r.mu.Lock()
+	r.id, r.id2 = id, ""
+	r.offset, r.secondOffset = offset, -1
+	if r.backlog != nil {
+		r.backlog.histlen = 0
+	}
+	r.master = m.newMasterClient()
+	r.disconnectReplicasLocked()
+	r.mu.Unlock()
+	m.writeMu.Unlock()
+	if m.aof == nil {
+		return nil
+	}
+	// the append only file still holds the old dataset. A rewrite running may have captured part of it, so wait and rewrite again.
+	for !m.bgRewriteAOF() {
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// newMasterClient creates the client applying the stream of the master, which may write on a read-only replica.
+func (m *Manager) newMasterClient() *Client {
+	c := m.newFakeClient(0)
+	c.flags = clientMaster
+	return c
+}
+
+// applyStream applies the commands sent by the master and proxies them to the replicas of this node.
+func (m *Manager) applyStream(ctx context.Context, link *masterLink, rd *bufio.Reader) error {
+	reader := &aofReader{r: rd}
+	r := m.repl
+	r.mu.Lock()
+	if r.master == nil {
+		r.master = m.newMasterClient()
+	}
+	// the backlog lets the replicas of this node continue after it's promoted
+	r.createBacklogLocked()
+	master := r.master
+	r.mu.Unlock()
+	for {
+		cmd, err := reader.readCommand()
+		if err != nil {
+			return err
+		}
+		link.setState(linkConnected)
+		getAck := false
+		if strings.ToLower(string(cmd[0])) == "replconf" {
+			getAck = len(cmd) > 1 && strings.ToLower(string(cmd[1])) == "getack"
+		} else {
+			m.ExecCommand(ctx, master, cmd)
+		}
+		// the commands are encoded the same way by every node, so the offsets match the ones of the master
+		r.feedRaw(appendCommand(nil, cmd))
+		if getAck {
+			if err = link.send(m.replicaAck()...); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// replicaAck returns the REPLCONF ACK command acknowledging the processed offset to the master,
+// with the offset fsynced to the append only file if it's enabled.
+func (m *Manager) replicaAck() []string {
+	ack := []string{"REPLCONF", "ACK", strconv.FormatInt(m.repl.getOffset(), 10)}
+	if m.aof != nil {
+		ack = append(ack, "FACK", strconv.FormatInt(m.aofFsyncedOffset(), 10))
+	}
+	return ack
+}
+
+// ackLoop sends the acknowledgements returned by ack to the master until stopped is closed.
+func (l *masterLink) ackLoop(ack func() []string, stopped <-chan struct{}) {
+	ticker := time.NewTicker(replicaAckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.send(ack()...); err != nil {
+				return
+			}
+		case <-stopped:
+			return
+		}
+	}
+}
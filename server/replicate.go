@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/innovationb1ue/RedisGO/raftexample"
+	"github.com/innovationb1ue/RedisGO/resp"
+)
+
+// replicate.go keeps the state machines of a cluster identical. Commands that depend on the clock
+// or on randomness are rewritten by the node proposing them, and expired keys are deleted by the leader
+// through the raft log instead of the local timers of every node.
+
+const (
+	// clusterExpireInterval is the time between two scans of the leader for expired keys
+	clusterExpireInterval = 100 * time.Millisecond
+	// clusterExpireKeys is the maximum number of expired keys deleted per database in a scan
+	clusterExpireKeys = 64
+	// clusterExpireRetry is the time after which the deletion of a key that is still there is proposed again
+	clusterExpireRetry = time.Second
+)
+
+// clusterProposal turns a write command of the client into a raft proposal that every node applies the same way.
+// The returned function converts the result of the proposal into the reply of the command and may be nil.
+// If the command needs no proposal, the reply is returned instead.
+func (m *Manager) clusterProposal(ctx context.Context, c *Client, id string, cmd [][]byte) (*raftexample.RaftProposal, func(resp.RedisData) resp.RedisData, resp.RedisData) {
+	switch strings.ToLower(string(cmd[0])) {
+	case "spop":
+		if proposal, finish, res := m.spopProposal(ctx, c, id, cmd); proposal != nil || res != nil {
+			return proposal, finish, res
+		}
+	case "migrate":
+		// the keys are sent by this node only
+		return m.migrateProposal(ctx, c, id, cmd)
+	}
+	return &raftexample.RaftProposal{
+		ID:   id,
+		DB:   c.dbIdx,
+		Args: c.db.RewriteForReplication(cmd, time.Now().UnixMilli()),
+	}, nil, nil
+}
+
+// spopProposal picks the members popped by SPOP on this node and proposes to remove them with SREM.
+// A member removed by another client in the meantime is left out of the reply.
+// It returns nothing if the count is invalid, so the command is proposed as is and fails on every node.
+func (m *Manager) spopProposal(ctx context.Context, c *Client, id string, cmd [][]byte) (*raftexample.RaftProposal, func(resp.RedisData) resp.RedisData, resp.RedisData) {
+	withCount := len(cmd) == 3
+	count := []byte("1")
+	if withCount {
+		if n, err := strconv.Atoi(string(cmd[2])); err != nil || n < 0 {
+			return nil, nil, nil
+		}
+		count = cmd[2]
+	}
+	picked := m.clusterRead(ctx, c, [][]byte{[]byte("srandmember"), cmd[1], count})
+	var members []resp.RedisData
+	switch res := picked.(type) {
+	case *resp.ErrorData:
+		return nil, nil, res
+	case *resp.ArrayData:
+		members = res.Data()
+	}
+	if len(members) == 0 {
+		if withCount {
+			return nil, nil, resp.MakeEmptyArrayData()
+		}
+		return nil, nil, resp.MakeBulkData(nil)
+	}
+	proposal := &raftexample.RaftProposal{
+		ID:    id,
+		DB:    c.dbIdx,
+		Multi: true,
+		Batch: make([][][]byte, 0, len(members)),
+	}
+	for _, member := range members {
+		proposal.Batch = append(proposal.Batch, [][]byte{[]byte("srem"), cmd[1], member.ByteData()})
+	}
+	finish := func(res resp.RedisData) resp.RedisData {
+		removed, ok := res.(*resp.ArrayData)
+		if !ok {
+			return res
+		}
+		popped := make([]resp.RedisData, 0, len(members))
+		for i, r := range removed.Data() {
+			if n, ok := r.(*resp.IntData); ok && n.Data() == 1 {
+				popped = append(popped, resp.MakeBulkData(members[i].ByteData()))
+			}
+		}
+		if withCount {
+			return resp.MakeArrayData(popped)
+		}
+		if len(popped) == 0 {
+			return resp.MakeBulkData(nil)
+		}
+		return popped[0]
+	}
+	return proposal, finish, nil
+}
+
+// transactionCommands rewrites the queued commands of a transaction for replication.
+func (m *Manager) transactionCommands(c *Client, queue [][][]byte) [][][]byte {
+	now := time.Now().UnixMilli()
+	db := c.db
+	res := make([][][]byte, 0, len(queue))
+	for _, cmd := range queue {
+		if strings.ToLower(string(cmd[0])) == "select" && len(cmd) == 2 {
+			if idx, err := strconv.Atoi(string(cmd[1])); err == nil && idx >= 0 && idx < len(m.DBs) {
+				db = m.DBs[idx]
+			}
+		}
+		res = append(res, db.RewriteForReplication(cmd, now))
+	}
+	return res
+}
+
+// clusterExpireCron deletes the expired keys through the raft log while this node is the leader.
+// The deletion is proposed as a transaction watching the key, so it's dropped if the key changed in the meantime.
+func (m *Manager) clusterExpireCron(ctx context.Context, node *raftexample.RaftNode, proposeC chan<- *raftexample.RaftProposal) {
+	ticker := time.NewTicker(clusterExpireInterval)
+	defer ticker.Stop()
+	// proposed holds when the deletion of the keys of each database was proposed,
+	// so that a key is not proposed again while its deletion is in flight
+	proposed := make([]map[string]int64, len(m.DBs))
+	for idx := range proposed {
+		proposed[idx] = make(map[string]int64)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !node.IsLeader() {
+			continue
+		}
+		now := time.Now().UnixMilli()
+		for idx := range m.DBs {
+			for _, proposal := range m.expireProposals(idx, now, proposed[idx]) {
+				select {
+				case proposeC <- proposal:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+}
+
+// expireProposals returns the deletions of the expired keys of a database, leaving out the keys
+// proposed within clusterExpireRetry. The proposed keys are recorded in proposed.
+func (m *Manager) expireProposals(idx int, now int64, proposed map[string]int64) []*raftexample.RaftProposal {
+	for key, at := range proposed {
+		if now-at >= clusterExpireRetry.Milliseconds() {
+			delete(proposed, key)
+		}
+	}
+	// the keys must not change under a snapshot load between reading them and their digests
+	m.writeMu.RLock()
+	defer m.writeMu.RUnlock()
+	db := m.DBs[idx]
+	res := make([]*raftexample.RaftProposal, 0)
+	// the keys in flight are skipped without taking the place of the other expired keys
+	for _, key := range db.ExpiredKeys(now, clusterExpireKeys+len(proposed)) {
+		if _, ok := proposed[key]; ok || len(res) == clusterExpireKeys {
+			continue
+		}
+		proposed[key] = now
+		res = append(res, &raftexample.RaftProposal{
+			ID:      uuid.NewString(),
+			DB:      idx,
+			Multi:   true,
+			Batch:   [][][]byte{{[]byte("del"), []byte(key)}},
+			Watches: []raftexample.RaftWatch{{DB: idx, Key: key, Digest: db.KeyDigest(key)}},
+		})
+	}
+	return res
+}
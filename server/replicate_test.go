@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/innovationb1ue/RedisGO/memdb"
+	"github.com/innovationb1ue/RedisGO/raftexample"
+	"github.com/innovationb1ue/RedisGO/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicate_SpopProposal(t *testing.T) {
+	ctx := context.Background()
+	mgr := newAOFTestManager(t.TempDir())
+	mgr.cfg.IsCluster = true
+	c := mgr.newFakeClient(0)
+	c.readMode = readStale
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("sadd s a b c"))
+
+	proposal, finish, res := mgr.clusterProposal(ctx, c, "id", memdb.MakeCommandBytes("spop s 2"))
+	assert.Nil(t, res)
+	assert.True(t, proposal.Multi)
+	assert.Equal(t, 2, len(proposal.Batch))
+	for _, cmd := range proposal.Batch {
+		assert.Equal(t, "srem", string(cmd[0]))
+	}
+	// one of the members was removed by another client before the proposal was applied
+	mgr.ExecCommand(ctx, c, [][]byte{[]byte("srem"), []byte("s"), proposal.Batch[0][2]})
+	popped := finish(mgr.applyTransaction(ctx, proposal)).(*resp.ArrayData).Data()
+	assert.Equal(t, 1, len(popped))
+	assert.Equal(t, proposal.Batch[1][2], popped[0].ByteData())
+	assert.Equal(t, []byte(":1\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("scard s")).ToBytes())
+
+	// nothing to propose for an empty set
+	proposal, _, res = mgr.clusterProposal(ctx, c, "id", memdb.MakeCommandBytes("spop nokey"))
+	assert.Nil(t, proposal)
+	assert.Equal(t, []byte("$-1\r\n"), res.ToBytes())
+	// an invalid count fails on every node
+	proposal, _, _ = mgr.clusterProposal(ctx, c, "id", memdb.MakeCommandBytes("spop s -1"))
+	assert.Equal(t, memdb.MakeCommandBytes("spop s -1"), proposal.Args)
+
+	// SPOP can't be queued in a transaction
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("multi"))
+	_, isErr := mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("spop s")).(*resp.ErrorData)
+	assert.True(t, isErr)
+	assert.Equal(t, []byte("-EXECABORT Transaction discarded because of previous errors.\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("exec")).ToBytes())
+}
+
+func TestReplicate_TransactionCommands(t *testing.T) {
+	ctx := context.Background()
+	mgr := newAOFTestManager(t.TempDir())
+	mgr.cfg.IsCluster = true
+	c := mgr.newFakeClient(0)
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("multi"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("set k v"))
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("expire k 100"))
+	queue, _ := mgr.endMulti(c)
+	proposal := mgr.transactionProposal(c, "id", queue)
+	assert.Equal(t, memdb.MakeCommandBytes("set k v"), proposal.Batch[0])
+	assert.Equal(t, "PEXPIREAT", string(proposal.Batch[1][0]))
+
+	// the rewritten transaction has the same effect as the original one
+	proposal, err := raftexample.DecodeProposal(proposal.ToBytes())
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("*2\r\n+OK\r\n:1\r\n"), mgr.applyTransaction(ctx, proposal).ToBytes())
+	ttl := mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("ttl k")).(*resp.IntData).Data()
+	assert.True(t, ttl >= 99 && ttl <= 101)
+}
+
+func TestReplicate_ExpireProposals(t *testing.T) {
+	ctx := context.Background()
+	mgr := newAOFTestManager(t.TempDir())
+	mgr.cfg.IsCluster = true
+	c := mgr.newFakeClient(0)
+	c.readMode = readStale
+	db := mgr.DBs[0]
+	db.SetPassiveExpire(true)
+	mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("set k v"))
+	now := time.Now().UnixMilli()
+	db.SetTTL("k", now-1)
+
+	// the expired key can't be read while its deletion is not applied
+	assert.Equal(t, []byte("$-1\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("get k")).ToBytes())
+	assert.Equal(t, []byte(":0\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("exists k")).ToBytes())
+	assert.Equal(t, []byte(":-2\r\n"), mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("ttl k")).ToBytes())
+	assert.True(t, db.Exists("k"))
+
+	// the deletion is proposed again only if it's not applied after a while
+	proposed := make(map[string]int64)
+	proposals := mgr.expireProposals(0, now, proposed)
+	assert.Equal(t, 1, len(proposals))
+	assert.Equal(t, 0, len(mgr.expireProposals(0, now+clusterExpireInterval.Milliseconds(), proposed)))
+	assert.Equal(t, 1, len(mgr.expireProposals(0, now+clusterExpireRetry.Milliseconds(), proposed)))
+
+	mgr.applyTransaction(ctx, proposals[0])
+	assert.False(t, db.Exists("k"))
+	assert.Equal(t, 0, len(mgr.expireProposals(0, now+2*clusterExpireRetry.Milliseconds(), proposed)))
+}
@@ -0,0 +1,538 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/innovationb1ue/RedisGO/logger"
+	"github.com/innovationb1ue/RedisGO/memdb"
+	"github.com/innovationb1ue/RedisGO/resp"
+)
+
+// replication.go implements the master side of the master-replica replication.
+// The write commands are fed to the replicas as a stream in the format of the append only file.
+// Every byte of the stream has an offset, and the latest bytes are kept in a circular backlog,
+// so a replica that reconnects with PSYNC gets the bytes it missed instead of a new snapshot
+// as long as they are still in the backlog. A replica proxies the stream of its master to its own
+// replicas byte for byte, so the offsets are the same on every node replicating the same master.
+
+// replica states reported by INFO
+const (
+	replicaWaitBgsave = "wait_bgsave" // the snapshot of the full sync is being sent
+	replicaOnline     = "online"      // the replica receives the stream
+)
+
+var errReplicaBehind = errors.New("the replica fell behind the replication backlog")
+
+// replBacklog is a circular buffer holding the latest bytes of the replication stream.
+// The byte at the offset o of the stream is held at buf[o%len(buf)].
+type replBacklog struct {
+	buf     []byte
+	histlen int64 // number of bytes held, at most len(buf)
+}
+
+// write appends data to the backlog. start is the offset of the first byte of data.
+func (b *replBacklog) write(data []byte, start int64) {
+	size := int64(len(b.buf))
+	b.histlen += int64(len(data))
+	if b.histlen > size {
+		b.histlen = size
+	}
+	// only the last bytes fit
+	if int64(len(data)) > size {
+		start += int64(len(data)) - size
+		data = data[int64(len(data))-size:]
+	}
+	n := copy(b.buf[start%size:], data)
+	copy(b.buf, data[n:])
+}
+
+// read returns a copy of the bytes of the stream from the offset start to the offset end, which must be held.
+func (b *replBacklog) read(start, end int64) []byte {
+	res := make([]byte, end-start)
+	n := copy(res, b.buf[start%int64(len(b.buf)):])
+	copy(res[n:], b.buf)
+	return res
+}
+
+// replicaConn is a replica connected to this node.
+type replicaConn struct {
+	c       *Client
+	addr    string        // address of the replica, with the port it's listening on
+	state   string        // replicaWaitBgsave or replicaOnline
+	sent    int64         // offset of the stream sent so far
+	ack     int64         // offset acknowledged by the replica
+	aofAck  int64         // offset fsynced to the append only file of the replica, -1 without one
+	ackTime time.Time     // time of the last acknowledgement
+	notify  chan struct{} // signaled when the stream grows
+	done    chan struct{} // closed when the replica is removed
+}
+
+// replication holds the replication states of the Manager.
+type replication struct {
+	mu sync.Mutex
+	// ID of the history of the dataset, and of the history it continues after a promotion
+	id, id2 string
+	// offset of the stream so far, and the offset up to which id2 is valid or -1
+	offset, secondOffset int64
+	// nil until the first replica connects
+	backlog     *replBacklog
+	backlogSize int64
+	// database selected by the last command in the stream. -1 forces a SELECT before the next command
+	curDB    int
+	replicas map[*Client]*replicaConn
+	lastPing time.Time
+	// closed and replaced when a replica acknowledges an offset or the append only file is fsynced,
+	// which wakes up the clients blocked in WAIT and WAITAOF
+	acked chan struct{}
+	// replica side. link is nil when this node is a master
+	replicating atomic.Bool
+	link        *masterLink
+	// client applying the stream of the master. It's kept across the reconnections,
+	// since the stream continues with the database it selected and the transaction it started
+	master *Client
+}
+
+func newReplication(backlogSize int64) *replication {
+	return &replication{
+		id:           newReplID(),
+		secondOffset: -1,
+		backlogSize:  backlogSize,
+		curDB:        -1,
+		replicas:     make(map[*Client]*replicaConn),
+		acked:        make(chan struct{}),
+	}
+}
+
+// newReplID returns a random replication ID of 40 hex characters.
+func newReplID() string {
+	id := make([]byte, 20)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// feed appends the commands executed by this node to the stream. A replica only proxies the stream of its master.
+func (r *replication) feed(entries []aofEntry) {
+	if r.replicating.Load() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.backlog == nil {
+		return
+	}
+	var data []byte
+	data, r.curDB = appendEntries(make([]byte, 0, 64), r.curDB, entries)
+	r.writeLocked(data)
+}
+
+// feedRaw appends the encoded commands to the stream.
+func (r *replication) feedRaw(data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeLocked(data)
+}
+
+func (r *replication) writeLocked(data []byte) {
+	if r.backlog != nil {
+		r.backlog.write(data, r.offset)
+	}
+	r.offset += int64(len(data))
+	for _, rc := range r.replicas {
+		select {
+		case rc.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// createBacklogLocked creates the backlog when the first replica connects or when this node starts replicating.
+// The stream starts at the current offset, so the previous bytes can't be resent.
+func (r *replication) createBacklogLocked() {
+	if r.backlog == nil {
+		r.backlog = &replBacklog{buf: make([]byte, r.backlogSize)}
+	}
+}
+
+// canContinue tells whether a replica that asks for the stream of id from the offset start,
+// as sent by PSYNC, can continue from the backlog.
+func (r *replication) canContinue(id string, start int64) bool {
+	if r.backlog == nil {
+		return false
+	}
+	if id != r.id && (id != r.id2 || start > r.secondOffset) {
+		return false
+	}
+	return start > r.offset-r.backlog.histlen && start <= r.offset+1
+}
+
+// pending returns the bytes of the stream not sent to the replica yet and marks them as sent.
+func (r *replication) pending(rc *replicaConn) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rc.state = replicaOnline
+	if rc.sent == r.offset {
+		return nil, nil
+	}
+	if r.backlog == nil || rc.sent < r.offset-r.backlog.histlen {
+		return nil, errReplicaBehind
+	}
+	data := r.backlog.read(rc.sent, r.offset)
+	rc.sent = r.offset
+	return data, nil
+}
+
+// removeReplica forgets the replica once its connection is closed.
+func (r *replication) removeReplica(c *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rc, ok := r.replicas[c]; ok {
+		delete(r.replicas, c)
+		close(rc.done)
+	}
+}
+
+// disconnectReplicasLocked closes the connections of the replicas, which have to sync again.
+func (r *replication) disconnectReplicasLocked() {
+	for _, rc := range r.replicas {
+		_ = rc.c.conn.Close()
+	}
+}
+
+// Psync handles PSYNC replid offset, sent by a replica to receive the stream from offset.
+// The replica continues from the backlog if possible, otherwise it gets a snapshot of the
+// dataset and the stream from the offset of the snapshot. The replies and the stream are
+// written to the connection by a dedicated goroutine, and nothing else is replied to the replica.
+func (m *Manager) Psync(c *Client, cmd [][]byte) resp.RedisData {
+	if m.cfg.IsCluster {
+		return resp.MakeErrorData("ERR PSYNC not allowed in cluster mode.")
+	}
+	if c.conn == nil || c.hasFlag(clientReplica) {
+		return resp.MakeErrorData("ERR Replica already connected")
+	}
+	start, err := strconv.ParseInt(string(cmd[2]), 10, 64)
+	if err != nil {
+		return resp.MakeErrorData("ERR value is not an integer or out of range")
+	}
+	r := m.repl
+	if link := r.currentLink(); link != nil && link.getState() != linkConnected {
+		return resp.MakeErrorData("NOMASTERLINK Can't SYNC while not connected with my master")
+	}
+	rc := &replicaConn{
+		c:       c,
+		addr:    replicaAddr(c),
+		aofAck:  -1,
+		ackTime: time.Now(),
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	var preamble []byte
+	r.mu.Lock()
+	if r.canContinue(string(cmd[1]), start) {
+		rc.state, rc.sent, rc.ack = replicaOnline, start-1, start-1
+		preamble = []byte("+CONTINUE " + r.id + "\r\n")
+		r.replicas[c] = rc
+		r.mu.Unlock()
+		logger.Info("partial resynchronization of replica ", rc.addr, " from offset ", start)
+	} else {
+		r.mu.Unlock()
+		// the snapshot and the offset of the stream following it are taken while no command runs
+		m.writeMu.Lock()
+		snapshot, err := memdb.Snapshot(m.DBs)
+		if err != nil {
+			m.writeMu.Unlock()
+			logger.Error("replication snapshot error: ", err)
+			return resp.MakeErrorData("ERR " + err.Error())
+		}
+		r.mu.Lock()
+		r.createBacklogLocked()
+		// the replica starts with no database selected
+		r.curDB = -1
+		rc.state, rc.sent = replicaWaitBgsave, r.offset
+		preamble = []byte("+FULLRESYNC " + r.id + " " + strconv.FormatInt(r.offset, 10) + "\r\n")
+		r.replicas[c] = rc
+		r.mu.Unlock()
+		m.writeMu.Unlock()
+		preamble = append(preamble, '$')
+		preamble = strconv.AppendInt(preamble, int64(len(snapshot)), 10)
+		preamble = append(preamble, '\r', '\n')
+		preamble = append(preamble, snapshot...)
+		logger.Info("full resynchronization of replica ", rc.addr, ", sending ", len(snapshot), " bytes")
+	}
+	c.setFlag(clientReplica, true)
+	go m.serveReplica(rc, preamble)
+	return nil
+}
+
+// replicaAddr returns the address of the replica, with the port announced by REPLCONF listening-port.
+func replicaAddr(c *Client) string {
+	host, port, err := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if err != nil {
+		return c.conn.RemoteAddr().String()
+	}
+	if c.replPort > 0 {
+		port = strconv.Itoa(c.replPort)
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// serveReplica writes the preamble and then the stream to the replica until it disconnects.
+// The replica is disconnected if it falls behind the backlog.
+func (m *Manager) serveReplica(rc *replicaConn, preamble []byte) {
+	timeout := time.Duration(m.cfg.ReplTimeout) * time.Second
+	write := func(data []byte) error {
+		if err := rc.c.conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+		_, err := rc.c.conn.Write(data)
+		return err
+	}
+	err := write(preamble)
+	for err == nil {
+		var data []byte
+		if data, err = m.repl.pending(rc); err != nil || len(data) > 0 {
+			if err == nil {
+				err = write(data)
+			}
+			continue
+		}
+		select {
+		case <-rc.notify:
+		case <-rc.done:
+			return
+		}
+	}
+	logger.Warning("disconnecting replica ", rc.addr, ": ", err)
+	_ = rc.c.conn.Close()
+}
+
+// replicationCron pings the replicas, so they notice a broken link, and disconnects the replicas
+// that stopped acknowledging the stream.
+func (m *Manager) replicationCron() {
+	r := m.repl
+	now := time.Now()
+	timeout := time.Duration(m.cfg.ReplTimeout) * time.Second
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rc := range r.replicas {
+		if rc.state == replicaOnline && now.Sub(rc.ackTime) > timeout {
+			logger.Warning("disconnecting timed out replica ", rc.addr)
+			_ = rc.c.conn.Close()
+		}
+	}
+	// a replica pings its own replicas with the stream of its master
+	if len(r.replicas) == 0 || r.replicating.Load() || now.Sub(r.lastPing) < time.Duration(m.cfg.ReplPingPeriod)*time.Second {
+		return
+	}
+	r.lastPing = now
+	r.writeLocked(appendCommand(nil, [][]byte{[]byte("PING")}))
+}
+
+// ReplConf handles the REPLCONF options sent by the replicas.
+func (m *Manager) ReplConf(c *Client, cmd [][]byte) resp.RedisData {
+	if len(cmd)%2 == 0 {
+		return resp.MakeErrorData("ERR syntax error")
+	}
+	for i := 1; i < len(cmd); i += 2 {
+		switch opt := strings.ToLower(string(cmd[i])); opt {
+		case "listening-port":
+			port, err := strconv.Atoi(string(cmd[i+1]))
+			if err != nil || port <= 0 || port > 65535 {
+				return resp.MakeErrorData("ERR value is not an integer or out of range")
+			}
+			c.replPort = port
+		case "capa", "ip-address":
+			// the stream is always in the psync2 format
+		case "ack":
+			offset, err := strconv.ParseInt(string(cmd[i+1]), 10, 64)
+			if err != nil {
+				return nil
+			}
+			// followed by FACK and the offset fsynced to the append only file of the replica if it has one
+			aofOffset := int64(-1)
+			if i+3 < len(cmd) && strings.ToLower(string(cmd[i+2])) == "fack" {
+				if aofOffset, err = strconv.ParseInt(string(cmd[i+3]), 10, 64); err != nil {
+					aofOffset = -1
+				}
+			}
+			m.repl.acknowledge(c, offset, aofOffset)
+			return nil
+		case "getack":
+			// only sent by a master, which is served by the replica link
+			return nil
+		default:
+			return resp.MakeErrorData("ERR Unrecognized REPLCONF option: " + opt)
+		}
+	}
+	return resp.MakeStringData("OK")
+}
+
+// acknowledge records the offsets processed and fsynced by the replica.
+func (r *replication) acknowledge(c *Client, offset, aofOffset int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rc, ok := r.replicas[c]; ok {
+		if offset > rc.ack {
+			rc.ack = offset
+		}
+		if aofOffset > rc.aofAck {
+			rc.aofAck = aofOffset
+		}
+		rc.ackTime = time.Now()
+		r.wakeWaitersLocked()
+	}
+}
+
+// countAcked returns the number of replicas that acknowledged the stream up to offset,
+// or fsynced it to their append only files if aof is true.
+func (r *replication) countAcked(offset int64, aof bool) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, rc := range r.replicas {
+		acked := rc.ack
+		if aof {
+			acked = rc.aofAck
+		}
+		if rc.state == replicaOnline && acked >= offset {
+			n++
+		}
+	}
+	return n
+}
+
+// requestAck asks the replicas to acknowledge their offsets now rather than at their next periodic acknowledgement.
+func (r *replication) requestAck() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.replicas) == 0 {
+		return
+	}
+	r.writeLocked(appendCommand(nil, [][]byte{[]byte("REPLCONF"), []byte("GETACK"), []byte("*")}))
+}
+
+// ackedC returns the channel closed at the next acknowledgement.
+func (r *replication) ackedC() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.acked
+}
+
+func (r *replication) wakeWaiters() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.wakeWaitersLocked()
+}
+
+func (r *replication) wakeWaitersLocked() {
+	close(r.acked)
+	r.acked = make(chan struct{})
+}
+
+// ReplicaOf handles REPLICAOF host port, which makes this node replicate another one, and REPLICAOF NO ONE,
+// which turns a replica into a master.
+func (m *Manager) ReplicaOf(ctx context.Context, cmd [][]byte) resp.RedisData {
+	if m.cfg.IsCluster {
+		return resp.MakeErrorData("ERR REPLICAOF not allowed in cluster mode.")
+	}
+	if strings.ToLower(string(cmd[1])) == "no" && strings.ToLower(string(cmd[2])) == "one" {
+		m.promote()
+		return resp.MakeStringData("OK")
+	}
+	port, err := strconv.Atoi(string(cmd[2]))
+	if err != nil || port <= 0 || port > 65535 {
+		return resp.MakeErrorData("ERR Invalid master port")
+	}
+	addr := net.JoinHostPort(string(cmd[1]), string(cmd[2]))
+	if link := m.repl.currentLink(); link != nil && link.addr == addr {
+		return resp.MakeStringData("OK Already connected to specified master")
+	}
+	m.replicate(ctx, addr)
+	return resp.MakeStringData("OK")
+}
+
+// promote stops replicating the master and makes this node a master. The replicas of this node
+// and of the same master can continue with the stream of this node, which continues the stream
+// of the old master under a new ID.
+func (m *Manager) promote() {
+	m.stopReplicaLink()
+	r := m.repl
+	r.mu.Lock()
+	if !r.replicating.Load() {
+		r.mu.Unlock()
+		return
+	}
+	r.id2, r.secondOffset = r.id, r.offset+1
+	r.id = newReplID()
+	r.curDB = -1
+	r.master = nil
+	r.replicating.Store(false)
+	r.mu.Unlock()
+	for _, db := range m.DBs {
+		db.SetPassiveExpire(false)
+	}
+	logger.Info("replication stopped, this node is a master now")
+}
+
+// Role handles ROLE.
+func (m *Manager) Role(cmd [][]byte) resp.RedisData {
+	r := m.repl
+	if link := r.currentLink(); link != nil {
+		host, port := link.hostPort()
+		return resp.MakeArrayData([]resp.RedisData{
+			resp.MakeBulkData([]byte("slave")),
+			resp.MakeBulkData([]byte(host)),
+			resp.MakeIntData(int64(port)),
+			resp.MakeBulkData([]byte(link.getState())),
+			resp.MakeIntData(r.getOffset()),
+		})
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	replicas := make([]resp.RedisData, 0, len(r.replicas))
+	for _, rc := range r.sortedReplicasLocked() {
+		host, port, _ := net.SplitHostPort(rc.addr)
+		replicas = append(replicas, resp.MakeArrayData([]resp.RedisData{
+			resp.MakeBulkData([]byte(host)),
+			resp.MakeBulkData([]byte(port)),
+			resp.MakeBulkData([]byte(strconv.FormatInt(rc.ack, 10))),
+		}))
+	}
+	return resp.MakeArrayData([]resp.RedisData{
+		resp.MakeBulkData([]byte("master")),
+		resp.MakeIntData(r.offset),
+		resp.MakeArrayData(replicas),
+	})
+}
+
+// sortedReplicasLocked returns the replicas in the order they connected.
+func (r *replication) sortedReplicasLocked() []*replicaConn {
+	res := make([]*replicaConn, 0, len(r.replicas))
+	for _, rc := range r.replicas {
+		res = append(res, rc)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].c.ID < res[j].c.ID })
+	return res
+}
+
+func (r *replication) getOffset() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.offset
+}
+
+// readOnly tells whether the writes of the clients are rejected.
+func (m *Manager) readOnly() bool {
+	return m.cfg.ReplicaReadOnly && m.repl.replicating.Load()
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/innovationb1ue/RedisGO/config"
+	"github.com/innovationb1ue/RedisGO/memdb"
+	"github.com/innovationb1ue/RedisGO/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplBacklog(t *testing.T) {
+	b := &replBacklog{buf: make([]byte, 8)}
+	b.write([]byte("abcde"), 0)
+	assert.Equal(t, int64(5), b.histlen)
+	assert.Equal(t, []byte("bcd"), b.read(1, 4))
+	// the buffer wraps around
+	b.write([]byte("fghij"), 5)
+	assert.Equal(t, int64(8), b.histlen)
+	assert.Equal(t, []byte("cdefghij"), b.read(2, 10))
+	// only the end of a write larger than the buffer is kept
+	b.write([]byte("0123456789"), 10)
+	assert.Equal(t, []byte("23456789"), b.read(12, 20))
+}
+
+func newReplTestManager(t *testing.T) *Manager {
+	return NewManager(&config.Config{
+		Databases:       2,
+		Dir:             t.TempDir(),
+		ReplicaReadOnly: true,
+		ReplBacklogSize: 1024 * 1024,
+		ReplTimeout:     5,
+		ReplPingPeriod:  1,
+	})
+}
+
+// waitFor polls cond until it holds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for ", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	master, replica := newReplTestManager(t), newReplTestManager(t)
+	port := serveTestManager(t, ctx, master)
+	mc, rc := master.newFakeClient(0), replica.newFakeClient(0)
+	exec := func(mgr *Manager, c *Client, cmd string) string {
+		return string(mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes(cmd)).ToBytes())
+	}
+	exec(master, mc, "set k v")
+	exec(master, mc, "sadd set a b c")
+
+	// the replica gets a snapshot of the dataset first
+	assert.Equal(t, "+OK\r\n", exec(replica, rc, "replicaof 127.0.0.1 "+port))
+	assert.Equal(t, "+OK Already connected to specified master\r\n", exec(replica, rc, "replicaof 127.0.0.1 "+port))
+	waitFor(t, "the full sync", func() bool { return exec(replica, rc, "get k") == "$1\r\nv\r\n" })
+	waitFor(t, "the link", func() bool { return replica.repl.currentLink().getState() == linkConnected })
+	assert.Equal(t, master.repl.id, replica.repl.id)
+
+	// then the stream of the write commands, in the form every node applies the same way
+	exec(master, mc, "spop set 2")
+	exec(master, mc, "select 1")
+	exec(master, mc, "set k v1")
+	exec(master, mc, "expire k 100")
+	exec(master, mc, "multi")
+	exec(master, mc, "incr counter")
+	exec(master, mc, "xadd stream * f v")
+	exec(master, mc, "exec")
+	rc.selectDB(replica.DBs[1], 1)
+	waitFor(t, "the stream", func() bool { return exec(replica, rc, "get counter") == "$1\r\n1\r\n" })
+	assert.Equal(t, "$2\r\nv1\r\n", exec(replica, rc, "get k"))
+	// the expiration time is absolute, so it's the same to the millisecond
+	assert.Equal(t, exec(master, mc, "pexpiretime k"), exec(replica, rc, "pexpiretime k"))
+	assert.Equal(t, exec(master, mc, "xrange stream - +"), exec(replica, rc, "xrange stream - +"))
+	exec(master, mc, "select 0")
+	rc.selectDB(replica.DBs[0], 0)
+	members := func(mgr *Manager, c *Client) []string {
+		var res []string
+		for _, member := range mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes("smembers set")).(*resp.SetData).Data() {
+			res = append(res, string(member.ByteData()))
+		}
+		return res
+	}
+	assert.ElementsMatch(t, members(master, mc), members(replica, rc))
+	assert.Len(t, members(replica, rc), 1)
+	waitFor(t, "the acknowledgement", func() bool {
+		replicas := master.Role(memdb.MakeCommandBytes("role")).(*resp.ArrayData).Data()[2].(*resp.ArrayData).Data()
+		return len(replicas) == 1 &&
+			string(replicas[0].(*resp.ArrayData).Data()[2].ByteData()) == strconv.FormatInt(master.repl.getOffset(), 10)
+	})
+
+	// the replica is read-only
+	assert.Equal(t, "-READONLY You can't write against a read only replica.\r\n", exec(replica, rc, "set k v"))
+	exec(replica, rc, "multi")
+	exec(replica, rc, "set k v")
+	assert.Equal(t, "-EXECABORT Transaction discarded because of previous errors.\r\n", exec(replica, rc, "exec"))
+	role := replica.Role(memdb.MakeCommandBytes("role")).(*resp.ArrayData).Data()
+	assert.Equal(t, "slave", string(role[0].ByteData()))
+	assert.Equal(t, "connected", string(role[3].ByteData()))
+	assert.Contains(t, exec(replica, rc, "info replication"), "master_link_status:up\r\n")
+
+	// a replica reconnecting continues from the backlog with the same client applying the stream
+	applier := replica.repl.master
+	replica.stopReplicaLink()
+	exec(master, mc, "set after reconnect")
+	replica.replicate(ctx, "127.0.0.1:"+port)
+	waitFor(t, "the partial sync", func() bool { return exec(replica, rc, "get after") == "$9\r\nreconnect\r\n" })
+	assert.Same(t, applier, replica.repl.master)
+
+	// a promoted replica accepts writes and continues the history of its master
+	masterID := master.repl.id
+	assert.Equal(t, "+OK\r\n", exec(replica, rc, "replicaof no one"))
+	assert.Equal(t, "+OK\r\n", exec(replica, rc, "set k promoted"))
+	assert.Equal(t, masterID, replica.repl.id2)
+	assert.Contains(t, exec(replica, rc, "info replication"), "role:master\r\n")
+	assert.True(t, replica.repl.canContinue(masterID, master.repl.getOffset()+1))
+}
+
+func TestReplication_ConcurrentWrites(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	master, replica := newReplTestManager(t), newReplTestManager(t)
+	// the master also logs the writes to an append only file, so that each write takes a while to propagate
+	master.cfg.AppendOnly, master.cfg.AppendFilename, master.cfg.AppendFsync = true, "appendonly.aof", fsyncAlways
+	assert.Nil(t, master.startAOF(ctx))
+	defer master.stopAOF()
+	port := serveTestManager(t, ctx, master)
+	rc := replica.newFakeClient(0)
+	assert.Equal(t, "+OK\r\n", string(replica.ExecCommand(ctx, rc, memdb.MakeCommandBytes("replicaof 127.0.0.1 "+port)).ToBytes()))
+	waitFor(t, "the link", func() bool { return replica.repl.currentLink().getState() == linkConnected })
+
+	// the writes to a key are replicated in the order they are executed
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := master.newFakeClient(0)
+			for j := 0; j < 50; j++ {
+				master.ExecCommand(ctx, c, memdb.MakeCommandBytes(fmt.Sprintf("set k %d-%d", i, j)))
+				master.ExecCommand(ctx, c, memdb.MakeCommandBytes(fmt.Sprintf("rpush list %d-%d", i, j)))
+			}
+		}(i)
+	}
+	wg.Wait()
+	waitFor(t, "the stream", func() bool { return replica.repl.getOffset() == master.repl.getOffset() })
+	for _, cmd := range []string{"get k", "lrange list 0 -1"} {
+		assert.Equal(t, master.ExecCommand(ctx, master.newFakeClient(0), memdb.MakeCommandBytes(cmd)).ToBytes(),
+			replica.ExecCommand(ctx, rc, memdb.MakeCommandBytes(cmd)).ToBytes())
+	}
+}
+
+func TestReplication_BlockedClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	master, replica := newReplTestManager(t), newReplTestManager(t)
+	port := serveTestManager(t, ctx, master)
+	master.ExecCommand(ctx, master.newFakeClient(0), memdb.MakeCommandBytes("rpush list a b"))
+
+	// a client blocked before the node became a replica doesn't pop from the dataset of the master
+	c := replica.newFakeClient(0)
+	resC := make(chan string, 1)
+	go func() { resC <- string(replica.ExecCommand(ctx, c, memdb.MakeCommandBytes("blpop list 5")).ToBytes()) }()
+	waitFor(t, "the blocked client", func() bool { return c.hasFlag(clientBlocked) })
+	rc := replica.newFakeClient(0)
+	assert.Equal(t, "+OK\r\n", string(replica.ExecCommand(ctx, rc, memdb.MakeCommandBytes("replicaof 127.0.0.1 "+port)).ToBytes()))
+	assert.Equal(t, "-UNBLOCKED force unblock from blocking operation, instance state changed (master -> replica?)\r\n", <-resC)
+	waitFor(t, "the full sync", func() bool { return replica.repl.currentLink().getState() == linkConnected })
+	assert.Equal(t, "*2\r\n$1\r\na\r\n$1\r\nb\r\n", string(replica.ExecCommand(ctx, rc, memdb.MakeCommandBytes("lrange list 0 -1")).ToBytes()))
+}
+
+func TestReplication_ExpiredKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	master, replica := newReplTestManager(t), newReplTestManager(t)
+	port := serveTestManager(t, ctx, master)
+	mc, rc := master.newFakeClient(0), replica.newFakeClient(0)
+	exec := func(mgr *Manager, c *Client, cmd string) string {
+		return string(mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes(cmd)).ToBytes())
+	}
+	// the deletion of the master is held back to see the replica before it arrives
+	master.DBs[0].SetPassiveExpire(true)
+	exec(master, mc, "set k v px 200")
+	exec(replica, rc, "replicaof 127.0.0.1 "+port)
+	waitFor(t, "the full sync", func() bool { return exec(replica, rc, "get k") == "$1\r\nv\r\n" })
+
+	// the replica keeps the expired key until the master deletes it, but doesn't serve it
+	time.Sleep(250 * time.Millisecond)
+	assert.Equal(t, "$-1\r\n", exec(replica, rc, "get k"))
+	assert.Equal(t, ":0\r\n", exec(replica, rc, "exists k"))
+	assert.Equal(t, ":-2\r\n", exec(replica, rc, "pttl k"))
+	assert.Equal(t, "*0\r\n", exec(replica, rc, "keys *"))
+	assert.True(t, replica.DBs[0].Exists("k"))
+
+	master.DBs[0].SetPassiveExpire(false)
+	assert.Equal(t, "$-1\r\n", exec(master, mc, "get k"))
+	waitFor(t, "the deletion", func() bool { return !replica.DBs[0].Exists("k") })
+}
@@ -5,16 +5,14 @@ import (
 	"fmt"
 	"github.com/innovationb1ue/RedisGO/config"
 	"github.com/innovationb1ue/RedisGO/logger"
+	"github.com/innovationb1ue/RedisGO/memdb"
 	"github.com/innovationb1ue/RedisGO/raftexample"
 	"github.com/innovationb1ue/RedisGO/resp"
-	"go.etcd.io/etcd/raft/v3/raftpb"
-	"go.etcd.io/etcd/server/v3/etcdserver/api/snap"
-	"log"
+	"go.etcd.io/etcd/raft/v3"
 	"net"
 	"os"
 	"os/signal"
 	"strconv"
-	"strings"
 	"sync"
 	"syscall"
 )
@@ -28,6 +26,10 @@ func Start(cfg *config.Config) error {
 		return err
 	}
 	var isTerminating bool
+	// create n db for SELECT cmd
+	mgr := NewManager(cfg)
+	// raft groups serving the hash slots in cluster mode
+	var cluster *Cluster
 	// create client disconnect wait group
 	wg := sync.WaitGroup{}
 	ctx, cancel := context.WithCancel(context.Background())
@@ -43,6 +45,13 @@ func Start(cfg *config.Config) error {
 		cancel()
 		// 3. wait for all clients to disconnect
 		wg.Wait()
+		// 4. persist the dataset if save points are configured
+		if !cfg.IsCluster && len(cfg.SaveParams) > 0 {
+			if err := mgr.saveRDB(); err != nil {
+				logger.Error("saving on shutdown error: ", err)
+			}
+		}
+		mgr.stopAOF()
 		logger.Info("See you again. ")
 	}()
 	// welcome text
@@ -53,8 +62,23 @@ func Start(cfg *config.Config) error {
 	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
 	// client chan
 	clients := make(chan net.Conn)
-	// create n db for SELECT cmd
-	mgr := NewManager(cfg)
+	if !cfg.IsCluster {
+		// restore the dataset from the append only file if enabled, otherwise from the last snapshot
+		if cfg.AppendOnly {
+			if err := mgr.initAOF(ctx); err != nil {
+				logger.Error("loading append only file error: ", err)
+				return err
+			}
+		} else if err := mgr.loadRDB(); err != nil {
+			logger.Error("loading snapshot error: ", err)
+			return err
+		}
+		go mgr.serverCron(ctx)
+		go mgr.expireCron(ctx)
+		if cfg.ReplicaOf != "" {
+			mgr.replicate(ctx, cfg.ReplicaOf)
+		}
+	}
 
 	// spawn a worker to accept tcp connections & create client objects
 	go func() {
@@ -73,32 +97,15 @@ func Start(cfg *config.Config) error {
 	}()
 
 	// cluster logic here *******************
-	var proposeC chan *raftexample.RaftProposal
-	var confChangeC chan raftpb.ConfChangeI
-	var commitC <-chan *raftexample.RaftCommit
-	var errorC <-chan error
-	var snapshotterReady <-chan *snap.Snapshotter
-	var resultCallback map[string]chan resp.RedisData
-	var clusterFilter *middleware
-	var RaftNode *raftexample.RaftNode
+	var clusterStopped <-chan struct{}
 	if cfg.IsCluster {
 		logger.Info("Initializing cluster node")
-		// send to proposeC to send message to raft cluster
-		proposeC = make(chan *raftexample.RaftProposal)
-		confChangeC = make(chan raftpb.ConfChangeI)
-		defer close(proposeC)
-		defer close(confChangeC)
-		resultCallback = make(map[string]chan resp.RedisData)
-		// start raft node
-		getSnapshot := func() ([]byte, error) { return mgr.CurrentDB.GetSnapshot() }
-		// read from commitC to update state machine
-		commitC, errorC, snapshotterReady, RaftNode = raftexample.NewRaftNode(cfg.NodeID, cfg.RaftAddr, strings.Split(cfg.PeerAddrs, ","), cfg.JoinCluster, getSnapshot, proposeC, confChangeC)
-		<-snapshotterReady
-		mgr.CurrentDB.Raft = RaftNode
-		go handleClusterCommits(ctx, commitC, confChangeC, mgr, resultCallback, errorC)
-		// build cluster command filter
-		clusterFilter = newMiddleware()
-		clusterFilter.Add(ClusterCmdFilter)
+		cluster, err = newCluster(ctx, cfg)
+		if err != nil {
+			logger.Error("starting cluster error: ", err)
+			return err
+		}
+		clusterStopped = cluster.stopped
 	}
 
 	// server event loop
@@ -115,7 +122,7 @@ func Start(cfg *config.Config) error {
 				defer wg.Done()
 				// decide the right handler to process command
 				if cfg.IsCluster {
-					mgr.HandleCluster(ctx, conn, proposeC, confChangeC, resultCallback, clusterFilter)
+					cluster.Handle(ctx, conn)
 				} else {
 					mgr.Handle(ctx, conn)
 				}
@@ -129,27 +136,36 @@ func Start(cfg *config.Config) error {
 				return nil
 			}
 		// error in raft cluster
-		case <-errorC:
+		case <-clusterStopped:
 			return nil
 		}
 
 	}
 }
 
-func handleClusterCommits(ctx context.Context, commitC <-chan *raftexample.RaftCommit, confChangeC chan<- raftpb.ConfChangeI, dbMgr *Manager, resultCallback map[string]chan resp.RedisData, errorC <-chan error) {
+// handleClusterCommits applies the entries committed by raft and hands the results to the clients waiting for them.
+func handleClusterCommits(ctx context.Context, commitC <-chan *raftexample.RaftCommit, dbMgr *Manager, results *proposalResults, errorC <-chan error) {
 	for msg := range commitC {
-		logger.Info("commitC receive ", msg)
-		if msg == nil {
-			logger.Info("loaded empty snapshot")
+		if msg.Snapshot {
+			if err := dbMgr.loadClusterSnapshot(dbMgr.DBs[0].Raft); err != nil {
+				logger.Panic("loading raft snapshot error: ", err)
+				panic(err)
+			}
+			close(msg.ApplyDoneC)
 			continue
 		}
+		logger.Debug("cluster commitC: applying ", len(msg.Data), " commands")
 		for _, cmd := range msg.Data {
-			ctx = context.WithValue(ctx, "confChangeC", confChangeC)
-			res := dbMgr.ExecStrCommand(ctx, cmd.Data, nil)
-			if callback, ok := resultCallback[cmd.ID]; ok {
-				callback <- res
+			var res resp.RedisData
+			if cmd.DB < 0 || cmd.DB >= len(dbMgr.DBs) {
+				res = resp.MakeErrorData("ERR DB index is out of range")
+			} else if cmd.Multi {
+				res = dbMgr.applyTransaction(ctx, cmd)
+			} else {
+				res = dbMgr.ExecClusterCommand(ctx, cmd.DB, cmd.Args)
 			}
-			log.Println("cluster commitC: exec command ", msg.Data, "result = ", res)
+			results.trigger(cmd.ID, res)
+			logger.Debug("cluster commitC: exec command ", cmd.ID, " result = ", res)
 		}
 		close(msg.ApplyDoneC)
 	}
@@ -157,3 +173,28 @@ func handleClusterCommits(ctx context.Context, commitC <-chan *raftexample.RaftC
 		logger.Error(err)
 	}
 }
+
+// clusterSnapshot encodes the dataset for a raft snapshot.
+func (m *Manager) clusterSnapshot() ([]byte, error) {
+	m.writeMu.RLock()
+	defer m.writeMu.RUnlock()
+	return memdb.Snapshot(m.DBs)
+}
+
+// loadClusterSnapshot replaces the dataset with the latest raft snapshot of node.
+func (m *Manager) loadClusterSnapshot(node *raftexample.RaftNode) error {
+	snapshot, err := node.Snapshot()
+	if err != nil {
+		return err
+	}
+	if raft.IsEmptySnap(snapshot) {
+		return nil
+	}
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if err := memdb.LoadSnapshot(snapshot.Data, m.DBs); err != nil {
+		return err
+	}
+	logger.Info("loaded raft snapshot at index ", snapshot.Metadata.Index)
+	return nil
+}
@@ -0,0 +1,44 @@
+package server
+
+import "bytes"
+
+// slot.go maps keys to the hash slots of Redis Cluster, so that cluster aware clients can route the commands.
+
+// clusterSlots is the number of hash slots
+const clusterSlots = 16384
+
+// crc16Table is the lookup table of the CRC16-CCITT (XMODEM) checksum used by Redis Cluster.
+var crc16Table = func() [256]uint16 {
+	var table [256]uint16
+	for i := range table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^b]
+	}
+	return crc
+}
+
+// keyHashSlot returns the hash slot of the key. If the key contains a non-empty hash tag like "{user1}.name",
+// only the tag is hashed, so keys with the same tag are in the same slot.
+func keyHashSlot(key []byte) int {
+	if start := bytes.IndexByte(key, '{'); start >= 0 {
+		if end := bytes.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
@@ -0,0 +1,19 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyHashSlot(t *testing.T) {
+	// the slots computed by Redis Cluster
+	assert.Equal(t, 12739, keyHashSlot([]byte("123456789")))
+	assert.Equal(t, 12182, keyHashSlot([]byte("foo")))
+	assert.Equal(t, 5061, keyHashSlot([]byte("bar")))
+	// only the hash tag is hashed
+	assert.Equal(t, keyHashSlot([]byte("user1")), keyHashSlot([]byte("{user1}.name")))
+	assert.Equal(t, keyHashSlot([]byte("user1")), keyHashSlot([]byte("x{user1}{user2}")))
+	// an empty tag hashes the whole key
+	assert.Equal(t, int(crc16([]byte("{}.name"))%clusterSlots), keyHashSlot([]byte("{}.name")))
+}
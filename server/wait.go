@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/innovationb1ue/RedisGO/raftexample"
+	"github.com/innovationb1ue/RedisGO/resp"
+)
+
+// wait.go implements WAIT and WAITAOF, which block the client until its writes reached the replicas
+// or were fsynced to the append only files. In cluster mode they count the voters of the raft group
+// whose log holds the entries committed so far, which include the writes of the client.
+
+// clusterWaitInterval is the time between two checks of the logs of the voters. Raft doesn't tell
+// when the followers append entries, so the cluster polls the progress of the leader.
+const clusterWaitInterval = 10 * time.Millisecond
+
+// Wait handles WAIT numreplicas timeout. It returns the number of replicas that acknowledged the writes
+// of the client, once numreplicas did or after timeout milliseconds. A timeout of 0 waits forever.
+// Inside a transaction the replicas are counted without waiting.
+func (m *Manager) Wait(ctx context.Context, c *Client, cmd [][]byte, inExec bool) resp.RedisData {
+	if m.repl.replicating.Load() {
+		return resp.MakeErrorData("ERR WAIT cannot be used with replica instances.")
+	}
+	numReplicas, err := strconv.Atoi(string(cmd[1]))
+	if err != nil {
+		return resp.MakeErrorData("ERR value is not an integer or out of range")
+	}
+	timeout, errData := parseWaitTimeout(cmd[2])
+	if errData != nil {
+		return errData
+	}
+	if m.cfg.IsCluster {
+		n, errData := m.clusterWait(ctx, c, numReplicas, timeout, !inExec)
+		if errData != nil {
+			return errData
+		}
+		return resp.MakeIntData(int64(n))
+	}
+	offset := c.woff
+	if m.repl.countAcked(offset, false) < numReplicas && !inExec {
+		m.repl.requestAck()
+		m.waitUntil(ctx, c, timeout, func() bool { return m.repl.countAcked(offset, false) >= numReplicas })
+	}
+	return resp.MakeIntData(int64(m.repl.countAcked(offset, false)))
+}
+
+// WaitAOF handles WAITAOF numlocal numreplicas timeout. It returns whether the writes of the client were fsynced
+// to the local append only file and the number of replicas that fsynced them, once numlocal and numreplicas are
+// reached or after timeout milliseconds. In cluster mode the raft log is the append only file, which holds the writes
+// once they are applied.
+func (m *Manager) WaitAOF(ctx context.Context, c *Client, cmd [][]byte, inExec bool) resp.RedisData {
+	if m.repl.replicating.Load() {
+		return resp.MakeErrorData("ERR WAITAOF cannot be used with replica instances.")
+	}
+	numLocal, err := strconv.Atoi(string(cmd[1]))
+	if err != nil {
+		return resp.MakeErrorData("ERR value is not an integer or out of range")
+	}
+	numReplicas, err := strconv.Atoi(string(cmd[2]))
+	if err != nil {
+		return resp.MakeErrorData("ERR value is not an integer or out of range")
+	}
+	timeout, errData := parseWaitTimeout(cmd[3])
+	if errData != nil {
+		return errData
+	}
+	if numLocal > 0 && m.aof == nil && !m.cfg.IsCluster {
+		return resp.MakeErrorData("ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled.")
+	}
+	if m.cfg.IsCluster {
+		n, errData := m.clusterWait(ctx, c, numReplicas, timeout, !inExec)
+		if errData != nil {
+			return errData
+		}
+		return resp.MakeArrayData([]resp.RedisData{resp.MakeIntData(1), resp.MakeIntData(int64(n))})
+	}
+	offset := c.woff
+	local := func() int {
+		if m.aof != nil && m.aofFsyncedOffset() >= offset {
+			return 1
+		}
+		return 0
+	}
+	if (local() < numLocal || m.repl.countAcked(offset, true) < numReplicas) && !inExec {
+		m.repl.requestAck()
+		m.waitUntil(ctx, c, timeout, func() bool {
+			return local() >= numLocal && m.repl.countAcked(offset, true) >= numReplicas
+		})
+	}
+	return resp.MakeArrayData([]resp.RedisData{
+		resp.MakeIntData(int64(local())),
+		resp.MakeIntData(int64(m.repl.countAcked(offset, true))),
+	})
+}
+
+// parseWaitTimeout parses the timeout of WAIT and WAITAOF in milliseconds.
+func parseWaitTimeout(arg []byte) (time.Duration, resp.RedisData) {
+	ms, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return 0, resp.MakeErrorData("ERR timeout is not an integer or out of range")
+	}
+	if ms < 0 {
+		return 0, resp.MakeErrorData("ERR timeout is negative")
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// clusterWait waits until numReplicas voters other than the leader hold the entries committed so far.
+// The writes of the client were applied before WAIT runs, so they are part of them.
+func (m *Manager) clusterWait(ctx context.Context, c *Client, numReplicas int, timeout time.Duration, block bool) (int, resp.RedisData) {
+	if errData := m.leaderRedirect(nil); errData != nil {
+		return 0, errData
+	}
+	node := c.db.Raft
+	index := node.CommittedIndex()
+	n, err := node.Replicated(index)
+	if err == nil && n < numReplicas && block {
+		m.waitUntil(ctx, c, timeout, func() bool {
+			n, err = node.Replicated(index)
+			return err != nil || n >= numReplicas
+		})
+	}
+	if errors.Is(err, raftexample.ErrNotLeader) {
+		// the leadership moved while waiting
+		if errData := m.leaderRedirect(nil); errData != nil {
+			return 0, errData
+		}
+	}
+	if err != nil {
+		return 0, resp.MakeErrorData("ERR " + err.Error())
+	}
+	return n, nil
+}
+
+// waitUntil blocks the client until done returns true, the timeout expires or the server stops.
+// A timeout of 0 waits forever. done is checked again whenever a replica acknowledges an offset
+// or the append only file is fsynced.
+func (m *Manager) waitUntil(ctx context.Context, c *Client, timeout time.Duration, done func() bool) {
+	c.setFlag(clientBlocked, true)
+	defer c.setFlag(clientBlocked, false)
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var poll <-chan time.Time
+	if m.cfg.IsCluster {
+		ticker := time.NewTicker(clusterWaitInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	for {
+		// taken before checking, so an acknowledgement received in between is not missed
+		acked := m.repl.ackedC()
+		if done() {
+			return
+		}
+		select {
+		case <-acked:
+		case <-poll:
+		case <-expired:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/innovationb1ue/RedisGO/memdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWait(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	master, replica := newReplTestManager(t), newReplTestManager(t)
+	for _, mgr := range []*Manager{master, replica} {
+		mgr.cfg.AppendFilename = "appendonly.aof"
+		mgr.cfg.AppendFsync = fsyncEverySec
+	}
+	assert.Nil(t, master.startAOF(ctx))
+	defer master.stopAOF()
+	mc, rc := master.newFakeClient(0), replica.newFakeClient(0)
+	exec := func(mgr *Manager, c *Client, cmd string) string {
+		return string(mgr.ExecCommand(ctx, c, memdb.MakeCommandBytes(cmd)).ToBytes())
+	}
+	assert.Equal(t, "-ERR timeout is negative\r\n", exec(master, mc, "wait 1 -1"))
+	assert.Equal(t, "-ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled.\r\n", exec(replica, rc, "waitaof 1 0 0"))
+
+	// the count reached is returned once the timeout expires
+	exec(master, mc, "set k v")
+	start := time.Now()
+	assert.Equal(t, ":0\r\n", exec(master, mc, "wait 1 50"))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	// the write is fsynced by the next fsync of the everysec policy
+	assert.Equal(t, "*2\r\n:1\r\n:0\r\n", exec(master, mc, "waitaof 1 0 0"))
+
+	assert.Nil(t, replica.startAOF(ctx))
+	defer replica.stopAOF()
+	port := serveTestManager(t, ctx, master)
+	exec(replica, rc, "replicaof 127.0.0.1 "+port)
+	waitFor(t, "the link", func() bool {
+		link := replica.repl.currentLink()
+		return link != nil && link.getState() == linkConnected
+	})
+	assert.Equal(t, "-ERR WAIT cannot be used with replica instances.\r\n", exec(replica, rc, "wait 1 0"))
+	exec(master, mc, "set k v2")
+	assert.Equal(t, ":1\r\n", exec(master, mc, "wait 1 0"))
+	assert.Equal(t, "*2\r\n:1\r\n:1\r\n", exec(master, mc, "waitaof 1 1 0"))
+	// the replicas are counted without waiting inside a transaction
+	exec(master, mc, "multi")
+	exec(master, mc, "wait 2 0")
+	assert.Equal(t, "*1\r\n:1\r\n", exec(master, mc, "exec"))
+}